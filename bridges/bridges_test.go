@@ -0,0 +1,143 @@
+package bridges
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// Tests that bridge lines are parsed and normalized the way Tor accepts them.
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1:443"},
+		{"Bridge 192.0.2.1:9001", "192.0.2.1:9001"},
+		{"192.0.2.1:9001 4352 e58420e68f5e40bf7c74faddccd9d1349413", "192.0.2.1:9001 4352E58420E68F5E40BF7C74FADDCCD9D1349413"},
+		{"[2001:db8::1]", "[2001:db8::1]:443"},
+		{"[2001:db8::1]:80 4352E58420E68F5E40BF7C74FADDCCD9D1349413", "[2001:db8::1]:80 4352E58420E68F5E40BF7C74FADDCCD9D1349413"},
+		{"snowflake 192.0.2.3:1", "snowflake 192.0.2.3:1"},
+		{
+			"obfs4 192.0.2.2:443 4352E58420E68F5E40BF7C74FADDCCD9D1349413 iat-mode=0 cert=ssH+9rP8dG2NLDN2XuFw63hIO/9MNNinLmxQDpVa+7kTOa9/m+tGWT1SmSYpQ9uTBGa6Hw",
+			"obfs4 192.0.2.2:443 4352E58420E68F5E40BF7C74FADDCCD9D1349413 cert=ssH+9rP8dG2NLDN2XuFw63hIO/9MNNinLmxQDpVa+7kTOa9/m+tGWT1SmSYpQ9uTBGa6Hw iat-mode=0",
+		},
+		{"meek_lite 192.0.2.2:2 url=https://example.com/ front=example.org", "meek_lite 192.0.2.2:2 front=example.org url=https://example.com/"},
+	}
+	for i, tt := range tests {
+		bridge, err := Parse(tt.line)
+		if err != nil {
+			t.Errorf("test %d: failed to parse %q: %v", i, tt.line, err)
+			continue
+		}
+		if have := bridge.String(); have != tt.want {
+			t.Errorf("test %d: bridge mismatch: have %q, want %q", i, have, tt.want)
+		}
+		if reparsed, err := Parse(bridge.String()); err != nil || reparsed.String() != tt.want {
+			t.Errorf("test %d: round trip mismatch: have %v, %v, want %q", i, reparsed, err, tt.want)
+		}
+	}
+}
+
+// Tests that the bridge lines rejected by Tor are rejected here too.
+func TestParseInvalid(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"Bridge",
+		"obfs4",                              // missing address
+		"obfs-4 192.0.2.1:443",               // transport isn't an identifier
+		"bridge.example.com:443",             // hostnames are not resolved
+		"2001:db8::1",                        // IPv6 needs brackets
+		"192.0.2.1:0",                        // port out of range
+		"192.0.2.1:65536",                    // port out of range
+		"192.0.2.1:443 4352E58420E68F5E40BF", // fingerprint too short
+		"192.0.2.1:443 XX52E58420E68F5E40BF7C74FADDCCD9D1349413",            // fingerprint not hex
+		"obfs4 192.0.2.1:443 4352E58420E68F5E40BF7C74FADDCCD9D1349413 cert", // not a key=value argument
+		"obfs4 192.0.2.1:443 =value",                                        // empty key
+	} {
+		if bridge, err := Parse(line); err == nil {
+			t.Errorf("invalid line %q accepted as %q", line, bridge)
+		}
+	}
+}
+
+// Tests that pasted blocks of bridges skip noise and report line numbers.
+func TestParseAll(t *testing.T) {
+	bridges, err := ParseAll("# from BridgeDB\n\nobfs4 192.0.2.1:443 cert=abc iat-mode=0\r\n  Bridge 192.0.2.2:80  \n")
+	if err != nil {
+		t.Fatalf("failed to parse bridges: %v", err)
+	}
+	if len(bridges) != 2 || bridges[0].Transport != "obfs4" || bridges[1].Addr != "192.0.2.2:80" {
+		t.Errorf("bridges mismatch: have %v", bridges)
+	}
+	if _, err := ParseAll("192.0.2.1\nnonsense here\n"); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("error mismatch: have %v, want line 2 failure", err)
+	}
+}
+
+// Tests that bridges are added and removed on the running Tor, and that their
+// reachability is read from the guard states.
+func TestManager(t *testing.T) {
+	server := controltest.NewServer()
+	server.Handle("GETCONF", func(args string) ([]string, error) {
+		return []string{"Bridge=192.0.2.1:443 4352E58420E68F5E40BF7C74FADDCCD9D1349413"}, nil
+	})
+	server.Handle("SETCONF", func(args string) ([]string, error) { return nil, nil })
+	server.SetInfo("entry-guards", strings.Join([]string{
+		"$4352E58420E68F5E40BF7C74FADDCCD9D1349413~first up",
+		"$A4F3B5E5F8E1A6C5D5F3B5E5F8E1A6C5D5F3B5E5 down 2020-07-19 18:46:00",
+	}, "\n"))
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	m, err := NewManager(conn)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	second, _ := Parse("obfs4 192.0.2.2:443 A4F3B5E5F8E1A6C5D5F3B5E5F8E1A6C5D5F3B5E5 cert=abc")
+	third, _ := Parse("192.0.2.3:443")
+	if err := m.Add(second, third); err != nil {
+		t.Fatalf("failed to add bridges: %v", err)
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatalf("failed to query status: %v", err)
+	}
+	want := []Reachability{ReachabilityUp, ReachabilityDown, ReachabilityUnknown}
+	if len(statuses) != len(want) {
+		t.Fatalf("status count mismatch: have %d, want %d", len(statuses), len(want))
+	}
+	for i, status := range statuses {
+		if status.Reachability != want[i] {
+			t.Errorf("bridge %d: reachability mismatch: have %v, want %v", i, status.Reachability, want[i])
+		}
+	}
+	if since := time.Date(2020, 7, 19, 18, 46, 0, 0, time.UTC); !statuses[1].Since.Equal(since) {
+		t.Errorf("down since mismatch: have %v, want %v", statuses[1].Since, since)
+	}
+	if err := m.Remove("192.0.2.1:443", "192.0.2.2", "192.0.2.3"); err != nil {
+		t.Fatalf("failed to remove bridges: %v", err)
+	}
+	var setconfs []string
+	for _, cmd := range server.History() {
+		if strings.HasPrefix(cmd, "SETCONF") {
+			setconfs = append(setconfs, cmd)
+		}
+	}
+	wantCmds := []string{
+		`SETCONF UseBridges=1 Bridge="192.0.2.1:443 4352E58420E68F5E40BF7C74FADDCCD9D1349413" Bridge="obfs4 192.0.2.2:443 A4F3B5E5F8E1A6C5D5F3B5E5F8E1A6C5D5F3B5E5 cert=abc" Bridge=192.0.2.3:443`,
+		`SETCONF UseBridges=0 Bridge`,
+	}
+	if strings.Join(setconfs, "\n") != strings.Join(wantCmds, "\n") {
+		t.Errorf("command mismatch:\nhave:\n%s\nwant:\n%s", strings.Join(setconfs, "\n"), strings.Join(wantCmds, "\n"))
+	}
+	if len(m.Bridges()) != 0 {
+		t.Errorf("bridges left after removal: %v", m.Bridges())
+	}
+}
@@ -0,0 +1,182 @@
+// Package bridges parses and validates Tor bridge lines, and manages the bridges
+// of a running Tor instance.
+package bridges
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"berty.tech/go-libtor/pt"
+)
+
+// defaultPort is the port Tor assumes for bridges configured without one.
+const defaultPort = 443
+
+// Bridge is a parsed bridge line, in the form of
+//
+//	[transport] IP:port [fingerprint] [key=value ...]
+type Bridge struct {
+	Transport   string  // Pluggable transport name, empty for a plain bridge
+	Addr        string  // Bridge address as "IP:port"
+	Fingerprint string  // Identity fingerprint in upper case hex, if known
+	Args        pt.Args // Transport arguments (e.g. cert and iat-mode for obfs4)
+}
+
+// Parse parses a single bridge line the way Tor does, optionally prefixed with
+// the "Bridge" keyword of the torrc.
+func Parse(line string) (*Bridge, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "Bridge") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("empty bridge line")
+	}
+	b := new(Bridge)
+
+	// The first field is a transport name if it can't be an address
+	if !strings.ContainsAny(fields[0], ".:") {
+		if !isIdentifier(fields[0]) {
+			return nil, fmt.Errorf("invalid transport name %q", fields[0])
+		}
+		b.Transport, fields = fields[0], fields[1:]
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("missing address for %s bridge", b.Transport)
+		}
+	}
+	addr, err := parseAddr(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	b.Addr, fields = addr, fields[1:]
+
+	// Plain bridges may have a fingerprint split by spaces, transports a single
+	// field followed by the arguments
+	var fingerprint string
+	switch {
+	case len(fields) == 0:
+	case b.Transport == "":
+		fingerprint, fields = strings.Join(fields, ""), nil
+	case !isKeyValue(fields[0]):
+		fingerprint, fields = fields[0], fields[1:]
+	}
+	if fingerprint != "" {
+		if len(fingerprint) != 2*20 {
+			return nil, fmt.Errorf("fingerprint %q has wrong length", fingerprint)
+		}
+		if _, err := hex.DecodeString(fingerprint); err != nil {
+			return nil, fmt.Errorf("invalid fingerprint %q", fingerprint)
+		}
+		b.Fingerprint = strings.ToUpper(fingerprint)
+	}
+	if len(fields) > 0 {
+		b.Args = make(pt.Args)
+		for _, field := range fields {
+			if !isKeyValue(field) {
+				return nil, fmt.Errorf("%q is not a key=value argument", field)
+			}
+			kv := strings.SplitN(field, "=", 2)
+			b.Args.Add(kv[0], kv[1])
+		}
+	}
+	return b, nil
+}
+
+// ParseAll parses a block of bridge lines, as pasted by users or handed out by
+// BridgeDB. Empty lines and comments are skipped, and the first invalid line is
+// reported with its line number.
+func ParseAll(text string) ([]*Bridge, error) {
+	var (
+		bridges []*Bridge
+		scanner = bufio.NewScanner(strings.NewReader(text))
+	)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bridge, err := Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", number, err)
+		}
+		bridges = append(bridges, bridge)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return bridges, nil
+}
+
+// String formats the bridge as the value of a Bridge option. Arguments are
+// sorted by key.
+func (b *Bridge) String() string {
+	var fields []string
+	if b.Transport != "" {
+		fields = append(fields, b.Transport)
+	}
+	fields = append(fields, b.Addr)
+	if b.Fingerprint != "" {
+		fields = append(fields, b.Fingerprint)
+	}
+	keys := make([]string, 0, len(b.Args))
+	for key := range b.Args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range b.Args[key] {
+			fields = append(fields, key+"="+value)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// parseAddr validates an "IP:port" bridge address, defaulting to port 443 as
+// Tor does. Hostnames are not accepted, and IPv6 addresses need brackets.
+func parseAddr(addr string) (string, error) {
+	host, port := addr, strconv.Itoa(defaultPort)
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		host = addr[1 : len(addr)-1]
+	} else if strings.Contains(addr, ":") {
+		var err error
+		if host, port, err = net.SplitHostPort(addr); err != nil {
+			return "", fmt.Errorf("invalid address %q: %v", addr, err)
+		}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("invalid address %q: not an IP address", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid address %q: bad port", addr)
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// isIdentifier checks whether s is a valid C identifier, as Tor requires of
+// transport names.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isKeyValue checks whether s is a key=value argument with a non empty key.
+func isKeyValue(s string) bool {
+	return strings.Index(s, "=") > 0
+}
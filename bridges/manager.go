@@ -0,0 +1,209 @@
+package bridges
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+)
+
+// Reachability is what Tor knows about whether a bridge can be connected to.
+type Reachability int
+
+// Bridge reachability states, as reported by Tor's guard subsystem.
+const (
+	ReachabilityUnknown  Reachability = iota // Tor didn't try the bridge yet or can't identify it
+	ReachabilityNever                        // Tor never managed to connect
+	ReachabilityUp                           // The bridge is reachable and usable
+	ReachabilityDown                         // Connecting to the bridge failed recently
+	ReachabilityUnusable                     // The bridge can't be used, e.g. no longer listed
+)
+
+// String implements fmt.Stringer.
+func (r Reachability) String() string {
+	switch r {
+	case ReachabilityUnknown:
+		return "unknown"
+	case ReachabilityNever:
+		return "never-connected"
+	case ReachabilityUp:
+		return "up"
+	case ReachabilityDown:
+		return "down"
+	case ReachabilityUnusable:
+		return "unusable"
+	default:
+		return fmt.Sprintf("Reachability(%d)", int(r))
+	}
+}
+
+// Status is the reachability of a configured bridge.
+type Status struct {
+	Bridge       *Bridge
+	Reachability Reachability
+	Since        time.Time // When the bridge went down or unusable, if known
+}
+
+// Manager adds and removes the bridges of a running Tor instance.
+type Manager struct {
+	conn    *control.Conn
+	bridges []*Bridge
+	lock    sync.Mutex
+}
+
+// NewManager creates a bridge manager for the Tor instance behind an
+// authenticated control connection, picking up any bridges already configured.
+func NewManager(conn *control.Conn) (*Manager, error) {
+	m := &Manager{conn: conn}
+
+	kvs, err := conn.GetConf("Bridge")
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		if kv.Key != "Bridge" || kv.Val == "" {
+			continue
+		}
+		bridge, err := Parse(kv.Val)
+		if err != nil {
+			return nil, fmt.Errorf("configured bridge: %v", err)
+		}
+		m.bridges = append(m.bridges, bridge)
+	}
+	return m, nil
+}
+
+// Bridges returns the currently configured bridges.
+func (m *Manager) Bridges() []*Bridge {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]*Bridge(nil), m.bridges...)
+}
+
+// Add configures new bridges and enables their use. Bridges already present
+// (with the same address) are replaced. Transports used by the bridges must be
+// configured beforehand, e.g. via pt.Server.
+func (m *Manager) Add(bridges ...*Bridge) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	updated := append([]*Bridge(nil), m.bridges...)
+	for _, bridge := range bridges {
+		if i := indexOf(updated, bridge.Addr); i >= 0 {
+			updated[i] = bridge
+		} else {
+			updated = append(updated, bridge)
+		}
+	}
+	return m.apply(updated)
+}
+
+// Remove drops the bridges at the given addresses, disabling bridges altogether
+// if none remain.
+func (m *Manager) Remove(addrs ...string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	updated := append([]*Bridge(nil), m.bridges...)
+	for _, addr := range addrs {
+		if i := indexOf(updated, addr); i >= 0 {
+			updated = append(updated[:i], updated[i+1:]...)
+		}
+	}
+	return m.apply(updated)
+}
+
+// apply sets the bridges of Tor in one go, so it never runs with a partial set.
+// The lock must be held.
+func (m *Manager) apply(bridges []*Bridge) error {
+	var kvs []*control.KeyVal
+	if len(bridges) == 0 {
+		kvs = append(kvs, control.NewKeyVal("UseBridges", "0"), control.NewKeyVal("Bridge", ""))
+	} else {
+		kvs = append(kvs, control.NewKeyVal("UseBridges", "1"))
+		for _, bridge := range bridges {
+			kvs = append(kvs, control.NewKeyVal("Bridge", bridge.String()))
+		}
+	}
+	if err := m.conn.SetConf(kvs...); err != nil {
+		return err
+	}
+	m.bridges = bridges
+	return nil
+}
+
+// Status reports the reachability of every configured bridge, from the state of
+// Tor's guards. Bridges configured without a fingerprint can't be identified
+// and are reported as unknown.
+func (m *Manager) Status() ([]*Status, error) {
+	infos, err := m.conn.GetInfo("entry-guards")
+	if err != nil {
+		return nil, err
+	}
+	guards := make(map[string]*Status)
+	for _, info := range infos {
+		for _, line := range strings.Split(info.Val, "\n") {
+			fingerprint, status := parseGuard(line)
+			if status != nil {
+				guards[fingerprint] = status
+			}
+		}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	statuses := make([]*Status, len(m.bridges))
+	for i, bridge := range m.bridges {
+		statuses[i] = &Status{Bridge: bridge}
+		if guard, ok := guards[bridge.Fingerprint]; ok && bridge.Fingerprint != "" {
+			statuses[i].Reachability, statuses[i].Since = guard.Reachability, guard.Since
+		}
+	}
+	return statuses, nil
+}
+
+// parseGuard parses an entry-guards line ("$FINGERPRINT[~=]nickname status
+// [YYYY-MM-DD HH:MM:SS]"), returning the guard fingerprint and status.
+func parseGuard(line string) (string, *Status) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "$") {
+		return "", nil
+	}
+	fingerprint := strings.TrimPrefix(fields[0], "$")
+	if i := strings.IndexAny(fingerprint, "~="); i >= 0 {
+		fingerprint = fingerprint[:i]
+	}
+	status := new(Status)
+	switch fields[1] {
+	case "never-connected":
+		status.Reachability = ReachabilityNever
+	case "up":
+		status.Reachability = ReachabilityUp
+	case "down":
+		status.Reachability = ReachabilityDown
+	case "unusable":
+		status.Reachability = ReachabilityUnusable
+	}
+	if len(fields) >= 4 {
+		if since, err := time.Parse("2006-01-02 15:04:05", fields[2]+" "+fields[3]); err == nil {
+			status.Since = since
+		}
+	}
+	return strings.ToUpper(fingerprint), status
+}
+
+// indexOf returns the index of the bridge with the given address, or -1.
+func indexOf(bridges []*Bridge, addr string) int {
+	if normalized, err := parseAddr(addr); err == nil {
+		addr = normalized
+	}
+	for i, bridge := range bridges {
+		if bridge.Addr == addr {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,17 @@
+package libtor
+
+import "berty.tech/go-libtor/libtor"
+
+// Bug is a failed assertion or BUG() warning raised within Tor, along with the
+// backtrace of the thread that hit it.
+type Bug = libtor.Bug
+
+// HandleBugs registers a callback to receive every assertion failure and BUG()
+// warning of Tor, replacing any previous one (nil disables reporting).
+//
+// The callback runs synchronously before Tor logs the bug and, for fatal ones,
+// aborts the process, so it's the last chance to ship a crash report. Bugs hit
+// by Tor instances started with SubprocessCreator are relayed to it too.
+func HandleBugs(handler func(*Bug)) {
+	libtor.HandleBugs(handler)
+}
@@ -178,6 +178,7 @@ func WrapTor(root string) error {
 				if err := tmpl.Execute(buff, map[string]string{
 					"TargetFilter": targetFilter,
 					"File":         dep[1],
+					"Defines":      torDefines[dep[1]],
 				}); err != nil {
 					return err
 				}
@@ -192,6 +193,7 @@ func WrapTor(root string) error {
 				if err := tmpl.Execute(buff, map[string]string{
 					"TargetFilter": targetFilter,
 					"File":         strings.Replace(dep[1], "-c64", "", -1),
+					"Defines":      torDefines[dep[1]],
 				}); err != nil {
 					return err
 				}
@@ -208,6 +210,7 @@ func WrapTor(root string) error {
 		if err := tmpl.Execute(buff, map[string]string{
 			"TargetFilter": targetFilter,
 			"File":         dep[1],
+			"Defines":      torDefines[dep[1]],
 		}); err != nil {
 			return err
 		}
@@ -305,6 +308,13 @@ package libtor
 import "C"
 `
 
+// torDefines are extra macros prepended to specific Tor sources when wrapping.
+// The assertion and BUG() reporters of util_bug.c are renamed, so libtor can
+// interpose its own hooks in front of them (see libtor/bughook.go).
+var torDefines = map[string]string{
+	"src/lib/log/util_bug": "\n#define tor_assertion_failed_ tor_assertion_failed_orig_\n#define tor_bug_occurred_ tor_bug_occurred_orig_\n",
+}
+
 // torTemplate is the source file template used in Tor Go wrappers.
 var torTemplate = `// go-libtor - Self-contained Tor from Go
 // Copyright (c) 2018 Péter Szilágyi. All rights reserved.
@@ -314,7 +324,7 @@ package libtor
 
 /*
 #define BUILDDIR ""
-
+{{.Defines}}
 #include <../{{.File}}.c>
 */
 import "C"
@@ -847,6 +847,7 @@ func wrapTor(tgt string, lock *lockJson) (string, string, error) {
 				if err := tmpl.Execute(buff, map[string]string{
 					"TargetFilter": tgtFilt,
 					"File":         dep[1],
+					"Defines":      torDefines[dep[1]],
 				}); err != nil {
 					return "", "", err
 				}
@@ -858,6 +859,7 @@ func wrapTor(tgt string, lock *lockJson) (string, string, error) {
 				if err := tmpl.Execute(buff, map[string]string{
 					"TargetFilter": tgtFilt,
 					"File":         strings.Replace(dep[1], "-c64", "", -1),
+					"Defines":      torDefines[dep[1]],
 				}); err != nil {
 					return "", "", err
 				}
@@ -871,6 +873,7 @@ func wrapTor(tgt string, lock *lockJson) (string, string, error) {
 		if err := tmpl.Execute(buff, map[string]string{
 			"TargetFilter": tgtFilt,
 			"File":         dep[1],
+			"Defines":      torDefines[dep[1]],
 		}); err != nil {
 			return "", "", err
 		}
@@ -932,6 +935,13 @@ package libtor
 import "C"
 `
 
+// torDefines are extra macros prepended to specific Tor sources when wrapping.
+// The assertion and BUG() reporters of util_bug.c are renamed, so libtor can
+// interpose its own hooks in front of them (see libtor/bughook.go).
+var torDefines = map[string]string{
+	"src/lib/log/util_bug": "\n#define tor_assertion_failed_ tor_assertion_failed_orig_\n#define tor_bug_occurred_ tor_bug_occurred_orig_\n",
+}
+
 // torTemplate is the source file template used in Tor Go wrappers.
 var torTemplate = `// go-libtor - Self-contained Tor from Go
 // Copyright (c) 2018 Péter Szilágyi. All rights reserved.
@@ -941,7 +951,7 @@ package libtor
 
 /*
 #define BUILDDIR ""
-
+{{.Defines}}
 #include <../{{.File}}.c>
 */
 import "C"
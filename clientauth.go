@@ -0,0 +1,263 @@
+package libtor
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/libtor"
+)
+
+// clientAuthEncoding is the unpadded base32 flavor used in client auth files.
+var clientAuthEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Client authorization file extensions of the service and the client side.
+const (
+	serviceAuthExtension = ".auth"
+	clientAuthExtension  = ".auth_private"
+)
+
+// ClientAuthKey is an x25519 keypair authorizing a client to decrypt the
+// descriptor of a v3 onion service. The service only ever needs the public
+// half, the client keeps the private one.
+type ClientAuthKey struct {
+	PublicKey  [32]byte
+	PrivateKey [32]byte
+}
+
+// GenerateClientAuthKey creates a new random client authorization keypair via
+// the curve25519 implementation of the embedded Tor.
+func GenerateClientAuthKey() (*ClientAuthKey, error) {
+	pub, sec, err := libtor.GenerateX25519()
+	if err != nil {
+		return nil, err
+	}
+	return &ClientAuthKey{PublicKey: pub, PrivateKey: sec}, nil
+}
+
+// ServiceLine returns the content of the service side authorized_clients/*.auth
+// file: "descriptor:x25519:<base32 public key>".
+func (k *ClientAuthKey) ServiceLine() string {
+	return "descriptor:x25519:" + clientAuthEncoding.EncodeToString(k.PublicKey[:])
+}
+
+// ClientLine returns the content of the client side *.auth_private file for an
+// onion service: "<onion id>:descriptor:x25519:<base32 private key>".
+func (k *ClientAuthKey) ClientLine(onionID string) string {
+	onionID = strings.TrimSuffix(onionID, ".onion")
+	return onionID + ":descriptor:x25519:" + clientAuthEncoding.EncodeToString(k.PrivateKey[:])
+}
+
+// ParseServiceLine parses the content of a service side *.auth file, returning
+// the public key of the authorized client.
+func ParseServiceLine(line string) ([32]byte, error) {
+	var pub [32]byte
+
+	fields := strings.Split(strings.TrimSpace(line), ":")
+	if len(fields) != 3 || fields[0] != "descriptor" || fields[1] != "x25519" {
+		return pub, fmt.Errorf("invalid client authorization %q", line)
+	}
+	if err := decodeClientAuthKey(pub[:], fields[2]); err != nil {
+		return pub, err
+	}
+	return pub, nil
+}
+
+// ParseClientLine parses the content of a client side *.auth_private file,
+// returning the onion service ID and the full client keypair.
+func ParseClientLine(line string) (string, *ClientAuthKey, error) {
+	fields := strings.Split(strings.TrimSpace(line), ":")
+	if len(fields) != 4 || fields[1] != "descriptor" || fields[2] != "x25519" {
+		return "", nil, errors.New("invalid client authorization")
+	}
+	key := new(ClientAuthKey)
+	if err := decodeClientAuthKey(key.PrivateKey[:], fields[3]); err != nil {
+		return "", nil, err
+	}
+	pub, err := libtor.X25519PublicKey(key.PrivateKey)
+	if err != nil {
+		return "", nil, err
+	}
+	key.PublicKey = pub
+	return fields[0], key, nil
+}
+
+// decodeClientAuthKey decodes a base32 key of a client authorization file.
+func decodeClientAuthKey(dst []byte, encoded string) error {
+	key, err := clientAuthEncoding.DecodeString(strings.ToUpper(encoded))
+	if err != nil {
+		return fmt.Errorf("invalid client authorization key: %v", err)
+	}
+	if len(key) != len(dst) {
+		return fmt.Errorf("invalid client authorization key length %d", len(key))
+	}
+	copy(dst, key)
+	return nil
+}
+
+// ServiceAuth manages the clients authorized to access a v3 onion service that
+// is configured via HiddenServiceDir. Note, the embedded Tor (0.3.5) does not
+// support client authorization for ADD_ONION created services.
+type ServiceAuth struct {
+	conn *control.Conn
+	dir  string
+}
+
+// NewServiceAuth creates a client authorization manager for the onion service
+// in serviceDir. If conn is set, changes are applied to the running Tor
+// instance immediately, otherwise only the files are updated.
+func NewServiceAuth(conn *control.Conn, serviceDir string) *ServiceAuth {
+	return &ServiceAuth{conn: conn, dir: filepath.Join(serviceDir, "authorized_clients")}
+}
+
+// Authorize generates a new keypair for a client and authorizes it to access
+// the service. The returned key must be handed over to the client.
+func (s *ServiceAuth) Authorize(name string) (*ClientAuthKey, error) {
+	key, err := GenerateClientAuthKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.AuthorizeKey(name, key.PublicKey); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// AuthorizeKey authorizes a client by its public key, replacing any previous
+// key authorized under the same name.
+func (s *ServiceAuth) AuthorizeKey(name string, pub [32]byte) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create authorized clients directory: %v", err)
+	}
+	path, err := authFilePath(s.dir, name, serviceAuthExtension)
+	if err != nil {
+		return err
+	}
+	key := &ClientAuthKey{PublicKey: pub}
+	if err := ioutil.WriteFile(path, []byte(key.ServiceLine()+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write client authorization: %v", err)
+	}
+	return reloadClientAuth(s.conn)
+}
+
+// Revoke removes the authorization of a client. Revoking an unknown client is
+// not an error.
+func (s *ServiceAuth) Revoke(name string) error {
+	path, err := authFilePath(s.dir, name, serviceAuthExtension)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove client authorization: %v", err)
+	}
+	return reloadClientAuth(s.conn)
+}
+
+// Clients returns the public keys of the authorized clients, keyed by name.
+func (s *ServiceAuth) Clients() (map[string][32]byte, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list authorized clients: %v", err)
+	}
+	clients := make(map[string][32]byte)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), serviceAuthExtension) {
+			continue
+		}
+		blob, err := ioutil.ReadFile(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client authorization: %v", err)
+		}
+		pub, err := ParseServiceLine(string(blob))
+		if err != nil {
+			return nil, err
+		}
+		clients[strings.TrimSuffix(file.Name(), serviceAuthExtension)] = pub
+	}
+	return clients, nil
+}
+
+// ClientAuth manages the credentials the embedded Tor uses to access client
+// authorized v3 onion services, stored in its ClientOnionAuthDir.
+type ClientAuth struct {
+	conn *control.Conn
+	dir  string
+}
+
+// NewClientAuth creates a credential manager keeping the keys in authDir. If
+// conn is set, the directory is configured as the ClientOnionAuthDir of the
+// running Tor instance on every change, otherwise only the files are updated.
+func NewClientAuth(conn *control.Conn, authDir string) *ClientAuth {
+	return &ClientAuth{conn: conn, dir: authDir}
+}
+
+// Add stores the credentials to access an onion service under name, replacing
+// any previous ones.
+func (c *ClientAuth) Add(name, onionID string, key *ClientAuthKey) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create client authorization directory: %v", err)
+	}
+	path, err := authFilePath(c.dir, name, clientAuthExtension)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, []byte(key.ClientLine(onionID)+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write client authorization: %v", err)
+	}
+	return c.apply()
+}
+
+// Remove deletes the credentials stored under name. Removing unknown
+// credentials is not an error.
+func (c *ClientAuth) Remove(name string) error {
+	path, err := authFilePath(c.dir, name, clientAuthExtension)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove client authorization: %v", err)
+	}
+	return c.apply()
+}
+
+// apply points Tor to the credential directory, making it reload its contents.
+func (c *ClientAuth) apply() error {
+	if c.conn == nil {
+		return nil
+	}
+	if err := c.conn.SetConf(control.KeyVals("ClientOnionAuthDir", c.dir)...); err != nil {
+		return fmt.Errorf("failed to apply client authorizations: %v", err)
+	}
+	return nil
+}
+
+// authFilePath validates a client name and returns the path of its file.
+func authFilePath(dir, name, extension string) (string, error) {
+	if !keyNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid client name %q", name)
+	}
+	return filepath.Join(dir, name+extension), nil
+}
+
+// reloadClientAuth makes a running Tor reload the client authorizations of all
+// its services. Any configuration change triggers a reload of the onion service
+// keys, so the current ClientOnionAuthDir is simply set again.
+func reloadClientAuth(conn *control.Conn) error {
+	if conn == nil {
+		return nil
+	}
+	conf, err := conn.GetConf("ClientOnionAuthDir")
+	if err != nil {
+		return fmt.Errorf("failed to query configuration: %v", err)
+	}
+	if err := conn.SetConf(conf...); err != nil {
+		return fmt.Errorf("failed to reload client authorizations: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package libtor
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// Tests that client authorization lines round trip through their parsers, with
+// the public key derived from the private one on the client side.
+func TestClientAuthLines(t *testing.T) {
+	// X25519 test vector of RFC 7748, section 6.1
+	var key ClientAuthKey
+	sec, _ := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	pub, _ := hex.DecodeString("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+	copy(key.PrivateKey[:], sec)
+	copy(key.PublicKey[:], pub)
+
+	line := key.ServiceLine()
+	if !strings.HasPrefix(line, "descriptor:x25519:") || strings.Contains(line, "=") {
+		t.Errorf("service line mismatch: have %s", line)
+	}
+	parsed, err := ParseServiceLine(line + "\n")
+	if err != nil {
+		t.Fatalf("failed to parse service line: %v", err)
+	}
+	if parsed != key.PublicKey {
+		t.Errorf("service key mismatch: have %x, want %x", parsed, key.PublicKey)
+	}
+	if parsed, err := ParseServiceLine(strings.ToLower(line)); err != nil || parsed != key.PublicKey {
+		t.Errorf("lower case service line mismatch: have %x, %v", parsed, err)
+	}
+	id, client, err := ParseClientLine(key.ClientLine("exampleonion.onion"))
+	if err != nil {
+		t.Fatalf("failed to parse client line: %v", err)
+	}
+	if id != "exampleonion" {
+		t.Errorf("onion ID mismatch: have %s, want %s", id, "exampleonion")
+	}
+	if *client != key {
+		t.Errorf("client key mismatch: have %x, want %x", *client, key)
+	}
+	// Malformed lines must be rejected
+	services := []string{
+		"",
+		"descriptor:x25519",
+		"descriptor:ed25519:" + clientAuthEncoding.EncodeToString(pub),
+		"descriptor:x25519:" + clientAuthEncoding.EncodeToString(pub[:31]),
+		"descriptor:x25519:not-base32",
+	}
+	for i, tt := range services {
+		if _, err := ParseServiceLine(tt); err == nil {
+			t.Errorf("test %d: invalid service line accepted: %q", i, tt)
+		}
+	}
+	clients := []string{
+		"",
+		"descriptor:x25519:" + clientAuthEncoding.EncodeToString(sec),
+		"exampleonion:descriptor:ed25519:" + clientAuthEncoding.EncodeToString(sec),
+		"exampleonion:descriptor:x25519:" + clientAuthEncoding.EncodeToString(sec[:16]),
+	}
+	for i, tt := range clients {
+		if _, _, err := ParseClientLine(tt); err == nil {
+			t.Errorf("test %d: invalid client line accepted: %q", i, tt)
+		}
+	}
+}
+
+// Tests that authorizing and revoking clients updates the authorized_clients
+// directory and makes the running Tor reload it.
+func TestServiceAuth(t *testing.T) {
+	server := controltest.NewServer()
+	server.Handle("GETCONF", func(args string) ([]string, error) {
+		return []string{"ClientOnionAuthDir=/var/lib/tor/auth"}, nil
+	})
+	server.Handle("SETCONF", func(args string) ([]string, error) { return nil, nil })
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	dir, err := ioutil.TempDir("", "clientauth")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	auth := NewServiceAuth(conn, dir)
+	alice, err := auth.Authorize("alice")
+	if err != nil {
+		t.Fatalf("failed to authorize client: %v", err)
+	}
+	bob, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+	if err := auth.AuthorizeKey("bob", bob.PublicKey); err != nil {
+		t.Fatalf("failed to authorize client key: %v", err)
+	}
+	path := filepath.Join(dir, "authorized_clients", "alice.auth")
+	if info, err := os.Stat(path); err != nil {
+		t.Fatalf("failed to stat client authorization: %v", err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("client authorization mode mismatch: have %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	if blob, _ := ioutil.ReadFile(path); string(blob) != alice.ServiceLine()+"\n" {
+		t.Errorf("client authorization mismatch: have %q, want %q", blob, alice.ServiceLine()+"\n")
+	}
+	clients, err := auth.Clients()
+	if err != nil {
+		t.Fatalf("failed to list clients: %v", err)
+	}
+	if len(clients) != 2 || clients["alice"] != alice.PublicKey || clients["bob"] != bob.PublicKey {
+		t.Errorf("authorized clients mismatch: have %x", clients)
+	}
+	// Revocations must be idempotent and invalid names refused
+	for i := 0; i < 2; i++ {
+		if err := auth.Revoke("alice"); err != nil {
+			t.Errorf("revocation %d: failed to revoke client: %v", i, err)
+		}
+	}
+	if err := auth.Revoke("../alice"); err == nil {
+		t.Errorf("invalid client name accepted")
+	}
+	if clients, err := auth.Clients(); err != nil || len(clients) != 1 || clients["bob"] != bob.PublicKey {
+		t.Errorf("remaining clients mismatch: have %x, %v", clients, err)
+	}
+	// Every change must have reloaded the current configuration
+	var reloads int
+	for _, cmd := range server.History() {
+		if strings.HasPrefix(cmd, "SETCONF") {
+			if !strings.HasPrefix(cmd, "SETCONF ClientOnionAuthDir=/var/lib/tor/auth") {
+				t.Errorf("reload mismatch: have %s", cmd)
+			}
+			reloads++
+		}
+	}
+	if reloads != 4 {
+		t.Errorf("reload count mismatch: have %d, want %d", reloads, 4)
+	}
+}
+
+// Tests that client credentials are stored in the auth directory, which is set
+// as the ClientOnionAuthDir on every change.
+func TestClientAuth(t *testing.T) {
+	server := controltest.NewServer()
+	server.Handle("SETCONF", func(args string) ([]string, error) { return nil, nil })
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	dir, err := ioutil.TempDir("", "clientauth")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+	auth := NewClientAuth(conn, filepath.Join(dir, "auth"))
+	if err := auth.Add("service", "exampleonion.onion", key); err != nil {
+		t.Fatalf("failed to add credentials: %v", err)
+	}
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "auth", "service.auth_private"))
+	if err != nil {
+		t.Fatalf("failed to read credentials: %v", err)
+	}
+	id, parsed, err := ParseClientLine(string(blob))
+	if err != nil || id != "exampleonion" || *parsed != *key {
+		t.Errorf("stored credentials mismatch: have %s %x, %v", id, parsed, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := auth.Remove("service"); err != nil {
+			t.Errorf("removal %d: failed to remove credentials: %v", i, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "auth", "service.auth_private")); !os.IsNotExist(err) {
+		t.Errorf("credentials not removed: %v", err)
+	}
+	var setconfs []string
+	for _, cmd := range server.History() {
+		if strings.HasPrefix(cmd, "SETCONF") {
+			setconfs = append(setconfs, cmd)
+		}
+	}
+	want := "SETCONF ClientOnionAuthDir=" + filepath.Join(dir, "auth")
+	if len(setconfs) != 3 {
+		t.Fatalf("SETCONF count mismatch: have %q, want 3", setconfs)
+	}
+	for i, cmd := range setconfs {
+		if cmd != want {
+			t.Errorf("SETCONF %d mismatch: have %s, want %s", i, cmd, want)
+		}
+	}
+	// Without a controller only the files are updated
+	if err := NewClientAuth(nil, filepath.Join(dir, "auth")).Add("offline", "exampleonion", key); err != nil {
+		t.Errorf("failed to add offline credentials: %v", err)
+	}
+}
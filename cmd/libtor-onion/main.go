@@ -0,0 +1,163 @@
+// Command libtor-onion generates v3 onion service keys offline, optionally
+// searching for addresses starting with a chosen prefix, and writes them in the
+// layout Tor loads from a HiddenServiceDir.
+//
+// Usage:
+//
+//	libtor-onion [-n count] [-prefix abc,xyz] [-workers N] [-out dir]
+//
+// Every generated service is written into its own <out>/<address> directory,
+// containing hs_ed25519_secret_key, hs_ed25519_public_key and hostname.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/torutil/ed25519"
+
+	golibtor "berty.tech/go-libtor"
+	"berty.tech/go-libtor/libtor"
+)
+
+var (
+	countFlag    = flag.Int("n", 1, "Number of onion service keys to generate")
+	prefixFlag   = flag.String("prefix", "", "Comma separated address prefixes to search for")
+	workersFlag  = flag.Int("workers", runtime.NumCPU(), "Number of concurrent key generators")
+	outFlag      = flag.String("out", ".", "Directory to write the service directories into")
+	progressFlag = flag.Duration("progress", 10*time.Second, "Interval of search progress reports (0 to disable)")
+)
+
+// base32Alphabet is the character set of onion addresses.
+const base32Alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+
+func main() {
+	flag.Parse()
+
+	prefixes, err := parsePrefixes(*prefixFlag)
+	if err != nil {
+		log.Fatalf("Invalid prefix: %v", err)
+	}
+	if *countFlag < 1 || *workersFlag < 1 {
+		log.Fatalf("Key count and worker count must be positive")
+	}
+	if err := os.MkdirAll(*outFlag, 0700); err != nil {
+		log.Fatalf("Failed to create output directory: %v", err)
+	}
+	// Start the key generators and report progress if a long search is expected
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		tried   uint64
+		pending sync.WaitGroup
+		found   = make(chan *control.ED25519Key)
+	)
+	for i := 0; i < *workersFlag; i++ {
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			search(ctx, prefixes, found, &tried)
+		}()
+	}
+	if len(prefixes) > 0 && *progressFlag > 0 {
+		go report(ctx, *progressFlag, &tried)
+	}
+	// Write out the matching keys until enough were found
+	for i := 0; i < *countFlag; i++ {
+		key := <-found
+
+		id := golibtor.OnionID(key)
+		if err := golibtor.WriteHiddenServiceDir(filepath.Join(*outFlag, id), key); err != nil {
+			log.Fatalf("Failed to write onion service %s: %v", id, err)
+		}
+		fmt.Println(id + ".onion")
+	}
+	cancel()
+	pending.Wait()
+}
+
+// parsePrefixes splits and validates the comma separated prefix list.
+func parsePrefixes(list string) ([]string, error) {
+	var prefixes []string
+	for _, prefix := range strings.Split(list, ",") {
+		prefix = strings.ToLower(strings.TrimSpace(prefix))
+		if prefix == "" {
+			continue
+		}
+		if len(prefix) > 56 {
+			return nil, fmt.Errorf("%q longer than an onion address", prefix)
+		}
+		for _, char := range prefix {
+			if !strings.ContainsRune(base32Alphabet, char) {
+				return nil, fmt.Errorf("%q contains %q, not in [a-z2-7]", prefix, char)
+			}
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// search generates keys until one matches any of the prefixes (or any key if no
+// prefixes were given), delivering it on found. It returns when ctx is done.
+func search(ctx context.Context, prefixes []string, found chan *control.ED25519Key, tried *uint64) {
+	for ctx.Err() == nil {
+		sec, pub, err := libtor.GenerateED25519()
+		if err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		atomic.AddUint64(tried, 1)
+
+		if !matches(libtor.HSAddress(pub), prefixes) {
+			continue
+		}
+		key := &control.ED25519Key{KeyPair: ed25519.PrivateKey(sec[:]).KeyPair()}
+		select {
+		case found <- key:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// matches reports whether an address starts with any of the prefixes.
+func matches(address string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(address, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// report periodically prints the search rate to stderr.
+func report(ctx context.Context, interval time.Duration, tried *uint64) {
+	start := time.Now()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			count := atomic.LoadUint64(tried)
+			rate := float64(count) / time.Since(start).Seconds()
+			fmt.Fprintf(os.Stderr, "Tried %d keys (%.0f keys/s)\n", count, rate)
+		}
+	}
+}
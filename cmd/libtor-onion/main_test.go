@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Tests that prefix lists are normalized and that prefixes no onion address can
+// start with are rejected.
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		list     string
+		prefixes []string
+		ok       bool
+	}{
+		{"", nil, true},
+		{"abc", []string{"abc"}, true},
+		{" ABC , xyz27,, ", []string{"abc", "xyz27"}, true},
+		{"abc1", nil, false},
+		{"abc,x8", nil, false},
+		{"ab-c", nil, false},
+		{"ab.onion", nil, false},
+		{strings.Repeat("a", 56), []string{strings.Repeat("a", 56)}, true},
+		{strings.Repeat("a", 57), nil, false},
+	}
+	for i, tt := range tests {
+		prefixes, err := parsePrefixes(tt.list)
+		if (err == nil) != tt.ok {
+			t.Errorf("test %d: error mismatch: have %v, want ok %v", i, err, tt.ok)
+			continue
+		}
+		if !reflect.DeepEqual(prefixes, tt.prefixes) {
+			t.Errorf("test %d: prefixes mismatch: have %q, want %q", i, prefixes, tt.prefixes)
+		}
+	}
+}
+
+// Tests that addresses match any of the prefixes, or anything if none is given.
+func TestMatches(t *testing.T) {
+	address := "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"
+
+	tests := []struct {
+		prefixes []string
+		match    bool
+	}{
+		{nil, true},
+		{[]string{"pg6"}, true},
+		{[]string{"abc", "pg6mm"}, true},
+		{[]string{"abc", "g6"}, false},
+		{[]string{address + "a"}, false},
+	}
+	for i, tt := range tests {
+		if match := matches(address, tt.prefixes); match != tt.match {
+			t.Errorf("test %d: match mismatch: have %v, want %v", i, match, tt.match)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package libtor
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/libtor"
+)
+
+// DecodeOnionDescriptor decrypts a v3 onion service descriptor, e.g. the content
+// of an HS_DESC_CONTENT event, into its outer and inner layers via the embedded
+// Tor. Descriptors restricted to authorized clients need the key of one of them,
+// auth is nil otherwise. It does not need a running instance.
+func DecodeOnionDescriptor(onionID string, encoded string, auth *ClientAuthKey) (*libtor.HSDescriptor, error) {
+	onionID = strings.TrimSuffix(onionID, ".onion")
+	if auth == nil {
+		return libtor.DecodeHSDescriptor(onionID, encoded, nil)
+	}
+	sec := auth.PrivateKey
+	return libtor.DecodeHSDescriptor(onionID, encoded, &sec)
+}
+
+// EncodeOnionDescriptor signs and encrypts a descriptor of the service of key for
+// the time period at the given moment, e.g. to feed crafted descriptors to tests.
+// The keys of the outer layer are derived from the service key, whatever the
+// descriptor holds. The time periods are those of the public network, test
+// networks need libtor.EncodeHSDescriptor. It does not need a running instance.
+func EncodeOnionDescriptor(key *control.ED25519Key, at time.Time, desc *libtor.HSDescriptor) (string, error) {
+	var (
+		sec [64]byte
+		pub [32]byte
+	)
+	copy(sec[:], key.PrivateKey())
+	copy(pub[:], key.PublicKey())
+
+	period := libtor.HSTimePeriod(at, libtor.HSPeriodLength, libtor.HSRotationOffset)
+	return libtor.EncodeHSDescriptor(sec, pub, period, libtor.HSPeriodLength, desc)
+}
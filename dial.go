@@ -0,0 +1,43 @@
+package libtor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/internal/socks"
+)
+
+// DialContext opens a stream to addr ("host:port", where host may be a hostname,
+// an IP or an onion address) through the SOCKS listener of Tor. Hostnames are
+// resolved by the exit relay.
+func (t *Tor) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxy, err := t.SocksAddr()
+	if err != nil {
+		return nil, err
+	}
+	return socks.Dial(ctx, proxy, network, addr, nil)
+}
+
+// SocksAddr returns the address of the SOCKS listener of Tor, either as
+// "host:port" or as "unix:/path".
+func (t *Tor) SocksAddr() (string, error) {
+	return socksAddr(t.Control)
+}
+
+// socksAddr queries the address of the first SOCKS listener of Tor.
+func socksAddr(conn *control.Conn) (string, error) {
+	infos, err := conn.GetInfo("net/listeners/socks")
+	if err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		if fields := strings.Fields(info.Val); len(fields) > 0 {
+			return strings.Trim(fields[0], `"`), nil
+		}
+	}
+	return "", errors.New("no SOCKS listener")
+}
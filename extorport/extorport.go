@@ -0,0 +1,347 @@
+// Package extorport implements the Extended ORPort protocol of Tor, through
+// which server side pluggable transports hand the connections they accepted
+// over to a bridge, along with the name of the transport and the address of
+// the user for Tor's statistics.
+//
+// Both sides of the protocol are provided: Dial and Handshake for transports
+// feeding Tor, Accept for the Tor side, e.g. to test transports without Tor.
+// See ext-orport-spec.txt in the Tor specifications for the details.
+//
+// Addresses are either "host:port" or "unix:/path", but the embedded Tor 0.3.5
+// only opens its ExtORPort on TCP (e.g. "ExtORPort auto"): Unix sockets need a
+// newer Tor, run as a separate process.
+package extorport
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/control"
+)
+
+// CookieFile is the default name of the cookie file within the data directory
+// of Tor, used unless ExtORPortCookieAuthFile is set.
+const CookieFile = "extended_orport_auth_cookie"
+
+// Authentication constants of the SAFE_COOKIE method.
+const (
+	AuthSafeCookie = 1 // Identifier of the SAFE_COOKIE authentication method
+
+	CookieHeader = "! Extended ORPort Auth Cookie !\x0a" // Header of the cookie file
+	CookieSize   = 32                                    // Size of the cookie, after the header
+	NonceSize    = 32                                    // Size of the nonces of both sides
+
+	serverHashText = "ExtORPort authentication server-to-client hash"
+	clientHashText = "ExtORPort authentication client-to-server hash"
+)
+
+// Commands sent by transports, and replies sent by Tor.
+const (
+	CmdDone      = 0x0000 // Metadata complete, OR traffic follows
+	CmdUserAddr  = 0x0001 // Address of the user, as "host:port"
+	CmdTransport = 0x0002 // Name of the transport
+
+	ReplyOkay    = 0x1000 // Connection accepted
+	ReplyDeny    = 0x1001 // Connection refused
+	ReplyControl = 0x1002 // Control message, unused by Tor so far
+)
+
+var (
+	// ErrAuthRejected is returned when the peer refused the authentication, or
+	// proved not to know the cookie.
+	ErrAuthRejected = errors.New("ExtORPort authentication rejected")
+
+	// ErrDenied is returned when Tor refused the connection after the metadata.
+	ErrDenied = errors.New("ExtORPort connection denied")
+)
+
+// Info is the metadata of a transport connection.
+type Info struct {
+	Transport string // Name of the transport the connection came through
+	UserAddr  string // Address of the user, "host:port"
+}
+
+// ReadCookie loads the authentication cookie from a cookie file.
+func ReadCookie(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != len(CookieHeader)+CookieSize || !bytes.HasPrefix(data, []byte(CookieHeader)) {
+		return nil, errors.New("malformed ExtORPort cookie file")
+	}
+	return data[len(CookieHeader):], nil
+}
+
+// WriteCookie stores an authentication cookie into a cookie file, the way Tor
+// does.
+func WriteCookie(path string, cookie []byte) error {
+	if len(cookie) != CookieSize {
+		return fmt.Errorf("invalid cookie size %d", len(cookie))
+	}
+	return ioutil.WriteFile(path, append([]byte(CookieHeader), cookie...), 0600)
+}
+
+// Addr queries the address of the first ExtORPort listener of the Tor instance
+// behind an authenticated control connection, either as "host:port" or as
+// "unix:/path". It returns an empty string if Tor has no ExtORPort.
+func Addr(conn *control.Conn) (string, error) {
+	infos, err := conn.GetInfo("net/listeners/extor")
+	if err != nil {
+		return "", fmt.Errorf("failed to query ExtORPort listener: %v", err)
+	}
+	for _, info := range infos {
+		if fields := strings.Fields(info.Val); len(fields) > 0 {
+			return strings.Trim(fields[0], `"`), nil
+		}
+	}
+	return "", nil
+}
+
+// CookiePath queries where the Tor instance behind an authenticated control
+// connection writes its ExtORPort cookie.
+func CookiePath(conn *control.Conn) (string, error) {
+	kvs, err := conn.GetConf("ExtORPortCookieAuthFile", "DataDirectory")
+	if err != nil {
+		return "", fmt.Errorf("failed to query ExtORPort cookie file: %v", err)
+	}
+	var path, dataDir string
+	for _, kv := range kvs {
+		switch kv.Key {
+		case "ExtORPortCookieAuthFile":
+			path = kv.Val
+		case "DataDirectory":
+			dataDir = kv.Val
+		}
+	}
+	if path != "" {
+		return path, nil
+	}
+	if dataDir == "" {
+		return "", errors.New("no data directory to find the ExtORPort cookie in")
+	}
+	return filepath.Join(dataDir, CookieFile), nil
+}
+
+// Dial connects to the ExtORPort at addr ("host:port" or "unix:/path") and runs
+// the handshake. The returned connection carries the OR protocol.
+func Dial(ctx context.Context, addr string, cookie []byte, info *Info) (net.Conn, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Abort the handshake if the context is cancelled midway
+	var (
+		stop    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	err = Handshake(conn, cookie, info)
+	close(stop)
+	<-stopped
+
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Handshake authenticates to the ExtORPort over conn and sends the metadata of
+// the connection, if any. Once it returns, conn carries the OR protocol.
+func Handshake(conn io.ReadWriter, cookie []byte, info *Info) error {
+	if err := Authenticate(conn, cookie); err != nil {
+		return err
+	}
+	if info != nil && info.UserAddr != "" {
+		if err := WriteCommand(conn, CmdUserAddr, []byte(info.UserAddr)); err != nil {
+			return err
+		}
+	}
+	if info != nil && info.Transport != "" {
+		if err := WriteCommand(conn, CmdTransport, []byte(info.Transport)); err != nil {
+			return err
+		}
+	}
+	if err := WriteCommand(conn, CmdDone, nil); err != nil {
+		return err
+	}
+	for {
+		cmd, _, err := ReadCommand(conn)
+		if err != nil {
+			return err
+		}
+		switch cmd {
+		case ReplyOkay:
+			return nil
+		case ReplyDeny:
+			return ErrDenied
+		}
+		// Control messages and unknown replies are skipped
+	}
+}
+
+// Authenticate runs the client side of the SAFE_COOKIE authentication.
+func Authenticate(conn io.ReadWriter, cookie []byte) error {
+	// Pick SAFE_COOKIE from the zero terminated list of supported methods
+	var (
+		method    = make([]byte, 1)
+		supported bool
+	)
+	for {
+		if _, err := io.ReadFull(conn, method); err != nil {
+			return err
+		}
+		if method[0] == 0 {
+			break
+		}
+		if method[0] == AuthSafeCookie {
+			supported = true
+		}
+	}
+	if !supported {
+		return errors.New("ExtORPort doesn't support SAFE_COOKIE authentication")
+	}
+	clientNonce := make([]byte, NonceSize)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(append([]byte{AuthSafeCookie}, clientNonce...)); err != nil {
+		return err
+	}
+	// Verify the peer knows the cookie too, then prove we do
+	reply := make([]byte, sha256.Size+NonceSize)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	serverHash, serverNonce := reply[:sha256.Size], reply[sha256.Size:]
+
+	if !hmac.Equal(serverHash, hash(cookie, serverHashText, clientNonce, serverNonce)) {
+		return ErrAuthRejected
+	}
+	if _, err := conn.Write(hash(cookie, clientHashText, clientNonce, serverNonce)); err != nil {
+		return err
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return err
+	}
+	if status[0] != 1 {
+		return ErrAuthRejected
+	}
+	return nil
+}
+
+// Accept runs the Tor side of the handshake over conn, returning the metadata
+// sent by the transport. Once it returns, conn carries the OR protocol.
+func Accept(conn io.ReadWriter, cookie []byte) (*Info, error) {
+	if _, err := conn.Write([]byte{AuthSafeCookie, 0}); err != nil {
+		return nil, err
+	}
+	request := make([]byte, 1+NonceSize)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+	if request[0] != AuthSafeCookie {
+		return nil, fmt.Errorf("unsupported authentication method %d", request[0])
+	}
+	clientNonce, serverNonce := request[1:], make([]byte, NonceSize)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(hash(cookie, serverHashText, clientNonce, serverNonce), serverNonce...)); err != nil {
+		return nil, err
+	}
+	clientHash := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, clientHash); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(clientHash, hash(cookie, clientHashText, clientNonce, serverNonce)) {
+		conn.Write([]byte{0})
+		return nil, ErrAuthRejected
+	}
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return nil, err
+	}
+	info := new(Info)
+	for {
+		cmd, body, err := ReadCommand(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch cmd {
+		case CmdUserAddr:
+			info.UserAddr = string(body)
+		case CmdTransport:
+			info.Transport = string(body)
+		case CmdDone:
+			return info, WriteCommand(conn, ReplyOkay, nil)
+		}
+		// Unknown commands are ignored, as Tor does
+	}
+}
+
+// hash computes the HMAC proving knowledge of the cookie in one direction.
+func hash(cookie []byte, text string, clientNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, cookie)
+	mac.Write([]byte(text))
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	return mac.Sum(nil)
+}
+
+// WriteCommand sends a single command, framed as a 2 byte command code and a 2
+// byte body length, followed by the body.
+func WriteCommand(w io.Writer, cmd uint16, body []byte) error {
+	if len(body) > 65535 {
+		return fmt.Errorf("ExtORPort command body too long (%d bytes)", len(body))
+	}
+	msg := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint16(msg[0:2], cmd)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(body)))
+	copy(msg[4:], body)
+
+	_, err := w.Write(msg)
+	return err
+}
+
+// ReadCommand receives a single command.
+func ReadCommand(r io.Reader) (uint16, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint16(header[0:2]), body, nil
+}
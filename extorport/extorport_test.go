@@ -0,0 +1,187 @@
+package extorport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pair returns the two ends of a loopback TCP connection.
+func pair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	return client, server
+}
+
+// newCookie generates a random authentication cookie.
+func newCookie() []byte {
+	cookie := make([]byte, CookieSize)
+	rand.Read(cookie)
+	return cookie
+}
+
+// Tests that a transport authenticates and passes its metadata to the Tor side,
+// after which the connection carries arbitrary traffic.
+func TestHandshake(t *testing.T) {
+	client, server := pair(t)
+	defer client.Close()
+	defer server.Close()
+
+	cookie := newCookie()
+	accepted := make(chan *Info, 1)
+	go func() {
+		info, err := Accept(server, cookie)
+		if err != nil {
+			t.Errorf("failed to accept handshake: %v", err)
+		}
+		accepted <- info
+		io.Copy(server, server)
+	}()
+	want := &Info{Transport: "webtunnel", UserAddr: "192.0.2.1:54321"}
+	if err := Handshake(client, cookie, want); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if info := <-accepted; info == nil || *info != *want {
+		t.Fatalf("metadata mismatch: have %+v, want %+v", info, want)
+	}
+	msg := []byte("OR traffic")
+	client.Write(msg)
+	echo := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, echo); err != nil || !bytes.Equal(echo, msg) {
+		t.Errorf("echo mismatch: have %q, %v, want %q", echo, err, msg)
+	}
+}
+
+// Tests that neither side gets through without knowing the cookie.
+func TestHandshakeWrongCookie(t *testing.T) {
+	// Tor proves its knowledge first, so transports spot an impostor
+	client, server := pair(t)
+	defer client.Close()
+	defer server.Close()
+
+	go Accept(server, newCookie())
+	if err := Handshake(client, newCookie(), nil); err != ErrAuthRejected {
+		t.Errorf("impostor server error mismatch: have %v, want %v", err, ErrAuthRejected)
+	}
+	client.Close()
+
+	// Tor rejects transports failing to prove theirs
+	client, server = pair(t)
+	defer client.Close()
+	defer server.Close()
+
+	cookie := newCookie()
+	rejected := make(chan error, 1)
+	go func() {
+		_, err := Accept(server, cookie)
+		rejected <- err
+	}()
+	// Answer with a bogus client hash after checking the server one
+	methods := make([]byte, 2)
+	io.ReadFull(client, methods)
+	client.Write(append([]byte{AuthSafeCookie}, make([]byte, NonceSize)...))
+	io.ReadFull(client, make([]byte, 64))
+	client.Write(make([]byte, 32))
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(client, status); err != nil || status[0] != 0 {
+		t.Errorf("authentication status mismatch: have %v, %v, want 0", status, err)
+	}
+	if err := <-rejected; err != ErrAuthRejected {
+		t.Errorf("impostor client error mismatch: have %v, want %v", err, ErrAuthRejected)
+	}
+}
+
+// Tests that control messages are skipped and denials reported.
+func TestHandshakeReplies(t *testing.T) {
+	tests := []struct {
+		replies []uint16
+		err     error
+	}{
+		{[]uint16{ReplyControl, 0x1234, ReplyOkay}, nil},
+		{[]uint16{ReplyDeny}, ErrDenied},
+	}
+	for i, tt := range tests {
+		client, server := pair(t)
+		cookie := newCookie()
+
+		go func(replies []uint16) {
+			defer server.Close()
+
+			// Run the authentication only, replying with the canned answers
+			server.Write([]byte{AuthSafeCookie, 0})
+			request := make([]byte, 1+NonceSize)
+			io.ReadFull(server, request)
+			serverNonce := make([]byte, NonceSize)
+			server.Write(append(hash(cookie, serverHashText, request[1:], serverNonce), serverNonce...))
+			io.ReadFull(server, make([]byte, 32))
+			server.Write([]byte{1})
+
+			for {
+				cmd, _, err := ReadCommand(server)
+				if err != nil || cmd == CmdDone {
+					break
+				}
+			}
+			for _, reply := range replies {
+				WriteCommand(server, reply, []byte("ignored"))
+			}
+			io.Copy(ioutil.Discard, server)
+		}(tt.replies)
+
+		if err := Handshake(client, cookie, &Info{Transport: "obfs4"}); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		client.Close()
+	}
+}
+
+// Tests that cookie files are written and read in the format of Tor.
+func TestCookieFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, CookieFile)
+	cookie := newCookie()
+	if err := WriteCookie(path, cookie); err != nil {
+		t.Fatalf("failed to write cookie: %v", err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if len(data) != 64 || string(data[:32]) != CookieHeader {
+		t.Errorf("cookie file format mismatch: have %q", data)
+	}
+	loaded, err := ReadCookie(path)
+	if err != nil {
+		t.Fatalf("failed to read cookie: %v", err)
+	}
+	if !bytes.Equal(loaded, cookie) {
+		t.Errorf("cookie mismatch: have %x, want %x", loaded, cookie)
+	}
+	// Truncated or foreign files must be refused
+	for _, data := range [][]byte{data[:40], append([]byte("! Control Port Auth Cookie !!!!\x0a"), cookie...)} {
+		ioutil.WriteFile(path, data, 0600)
+		if _, err := ReadCookie(path); err == nil {
+			t.Errorf("malformed cookie file accepted: %q", data)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package extorport_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"berty.tech/go-libtor"
+	"berty.tech/go-libtor/extorport"
+	"berty.tech/go-libtor/relay"
+)
+
+// Tests that transport connections are accepted by the ExtORPort of an embedded
+// Tor bridge, and carry the OR protocol afterwards. The embedded Tor only listens
+// on TCP for it, Unix sockets need a newer Tor.
+func TestEmbeddedTor(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping embedded Tor in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "extorport")
+	if err != nil {
+		t.Fatalf("failed to create data directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tor, err := libtor.Start(ctx, &libtor.StartConf{
+		DataDir: dir,
+		Relay: &relay.Config{
+			Mode:               relay.ModeBridge,
+			Address:            "127.0.0.1",
+			BridgeDistribution: "none",
+		},
+		ExtraArgs: []string{
+			"--ExtORPort", "auto",
+			"--PublishServerDescriptor", "0",
+			"--AssumeReachable", "1",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to start embedded bridge: %v", err)
+	}
+	defer tor.Close()
+
+	addr, err := extorport.Addr(tor.Control)
+	if err != nil {
+		t.Fatalf("failed to query ExtORPort: %v", err)
+	}
+	if host, _, err := net.SplitHostPort(addr); err != nil || !net.ParseIP(host).IsLoopback() {
+		t.Fatalf("ExtORPort address mismatch: have %s, want a loopback TCP address", addr)
+	}
+	path, err := extorport.CookiePath(tor.Control)
+	if err != nil {
+		t.Fatalf("failed to query cookie file: %v", err)
+	}
+	cookie, err := extorport.ReadCookie(path)
+	if err != nil {
+		t.Fatalf("failed to read cookie: %v", err)
+	}
+	// Hand a connection over and speak the OR protocol: TLS, then VERSIONS
+	conn, err := extorport.Dial(ctx, addr, cookie, &extorport.Info{
+		Transport: "webtunnel",
+		UserAddr:  "192.0.2.1:54321",
+	})
+	if err != nil {
+		t.Fatalf("failed to hand over connection: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	link := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := link.Handshake(); err != nil {
+		t.Fatalf("failed to establish OR link: %v", err)
+	}
+	link.Write([]byte{0, 0, 7, 0, 4, 0, 4, 0, 5})
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(link, header); err != nil {
+		t.Fatalf("failed to read VERSIONS cell: %v", err)
+	}
+	if header[2] != 7 {
+		t.Errorf("cell command mismatch: have %d, want %d", header[2], 7)
+	}
+	if size := binary.BigEndian.Uint16(header[3:5]); size == 0 || size%2 != 0 {
+		t.Errorf("invalid VERSIONS cell length %d", size)
+	}
+	// Connections failing to authenticate must be refused
+	wrong := make([]byte, extorport.CookieSize)
+	if _, err := extorport.Dial(ctx, addr, wrong, nil); err != extorport.ErrAuthRejected {
+		t.Errorf("wrong cookie error mismatch: have %v, want %v", err, extorport.ErrAuthRejected)
+	}
+}
@@ -0,0 +1,475 @@
+// Package health monitors the reachability of onion services and repairs them
+// when they stop being reachable, e.g. after the host changed networks.
+//
+// A monitor follows the descriptor uploads of a service and counts its
+// established introduction points. It also periodically probes the service end
+// to end, by connecting to it over a separate circuit. When probes keep
+// failing, it first forces a republish by tearing down the introduction
+// circuits (making Tor pick new introduction points and upload a fresh
+// descriptor), and if that doesn't help, re-creates the service altogether.
+//
+// The introductions answered by the service are counted as well, e.g. to gauge
+// its load.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/internal/circstatus"
+)
+
+// Defaults of the monitor configuration.
+const (
+	DefaultInterval     = 5 * time.Minute
+	DefaultProbeTimeout = 2 * time.Minute
+	DefaultMaxFailures  = 2
+)
+
+// Health is the overall condition of an onion service.
+type Health int
+
+// Health conditions, from best to worst.
+const (
+	HealthUnknown     Health = iota // Not checked yet
+	HealthHealthy                   // Published, with introduction points, and reachable
+	HealthDegraded                  // Reachable, but without introduction points or a published descriptor
+	HealthUnreachable               // Probes failed
+)
+
+// String implements fmt.Stringer.
+func (h Health) String() string {
+	switch h {
+	case HealthUnknown:
+		return "unknown"
+	case HealthHealthy:
+		return "healthy"
+	case HealthDegraded:
+		return "degraded"
+	case HealthUnreachable:
+		return "unreachable"
+	default:
+		return fmt.Sprintf("Health(%d)", int(h))
+	}
+}
+
+// Status is a snapshot of the health of an onion service.
+type Status struct {
+	ID     string // Onion service ID, without the .onion suffix
+	Health Health // Overall condition
+
+	Published      time.Time // When an HSDir last accepted the descriptor
+	UploadFailures int       // Failed descriptor uploads since the last accepted one
+	IntroPoints    int       // Established introduction points
+
+	LastProbe     time.Time // When the last probe finished
+	ProbeError    error     // Failure of the last probe, nil if it succeeded
+	ProbeFailures int       // Consecutive failed probes
+
+	Republishes int // Number of forced republishes
+	Recreations int // Number of service re-creations
+
+	// Introductions counts the introduction requests the service answered by
+	// building a rendezvous circuit, relaunches of failed ones aside, and
+	// RendezvousFailures those circuits that failed.
+	Introductions      int
+	RendezvousFailures int
+}
+
+// Config is the configuration of a monitor.
+type Config struct {
+	// Control is the authenticated controller connection of the Tor instance
+	// hosting the service.
+	Control *control.Conn
+
+	// ServiceID returns the current ID of the service, which may change if it's
+	// rotated or re-created.
+	ServiceID func() string
+
+	// Port is the virtual port probes connect to, 80 if zero. Note, the service
+	// accepts the probe connections like any other, closed without any data.
+	Port int
+
+	// Dial opens probe connections to the service. It should isolate them onto
+	// circuits of their own (e.g. libtor.Identity.DialContext). If nil, the
+	// service isn't probed and no repairs are attempted.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Recreate re-creates the service under the same address. If nil, repairs
+	// stop at republishing.
+	Recreate func(ctx context.Context) error
+
+	Interval     time.Duration // Time between checks, DefaultInterval if zero
+	ProbeTimeout time.Duration // Time limit of a probe, DefaultProbeTimeout if zero
+	MaxFailures  int           // Consecutive failed probes before repairing, DefaultMaxFailures if zero
+
+	// OnChange, if set, is called whenever the health of the service changed.
+	OnChange func(status *Status)
+}
+
+// Monitor watches the health of an onion service.
+type Monitor struct {
+	conf Config
+
+	status      Status
+	republished bool            // Whether a republish was forced since the last successful probe
+	rendCircs   map[string]bool // Rendezvous circuits of the service in use, by circuit ID
+	relaunches  []time.Time     // Failures of rendezvous circuits Tor may relaunch
+	lock        sync.Mutex
+	checkLock   sync.Mutex // Serializes checks
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewMonitor starts monitoring an onion service, checking it every interval.
+func NewMonitor(conf *Config) (*Monitor, error) {
+	if conf == nil || conf.Control == nil {
+		return nil, errors.New("no controller connection configured")
+	}
+	if conf.ServiceID == nil {
+		return nil, errors.New("no service configured")
+	}
+	m := &Monitor{conf: *conf, rendCircs: make(map[string]bool)}
+	if m.conf.Port == 0 {
+		m.conf.Port = 80
+	}
+	if m.conf.Interval == 0 {
+		m.conf.Interval = DefaultInterval
+	}
+	if m.conf.ProbeTimeout == 0 {
+		m.conf.ProbeTimeout = DefaultProbeTimeout
+	}
+	if m.conf.MaxFailures == 0 {
+		m.conf.MaxFailures = DefaultMaxFailures
+	}
+	m.status.ID = m.conf.ServiceID()
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	events := make(chan control.Event, 64)
+	if err := m.conf.Control.AddEventListener(events, eventCodes...); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to events: %v", err)
+	}
+	go m.conf.Control.HandleEvents(m.ctx)
+
+	m.wg.Add(2)
+	go m.watch(events)
+	go m.loop()
+	return m, nil
+}
+
+// Status returns the current health of the service.
+func (m *Monitor) Status() *Status {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	status := m.status
+	return &status
+}
+
+// Close stops monitoring the service.
+func (m *Monitor) Close() error {
+	m.cancel()
+	m.wg.Wait()
+	return nil
+}
+
+// eventCodes are the events a monitor follows.
+var eventCodes = []control.EventCode{control.EventCodeHSDesc, control.EventCodeCircuit}
+
+// watch follows the descriptor uploads and rendezvous circuits of the service
+// until stopped.
+func (m *Monitor) watch(events chan control.Event) {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			// Keep draining the events until unsubscribed, as bine blocks the
+			// whole connection on a full listener
+			removed := make(chan struct{})
+			go func() {
+				m.conf.Control.RemoveEventListener(events, eventCodes...)
+				close(removed)
+			}()
+			for {
+				select {
+				case <-events:
+				case <-removed:
+					return
+				}
+			}
+		case event := <-events:
+			switch event := event.(type) {
+			case *control.HSDescEvent:
+				m.handleUpload(event)
+			case *control.CircuitEvent:
+				m.handleCircuit(event)
+			}
+		}
+	}
+}
+
+// relaunchWindow is how long after a rendezvous circuit failed a new one of the
+// service is taken for its relaunch, well above the circuit build timeout.
+const relaunchWindow = time.Minute
+
+// handleCircuit counts the rendezvous circuits of the service, each of which
+// answers an introduction request.
+//
+// Tor only tags a rendezvous circuit with the service after launching it, so the
+// circuit is counted on its first status naming the service (usually EXTENDED,
+// as cannibalized circuits report no launch at all). Failed circuits are
+// relaunched under new IDs without anything linking them to the failed one,
+// so circuits showing up shortly after a failure are taken for relaunches.
+func (m *Monitor) handleCircuit(event *control.CircuitEvent) {
+	if event.Purpose != "HS_SERVICE_REND" {
+		return
+	}
+	id := m.conf.ServiceID()
+	if event.RendQuery != id {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.follow(id)
+	if !m.rendCircs[event.CircuitID] && event.Status != "CLOSED" {
+		m.rendCircs[event.CircuitID] = true
+		if !m.takeRelaunch() {
+			m.status.Introductions++
+		}
+	}
+	switch event.Status {
+	case "FAILED":
+		m.status.RendezvousFailures++
+		m.relaunches = append(m.relaunches, time.Now())
+		delete(m.rendCircs, event.CircuitID)
+	case "CLOSED":
+		delete(m.rendCircs, event.CircuitID)
+	}
+}
+
+// takeRelaunch consumes the oldest recent rendezvous failure a new circuit may
+// be the relaunch of, reporting whether there was one. The lock must be held.
+func (m *Monitor) takeRelaunch() bool {
+	for len(m.relaunches) > 0 && time.Since(m.relaunches[0]) > relaunchWindow {
+		m.relaunches = m.relaunches[1:]
+	}
+	if len(m.relaunches) == 0 {
+		return false
+	}
+	m.relaunches = m.relaunches[1:]
+	return true
+}
+
+// handleUpload tracks the outcome of a descriptor upload of the service.
+func (m *Monitor) handleUpload(event *control.HSDescEvent) {
+	id := m.conf.ServiceID()
+	if event.Address != id {
+		return
+	}
+	m.lock.Lock()
+	m.follow(id)
+	switch event.Action {
+	case "UPLOADED":
+		m.status.Published = time.Now()
+		m.status.UploadFailures = 0
+	case "FAILED":
+		m.status.UploadFailures++
+	default:
+		m.lock.Unlock()
+		return
+	}
+	changed := m.updateHealth()
+	m.lock.Unlock()
+
+	if changed {
+		m.notify()
+	}
+}
+
+// loop checks the service every interval until stopped.
+func (m *Monitor) loop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.conf.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			m.Check(m.ctx)
+		}
+	}
+}
+
+// Check inspects the service right away, probing it and repairing it if needed,
+// e.g. after the host changed networks. It returns the resulting status.
+func (m *Monitor) Check(ctx context.Context) (*Status, error) {
+	m.checkLock.Lock()
+	defer m.checkLock.Unlock()
+
+	id := m.conf.ServiceID()
+	m.lock.Lock()
+	m.follow(id)
+	m.lock.Unlock()
+
+	intros, err := m.introCircuits(id)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	m.status.IntroPoints = intros.established
+	m.lock.Unlock()
+
+	if m.conf.Dial != nil {
+		perr := m.probe(ctx, id)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		m.lock.Lock()
+		m.status.LastProbe, m.status.ProbeError = time.Now(), perr
+		if perr == nil {
+			m.status.ProbeFailures, m.republished = 0, false
+		} else {
+			m.status.ProbeFailures++
+		}
+		failing := m.status.ProbeFailures >= m.conf.MaxFailures
+		republished := m.republished
+		m.lock.Unlock()
+
+		if failing {
+			if err := m.repair(ctx, intros.all, republished); err != nil {
+				return nil, err
+			}
+		}
+	}
+	m.lock.Lock()
+	changed := m.updateHealth()
+	status := m.status
+	m.lock.Unlock()
+
+	if changed {
+		m.notify()
+	}
+	return &status, nil
+}
+
+// repair escalates a failing service: republish first, re-create if that
+// didn't help.
+func (m *Monitor) repair(ctx context.Context, intros []string, republished bool) error {
+	if !republished || m.conf.Recreate == nil {
+		for _, circuit := range intros {
+			// The circuit may have closed on its own in the meantime
+			if err := m.conf.Control.CloseCircuit(circuit, nil); err != nil && !strings.Contains(err.Error(), "Unknown circuit") {
+				return fmt.Errorf("failed to close introduction circuit %s: %v", circuit, err)
+			}
+		}
+		m.lock.Lock()
+		m.status.Republishes++
+		m.status.ProbeFailures = 0
+		m.republished = true
+		m.lock.Unlock()
+		return nil
+	}
+	if err := m.conf.Recreate(ctx); err != nil {
+		return fmt.Errorf("failed to re-create onion service: %v", err)
+	}
+	m.lock.Lock()
+	m.status.Recreations++
+	m.status.ProbeFailures = 0
+	m.republished = false
+	m.lock.Unlock()
+	return nil
+}
+
+// probe connects to the service over a separate circuit.
+func (m *Monitor) probe(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.conf.ProbeTimeout)
+	defer cancel()
+
+	conn, err := m.conf.Dial(ctx, "tcp", net.JoinHostPort(id+".onion", strconv.Itoa(m.conf.Port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// introSet are the introduction circuits of a service.
+type introSet struct {
+	all         []string // IDs of all introduction circuits
+	established int      // Number of established introduction points
+}
+
+// introCircuits lists the introduction circuits of a service.
+func (m *Monitor) introCircuits(id string) (*introSet, error) {
+	circuits, err := circstatus.Query(m.conf.Control)
+	if err != nil {
+		return nil, err
+	}
+	result := new(introSet)
+	for _, circuit := range circuits {
+		if circuit.Attrs["PURPOSE"] != "HS_SERVICE_INTRO" || circuit.Attrs["REND_QUERY"] != id {
+			continue
+		}
+		result.all = append(result.all, circuit.ID)
+		if circuit.Status == "BUILT" && circuit.Attrs["HS_STATE"] == "HSSI_ESTABLISHED" {
+			result.established++
+		}
+	}
+	return result, nil
+}
+
+// follow switches the monitor over to the current ID of the service, dropping
+// the track record of a previous one. The lock must be held.
+func (m *Monitor) follow(id string) {
+	if id != m.status.ID {
+		m.status = Status{ID: id, Republishes: m.status.Republishes, Recreations: m.status.Recreations}
+		m.republished = false
+		m.rendCircs = make(map[string]bool)
+		m.relaunches = nil
+	}
+}
+
+// updateHealth derives the overall condition from the collected facts,
+// returning whether it changed. The lock must be held.
+func (m *Monitor) updateHealth() bool {
+	health := m.status.Health
+	switch {
+	case m.status.ProbeError != nil:
+		health = HealthUnreachable
+	case m.status.LastProbe.IsZero() && m.conf.Dial != nil:
+		// Without a probe, only descriptor uploads can degrade the service
+		if m.status.UploadFailures > 0 && m.status.Published.IsZero() {
+			health = HealthDegraded
+		}
+	case m.status.IntroPoints == 0 || m.status.Published.IsZero():
+		health = HealthDegraded
+	default:
+		health = HealthHealthy
+	}
+	if health == m.status.Health {
+		return false
+	}
+	m.status.Health = health
+	return true
+}
+
+// notify reports the current status to the change callback.
+func (m *Monitor) notify() {
+	if m.conf.OnChange != nil {
+		m.conf.OnChange(m.Status())
+	}
+}
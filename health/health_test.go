@@ -0,0 +1,290 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// serviceID is the onion service monitored by the tests.
+const serviceID = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"
+
+// introStatus is a circuit listing with two introduction circuits of the
+// service (one still being established) and unrelated ones.
+var introStatus = strings.Join([]string{
+	"1 BUILT $A~a,$B~b,$C~c BUILD_FLAGS=NEED_CAPACITY PURPOSE=GENERAL",
+	"2 BUILT $A~a,$D~d,$E~e BUILD_FLAGS=IS_INTERNAL,NEED_CAPACITY,NEED_UPTIME PURPOSE=HS_SERVICE_INTRO HS_STATE=HSSI_ESTABLISHED REND_QUERY=" + serviceID,
+	"3 EXTENDED $A~a,$F~f BUILD_FLAGS=IS_INTERNAL,NEED_CAPACITY,NEED_UPTIME PURPOSE=HS_SERVICE_INTRO HS_STATE=HSSI_CONNECTING REND_QUERY=" + serviceID,
+	"4 BUILT $A~a,$G~g,$H~h BUILD_FLAGS=IS_INTERNAL PURPOSE=HS_SERVICE_INTRO HS_STATE=HSSI_ESTABLISHED REND_QUERY=otherservice",
+}, "\n")
+
+// Tests that descriptor uploads and introduction points make up the health of
+// a service that isn't probed.
+func TestUploads(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("circuit-status", introStatus)
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	changes := make(chan *Status, 4)
+	m, err := NewMonitor(&Config{
+		Control:   conn,
+		ServiceID: func() string { return serviceID },
+		Interval:  time.Hour,
+		OnChange:  func(status *Status) { changes <- status },
+	})
+	if err != nil {
+		t.Fatalf("failed to start monitor: %v", err)
+	}
+	defer m.Close()
+
+	// Without a published descriptor, the service is degraded
+	status, err := m.Check(context.Background())
+	if err != nil {
+		t.Fatalf("failed to check service: %v", err)
+	}
+	if status.IntroPoints != 1 {
+		t.Errorf("introduction points mismatch: have %d, want %d", status.IntroPoints, 1)
+	}
+	if status.Health != HealthDegraded {
+		t.Errorf("health mismatch: have %v, want %v", status.Health, HealthDegraded)
+	}
+	<-changes
+
+	// Uploads of other services are ignored, failures counted
+	server.Event("HS_DESC UPLOADED otherservice UNKNOWN $AAAA~hsdir")
+	server.Event("HS_DESC FAILED " + serviceID + " UNKNOWN $BBBB~hsdir REASON=UPLOAD_REJECTED")
+	server.Event("HS_DESC UPLOADED " + serviceID + " UNKNOWN $CCCC~hsdir")
+
+	select {
+	case status = <-changes:
+	case <-time.After(time.Second):
+		t.Fatalf("no health change reported")
+	}
+	if status.Health != HealthHealthy {
+		t.Errorf("health mismatch: have %v, want %v", status.Health, HealthHealthy)
+	}
+	if status.Published.IsZero() || status.UploadFailures != 0 {
+		t.Errorf("upload tracking mismatch: have published %v after %d failures", status.Published, status.UploadFailures)
+	}
+}
+
+// Tests that failing probes escalate from republishing to re-creating the
+// service, until it's reachable again.
+func TestRepair(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("circuit-status", introStatus)
+	server.Handle("CLOSECIRCUIT", func(args string) ([]string, error) { return nil, nil })
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	var (
+		reachable  bool
+		dials      []string
+		recreation int
+	)
+	m, err := NewMonitor(&Config{
+		Control:   conn,
+		ServiceID: func() string { return serviceID },
+		Port:      443,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials = append(dials, addr)
+			if !reachable {
+				return nil, errors.New("host unreachable")
+			}
+			local, remote := net.Pipe()
+			remote.Close()
+			return local, nil
+		},
+		Recreate: func(ctx context.Context) error {
+			recreation++
+			return nil
+		},
+		Interval:    time.Hour,
+		MaxFailures: 2,
+	})
+	if err != nil {
+		t.Fatalf("failed to start monitor: %v", err)
+	}
+	defer m.Close()
+
+	check := func() *Status {
+		status, err := m.Check(context.Background())
+		if err != nil {
+			t.Fatalf("failed to check service: %v", err)
+		}
+		return status
+	}
+	// A single failure doesn't trigger any repair yet
+	if status := check(); status.Health != HealthUnreachable || status.ProbeFailures != 1 || status.Republishes != 0 {
+		t.Errorf("status after first failure mismatch: %+v", status)
+	}
+	if want := serviceID + ".onion:443"; dials[0] != want {
+		t.Errorf("probe address mismatch: have %s, want %s", dials[0], want)
+	}
+	// The second one republishes, closing the introduction circuits
+	if status := check(); status.Republishes != 1 || status.Recreations != 0 {
+		t.Errorf("status after second failure mismatch: %+v", status)
+	}
+	var closed []string
+	for _, cmd := range server.History() {
+		if strings.HasPrefix(cmd, "CLOSECIRCUIT") {
+			closed = append(closed, cmd)
+		}
+	}
+	if have, want := strings.Join(closed, ", "), "CLOSECIRCUIT 2, CLOSECIRCUIT 3"; have != want {
+		t.Errorf("closed circuits mismatch: have %s, want %s", have, want)
+	}
+	// Failing on after republishing re-creates the service
+	check()
+	if status := check(); status.Republishes != 1 || status.Recreations != 1 || recreation != 1 {
+		t.Errorf("status after re-creation mismatch: %+v", status)
+	}
+	// Once reachable, the service is healthy and the escalation starts over
+	server.Event("HS_DESC UPLOADED " + serviceID + " UNKNOWN $CCCC~hsdir")
+	reachable = true
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		status := check()
+		if status.Health == HealthHealthy {
+			if status.ProbeFailures != 0 || status.ProbeError != nil {
+				t.Errorf("probe failures left after recovery: %+v", status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("service not healthy after recovery: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that the introductions answered by the service are counted.
+func TestIntroductions(t *testing.T) {
+	server := controltest.NewServer()
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	m, err := NewMonitor(&Config{
+		Control:   conn,
+		ServiceID: func() string { return serviceID },
+		Interval:  time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to start monitor: %v", err)
+	}
+	defer m.Close()
+
+	// A launched rendezvous circuit, tagged with the service once extending, a
+	// cannibalized one, one failing and relaunched, unrelated circuits, and a
+	// later one failing too
+	const (
+		flags  = " BUILD_FLAGS=IS_INTERNAL,NEED_CAPACITY,NEED_UPTIME PURPOSE=HS_SERVICE_REND"
+		tagged = flags + " HS_STATE=HSSR_CONNECTING REND_QUERY=" + serviceID
+	)
+	server.Event("CIRC 5 LAUNCHED" + flags + " HS_STATE=HSSR_CONNECTING")
+	server.Event("CIRC 5 EXTENDED $A~a" + tagged)
+	server.Event("CIRC 5 EXTENDED $A~a,$B~b" + tagged)
+	server.Event("CIRC 5 BUILT $A~a,$B~b,$C~c,$D~d" + flags + " HS_STATE=HSSR_JOINED REND_QUERY=" + serviceID)
+	server.Event("CIRC 6 EXTENDED $A~a,$B~b,$C~c,$E~e" + tagged)
+	server.Event("CIRC 6 BUILT $A~a,$B~b,$C~c,$E~e" + flags + " HS_STATE=HSSR_JOINED REND_QUERY=" + serviceID)
+	server.Event("CIRC 5 CLOSED $A~a,$B~b,$C~c,$D~d" + flags + " HS_STATE=HSSR_JOINED REND_QUERY=" + serviceID + " REASON=FINISHED")
+	server.Event("CIRC 7 LAUNCHED" + flags + " HS_STATE=HSSR_CONNECTING")
+	server.Event("CIRC 7 EXTENDED $A~a" + tagged)
+	server.Event("CIRC 8 LAUNCHED" + flags + " HS_STATE=HSSR_CONNECTING")
+	server.Event("CIRC 7 FAILED $A~a" + tagged + " REASON=TIMEOUT")
+	server.Event("CIRC 8 EXTENDED $B~b" + tagged)
+	server.Event("CIRC 8 BUILT $B~b,$C~c,$D~d,$F~f" + flags + " HS_STATE=HSSR_JOINED REND_QUERY=" + serviceID)
+	server.Event("CIRC 9 EXTENDED $A~a" + flags + " HS_STATE=HSSR_CONNECTING REND_QUERY=otherservice")
+	server.Event("CIRC 10 LAUNCHED BUILD_FLAGS=NEED_CAPACITY PURPOSE=GENERAL")
+	server.Event("CIRC 11 EXTENDED $C~c" + tagged)
+	server.Event("CIRC 11 FAILED $C~c" + tagged + " REASON=DESTROYED")
+
+	// The last failure marks the end of the events
+	deadline := time.Now().Add(time.Second)
+	for {
+		status := m.Status()
+		if status.RendezvousFailures == 2 {
+			if status.Introductions != 4 {
+				t.Errorf("introduction count mismatch: have %d, want %d", status.Introductions, 4)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rendezvous failure count mismatch: have %d, want %d", status.RendezvousFailures, 2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that closing a monitor flooded with events neither hangs nor wedges the
+// shared control connection.
+func TestCloseFlooded(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("version", "0.3.5.8")
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	// Consume the rendezvous events slowly, so they back up
+	m, err := NewMonitor(&Config{
+		Control: conn,
+		ServiceID: func() string {
+			time.Sleep(time.Millisecond)
+			return serviceID
+		},
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to start monitor: %v", err)
+	}
+	// Keep pushing events while closing, more than the subscription buffers.
+	// The flood ends when the deferred close tears the connection down.
+	flooding := make(chan struct{})
+	go func() {
+		for i := 0; i < 5000; i++ {
+			server.Event(fmt.Sprintf("CIRC %d EXTENDED $A~a PURPOSE=HS_SERVICE_REND REND_QUERY=%s", i, serviceID))
+			if i == 100 {
+				close(flooding)
+			}
+		}
+	}()
+	<-flooding
+
+	done := make(chan error, 1)
+	go func() {
+		m.Close()
+		_, err := conn.GetInfo("version")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to query connection after close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("monitor close wedged the connection")
+	}
+}
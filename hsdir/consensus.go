@@ -0,0 +1,254 @@
+package hsdir
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consensusTime is the layout of the timestamps of a consensus.
+const consensusTime = "2006-01-02 15:04:05"
+
+// Consensus is the part of a microdescriptor consensus the hash ring of the
+// HSDirs is built from.
+type Consensus struct {
+	ValidAfter time.Time // Start of the validity, the time Tor computes with
+	FreshUntil time.Time // Next consensus, a voting interval after ValidAfter
+	ValidUntil time.Time // End of the validity
+
+	Params map[string]int // Network parameters
+
+	SRVCurrent  []byte // Shared random value of the current run, nil if none
+	SRVPrevious []byte // Shared random value of the previous run, nil if none
+
+	Relays []*Relay // Listed relays, in consensus order
+
+	// TestingTorNetwork is set when the consensus comes from a test network,
+	// whose time periods last a shared random protocol run like those of Tor
+	// running with the option of the same name.
+	TestingTorNetwork bool
+}
+
+// Relay is a relay listed in a consensus.
+type Relay struct {
+	Nickname    string
+	Fingerprint string   // Hex encoded RSA identity digest, in upper case
+	Ed25519ID   [32]byte // Ed25519 identity of its microdescriptor, zero if unknown
+	Flags       []string // Flags assigned by the authorities
+	Microdesc   string   // Base64 digest of its microdescriptor
+
+	hsdirV3 bool // Whether it announces the v3 HSDir protocol
+}
+
+// HSDir reports whether the relay is on the hash ring of v3 onion services: it
+// needs the HSDir flag, support for the v3 protocol and a known ed25519 key.
+func (r *Relay) HSDir() bool {
+	if !r.hsdirV3 || r.Ed25519ID == [32]byte{} {
+		return false
+	}
+	for _, flag := range r.Flags {
+		if flag == "HSDir" {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads the microdescriptor consensus and the microdescriptors cached in
+// the data directory of a Tor instance.
+func Load(dataDir string) (*Consensus, error) {
+	consensus, err := ioutil.ReadFile(filepath.Join(dataDir, "cached-microdesc-consensus"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consensus: %v", err)
+	}
+	// Tor appends new microdescriptors to a journal until it rebuilds the cache
+	var microdescs []byte
+	for _, name := range []string{"cached-microdescs", "cached-microdescs.new"} {
+		data, err := ioutil.ReadFile(filepath.Join(dataDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read microdescriptors: %v", err)
+		}
+		microdescs = append(microdescs, data...)
+	}
+	return ParseConsensus(string(consensus), string(microdescs))
+}
+
+// ParseConsensus parses a microdescriptor consensus, taking the ed25519
+// identities of the relays from a concatenation of their microdescriptors as
+// stored in the cached-microdescs file. Signatures are not verified.
+func ParseConsensus(consensus string, microdescs string) (*Consensus, error) {
+	ids := parseMicrodescs(microdescs)
+
+	c := &Consensus{Params: make(map[string]int)}
+	var relay *Relay
+
+	scanner := bufio.NewScanner(strings.NewReader(consensus))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var (
+			keyword, args = fields[0], fields[1:]
+			err           error
+		)
+		switch keyword {
+		case "network-status-version":
+			if len(args) < 2 || args[0] != "3" || args[1] != "microdesc" {
+				return nil, fmt.Errorf("not a microdescriptor consensus: %q", scanner.Text())
+			}
+		case "valid-after":
+			c.ValidAfter, err = parseTime(args)
+		case "fresh-until":
+			c.FreshUntil, err = parseTime(args)
+		case "valid-until":
+			c.ValidUntil, err = parseTime(args)
+		case "params":
+			for _, param := range args {
+				kv := strings.SplitN(param, "=", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("invalid consensus parameter %q", param)
+				}
+				if c.Params[kv[0]], err = strconv.Atoi(kv[1]); err != nil {
+					return nil, fmt.Errorf("invalid consensus parameter %q", param)
+				}
+			}
+		case "shared-rand-current-value":
+			c.SRVCurrent, err = parseSRV(args)
+		case "shared-rand-previous-value":
+			c.SRVPrevious, err = parseSRV(args)
+		case "r":
+			if len(args) < 7 {
+				return nil, fmt.Errorf("invalid router status %q", scanner.Text())
+			}
+			identity, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(args[1], "="))
+			if err != nil || len(identity) != 20 {
+				return nil, fmt.Errorf("invalid relay identity %q", args[1])
+			}
+			relay = &Relay{Nickname: args[0], Fingerprint: strings.ToUpper(hex.EncodeToString(identity))}
+			c.Relays = append(c.Relays, relay)
+		case "m":
+			if relay != nil && len(args) > 0 {
+				relay.Microdesc = strings.TrimRight(args[0], "=")
+				relay.Ed25519ID = ids[relay.Microdesc]
+			}
+		case "s":
+			if relay != nil {
+				relay.Flags = args
+			}
+		case "pr":
+			if relay != nil {
+				relay.hsdirV3 = supportsProtocol(args, "HSDir", 2)
+			}
+		case "directory-footer":
+			relay = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", keyword, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if c.ValidAfter.IsZero() || !c.FreshUntil.After(c.ValidAfter) {
+		return nil, errors.New("missing consensus validity")
+	}
+	return c, nil
+}
+
+// parseTime parses a date and time pair of a consensus.
+func parseTime(args []string) (time.Time, error) {
+	if len(args) != 2 {
+		return time.Time{}, fmt.Errorf("invalid time %q", args)
+	}
+	return time.Parse(consensusTime, args[0]+" "+args[1])
+}
+
+// parseSRV parses the reveal count and base64 value of a shared random value.
+func parseSRV(args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("invalid shared random value %q", args)
+	}
+	srv, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil || len(srv) != 32 {
+		return nil, fmt.Errorf("invalid shared random value %q", args[1])
+	}
+	return srv, nil
+}
+
+// supportsProtocol reports whether the protocol versions of a pr line, e.g.
+// "HSDir=1-2", include a version of a protocol.
+func supportsProtocol(entries []string, name string, version int) bool {
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] != name {
+			continue
+		}
+		for _, span := range strings.Split(kv[1], ",") {
+			bounds := strings.SplitN(span, "-", 2)
+			low, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				continue
+			}
+			high := low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					continue
+				}
+			}
+			if low <= version && version <= high {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseMicrodescs maps the base64 digests of microdescriptors to the ed25519
+// identities they hold. A microdescriptor runs from its onion-key line up to
+// the next one, leaving out the annotations preceding it.
+func parseMicrodescs(microdescs string) map[string][32]byte {
+	ids := make(map[string][32]byte)
+
+	var (
+		body []string
+		id   [32]byte
+	)
+	flush := func() {
+		if len(body) > 0 {
+			digest := sha256.Sum256([]byte(strings.Join(body, "")))
+			ids[base64.RawStdEncoding.EncodeToString(digest[:])] = id
+		}
+		body, id = nil, [32]byte{}
+	}
+	for _, line := range strings.SplitAfter(microdescs, "\n") {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "@"):
+			flush()
+		case strings.HasPrefix(line, "onion-key"):
+			flush()
+			body = append(body, line)
+		case body != nil:
+			body = append(body, line)
+			if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "id" && fields[1] == "ed25519" {
+				key, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(fields[2], "="))
+				if err == nil && len(key) == 32 {
+					copy(id[:], key)
+				}
+			}
+		}
+	}
+	flush()
+	return ids
+}
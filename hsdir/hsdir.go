@@ -0,0 +1,251 @@
+// Package hsdir computes which HSDirs are responsible for the descriptors of a
+// v3 onion service at a given time, to debug descriptors that can't be found.
+//
+// The hash ring of rend-spec-v3 is rebuilt from a consensus, e.g. the one cached
+// by any Tor instance (see Load), with the key blinding and hashing code of the
+// embedded Tor. Everything is computed from the consensus alone, without needing
+// a running Tor.
+package hsdir
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"berty.tech/go-libtor/libtor"
+)
+
+// Defaults of the consensus parameters shaping the hash ring, matching those of
+// Tor.
+const (
+	DefaultReplicas     = 2    // hsdir_n_replicas
+	DefaultSpreadStore  = 4    // hsdir_spread_store
+	DefaultSpreadFetch  = 3    // hsdir_spread_fetch
+	DefaultPeriodLength = 1440 // hsdir-interval, in minutes
+)
+
+// Bounds Tor clamps the hsdir-interval consensus parameter to, in minutes.
+const (
+	minPeriodLength = 30
+	maxPeriodLength = 14400
+)
+
+// srvRounds is the number of voting rounds of a phase of the shared random
+// protocol, a protocol run consisting of a commit and a reveal phase.
+const srvRounds = 12
+
+// Result is the placement of the descriptor of an onion service.
+type Result struct {
+	TimePeriod uint64   // Time period the descriptor is made for
+	BlindedKey [32]byte // Blinded key the descriptor is published under
+	SRV        [32]byte // Shared random value the ring was built with
+
+	// HSDirs are the relays the service uploads the descriptor to, in the
+	// order of the replicas.
+	HSDirs []*Relay
+
+	// FetchHSDirs are the relays clients pick from to fetch the descriptor.
+	FetchHSDirs []*Relay
+}
+
+// Fingerprints returns the fingerprints of the responsible HSDirs.
+func (r *Result) Fingerprints() []string {
+	fingerprints := make([]string, len(r.HSDirs))
+	for i, relay := range r.HSDirs {
+		fingerprints[i] = relay.Fingerprint
+	}
+	return fingerprints
+}
+
+// Lookup computes where the descriptor of an onion service (with or without the
+// .onion suffix) for the time period at a moment is stored. The consensus only
+// knows the shared random values of the time periods around its validity, so
+// the moment must be close to it.
+func (c *Consensus) Lookup(onionID string, at time.Time) (*Result, error) {
+	pub, err := libtor.HSPublicKey(strings.TrimSuffix(onionID, ".onion"))
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{TimePeriod: c.TimePeriod(at)}
+	if res.SRV, err = c.srv(res.TimePeriod); err != nil {
+		return nil, err
+	}
+	length := c.PeriodLength()
+	if res.BlindedKey, err = libtor.HSBlindedKey(pub, res.TimePeriod, length); err != nil {
+		return nil, err
+	}
+	ring, err := c.ring(res.SRV, res.TimePeriod)
+	if err != nil {
+		return nil, err
+	}
+	replicas := c.param("hsdir_n_replicas", DefaultReplicas)
+	if res.HSDirs, err = ring.responsible(res.BlindedKey, res.TimePeriod, length, replicas, c.param("hsdir_spread_store", DefaultSpreadStore)); err != nil {
+		return nil, err
+	}
+	if res.FetchHSDirs, err = ring.responsible(res.BlindedKey, res.TimePeriod, length, replicas, c.param("hsdir_spread_fetch", DefaultSpreadFetch)); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// param returns a consensus parameter, or its default if not set.
+func (c *Consensus) param(name string, def int) int {
+	if value, ok := c.Params[name]; ok {
+		return value
+	}
+	return def
+}
+
+// VotingInterval returns the time between two consensuses.
+func (c *Consensus) VotingInterval() time.Duration {
+	return c.FreshUntil.Sub(c.ValidAfter)
+}
+
+// PeriodLength returns the length of the onion service time periods, derived
+// like get_time_period_length does: a shared random protocol run on test
+// networks, the hsdir-interval parameter otherwise. It is a whole number of
+// minutes, the unit Tor hashes it in.
+func (c *Consensus) PeriodLength() time.Duration {
+	if c.TestingTorNetwork {
+		return (2 * c.rotationOffset()).Truncate(time.Minute)
+	}
+	minutes := c.param("hsdir-interval", DefaultPeriodLength)
+	if minutes < minPeriodLength {
+		minutes = minPeriodLength
+	} else if minutes > maxPeriodLength {
+		minutes = maxPeriodLength
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// rotationOffset returns how long after the start of a shared random protocol
+// run the time periods begin, the length of a protocol phase.
+func (c *Consensus) rotationOffset() time.Duration {
+	return srvRounds * c.VotingInterval()
+}
+
+// TimePeriod returns the number of the time period a moment falls in.
+func (c *Consensus) TimePeriod(at time.Time) uint64 {
+	return libtor.HSTimePeriod(at, c.PeriodLength(), c.rotationOffset())
+}
+
+// TimePeriodStart returns the start of a time period.
+func (c *Consensus) TimePeriodStart(period uint64) time.Time {
+	return time.Unix(int64(period)*int64(c.PeriodLength()/time.Second), 0).Add(c.rotationOffset().Truncate(time.Minute)).UTC()
+}
+
+// srv returns the shared random value the ring of a time period is built with.
+// Tor uses the current value for the time period that started after it was
+// agreed on and the previous one for the time period before, falling back to a
+// value derived from the time period if the consensus lacks it.
+func (c *Consensus) srv(period uint64) ([32]byte, error) {
+	var srv [32]byte
+
+	// Protocol runs last two phases and start at multiples of their length
+	run := int64(2 * c.rotationOffset() / time.Second)
+	runStart := time.Unix(c.ValidAfter.Unix()/run*run, 0)
+	current := c.TimePeriod(c.ValidAfter)
+
+	// Between the start of a time period and the next shared random value,
+	// the current value belongs to the current time period
+	newest := current
+	if !c.ValidAfter.Before(runStart) && c.ValidAfter.Before(c.TimePeriodStart(c.TimePeriod(runStart)+1)) {
+		newest = current + 1
+	}
+	var value []byte
+	switch period {
+	case newest:
+		value = c.SRVCurrent
+	case newest - 1:
+		value = c.SRVPrevious
+	default:
+		return srv, fmt.Errorf("time period %d not covered by the consensus of %v", period, c.ValidAfter)
+	}
+	if value == nil {
+		return libtor.HSDisasterSRV(period, c.PeriodLength())
+	}
+	copy(srv[:], value)
+	return srv, nil
+}
+
+// ringEntry is an HSDir at its position on the hash ring.
+type ringEntry struct {
+	index [32]byte
+	relay *Relay
+}
+
+// hashRing is the list of HSDirs of a time period, sorted by their index.
+type hashRing []ringEntry
+
+// ring builds the hash ring of a time period.
+func (c *Consensus) ring(srv [32]byte, period uint64) (hashRing, error) {
+	var ring hashRing
+	for _, relay := range c.Relays {
+		if !relay.HSDir() {
+			continue
+		}
+		index, err := libtor.HSDirIndex(relay.Ed25519ID, srv, period, c.PeriodLength())
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, ringEntry{index: index, relay: relay})
+	}
+	if len(ring) == 0 {
+		return nil, errors.New("no v3 HSDirs in the consensus")
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return bytes.Compare(ring[i].index[:], ring[j].index[:]) < 0
+	})
+	return ring, nil
+}
+
+// responsible walks the ring the way hs_get_responsible_hsdirs does: for each
+// replica, the spread HSDirs following its index are taken, skipping the ones
+// already taken by earlier replicas.
+func (ring hashRing) responsible(blinded [32]byte, period uint64, length time.Duration, replicas, spread int) ([]*Relay, error) {
+	var (
+		relays []*Relay
+		taken  = make(map[*Relay]bool)
+	)
+	for replica := 1; replica <= replicas; replica++ {
+		target, err := libtor.HSIndex(uint64(replica), blinded, period, length)
+		if err != nil {
+			return nil, err
+		}
+		relays = append(relays, ring.walk(target, spread, taken)...)
+	}
+	return relays, nil
+}
+
+// walk takes up to spread HSDirs at or after an index not taken yet, marking
+// them as taken.
+func (ring hashRing) walk(target [32]byte, spread int, taken map[*Relay]bool) []*Relay {
+	var relays []*Relay
+
+	start := ring.search(target)
+	for idx := start; len(relays) < spread; {
+		if relay := ring[idx].relay; !taken[relay] {
+			relays = append(relays, relay)
+			taken[relay] = true
+		}
+		if idx = (idx + 1) % len(ring); idx == start {
+			break
+		}
+	}
+	return relays
+}
+
+// search returns the position of the first HSDir at or after an index,
+// wrapping around the end of the ring.
+func (ring hashRing) search(target [32]byte) int {
+	idx := sort.Search(len(ring), func(i int) bool {
+		return bytes.Compare(ring[i].index[:], target[:]) >= 0
+	})
+	if idx == len(ring) {
+		idx = 0
+	}
+	return idx
+}
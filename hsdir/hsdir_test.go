@@ -0,0 +1,207 @@
+package hsdir
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// microdesc builds a microdescriptor holding an ed25519 identity filled with a
+// byte, returning it along with its digest as listed in a consensus.
+func microdesc(fill byte) (string, string) {
+	id := base64.RawStdEncoding.EncodeToString([]byte(strings.Repeat(string(fill), 32)))
+	desc := "onion-key\n-----BEGIN RSA PUBLIC KEY-----\nMIGJAoGBAL\n-----END RSA PUBLIC KEY-----\nntor-onion-key AAAA\nid ed25519 " + id + "\n"
+	digest := sha256.Sum256([]byte(desc))
+	return desc, base64.RawStdEncoding.EncodeToString(digest[:])
+}
+
+// Tests that microdescriptor consensuses are parsed, with the ed25519 keys of
+// the relays taken from their microdescriptors.
+func TestParseConsensus(t *testing.T) {
+	desc1, digest1 := microdesc(1)
+	desc2, digest2 := microdesc(2)
+	desc3, digest3 := microdesc(3)
+
+	consensus := `network-status-version 3 microdesc
+vote-status consensus
+valid-after 2016-04-13 11:00:00
+fresh-until 2016-04-13 12:00:00
+valid-until 2016-04-13 14:00:00
+params hsdir_spread_store=5 hsdir-interval=720
+shared-rand-previous-value 9 ` + base64.StdEncoding.EncodeToString(make([]byte, 32)) + `
+r relay1 AAAAAAAAAAAAAAAAAAAAAAAAAAA 2016-04-13 10:00:00 127.0.0.1 5000 7000
+m ` + digest1 + `
+s Fast HSDir Running Stable V2Dir Valid
+pr Cons=1-2 HSDir=1-2 Link=1-5
+r relay2 AQEBAQEBAQEBAQEBAQEBAQEBAQE 2016-04-13 10:00:00 127.0.0.1 5001 7001
+m ` + digest2 + `
+s Fast Running Valid
+pr HSDir=1-2
+r relay3 AgICAgICAgICAgICAgICAgICAgI 2016-04-13 10:00:00 127.0.0.1 5002 7002
+m ` + digest3 + `
+s HSDir Running Valid
+pr HSDir=1
+directory-footer
+bandwidth-weights Wbd=0
+`
+	microdescs := "@last-listed 2016-04-13 11:00:00\n" + desc1 + desc2 + "@last-listed 2016-04-13 11:00:00\n" + desc3
+
+	c, err := ParseConsensus(consensus, microdescs)
+	if err != nil {
+		t.Fatalf("failed to parse consensus: %v", err)
+	}
+	if want := time.Date(2016, 4, 13, 11, 0, 0, 0, time.UTC); !c.ValidAfter.Equal(want) {
+		t.Errorf("valid after mismatch: have %v, want %v", c.ValidAfter, want)
+	}
+	if have := c.VotingInterval(); have != time.Hour {
+		t.Errorf("voting interval mismatch: have %v, want %v", have, time.Hour)
+	}
+	if have := c.PeriodLength(); have != 12*time.Hour {
+		t.Errorf("period length mismatch: have %v, want %v", have, 12*time.Hour)
+	}
+	if c.SRVCurrent != nil || len(c.SRVPrevious) != 32 {
+		t.Errorf("shared random values mismatch: have %x and %x", c.SRVCurrent, c.SRVPrevious)
+	}
+	if len(c.Relays) != 3 {
+		t.Fatalf("relay count mismatch: have %d, want 3", len(c.Relays))
+	}
+	for i, want := range []struct {
+		fingerprint string
+		hsdir       bool
+	}{
+		{"0000000000000000000000000000000000000000", true},
+		{"0101010101010101010101010101010101010101", false}, // No HSDir flag
+		{"0202020202020202020202020202020202020202", false}, // No v3 support
+	} {
+		relay := c.Relays[i]
+		if relay.Fingerprint != want.fingerprint {
+			t.Errorf("relay %d: fingerprint mismatch: have %s, want %s", i, relay.Fingerprint, want.fingerprint)
+		}
+		if relay.Ed25519ID[0] != byte(i+1) {
+			t.Errorf("relay %d: ed25519 identity mismatch: have %x", i, relay.Ed25519ID)
+		}
+		if relay.HSDir() != want.hsdir {
+			t.Errorf("relay %d: HSDir mismatch: have %v, want %v", i, relay.HSDir(), want.hsdir)
+		}
+	}
+	if _, err := ParseConsensus("network-status-version 3\n", ""); err == nil {
+		t.Errorf("parsed a consensus of the wrong flavor")
+	}
+}
+
+// Tests that time periods and their shared random values follow the schedule
+// of Tor: periods start 12 voting rounds after midnight, and the newest shared
+// random value belongs to the current period only once that started.
+func TestTimePeriods(t *testing.T) {
+	current, previous := make([]byte, 32), make([]byte, 32)
+	current[0], previous[0] = 1, 2
+
+	at := func(hour int) time.Time { return time.Date(2016, 4, 13, hour, 0, 0, 0, time.UTC) }
+	consensus := func(validAfter time.Time) *Consensus {
+		return &Consensus{
+			ValidAfter:  validAfter,
+			FreshUntil:  validAfter.Add(time.Hour),
+			SRVCurrent:  current,
+			SRVPrevious: previous,
+		}
+	}
+	c := consensus(at(11))
+	if period := c.TimePeriod(at(11)); period != 16903 {
+		t.Errorf("time period mismatch: have %d, want 16903", period)
+	}
+	if period := c.TimePeriod(at(12)); period != 16904 {
+		t.Errorf("time period mismatch: have %d, want 16904", period)
+	}
+	if start := c.TimePeriodStart(16904); !start.Equal(at(12)) {
+		t.Errorf("time period start mismatch: have %v, want %v", start, at(12))
+	}
+	tests := []struct {
+		validAfter time.Time
+		period     uint64
+		srv        []byte
+	}{
+		// Before noon, the current value is for the next period
+		{at(11), 16903, previous},
+		{at(11), 16904, current},
+		// After noon, it is for the current one
+		{at(13), 16904, current},
+		{at(13), 16903, previous},
+	}
+	for i, tt := range tests {
+		srv, err := consensus(tt.validAfter).srv(tt.period)
+		if err != nil {
+			t.Errorf("test %d: failed to select shared random value: %v", i, err)
+			continue
+		}
+		if srv[0] != tt.srv[0] {
+			t.Errorf("test %d: shared random value mismatch: have %x, want %x", i, srv[0], tt.srv[0])
+		}
+	}
+	if _, err := consensus(at(13)).srv(16905); err == nil {
+		t.Errorf("selected shared random value of an uncovered period")
+	}
+}
+
+// Tests that period lengths are derived like Tor does: a protocol run on test
+// networks, the clamped hsdir-interval parameter otherwise.
+func TestPeriodLength(t *testing.T) {
+	validAfter := time.Date(2016, 4, 13, 11, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		interval time.Duration
+		params   map[string]int
+		testing  bool
+		length   time.Duration
+	}{
+		{time.Hour, nil, false, 24 * time.Hour},
+		{time.Hour, map[string]int{"hsdir-interval": 10}, false, 30 * time.Minute},
+		{time.Hour, map[string]int{"hsdir-interval": 20000}, false, 14400 * time.Minute},
+		{time.Hour, map[string]int{"hsdir-interval": 60}, true, 24 * time.Hour},
+		{10 * time.Second, nil, true, 4 * time.Minute},
+		{20 * time.Second, nil, true, 8 * time.Minute},
+	}
+	for i, tt := range tests {
+		c := &Consensus{
+			ValidAfter:        validAfter,
+			FreshUntil:        validAfter.Add(tt.interval),
+			Params:            tt.params,
+			TestingTorNetwork: tt.testing,
+		}
+		if have := c.PeriodLength(); have != tt.length {
+			t.Errorf("test %d: period length mismatch: have %v, want %v", i, have, tt.length)
+		}
+	}
+}
+
+// Tests that the ring is walked from the index of a replica onwards, wrapping
+// around and skipping the HSDirs taken by earlier replicas.
+func TestWalk(t *testing.T) {
+	relays := make([]*Relay, 5)
+	ring := make(hashRing, len(relays))
+	for i := range relays {
+		relays[i] = &Relay{Nickname: string('a' + byte(i))}
+		ring[i].index[0] = byte(10 * (i + 1))
+		ring[i].relay = relays[i]
+	}
+	index := func(b byte) (target [32]byte) {
+		target[0] = b
+		return target
+	}
+	taken := make(map[*Relay]bool)
+
+	if have, want := ring.walk(index(25), 2, taken), relays[2:4]; !reflect.DeepEqual(have, want) {
+		t.Errorf("first replica mismatch: have %v, want %v", have, want)
+	}
+	if have, want := ring.walk(index(35), 3, taken), []*Relay{relays[4], relays[0], relays[1]}; !reflect.DeepEqual(have, want) {
+		t.Errorf("second replica mismatch: have %v, want %v", have, want)
+	}
+	if have := ring.walk(index(0), 3, taken); len(have) != 0 {
+		t.Errorf("exhausted ring mismatch: have %v, want none", have)
+	}
+	if have, want := ring.walk(index(50), 1, make(map[*Relay]bool)), relays[4:]; !reflect.DeepEqual(have, want) {
+		t.Errorf("exact index mismatch: have %v, want %v", have, want)
+	}
+}
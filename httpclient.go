@@ -0,0 +1,251 @@
+package libtor
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/internal/socks"
+)
+
+// OnionPolicy decides how HTTP requests to .onion hosts are handled.
+type OnionPolicy int
+
+const (
+	// OnionTLSOptional permits both plain HTTP and HTTPS to onion services, as
+	// onion services are authenticated and encrypted end to end by Tor already.
+	OnionTLSOptional OnionPolicy = iota
+
+	// OnionTLSRequired permits only HTTPS to onion services.
+	OnionTLSRequired
+
+	// OnionRefused rejects all requests to onion services.
+	OnionRefused
+)
+
+// String implements fmt.Stringer.
+func (p OnionPolicy) String() string {
+	switch p {
+	case OnionTLSOptional:
+		return "tls-optional"
+	case OnionTLSRequired:
+		return "tls-required"
+	case OnionRefused:
+		return "refused"
+	default:
+		return "unknown"
+	}
+}
+
+// HTTPClientConf is the configuration for an HTTP client or transport created
+// via NewHTTPClient or NewHTTPTransport.
+type HTTPClientConf struct {
+	// Control is the authenticated controller connection of the Tor instance to
+	// send the requests through (e.g. Tor.Control).
+	Control *control.Conn
+
+	// Identity is the isolation identity of requests whose context carries none
+	// (see WithIdentity). Requests of different identities never share a
+	// connection nor a circuit.
+	Identity string
+
+	// OnionPolicy decides whether plain HTTP is permitted to onion services.
+	OnionPolicy OnionPolicy
+
+	// AllowPlainHTTP permits plain HTTP to hosts other than onion services. As
+	// exit relays can read and tamper with it, it's refused by default.
+	AllowPlainHTTP bool
+
+	// TLSConfig is the TLS configuration of HTTPS connections. If nil, the
+	// default configuration is used.
+	TLSConfig *tls.Config
+
+	// Timeout is the overall time limit of requests made by the client, zero
+	// meaning no limit. It's ignored by NewHTTPTransport.
+	Timeout time.Duration
+}
+
+// defaultIdentity is the SOCKS username of requests without an identity, as Tor
+// requires a non-empty one.
+const defaultIdentity = "default"
+
+// identityKey is the context key of the isolation identity of a request.
+type identityKey struct{}
+
+// WithIdentity returns a context making the HTTP requests it's attached to use
+// the given isolation identity, overriding the one of the client (unless bound
+// to an Identity).
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// HTTPTransport is an http.RoundTripper sending requests through Tor. Hostnames
+// are always resolved by the exit relay, never locally, and every isolation
+// identity gets its own connection pool and circuits.
+type HTTPTransport struct {
+	conf  HTTPClientConf
+	socks string // Address of the SOCKS listener of Tor
+
+	pools      map[string]*http.Transport // Connection pools by identity
+	generation int                        // Bumped by NewIdentity to isolate from older streams
+	owner      *Identity                  // Identity the transport is bound to, if any
+	lock       sync.Mutex
+}
+
+// NewHTTPTransport creates an HTTP transport sending its requests through the
+// SOCKS listener of a Tor instance.
+func NewHTTPTransport(conf *HTTPClientConf) (*HTTPTransport, error) {
+	if conf == nil || conf.Control == nil {
+		return nil, errors.New("no controller connection configured")
+	}
+	socks, err := socksAddr(conf.Control)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SOCKS listener: %v", err)
+	}
+	return &HTTPTransport{
+		conf:  *conf,
+		socks: socks,
+		pools: make(map[string]*http.Transport),
+	}, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *HTTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.check(req); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	identity := t.conf.Identity
+	if id, ok := req.Context().Value(identityKey{}).(string); ok && t.owner == nil {
+		identity = id
+	}
+	return t.pool(identity).RoundTrip(req)
+}
+
+// check enforces the TLS and onion policies on a request.
+func (t *HTTPTransport) check(req *http.Request) error {
+	if req.URL == nil {
+		return errors.New("nil request URL")
+	}
+	scheme := strings.ToLower(req.URL.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return fmt.Errorf("unsupported protocol scheme %q", req.URL.Scheme)
+	}
+	host := strings.TrimSuffix(strings.ToLower(req.URL.Hostname()), ".")
+	if strings.HasSuffix(host, ".onion") {
+		switch t.conf.OnionPolicy {
+		case OnionTLSOptional:
+			return nil
+		case OnionTLSRequired:
+			if scheme != "https" {
+				return fmt.Errorf("plain HTTP refused to onion service %s", host)
+			}
+			return nil
+		default:
+			return fmt.Errorf("request refused to onion service %s", host)
+		}
+	}
+	if scheme != "https" && !t.conf.AllowPlainHTTP {
+		return fmt.Errorf("plain HTTP refused to %s", host)
+	}
+	return nil
+}
+
+// pool returns the connection pool of an identity, creating it if needed.
+func (t *HTTPTransport) pool(identity string) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if pool, ok := t.pools[identity]; ok {
+		return pool
+	}
+	user := identity
+	if user == "" {
+		user = defaultIdentity
+	}
+	auth := &socks.Auth{User: user, Pass: strconv.Itoa(t.generation)}
+	owner := t.owner
+
+	pool := &http.Transport{
+		// Never consult the proxy environment variables, nor resolve locally
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if owner != nil && owner.Retired() {
+				return nil, ErrIdentityRetired
+			}
+			return socks.Dial(ctx, t.socks, network, addr, auth)
+		},
+		TLSClientConfig:       t.conf.TLSConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	t.pools[identity] = pool
+	return pool
+}
+
+// CloseIdleConnections closes the idle connections of all identities.
+func (t *HTTPTransport) CloseIdleConnections() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, pool := range t.pools {
+		pool.CloseIdleConnections()
+	}
+}
+
+// NewIdentity drops the connection pools of all identities and signals Tor to
+// switch to clean circuits, so subsequent requests can't be linked to earlier
+// ones. Requests still in flight complete on their old connections.
+func (t *HTTPTransport) NewIdentity() error {
+	t.lock.Lock()
+	for _, pool := range t.pools {
+		pool.CloseIdleConnections()
+	}
+	t.pools = make(map[string]*http.Transport)
+	t.generation++
+	t.lock.Unlock()
+
+	if err := t.conf.Control.Signal("NEWNYM"); err != nil {
+		return fmt.Errorf("failed to signal new identity: %v", err)
+	}
+	return nil
+}
+
+// HTTPClient is an http.Client sending its requests through Tor.
+type HTTPClient struct {
+	*http.Client
+	TorTransport *HTTPTransport // Transport of the client, also set as Client.Transport
+}
+
+// NewHTTPClient creates an HTTP client sending its requests through the SOCKS
+// listener of a Tor instance.
+func NewHTTPClient(conf *HTTPClientConf) (*HTTPClient, error) {
+	transport, err := NewHTTPTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPClient{
+		Client:       &http.Client{Transport: transport, Timeout: conf.Timeout},
+		TorTransport: transport,
+	}, nil
+}
+
+// NewIdentity drops the connection pools of the client and signals Tor to switch
+// to clean circuits.
+func (c *HTTPClient) NewIdentity() error {
+	return c.TorTransport.NewIdentity()
+}
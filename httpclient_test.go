@@ -0,0 +1,51 @@
+package libtor
+
+import (
+	"net/http"
+	"testing"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// Tests that the client sends its requests through its Tor transport, and that
+// the transport enforces the TLS and onion policies.
+func TestHTTPClient(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("net/listeners/socks", `"127.0.0.1:9050"`)
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	client, err := NewHTTPClient(&HTTPClientConf{Control: conn, OnionPolicy: OnionTLSRequired})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if client.Transport != http.RoundTripper(client.TorTransport) {
+		t.Errorf("client transport mismatch: have %T, want %T", client.Transport, client.TorTransport)
+	}
+	if client.TorTransport.socks != "127.0.0.1:9050" {
+		t.Errorf("SOCKS address mismatch: have %s, want %s", client.TorTransport.socks, "127.0.0.1:9050")
+	}
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://example.com/", true},
+		{"http://example.com/", false},
+		{"ftp://example.com/", false},
+		{"https://exampleonion.onion/", true},
+		{"http://exampleonion.onion./", false},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatalf("test %d: failed to create request: %v", i, err)
+		}
+		if err := client.TorTransport.check(req); (err == nil) != tt.ok {
+			t.Errorf("test %d: policy mismatch for %s: have %v, want ok %v", i, tt.url, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package libtor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/internal/circstatus"
+	"berty.tech/go-libtor/internal/socks"
+)
+
+// ErrIdentityRetired is returned when dialing through a retired identity.
+var ErrIdentityRetired = errors.New("identity retired")
+
+// Identity is a stream isolation identity: the streams opened through it never
+// share a circuit with the streams of other identities, nor with unisolated
+// ones. It relies on Tor isolating streams by SOCKS credentials, which is the
+// default for SOCKS listeners (IsolateSOCKSAuth).
+type Identity struct {
+	Token string // Unique isolation token, the SOCKS username of the streams
+
+	conn  *control.Conn
+	socks string // Address of the SOCKS listener of Tor
+
+	transports []*HTTPTransport // HTTP transports bound to the identity
+	retired    bool
+	lock       sync.Mutex
+}
+
+// NewIdentity creates a new isolation identity on the Tor instance behind the
+// given controller connection.
+func NewIdentity(conn *control.Conn) (*Identity, error) {
+	if conn == nil {
+		return nil, errors.New("no controller connection configured")
+	}
+	socks, err := socksAddr(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SOCKS listener: %v", err)
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate isolation token: %v", err)
+	}
+	return &Identity{
+		Token: hex.EncodeToString(token),
+		conn:  conn,
+		socks: socks,
+	}, nil
+}
+
+// NewIdentity creates a new isolation identity on the Tor instance.
+func (t *Tor) NewIdentity() (*Identity, error) {
+	return NewIdentity(t.Control)
+}
+
+// DialContext opens a stream to addr through Tor, isolated to the identity. It
+// has the signature of net.Dialer.DialContext.
+func (id *Identity) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if id.Retired() {
+		return nil, ErrIdentityRetired
+	}
+	// Same credentials as the initial generation of the identity's HTTP clients
+	return socks.Dial(ctx, id.socks, network, addr, &socks.Auth{User: id.Token, Pass: "0"})
+}
+
+// Dial opens a stream to addr through Tor, isolated to the identity.
+func (id *Identity) Dial(network, addr string) (net.Conn, error) {
+	return id.DialContext(context.Background(), network, addr)
+}
+
+// HTTPClient creates an HTTP client whose requests are all isolated to the
+// identity. The Control and Identity fields of the configuration are ignored,
+// which may be nil for the defaults.
+func (id *Identity) HTTPClient(conf *HTTPClientConf) (*HTTPClient, error) {
+	if conf == nil {
+		conf = new(HTTPClientConf)
+	}
+	bound := *conf
+	bound.Control, bound.Identity = id.conn, id.Token
+
+	client, err := NewHTTPClient(&bound)
+	if err != nil {
+		return nil, err
+	}
+	id.lock.Lock()
+	defer id.lock.Unlock()
+
+	if id.retired {
+		return nil, ErrIdentityRetired
+	}
+	client.TorTransport.owner = id
+	id.transports = append(id.transports, client.TorTransport)
+	return client, nil
+}
+
+// Retired reports whether the identity was retired.
+func (id *Identity) Retired() bool {
+	id.lock.Lock()
+	defer id.lock.Unlock()
+
+	return id.retired
+}
+
+// Retire stops the identity from opening new streams and closes all circuits
+// built for it, tearing down the streams they carry.
+func (id *Identity) Retire() error {
+	id.lock.Lock()
+	id.retired = true
+	transports := id.transports
+	id.transports = nil
+	id.lock.Unlock()
+
+	for _, transport := range transports {
+		transport.CloseIdleConnections()
+	}
+	circuits, err := id.Circuits()
+	if err != nil {
+		return err
+	}
+	for _, circuit := range circuits {
+		// The circuit may have closed on its own in the meantime
+		if err := id.conn.CloseCircuit(circuit, nil); err != nil && !strings.Contains(err.Error(), "Unknown circuit") {
+			return fmt.Errorf("failed to close circuit %s: %v", circuit, err)
+		}
+	}
+	return nil
+}
+
+// Circuits returns the IDs of the circuits currently built for the identity.
+func (id *Identity) Circuits() ([]string, error) {
+	circuits, err := circstatus.Query(id.conn)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, circuit := range circuits {
+		if circuit.Attrs["SOCKS_USERNAME"] == id.Token {
+			ids = append(ids, circuit.ID)
+		}
+	}
+	return ids, nil
+}
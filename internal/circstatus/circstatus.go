@@ -0,0 +1,94 @@
+// Package circstatus queries and parses the circuit listing of a Tor instance,
+// for features to pick the circuits of a stream identity or an onion service.
+package circstatus
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/torutil"
+)
+
+// Circuit is a single entry of the circuit-status listing.
+type Circuit struct {
+	ID     string            // Circuit identifier, as accepted by CLOSECIRCUIT
+	Status string            // Circuit status, e.g. BUILT or EXTENDED
+	Path   string            // Comma separated relays, empty if not extended yet
+	Attrs  map[string]string // Key=Value attributes, quoted values unescaped
+}
+
+// Query fetches and parses the circuit-status listing of Tor.
+func Query(conn *control.Conn) ([]*Circuit, error) {
+	infos, err := conn.GetInfo("circuit-status")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query circuits: %v", err)
+	}
+	var circuits []*Circuit
+	for _, info := range infos {
+		circuits = append(circuits, Parse(info.Val)...)
+	}
+	return circuits, nil
+}
+
+// Parse parses a circuit-status listing, skipping malformed lines. Lines are
+// "CircuitID SP CircStatus [SP Path] [SP Key=Value]...".
+func Parse(status string) []*Circuit {
+	var circuits []*Circuit
+	for _, line := range strings.Split(status, "\n") {
+		fields := split(line)
+		if len(fields) < 2 {
+			continue
+		}
+		circuit := &Circuit{ID: fields[0], Status: fields[1], Attrs: make(map[string]string)}
+		for i, field := range fields[2:] {
+			key, val, ok := torutil.PartitionString(field, '=')
+			if !ok {
+				// Only the first optional field may be the path
+				if i == 0 {
+					circuit.Path = field
+				}
+				continue
+			}
+			if unquoted, err := torutil.UnescapeSimpleQuotedStringIfNeeded(val); err == nil {
+				val = unquoted
+			}
+			circuit.Attrs[key] = val
+		}
+		circuits = append(circuits, circuit)
+	}
+	return circuits
+}
+
+// split breaks a line into its space separated fields, keeping the spaces of
+// quoted values (e.g. a SOCKS_USERNAME) within their field.
+func split(line string) []string {
+	var (
+		fields  []string
+		start   = -1
+		quoted  bool
+		escaped bool
+	)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && (c == ' ' || c == '\t' || c == '\r'):
+			if start >= 0 {
+				fields, start = append(fields, line[start:i]), -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, line[start:])
+	}
+	return fields
+}
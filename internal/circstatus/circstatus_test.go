@@ -0,0 +1,31 @@
+package circstatus
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests that circuit listings are parsed into their fields, with quoted values
+// kept whole and unescaped.
+func TestParse(t *testing.T) {
+	status := "\n" +
+		"1 LAUNCHED BUILD_FLAGS=NEED_CAPACITY PURPOSE=GENERAL\n" +
+		"2 BUILT $A~a,$B~b PURPOSE=HS_SERVICE_INTRO HS_STATE=HSSI_ESTABLISHED REND_QUERY=service\n" +
+		`3 BUILT $A~a,$C~c PURPOSE=GENERAL SOCKS_USERNAME="alice \"a\" b" SOCKS_PASSWORD="0"` + "\n" +
+		"malformed\n"
+
+	want := []*Circuit{
+		{ID: "1", Status: "LAUNCHED", Attrs: map[string]string{"BUILD_FLAGS": "NEED_CAPACITY", "PURPOSE": "GENERAL"}},
+		{ID: "2", Status: "BUILT", Path: "$A~a,$B~b", Attrs: map[string]string{"PURPOSE": "HS_SERVICE_INTRO", "HS_STATE": "HSSI_ESTABLISHED", "REND_QUERY": "service"}},
+		{ID: "3", Status: "BUILT", Path: "$A~a,$C~c", Attrs: map[string]string{"PURPOSE": "GENERAL", "SOCKS_USERNAME": `alice "a" b`, "SOCKS_PASSWORD": "0"}},
+	}
+	have := Parse(status)
+	if len(have) != len(want) {
+		t.Fatalf("circuit count mismatch: have %d, want %d", len(have), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(have[i], want[i]) {
+			t.Errorf("circuit %d mismatch: have %+v, want %+v", i, have[i], want[i])
+		}
+	}
+}
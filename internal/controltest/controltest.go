@@ -0,0 +1,220 @@
+// Package controltest implements a scriptable fake of the Tor control port,
+// permitting controller code to be exercised without a running Tor instance.
+package controltest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"github.com/cretz/bine/control"
+)
+
+// Handler answers a single control command, receiving everything after the
+// command keyword. Multi-line commands (prefixed with "+") get their body
+// appended after a newline, the keyword is registered without the prefix. The
+// returned lines are sent back as the data part of a
+// "250" reply. A returned *textproto.Error is sent back with its own status
+// code, any other error is reported as a "550" failure.
+type Handler func(args string) ([]string, error)
+
+// Server is a fake Tor control port. The zero value is not usable, create new
+// instances via NewServer.
+type Server struct {
+	lock     sync.Mutex
+	info     map[string]string  // Values returned for GETINFO queries
+	handlers map[string]Handler // Custom handlers keyed by upper case command
+	history  []string           // Every command received, in order
+	conns    map[*serverConn]struct{}
+}
+
+// serverConn is a single controller connected to the fake server.
+type serverConn struct {
+	text  *textproto.Conn
+	write sync.Mutex
+}
+
+// NewServer creates a fake control port answering authentication, GETINFO,
+// SETEVENTS and QUIT out of the box.
+func NewServer() *Server {
+	return &Server{
+		info:     make(map[string]string),
+		handlers: make(map[string]Handler),
+		conns:    make(map[*serverConn]struct{}),
+	}
+}
+
+// SetInfo sets the value returned for a GETINFO key. Multi-line values are
+// sent back in the dot-encoded form, just as Tor does.
+func (s *Server) SetInfo(key, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.info[key] = value
+}
+
+// Handle registers a handler for a command keyword, overriding any builtin.
+func (s *Server) Handle(command string, handler Handler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.handlers[strings.ToUpper(command)] = handler
+}
+
+// History returns all the commands received by the server so far.
+func (s *Server) History() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string(nil), s.history...)
+}
+
+// Dial connects a new authenticated controller to the fake server.
+func (s *Server) Dial() (*control.Conn, error) {
+	client, server := net.Pipe()
+
+	sc := &serverConn{text: textproto.NewConn(server)}
+	s.lock.Lock()
+	s.conns[sc] = struct{}{}
+	s.lock.Unlock()
+
+	go s.serve(sc)
+
+	conn := control.NewConn(textproto.NewConn(client))
+	if err := conn.Authenticate(""); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Event pushes an asynchronous event line (without the 650 status code) to
+// every connected controller. Multi-line events are sent dot-encoded, with the
+// first line as the event line.
+func (s *Server) Event(event string) {
+	s.lock.Lock()
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.lock.Unlock()
+
+	for _, sc := range conns {
+		sc.write.Lock()
+		if idx := strings.IndexByte(event, '\n'); idx >= 0 {
+			sc.text.PrintfLine("650+%s", event[:idx])
+			body := sc.text.DotWriter()
+			body.Write([]byte(event[idx+1:]))
+			body.Close()
+			sc.text.PrintfLine("650 OK")
+		} else {
+			sc.text.PrintfLine("650 %s", event)
+		}
+		sc.write.Unlock()
+	}
+}
+
+// serve runs the request/reply loop of a single controller.
+func (s *Server) serve(sc *serverConn) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, sc)
+		s.lock.Unlock()
+		sc.text.Close()
+	}()
+	for {
+		line, err := sc.text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, args := line, ""
+		if idx := strings.IndexByte(line, ' '); idx >= 0 {
+			command, args = line[:idx], line[idx+1:]
+		}
+		command = strings.ToUpper(command)
+
+		if strings.HasPrefix(command, "+") {
+			body, err := sc.text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			command, args = command[1:], args+"\n"+strings.TrimSuffix(string(body), "\n")
+		}
+
+		s.lock.Lock()
+		s.history = append(s.history, line)
+		handler := s.handlers[command]
+		s.lock.Unlock()
+
+		var (
+			data []string
+			quit bool
+		)
+		switch {
+		case handler != nil:
+			data, err = handler(args)
+		case command == "PROTOCOLINFO":
+			data = []string{"PROTOCOLINFO 1", "AUTH METHODS=NULL", `VERSION Tor="0.3.5.14-dev"`}
+		case command == "AUTHENTICATE", command == "SETEVENTS", command == "USEFEATURE":
+		case command == "GETINFO":
+			data, err = s.getInfo(args)
+		case command == "QUIT":
+			quit = true
+		default:
+			err = &textproto.Error{Code: control.StatusErrUnrecognizedCmd, Msg: fmt.Sprintf("Unrecognized command %q", command)}
+		}
+		sc.write.Lock()
+		writeReply(sc.text, data, err)
+		sc.write.Unlock()
+
+		if quit {
+			return
+		}
+	}
+}
+
+// getInfo assembles the data lines for a GETINFO query.
+func (s *Server) getInfo(args string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var data []string
+	for _, key := range strings.Fields(args) {
+		value, ok := s.info[key]
+		if !ok {
+			return nil, &textproto.Error{Code: control.StatusErrUnrecognizedEntity, Msg: fmt.Sprintf("Unrecognized key %q", key)}
+		}
+		if strings.Contains(value, "\n") {
+			value = "\n" + value
+		}
+		data = append(data, key+"="+value)
+	}
+	return data, nil
+}
+
+// writeReply sends back a full control port reply, dot-encoding any multi-line
+// data entries.
+func writeReply(text *textproto.Conn, data []string, err error) {
+	if err != nil {
+		var terr *textproto.Error
+		if !errors.As(err, &terr) {
+			terr = &textproto.Error{Code: control.StatusErrUnspecifiedTorError, Msg: err.Error()}
+		}
+		text.PrintfLine("%d %s", terr.Code, terr.Msg)
+		return
+	}
+	for _, line := range data {
+		if idx := strings.IndexByte(line, '\n'); idx >= 0 {
+			text.PrintfLine("250+%s", line[:idx])
+			body := text.DotWriter()
+			body.Write([]byte(line[idx+1:]))
+			body.Close()
+			continue
+		}
+		text.PrintfLine("250-%s", line)
+	}
+	text.PrintfLine("250 OK")
+}
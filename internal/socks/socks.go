@@ -0,0 +1,161 @@
+// Package socks implements the client side of the SOCKS5 CONNECT handshake of
+// Tor's SOCKS listeners, shared by the dialers of the embedded Tor and of the
+// test network nodes.
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replyErrors are the textual forms of the SOCKS5 reply codes.
+var replyErrors = []string{
+	"",
+	"general failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// Auth are the SOCKS username and password of a stream. Tor doesn't check them,
+// but isolates streams with different credentials onto separate circuits.
+type Auth struct {
+	User string
+	Pass string
+}
+
+// Dial opens a stream to addr through the SOCKS listener at proxy, either
+// "host:port" or "unix:/path", authenticating with the given credentials if any.
+// Hostnames are passed on unresolved.
+func Dial(ctx context.Context, proxy, network, addr string, auth *Auth) (net.Conn, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if len(host) > 255 {
+		return nil, errors.New("hostname too long")
+	}
+	proxyNet := "tcp"
+	if strings.HasPrefix(proxy, "unix:") {
+		proxyNet, proxy = "unix", strings.TrimPrefix(proxy, "unix:")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, proxyNet, proxy)
+	if err != nil {
+		return nil, err
+	}
+	// Abort the handshake if the context is cancelled midway
+	var (
+		stop    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	err = connect(conn, host, port, auth)
+	close(stop)
+	<-stopped
+
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect runs a SOCKS5 CONNECT handshake by hostname, unauthenticated if no
+// credentials are given.
+func connect(conn net.Conn, host string, port int, auth *Auth) error {
+	method := byte(0)
+	if auth != nil {
+		method = 2
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return errors.New("SOCKS authentication rejected")
+	}
+	if auth != nil {
+		if len(auth.User) == 0 || len(auth.User) > 255 || len(auth.Pass) == 0 || len(auth.Pass) > 255 {
+			return errors.New("invalid SOCKS credentials")
+		}
+		req := append([]byte{1, byte(len(auth.User))}, auth.User...)
+		req = append(append(req, byte(len(auth.Pass))), auth.Pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS authentication rejected")
+		}
+	}
+	req := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply = make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(replyErrors) {
+			return errors.New(replyErrors[reply[1]])
+		}
+		return fmt.Errorf("SOCKS error %d", reply[1])
+	}
+	// Skip over the bound address, irrelevant for Tor
+	var skip int
+	switch reply[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		skip = int(size[0])
+	default:
+		return fmt.Errorf("unknown SOCKS address type %d", reply[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,116 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve answers a single SOCKS5 handshake on every accepted connection,
+// recording the credentials and target it received and replying with code.
+func serve(listener net.Listener, code byte, seen chan<- string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+
+			greeting := make([]byte, 3)
+			if _, err := io.ReadFull(conn, greeting); err != nil {
+				return
+			}
+			conn.Write([]byte{5, greeting[2]})
+
+			var record bytes.Buffer
+			if greeting[2] == 2 {
+				header := make([]byte, 2)
+				io.ReadFull(conn, header)
+				user := make([]byte, header[1])
+				io.ReadFull(conn, user)
+				size := make([]byte, 1)
+				io.ReadFull(conn, size)
+				pass := make([]byte, size[0])
+				io.ReadFull(conn, pass)
+				record.WriteString(string(user) + ":" + string(pass) + "@")
+				conn.Write([]byte{1, 0})
+			}
+			req := make([]byte, 5)
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			target := make([]byte, int(req[4])+2)
+			io.ReadFull(conn, target)
+			record.WriteString(string(target[:req[4]]))
+			seen <- record.String()
+
+			conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+			conn.Write([]byte("ok"))
+		}()
+	}
+}
+
+// Tests that CONNECT requests are sent by hostname, with credentials if given,
+// and that refusals are reported.
+func TestDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	seen := make(chan string, 1)
+	go serve(listener, 0, seen)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		auth *Auth
+		want string
+	}{
+		{nil, "example.onion"},
+		{&Auth{User: "isolation", Pass: "0"}, "isolation:0@example.onion"},
+	}
+	for i, tt := range tests {
+		conn, err := Dial(ctx, listener.Addr().String(), "tcp", "example.onion:80", tt.auth)
+		if err != nil {
+			t.Fatalf("test %d: failed to dial: %v", i, err)
+		}
+		if have := <-seen; have != tt.want {
+			t.Errorf("test %d: request mismatch: have %q, want %q", i, have, tt.want)
+		}
+		data := make([]byte, 2)
+		if _, err := io.ReadFull(conn, data); err != nil || string(data) != "ok" {
+			t.Errorf("test %d: stream mismatch: have %q, %v", i, data, err)
+		}
+		conn.Close()
+	}
+	if _, err := Dial(ctx, listener.Addr().String(), "udp", "example.onion:80", nil); err == nil {
+		t.Errorf("dialed an unsupported network")
+	}
+	if _, err := Dial(ctx, listener.Addr().String(), "tcp", "example.onion:0", nil); err == nil {
+		t.Errorf("dialed an invalid port")
+	}
+}
+
+// Tests that SOCKS error replies are turned into readable errors.
+func TestDialRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	seen := make(chan string, 1)
+	go serve(listener, 5, seen)
+
+	_, err = Dial(context.Background(), listener.Addr().String(), "tcp", "example.onion:80", nil)
+	if err == nil || err.Error() != "failed to connect to example.onion:80: connection refused" {
+		t.Errorf("refusal mismatch: have %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Package torversion queries the version of a Tor instance over its control
+// port, for features to fail explicitly on versions predating them.
+package torversion
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/bine/control"
+)
+
+// Query queries the major, minor and micro version of Tor.
+func Query(conn *control.Conn) ([3]int, error) {
+	infos, err := conn.GetInfo("version")
+	if err != nil {
+		return [3]int{}, err
+	}
+	if len(infos) == 0 {
+		return [3]int{}, errors.New("missing version")
+	}
+	return Parse(infos[0].Val)
+}
+
+// Parse parses the major, minor and micro version out of a version string of
+// Tor, e.g. "0.3.5.8 (git-5030edfb534245ed)".
+func Parse(value string) ([3]int, error) {
+	var version [3]int
+
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return version, errors.New("missing version")
+	}
+	parts := strings.SplitN(fields[0], ".", 4)
+	if len(parts) < 3 {
+		return version, fmt.Errorf("invalid version %q", value)
+	}
+	for i := range version {
+		var err error
+		if version[i], err = strconv.Atoi(parts[i]); err != nil {
+			return version, fmt.Errorf("invalid version %q", value)
+		}
+	}
+	return version, nil
+}
+
+// ParseProvider parses the major, minor and micro version out of the provider
+// version of the embedded Tor API, e.g. "tor 0.3.5.8".
+func ParseProvider(value string) ([3]int, error) {
+	return Parse(strings.TrimPrefix(value, "tor "))
+}
+
+// AtLeast reports whether a Tor version is at least major.minor.micro.
+func AtLeast(version [3]int, major, minor, micro int) bool {
+	if version[0] != major {
+		return version[0] > major
+	}
+	if version[1] != minor {
+		return version[1] > minor
+	}
+	return version[2] >= micro
+}
@@ -0,0 +1,100 @@
+package torversion
+
+import (
+	"testing"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// Tests that the version strings of Tor are parsed, whatever their suffixes.
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value   string
+		version [3]int
+		ok      bool
+	}{
+		{"0.3.5.8", [3]int{0, 3, 5}, true},
+		{"0.3.5.14-dev (git-5030edfb534245ed)", [3]int{0, 3, 5}, true},
+		{"0.4.1.5", [3]int{0, 4, 1}, true},
+		{"0.4.3.0-alpha-dev", [3]int{0, 4, 3}, true},
+		{"0.4", [3]int{}, false},
+		{"0.x.5.8", [3]int{}, false},
+		{"", [3]int{}, false},
+	}
+	for i, tt := range tests {
+		version, err := Parse(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("test %d: error mismatch: have %v, want ok %v", i, err, tt.ok)
+			continue
+		}
+		if tt.ok && version != tt.version {
+			t.Errorf("test %d: version mismatch: have %v, want %v", i, version, tt.version)
+		}
+	}
+}
+
+// Tests that the provider versions of the embedded Tor API are parsed, with or
+// without the provider name.
+func TestParseProvider(t *testing.T) {
+	tests := []struct {
+		value   string
+		version [3]int
+		ok      bool
+	}{
+		{"tor 0.3.5.8", [3]int{0, 3, 5}, true},
+		{"0.4.3.5", [3]int{0, 4, 3}, true},
+		{"tor", [3]int{}, false},
+	}
+	for i, tt := range tests {
+		version, err := ParseProvider(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("test %d: error mismatch: have %v, want ok %v", i, err, tt.ok)
+			continue
+		}
+		if tt.ok && version != tt.version {
+			t.Errorf("test %d: version mismatch: have %v, want %v", i, version, tt.version)
+		}
+	}
+}
+
+// Tests that versions are compared component by component.
+func TestAtLeast(t *testing.T) {
+	tests := []struct {
+		version [3]int
+		min     [3]int
+		ok      bool
+	}{
+		{[3]int{0, 3, 5}, [3]int{0, 4, 1}, false},
+		{[3]int{0, 4, 1}, [3]int{0, 4, 1}, true},
+		{[3]int{0, 4, 0}, [3]int{0, 4, 1}, false},
+		{[3]int{0, 4, 2}, [3]int{0, 4, 1}, true},
+		{[3]int{0, 5, 0}, [3]int{0, 4, 3}, true},
+		{[3]int{1, 0, 0}, [3]int{0, 4, 3}, true},
+		{[3]int{0, 9, 9}, [3]int{1, 0, 0}, false},
+	}
+	for i, tt := range tests {
+		if have := AtLeast(tt.version, tt.min[0], tt.min[1], tt.min[2]); have != tt.ok {
+			t.Errorf("test %d: %v at least %v: have %v, want %v", i, tt.version, tt.min, have, tt.ok)
+		}
+	}
+}
+
+// Tests that the version is queried over the control port.
+func TestQuery(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("version", "0.4.2.7 (git-a0e9dc8d1f8e3d0c)")
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	version, err := Query(conn)
+	if err != nil {
+		t.Fatalf("failed to query version: %v", err)
+	}
+	if want := [3]int{0, 4, 2}; version != want {
+		t.Errorf("version mismatch: have %v, want %v", version, want)
+	}
+}
@@ -0,0 +1,184 @@
+package libtor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/torutil/ed25519"
+
+	"berty.tech/go-libtor/libtor"
+)
+
+// ErrKeyNotFound is returned by a KeyStore if no key is stored under a name.
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrBadPassphrase is returned when loading an encrypted key with the wrong
+// passphrase.
+var ErrBadPassphrase = libtor.ErrBadPassphrase
+
+// KeyStore is a persistent storage for onion service private keys, permitting
+// services to keep their .onion address across restarts.
+type KeyStore interface {
+	// LoadKey retrieves the key stored under name, or ErrKeyNotFound.
+	LoadKey(name string) (*control.ED25519Key, error)
+
+	// StoreKey saves a key under name, overwriting any previous one.
+	StoreKey(name string, key *control.ED25519Key) error
+
+	// DeleteKey removes the key stored under name. Deleting a missing key is
+	// not an error.
+	DeleteKey(name string) error
+}
+
+// Tagged file headers, compatible with the ones written by Tor itself.
+const (
+	keyHeaderPlain     = "== ed25519v1-secret: type0 =="
+	keyHeaderEncrypted = "== Boxed Ed25519 key: master =="
+	keyHeaderLength    = 32
+)
+
+// keyNameRegexp restricts the key names to safe file names.
+var keyNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_\-][A-Za-z0-9_.\-]*$`)
+
+// FileKeyStore is a KeyStore keeping each key in a separate 0600 file within a
+// private directory. Unencrypted keys use the same format as the hidden service
+// directories of Tor (hs_ed25519_secret_key).
+type FileKeyStore struct {
+	dir        string
+	passphrase []byte // Passphrase to pwbox keys with, nil for plain files
+}
+
+// NewFileKeyStore creates a key store saving keys in plain files in dir.
+func NewFileKeyStore(dir string) (*FileKeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %v", err)
+	}
+	return &FileKeyStore{dir: dir}, nil
+}
+
+// NewEncryptedFileKeyStore creates a key store saving keys in files in dir, each
+// encrypted with a scrypt derived passphrase via Tor's pwbox.
+func NewEncryptedFileKeyStore(dir string, passphrase []byte) (*FileKeyStore, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	store, err := NewFileKeyStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	store.passphrase = append([]byte(nil), passphrase...)
+	return store, nil
+}
+
+// path returns the file path of a named key.
+func (s *FileKeyStore) path(name string) (string, error) {
+	if !keyNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid key name %q", name)
+	}
+	return filepath.Join(s.dir, name+".key"), nil
+}
+
+// LoadKey implements KeyStore, reading and decrypting if needed a key file.
+func (s *FileKeyStore) LoadKey(name string) (*control.ED25519Key, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	if len(blob) < keyHeaderLength {
+		return nil, fmt.Errorf("corrupted key file %s", path)
+	}
+	header, data := string(bytes.TrimRight(blob[:keyHeaderLength], "\x00")), blob[keyHeaderLength:]
+
+	switch header {
+	case keyHeaderPlain:
+		if s.passphrase != nil {
+			return nil, fmt.Errorf("unencrypted key file %s in encrypted store", path)
+		}
+	case keyHeaderEncrypted:
+		if s.passphrase == nil {
+			return nil, fmt.Errorf("encrypted key file %s in unencrypted store", path)
+		}
+		if data, err = libtor.Unpwbox(data, s.passphrase); err != nil {
+			if err == libtor.ErrBadPassphrase {
+				return nil, ErrBadPassphrase
+			}
+			return nil, fmt.Errorf("failed to decrypt key: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown key file header %q", header)
+	}
+	if len(data) != 64 {
+		return nil, fmt.Errorf("invalid key length %d", len(data))
+	}
+	return &control.ED25519Key{KeyPair: ed25519.PrivateKey(data).KeyPair()}, nil
+}
+
+// StoreKey implements KeyStore, atomically replacing the key file.
+func (s *FileKeyStore) StoreKey(name string, key *control.ED25519Key) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	header, data := keyHeaderPlain, []byte(key.PrivateKey())
+	if s.passphrase != nil {
+		if data, err = libtor.Pwbox(data, s.passphrase); err != nil {
+			return fmt.Errorf("failed to encrypt key: %v", err)
+		}
+		header = keyHeaderEncrypted
+	}
+	blob := make([]byte, keyHeaderLength, keyHeaderLength+len(data))
+	copy(blob, header)
+	blob = append(blob, data...)
+
+	// Write to a temporary file first to never leave a truncated key behind
+	tmp, err := ioutil.TempFile(s.dir, name+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to restrict key file: %v", err)
+	}
+	if _, err := tmp.Write(blob); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write key file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to flush key file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close key file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace key file: %v", err)
+	}
+	return nil
+}
+
+// DeleteKey implements KeyStore, removing a key file.
+func (s *FileKeyStore) DeleteKey(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete key: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package libtor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests that plain key stores write private Tor compatible key files, loading
+// back the same keys.
+func TestFileKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileKeyStore(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("failed to create key store: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "keys")); err != nil {
+		t.Errorf("failed to stat key directory: %v", err)
+	} else if info.Mode().Perm() != 0700 {
+		t.Errorf("key directory mode mismatch: have %v, want %v", info.Mode().Perm(), os.FileMode(0700))
+	}
+	if _, err := store.LoadKey("service"); err != ErrKeyNotFound {
+		t.Errorf("missing key error mismatch: have %v, want %v", err, ErrKeyNotFound)
+	}
+	key, err := generateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if err := store.StoreKey("service", key); err != nil {
+		t.Fatalf("failed to store key: %v", err)
+	}
+	path := filepath.Join(dir, "keys", "service.key")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat key file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode mismatch: have %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read key file: %v", err)
+	}
+	if !bytes.HasPrefix(blob, []byte(keyHeaderPlain+"\x00")) || !bytes.Equal(blob[keyHeaderLength:], key.PrivateKey()) {
+		t.Errorf("key file mismatch: have %x", blob)
+	}
+	loaded, err := store.LoadKey("service")
+	if err != nil {
+		t.Fatalf("failed to load key: %v", err)
+	}
+	if !bytes.Equal(loaded.PrivateKey(), key.PrivateKey()) {
+		t.Errorf("loaded key mismatch: have %x, want %x", loaded.PrivateKey(), key.PrivateKey())
+	}
+	// Invalid names must not escape the directory, deletions must be idempotent
+	for _, name := range []string{"", "../service", ".hidden", "a/b"} {
+		if err := store.StoreKey(name, key); err == nil {
+			t.Errorf("invalid key name %q accepted", name)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.DeleteKey("service"); err != nil {
+			t.Errorf("deletion %d: failed to delete key: %v", i, err)
+		}
+	}
+	if _, err := store.LoadKey("service"); err != ErrKeyNotFound {
+		t.Errorf("deleted key error mismatch: have %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+// Tests that encrypted key stores pwbox the keys, refusing wrong passphrases
+// and key files of the other kind.
+func TestEncryptedFileKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewEncryptedFileKeyStore(dir, nil); err == nil {
+		t.Errorf("empty passphrase accepted")
+	}
+	store, err := NewEncryptedFileKeyStore(dir, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("failed to create key store: %v", err)
+	}
+	key, err := generateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if err := store.StoreKey("service", key); err != nil {
+		t.Fatalf("failed to store key: %v", err)
+	}
+	path := filepath.Join(dir, "service.key")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat key file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode mismatch: have %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read key file: %v", err)
+	}
+	if !bytes.HasPrefix(blob, []byte(keyHeaderEncrypted+"\x00")) || bytes.Contains(blob, key.PrivateKey()[:32]) {
+		t.Errorf("key file not encrypted: have %x", blob)
+	}
+	loaded, err := store.LoadKey("service")
+	if err != nil {
+		t.Fatalf("failed to load key: %v", err)
+	}
+	if !bytes.Equal(loaded.PrivateKey(), key.PrivateKey()) {
+		t.Errorf("loaded key mismatch: have %x, want %x", loaded.PrivateKey(), key.PrivateKey())
+	}
+	// Wrong passphrases and mixed up stores must be detected
+	wrong, err := NewEncryptedFileKeyStore(dir, []byte("battery staple"))
+	if err != nil {
+		t.Fatalf("failed to create key store: %v", err)
+	}
+	if _, err := wrong.LoadKey("service"); err != ErrBadPassphrase {
+		t.Errorf("wrong passphrase error mismatch: have %v, want %v", err, ErrBadPassphrase)
+	}
+	plain, err := NewFileKeyStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create key store: %v", err)
+	}
+	if _, err := plain.LoadKey("service"); err == nil {
+		t.Errorf("encrypted key loaded by plain store")
+	}
+	if err := plain.StoreKey("plain", key); err != nil {
+		t.Fatalf("failed to store plain key: %v", err)
+	}
+	if _, err := store.LoadKey("plain"); err == nil {
+		t.Errorf("plain key loaded by encrypted store")
+	}
+}
@@ -23,3 +23,8 @@ const Available = true
 // Creator implements the bine.process.Creator, permitting libtor to act as an API
 // backend for the bine/tor Go interface.
 var Creator process.Creator = libtor.Creator
+
+// SubprocessCreator implements the bine.process.Creator just like Creator, but
+// runs Tor in a child process re-executing the current binary, so that a crash
+// within Tor does not take down the Go program.
+var SubprocessCreator process.Creator = libtor.SubprocessCreator
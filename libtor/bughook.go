@@ -0,0 +1,79 @@
+package libtor
+
+// This file interposes Tor's assertion and BUG() reporters. The wrapper of
+// util_bug.c renames the originals to tor_assertion_failed_orig_ and
+// tor_bug_occurred_orig_, so every other call site links against the hooks
+// below, which capture the stack and hand the report over to Go before Tor
+// logs it (and aborts, for fatal assertions).
+
+/*
+#include <pthread.h>
+#include <stdarg.h>
+#include <stdio.h>
+
+#include "lib/err/backtrace.h"
+#include "lib/log/log.h"
+#include "lib/log/util_bug.h"
+
+void tor_assertion_failed_orig_(const char *fname, unsigned int line,
+                                const char *func, const char *expr);
+void tor_bug_occurred_orig_(const char *fname, unsigned int line,
+                            const char *func, const char *expr, int once);
+
+void libtorBugHook(int fatal, char *fname, unsigned int line, char *func, char *expr, char *trace);
+
+// libtor_bug_lock serializes bug reports, guarding the backtrace buffer.
+static pthread_mutex_t libtor_bug_lock = PTHREAD_MUTEX_INITIALIZER;
+
+// libtor_bug_trace accumulates the backtrace lines of the report in progress.
+static char libtor_bug_trace[16384];
+static size_t libtor_bug_trace_len;
+
+// libtor_bug_collect is a tor_log_fn appending each line into the backtrace
+// buffer instead of logging it.
+static void libtor_bug_collect(int severity, unsigned domain, const char *fmt, ...) {
+	size_t avail = sizeof(libtor_bug_trace) - libtor_bug_trace_len;
+	if (avail < 2) {
+		return;
+	}
+	va_list ap;
+	va_start(ap, fmt);
+	int n = vsnprintf(libtor_bug_trace + libtor_bug_trace_len, avail - 1, fmt, ap);
+	va_end(ap);
+
+	if (n < 0) {
+		n = 0;
+	} else if ((size_t)n > avail - 2) {
+		n = avail - 2;
+	}
+	libtor_bug_trace_len += n;
+	libtor_bug_trace[libtor_bug_trace_len++] = '\n';
+	libtor_bug_trace[libtor_bug_trace_len] = '\0';
+}
+
+// libtor_report_bug captures the current stack and passes the bug to Go.
+static void libtor_report_bug(int fatal, const char *fname, unsigned int line,
+                              const char *func, const char *expr) {
+	pthread_mutex_lock(&libtor_bug_lock);
+	libtor_bug_trace_len = 0;
+	libtor_bug_trace[0] = '\0';
+
+	log_backtrace_impl(LOG_ERR, LD_BUG, "Bug report", libtor_bug_collect);
+	libtorBugHook(fatal, (char*)fname, line, (char*)func, (char*)expr, libtor_bug_trace);
+
+	pthread_mutex_unlock(&libtor_bug_lock);
+}
+
+void tor_assertion_failed_(const char *fname, unsigned int line,
+                           const char *func, const char *expr) {
+	libtor_report_bug(1, fname, line, func, expr);
+	tor_assertion_failed_orig_(fname, line, func, expr);
+}
+
+void tor_bug_occurred_(const char *fname, unsigned int line,
+                       const char *func, const char *expr, int once) {
+	libtor_report_bug(0, fname, line, func, expr);
+	tor_bug_occurred_orig_(fname, line, func, expr, once);
+}
+*/
+import "C"
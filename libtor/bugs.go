@@ -0,0 +1,86 @@
+package libtor
+
+import "C"
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Bug is a failed assertion or BUG() warning raised within Tor.
+type Bug struct {
+	Fatal     bool     // Whether Tor aborts after the report (failed tor_assert)
+	File      string   // Source file the bug was hit in
+	Line      int      // Source line the bug was hit at
+	Function  string   // Function the bug was hit in
+	Expr      string   // Failed condition, empty for unreachable lines
+	Backtrace []string // Symbolized stack of the reporting thread
+}
+
+// String implements fmt.Stringer, formatting the bug the same way Tor logs it.
+func (b *Bug) String() string {
+	switch {
+	case b.Fatal:
+		return fmt.Sprintf("Assertion %s failed in %s at %s:%d", b.Expr, b.Function, b.File, b.Line)
+	case b.Expr == "":
+		return fmt.Sprintf("Line unexpectedly reached at %s at %s:%d", b.Function, b.File, b.Line)
+	default:
+		return fmt.Sprintf("Non-fatal assertion %s failed in %s at %s:%d", b.Expr, b.Function, b.File, b.Line)
+	}
+}
+
+var (
+	bugHandler     func(*Bug) // Callback to report Tor bugs to
+	bugHandlerLock sync.RWMutex
+)
+
+// HandleBugs registers a callback to receive every assertion failure and BUG()
+// warning of Tor, replacing any previous one (nil disables reporting).
+//
+// The callback runs synchronously on the Tor thread hitting the bug, before Tor
+// logs it. For fatal bugs the process aborts as soon as it returns, so it should
+// persist or ship the report right away, without calling back into Tor.
+func HandleBugs(handler func(*Bug)) {
+	bugHandlerLock.Lock()
+	defer bugHandlerLock.Unlock()
+
+	bugHandler = handler
+}
+
+// reportBug passes a bug to the registered handler, if any.
+func reportBug(bug *Bug) {
+	bugHandlerLock.RLock()
+	handler := bugHandler
+	bugHandlerLock.RUnlock()
+
+	if handler != nil {
+		handler(bug)
+	}
+}
+
+//export libtorBugHook
+func libtorBugHook(fatal C.int, file *C.char, line C.uint, function *C.char, expr *C.char, trace *C.char) {
+	bug := &Bug{
+		Fatal:    fatal != 0,
+		File:     C.GoString(file),
+		Line:     int(line),
+		Function: C.GoString(function),
+		Expr:     C.GoString(expr),
+	}
+	bug.Backtrace = parseBacktrace(C.GoString(trace))
+	reportBug(bug)
+}
+
+// parseBacktrace splits a backtrace dumped by Tor into its stack frames.
+func parseBacktrace(trace string) []string {
+	// The first line is Tor's own header of the trace, skip it
+	lines := strings.Split(strings.TrimSpace(trace), "\n")
+
+	var frames []string
+	for _, frame := range lines[1:] {
+		if frame = strings.TrimSpace(frame); frame != "" {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
@@ -0,0 +1,102 @@
+// +build cgo
+
+package libtor
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Tests that the backtraces dumped by Tor are split into their frames, dropping
+// the header line.
+func TestParseBacktrace(t *testing.T) {
+	tests := []struct {
+		trace  string
+		frames []string
+	}{
+		{"", nil},
+		{"Bug: Tor 0.3.5.8: Non-fatal assertion failed. Stack trace:\n", nil},
+		{
+			"Non-fatal assertion failed. Stack trace:\n" +
+				"    /usr/bin/app(log_backtrace_impl+0x47) [0x5600a1]\n" +
+				"\n" +
+				"    /usr/bin/app(tor_bug_occurred_+0x16c) [0x5600b2]  \n",
+			[]string{
+				"/usr/bin/app(log_backtrace_impl+0x47) [0x5600a1]",
+				"/usr/bin/app(tor_bug_occurred_+0x16c) [0x5600b2]",
+			},
+		},
+	}
+	for i, tt := range tests {
+		if frames := parseBacktrace(tt.trace); !reflect.DeepEqual(frames, tt.frames) {
+			t.Errorf("test %d: frames mismatch: have %q, want %q", i, frames, tt.frames)
+		}
+	}
+}
+
+// Tests that bugs are formatted the same way Tor logs them.
+func TestBugString(t *testing.T) {
+	tests := []struct {
+		bug  *Bug
+		text string
+	}{
+		{
+			&Bug{Fatal: true, File: "src/core/or/circuitlist.c", Line: 42, Function: "circuit_free_", Expr: "circ"},
+			"Assertion circ failed in circuit_free_ at src/core/or/circuitlist.c:42",
+		},
+		{
+			&Bug{File: "src/core/or/relay.c", Line: 7, Function: "relay_send"},
+			"Line unexpectedly reached at relay_send at src/core/or/relay.c:7",
+		},
+		{
+			&Bug{File: "src/core/or/relay.c", Line: 7, Function: "relay_send", Expr: "len > 0"},
+			"Non-fatal assertion len > 0 failed in relay_send at src/core/or/relay.c:7",
+		},
+	}
+	for i, tt := range tests {
+		if text := tt.bug.String(); text != tt.text {
+			t.Errorf("test %d: text mismatch: have %q, want %q", i, text, tt.text)
+		}
+	}
+}
+
+// Tests that bugs streamed by a subprocess are relayed to the handler of this
+// process in order, and that the relay stops when the stream ends.
+func TestRelayBugs(t *testing.T) {
+	bugs := []*Bug{
+		{File: "a.c", Line: 1, Function: "a", Expr: "x", Backtrace: []string{"frame 1", "frame 2"}},
+		{Fatal: true, File: "b.c", Line: 2, Function: "b", Expr: "y"},
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	reported := make(chan *Bug, len(bugs))
+	HandleBugs(func(bug *Bug) { reported <- bug })
+	defer HandleBugs(nil)
+
+	done := make(chan struct{})
+	go func() {
+		relayBugs(reader)
+		close(done)
+	}()
+	enc := json.NewEncoder(writer)
+	for _, bug := range bugs {
+		if err := enc.Encode(bug); err != nil {
+			t.Fatalf("failed to stream bug: %v", err)
+		}
+	}
+	writer.Close()
+	<-done
+
+	close(reported)
+	var relayed []*Bug
+	for bug := range reported {
+		relayed = append(relayed, bug)
+	}
+	if !reflect.DeepEqual(relayed, bugs) {
+		t.Errorf("relayed bugs mismatch: have %v, want %v", relayed, bugs)
+	}
+}
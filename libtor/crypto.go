@@ -0,0 +1,76 @@
+package libtor
+
+/*
+#include <stdint.h>
+
+#include "lib/crypt_ops/crypto_curve25519.h"
+#include "lib/crypt_ops/crypto_init.h"
+#include "lib/crypt_ops/crypto_util.h"
+#include "lib/log/log.h"
+*/
+import "C"
+import (
+	"errors"
+	"sync"
+	"unsafe"
+)
+
+var (
+	cryptoOnce sync.Once // Guards the lazy initialization of Tor's crypto subsystem
+	cryptoErr  error     // Failure of the crypto initialization, if any
+)
+
+// cryptoInit ensures Tor's crypto library is usable, which might be needed before
+// any embedded Tor instance was started. The initialization runs only once, its
+// outcome is cached for all subsequent calls.
+func cryptoInit() error {
+	cryptoOnce.Do(func() {
+		// Crypto initialization logs, which asserts if logging is not yet set up
+		C.init_logging(0)
+		if C.crypto_early_init() != 0 {
+			cryptoErr = errors.New("failed to initialize crypto library")
+		}
+	})
+	return cryptoErr
+}
+
+// GenerateX25519 creates a new random curve25519 keypair via Tor's own
+// implementation, returning the public and the secret key.
+func GenerateX25519() (pub [32]byte, sec [32]byte, err error) {
+	if err = cryptoInit(); err != nil {
+		return
+	}
+	var (
+		cpub C.curve25519_public_key_t
+		csec C.curve25519_secret_key_t
+	)
+	if C.curve25519_secret_key_generate(&csec, 1) != 0 {
+		return pub, sec, errors.New("failed to generate curve25519 key")
+	}
+	C.curve25519_public_key_generate(&cpub, &csec)
+
+	copy(pub[:], C.GoBytes(unsafe.Pointer(&cpub.public_key[0]), C.CURVE25519_PUBKEY_LEN))
+	copy(sec[:], C.GoBytes(unsafe.Pointer(&csec.secret_key[0]), C.CURVE25519_SECKEY_LEN))
+	C.memwipe(unsafe.Pointer(&csec), 0, C.sizeof_curve25519_secret_key_t)
+	return pub, sec, nil
+}
+
+// X25519PublicKey derives the curve25519 public key of a secret key.
+func X25519PublicKey(sec [32]byte) ([32]byte, error) {
+	var pub [32]byte
+	if err := cryptoInit(); err != nil {
+		return pub, err
+	}
+	var (
+		cpub C.curve25519_public_key_t
+		csec C.curve25519_secret_key_t
+	)
+	for i, b := range sec {
+		csec.secret_key[i] = C.uint8_t(b)
+	}
+	C.curve25519_public_key_generate(&cpub, &csec)
+	C.memwipe(unsafe.Pointer(&csec), 0, C.sizeof_curve25519_secret_key_t)
+
+	copy(pub[:], C.GoBytes(unsafe.Pointer(&cpub.public_key[0]), C.CURVE25519_PUBKEY_LEN))
+	return pub, nil
+}
@@ -7,6 +7,9 @@ package libtor
 /*
 #define BUILDDIR ""
 
+#define tor_assertion_failed_ tor_assertion_failed_orig_
+#define tor_bug_occurred_ tor_bug_occurred_orig_
+
 #include <../src/lib/log/util_bug.c>
 */
 import "C"
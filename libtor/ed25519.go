@@ -0,0 +1,77 @@
+package libtor
+
+/*
+#include <stdlib.h>
+
+#include "core/or/or.h"
+#include "feature/hs/hs_common.h"
+#include "lib/crypt_ops/crypto_ed25519.h"
+#include "lib/crypt_ops/crypto_util.h"
+*/
+import "C"
+import (
+	"errors"
+	"path/filepath"
+	"unsafe"
+)
+
+// GenerateED25519 creates a new random ed25519 keypair via Tor's own
+// implementation, returning the expanded secret key and the public key.
+func GenerateED25519() (sec [64]byte, pub [32]byte, err error) {
+	if err = cryptoInit(); err != nil {
+		return
+	}
+	var pair C.ed25519_keypair_t
+	if C.ed25519_keypair_generate(&pair, 0) != 0 {
+		return sec, pub, errors.New("failed to generate ed25519 key")
+	}
+	copy(sec[:], C.GoBytes(unsafe.Pointer(&pair.seckey.seckey[0]), C.ED25519_SECKEY_LEN))
+	copy(pub[:], C.GoBytes(unsafe.Pointer(&pair.pubkey.pubkey[0]), C.ED25519_PUBKEY_LEN))
+	C.memwipe(unsafe.Pointer(&pair), 0, C.sizeof_ed25519_keypair_t)
+	return sec, pub, nil
+}
+
+// HSAddress computes the v3 onion service address (without the .onion suffix)
+// belonging to an ed25519 public key.
+func HSAddress(pub [32]byte) string {
+	var (
+		cpub C.ed25519_public_key_t
+		addr [C.HS_SERVICE_ADDR_LEN_BASE32 + 1]C.char
+	)
+	for i, b := range pub {
+		cpub.pubkey[i] = C.uint8_t(b)
+	}
+	C.hs_build_address(&cpub, C.HS_VERSION_THREE, &addr[0])
+	return C.GoString(&addr[0])
+}
+
+// WriteHSKeys writes an onion service keypair into dir in the format Tor loads
+// from a HiddenServiceDir (hs_ed25519_secret_key and hs_ed25519_public_key).
+func WriteHSKeys(dir string, sec [64]byte, pub [32]byte) error {
+	var (
+		csec C.ed25519_secret_key_t
+		cpub C.ed25519_public_key_t
+	)
+	for i, b := range sec {
+		csec.seckey[i] = C.uint8_t(b)
+	}
+	for i, b := range pub {
+		cpub.pubkey[i] = C.uint8_t(b)
+	}
+	defer C.memwipe(unsafe.Pointer(&csec), 0, C.sizeof_ed25519_secret_key_t)
+
+	tag := C.CString("type0")
+	defer C.free(unsafe.Pointer(tag))
+
+	secPath := C.CString(filepath.Join(dir, "hs_ed25519_secret_key"))
+	defer C.free(unsafe.Pointer(secPath))
+	if C.ed25519_seckey_write_to_file(&csec, secPath, tag) != 0 {
+		return errors.New("failed to write secret key")
+	}
+	pubPath := C.CString(filepath.Join(dir, "hs_ed25519_public_key"))
+	defer C.free(unsafe.Pointer(pubPath))
+	if C.ed25519_pubkey_write_to_file(&cpub, pubPath, tag) != 0 {
+		return errors.New("failed to write public key")
+	}
+	return nil
+}
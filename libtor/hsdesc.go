@@ -0,0 +1,628 @@
+package libtor
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+
+#include "core/or/or.h"
+#include "feature/hs/hs_common.h"
+#include "feature/hs/hs_descriptor.h"
+#include "feature/nodelist/torcert.h"
+#include "lib/crypt_ops/crypto_curve25519.h"
+#include "lib/crypt_ops/crypto_digest.h"
+#include "lib/crypt_ops/crypto_ed25519.h"
+#include "lib/crypt_ops/crypto_format.h"
+#include "lib/crypt_ops/crypto_util.h"
+#include "lib/malloc/malloc.h"
+#include "lib/net/address.h"
+#include "trunnel/ed25519_cert.h"
+
+// libtor_hs_decode decrypts a v3 descriptor of the service at address. The
+// subcredential is derived from the blinded key of the plaintext layer, so the
+// time period the descriptor was made for needn't be known.
+static int libtor_hs_decode(const char *address, const char *encoded, const uint8_t *client_sk,
+		hs_descriptor_t **desc_out) {
+	ed25519_public_key_t identity;
+	uint8_t checksum[DIGEST256_LEN], version;
+	uint8_t subcredential[DIGEST256_LEN];
+	hs_desc_plaintext_data_t plaintext;
+	curve25519_secret_key_t sk;
+	int ret;
+
+	if (hs_parse_address(address, &identity, checksum, &version) < 0) {
+		return -1;
+	}
+	memset(&plaintext, 0, sizeof(plaintext));
+	if (hs_desc_decode_plaintext(encoded, &plaintext) < 0) {
+		hs_desc_plaintext_data_free_contents(&plaintext);
+		return -2;
+	}
+	hs_get_subcredential(&identity, &plaintext.blinded_pubkey, subcredential);
+	hs_desc_plaintext_data_free_contents(&plaintext);
+
+	if (client_sk) {
+		memcpy(sk.secret_key, client_sk, CURVE25519_SECKEY_LEN);
+	}
+	ret = hs_desc_decode_descriptor(encoded, subcredential, client_sk ? &sk : NULL, desc_out);
+	memwipe(subcredential, 0, sizeof(subcredential));
+	memwipe(&sk, 0, sizeof(sk));
+	return ret < 0 ? -3 : 0;
+}
+
+// libtor_hs_list_len returns the number of items in a smartlist.
+static int libtor_hs_list_len(const smartlist_t *list) {
+	return list ? smartlist_len(list) : 0;
+}
+
+// libtor_hs_list_get returns an item of a smartlist.
+static void *libtor_hs_list_get(const smartlist_t *list, int index) {
+	return smartlist_get(list, index);
+}
+
+// libtor_hs_single_onion and libtor_hs_create2_ntor read the bit fields of the
+// encrypted layer, which cgo can't access.
+static int libtor_hs_single_onion(const hs_descriptor_t *desc) {
+	return desc->encrypted_data.single_onion_service;
+}
+static int libtor_hs_create2_ntor(const hs_descriptor_t *desc) {
+	return desc->encrypted_data.create2_ntor;
+}
+
+// libtor_hs_link_spec flattens a link specifier union. The address is formatted
+// into addr, identities copied into id, whose length is returned.
+static int libtor_hs_link_spec(const hs_desc_link_specifier_t *spec, char *addr, size_t addr_len,
+		uint16_t *port, uint8_t *id) {
+	switch (spec->type) {
+	case LS_IPV4:
+	case LS_IPV6:
+		tor_addr_to_str(addr, &spec->u.ap.addr, addr_len, 0);
+		*port = spec->u.ap.port;
+		return 0;
+	case LS_LEGACY_ID:
+		memcpy(id, spec->u.legacy_id, DIGEST_LEN);
+		return DIGEST_LEN;
+	case LS_ED25519_ID:
+		memcpy(id, spec->u.ed25519_id, ED25519_PUBKEY_LEN);
+		return ED25519_PUBKEY_LEN;
+	}
+	return -1;
+}
+
+// libtor_hs_ed25519_basepoint is the string form of the ed25519 base point
+// mixed into the key blinding parameter.
+static const char libtor_hs_ed25519_basepoint[] =
+	"(15112221349535400772501151409588531511454012693041857206046113283949847762202, "
+	"46316835694926478169428394003475163141307993866256225615783033603165251855960)";
+
+// libtor_hs_blind_param computes the parameter blinding an identity key for a
+// time period, like hs_build_blinded_pubkey does, but with the period length
+// (in minutes) passed in: Tor's version reads it from the global options, which
+// only exist while Tor runs.
+static void libtor_hs_blind_param(const uint8_t *pubkey, uint64_t period_num, uint64_t period_length,
+		uint8_t *param_out) {
+	const char blind_str[] = "Derive temporary signing key";
+	uint8_t nonce[HS_KEYBLIND_NONCE_LEN];
+	crypto_digest_t *digest;
+
+	memcpy(nonce, HS_KEYBLIND_NONCE_PREFIX, HS_KEYBLIND_NONCE_PREFIX_LEN);
+	set_uint64(nonce + HS_KEYBLIND_NONCE_PREFIX_LEN, tor_htonll(period_num));
+	set_uint64(nonce + HS_KEYBLIND_NONCE_PREFIX_LEN + sizeof(uint64_t), tor_htonll(period_length));
+
+	digest = crypto_digest256_new(DIGEST_SHA3_256);
+	crypto_digest_add_bytes(digest, blind_str, sizeof(blind_str));
+	crypto_digest_add_bytes(digest, (const char *)pubkey, ED25519_PUBKEY_LEN);
+	crypto_digest_add_bytes(digest, libtor_hs_ed25519_basepoint, strlen(libtor_hs_ed25519_basepoint));
+	crypto_digest_add_bytes(digest, (const char *)nonce, sizeof(nonce));
+	crypto_digest_get_digest(digest, (char *)param_out, DIGEST256_LEN);
+	crypto_digest_free(digest);
+}
+
+// libtor_hs_builder_t is a descriptor being assembled, along with the signing
+// keypair its certificates are issued with.
+typedef struct libtor_hs_builder_t {
+	hs_descriptor_t *desc;
+	ed25519_keypair_t signing_kp;
+	time_t now;
+} libtor_hs_builder_t;
+
+// libtor_hs_builder_free releases a descriptor builder.
+static void libtor_hs_builder_free(libtor_hs_builder_t *b) {
+	if (!b) {
+		return;
+	}
+	hs_descriptor_free(b->desc);
+	memwipe(&b->signing_kp, 0, sizeof(b->signing_kp));
+	tor_free(b);
+}
+
+// libtor_hs_builder_new starts a descriptor of the service of an identity
+// keypair, signed by a fresh descriptor signing key certified by the identity
+// blinded with a parameter (see libtor_hs_blind_param). Without an ephemeral key
+// for the client authorization, a random one is generated.
+static libtor_hs_builder_t *libtor_hs_builder_new(const uint8_t *seckey, const uint8_t *pubkey,
+		const uint8_t *blind_param, uint64_t revision, uint32_t lifetime, int single_onion,
+		const uint8_t *ephemeral_pk) {
+	ed25519_keypair_t identity_kp, blinded_kp;
+	curve25519_keypair_t ephemeral_kp;
+	hs_descriptor_t *desc;
+	libtor_hs_builder_t *b;
+
+	b = tor_malloc_zero(sizeof(*b));
+	b->now = time(NULL);
+	b->desc = desc = tor_malloc_zero(sizeof(hs_descriptor_t));
+
+	memcpy(identity_kp.seckey.seckey, seckey, ED25519_SECKEY_LEN);
+	memcpy(identity_kp.pubkey.pubkey, pubkey, ED25519_PUBKEY_LEN);
+	if (ed25519_keypair_blind(&blinded_kp, &identity_kp, blind_param) < 0) {
+		goto err;
+	}
+	if (ed25519_keypair_generate(&b->signing_kp, 0) < 0) {
+		goto err;
+	}
+	desc->plaintext_data.version = HS_VERSION_THREE;
+	desc->plaintext_data.lifetime_sec = lifetime;
+	desc->plaintext_data.revision_counter = revision;
+	memcpy(&desc->plaintext_data.signing_pubkey, &b->signing_kp.pubkey, sizeof(ed25519_public_key_t));
+	memcpy(&desc->plaintext_data.blinded_pubkey, &blinded_kp.pubkey, sizeof(ed25519_public_key_t));
+	desc->plaintext_data.signing_key_cert = tor_cert_create(&blinded_kp, CERT_TYPE_SIGNING_HS_DESC,
+		&b->signing_kp.pubkey, b->now, HS_DESC_CERT_LIFETIME, CERT_FLAG_INCLUDE_SIGNING_KEY);
+	if (!desc->plaintext_data.signing_key_cert) {
+		goto err;
+	}
+	hs_get_subcredential(&identity_kp.pubkey, &blinded_kp.pubkey, desc->subcredential);
+
+	if (ephemeral_pk) {
+		memcpy(desc->superencrypted_data.auth_ephemeral_pubkey.public_key, ephemeral_pk, CURVE25519_PUBKEY_LEN);
+	} else {
+		if (curve25519_keypair_generate(&ephemeral_kp, 0) < 0) {
+			goto err;
+		}
+		memcpy(&desc->superencrypted_data.auth_ephemeral_pubkey, &ephemeral_kp.pubkey, sizeof(curve25519_public_key_t));
+		memwipe(&ephemeral_kp, 0, sizeof(ephemeral_kp));
+	}
+	desc->superencrypted_data.clients = smartlist_new();
+	desc->encrypted_data.create2_ntor = 1;
+	desc->encrypted_data.single_onion_service = single_onion ? 1 : 0;
+	desc->encrypted_data.intro_points = smartlist_new();
+
+	memwipe(&identity_kp, 0, sizeof(identity_kp));
+	memwipe(&blinded_kp, 0, sizeof(blinded_kp));
+	return b;
+
+err:
+	memwipe(&identity_kp, 0, sizeof(identity_kp));
+	memwipe(&blinded_kp, 0, sizeof(blinded_kp));
+	libtor_hs_builder_free(b);
+	return NULL;
+}
+
+// libtor_hs_builder_add_client adds an authorized client entry to the
+// superencrypted layer.
+static void libtor_hs_builder_add_client(libtor_hs_builder_t *b, const uint8_t *client_id,
+		const uint8_t *iv, const uint8_t *encrypted_cookie) {
+	hs_desc_authorized_client_t *client = tor_malloc_zero(sizeof(*client));
+
+	memcpy(client->client_id, client_id, sizeof(client->client_id));
+	memcpy(client->iv, iv, sizeof(client->iv));
+	memcpy(client->encrypted_cookie, encrypted_cookie, sizeof(client->encrypted_cookie));
+	smartlist_add(b->desc->superencrypted_data.clients, client);
+}
+
+// libtor_hs_builder_add_fake_clients pads the authorized clients with fake ones,
+// just like Tor does for services without client authorization.
+static void libtor_hs_builder_add_fake_clients(libtor_hs_builder_t *b) {
+	while (smartlist_len(b->desc->superencrypted_data.clients) < 16) {
+		smartlist_add(b->desc->superencrypted_data.clients, hs_desc_build_fake_authorized_client());
+	}
+}
+
+// libtor_hs_builder_add_intro adds an introduction point to the encrypted layer,
+// certifying its keys with the descriptor signing key. The enc-key-cert holds
+// the ed25519 form of the curve25519 key with the sign bit cleared, as Tor does.
+static hs_desc_intro_point_t *libtor_hs_builder_add_intro(libtor_hs_builder_t *b, const uint8_t *onion_key,
+		const uint8_t *auth_key, const uint8_t *enc_key) {
+	hs_desc_intro_point_t *ip = hs_desc_intro_point_new();
+	ed25519_public_key_t auth_pk, enc_ed_pk;
+
+	memcpy(ip->onion_key.public_key, onion_key, CURVE25519_PUBKEY_LEN);
+	memcpy(ip->enc_key.public_key, enc_key, CURVE25519_PUBKEY_LEN);
+	memcpy(auth_pk.pubkey, auth_key, ED25519_PUBKEY_LEN);
+	if (ed25519_public_key_from_curve25519_public_key(&enc_ed_pk, &ip->enc_key, 0) < 0) {
+		goto err;
+	}
+	ip->auth_key_cert = tor_cert_create(&b->signing_kp, CERT_TYPE_AUTH_HS_IP_KEY,
+		&auth_pk, b->now, HS_DESC_CERT_LIFETIME, CERT_FLAG_INCLUDE_SIGNING_KEY);
+	ip->enc_key_cert = tor_cert_create(&b->signing_kp, CERT_TYPE_CROSS_HS_IP_KEYS,
+		&enc_ed_pk, b->now, HS_DESC_CERT_LIFETIME, CERT_FLAG_INCLUDE_SIGNING_KEY);
+	if (!ip->auth_key_cert || !ip->enc_key_cert) {
+		goto err;
+	}
+	smartlist_add(b->desc->encrypted_data.intro_points, ip);
+	return ip;
+
+err:
+	hs_desc_intro_point_free(ip);
+	return NULL;
+}
+
+// libtor_hs_intro_add_link adds a link specifier to an introduction point.
+static int libtor_hs_intro_add_link(hs_desc_intro_point_t *ip, uint8_t type, const char *addr,
+		uint16_t port, const uint8_t *id, size_t id_len) {
+	hs_desc_link_specifier_t *spec = tor_malloc_zero(sizeof(*spec));
+
+	spec->type = type;
+	switch (type) {
+	case LS_IPV4:
+	case LS_IPV6:
+		if (tor_addr_parse(&spec->u.ap.addr, addr) < 0) {
+			goto err;
+		}
+		spec->u.ap.port = port;
+		break;
+	case LS_LEGACY_ID:
+		if (id_len != DIGEST_LEN) {
+			goto err;
+		}
+		memcpy(spec->u.legacy_id, id, DIGEST_LEN);
+		break;
+	case LS_ED25519_ID:
+		if (id_len != ED25519_PUBKEY_LEN) {
+			goto err;
+		}
+		memcpy(spec->u.ed25519_id, id, ED25519_PUBKEY_LEN);
+		break;
+	default:
+		goto err;
+	}
+	smartlist_add(ip->link_specifiers, spec);
+	return 0;
+
+err:
+	tor_free(spec);
+	return -1;
+}
+
+// libtor_hs_builder_encode signs and encrypts the assembled descriptor.
+static int libtor_hs_builder_encode(libtor_hs_builder_t *b, char **encoded_out) {
+	return hs_desc_encode_descriptor(b->desc, &b->signing_kp, NULL, encoded_out);
+}
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"unsafe"
+)
+
+// Link specifier types, telling how to reach an introduction point.
+const (
+	LinkSpecIPv4      = 0 // IPv4 address and ORPort
+	LinkSpecIPv6      = 1 // IPv6 address and ORPort
+	LinkSpecLegacyID  = 2 // SHA1 digest of the RSA identity key
+	LinkSpecEd25519ID = 3 // Ed25519 identity key
+)
+
+// HSDescriptorLifetime is the lifetime of the descriptors Tor publishes.
+const HSDescriptorLifetime = 3 * time.Hour
+
+// Time period schedule of the public network: periods last a day and start at
+// noon UTC. Test networks (TestingTorNetwork) rotate faster.
+const (
+	HSPeriodLength   = 24 * time.Hour
+	HSRotationOffset = 12 * time.Hour
+)
+
+// HSLinkSpecifier is a single way of reaching an introduction point relay.
+type HSLinkSpecifier struct {
+	Type int    // One of the LinkSpec constants
+	Addr net.IP // Address of the relay (IPv4 and IPv6 only)
+	Port int    // ORPort of the relay (IPv4 and IPv6 only)
+	ID   []byte // Identity of the relay (legacy and ed25519 only)
+}
+
+// HSIntroPoint is an introduction point listed in a descriptor.
+type HSIntroPoint struct {
+	LinkSpecifiers []HSLinkSpecifier // How to reach the introduction point relay
+
+	OnionKey [32]byte // Curve25519 ntor key of the relay, to extend to it
+	AuthKey  [32]byte // Ed25519 key the service established the introduction point with
+	EncKey   [32]byte // Curve25519 key encrypting the introductions to the service
+
+	// AuthKeyExpiry is when the certificate of the authentication key expires,
+	// zero for descriptors to be encoded.
+	AuthKeyExpiry time.Time
+
+	// Legacy reports an introduction point relay without ed25519 support,
+	// established with an RSA key. They can't be encoded.
+	Legacy bool
+}
+
+// HSAuthClient is an entry of the client authorization list of a descriptor,
+// holding the descriptor cookie encrypted for one client. Services without
+// client authorization list fake entries.
+type HSAuthClient struct {
+	ID              [8]byte
+	IV              [16]byte
+	EncryptedCookie [16]byte
+}
+
+// HSDescriptor is the content of a v3 onion service descriptor.
+type HSDescriptor struct {
+	// Outer, plaintext layer
+	Version          int           // Descriptor version, always 3
+	Lifetime         time.Duration // Time HSDirs keep the descriptor for
+	SigningKey       [32]byte      // Ed25519 key the descriptor is signed with
+	SigningKeyExpiry time.Time     // Expiry of the certificate of the signing key
+	BlindedKey       [32]byte      // Blinded identity key of the time period
+	RevisionCounter  uint64        // Increasing counter of the descriptor versions
+
+	// Middle, superencrypted layer
+	AuthEphemeralKey [32]byte       // Curve25519 key of the client authorization
+	AuthClients      []HSAuthClient // Authorized clients, fake ones included
+
+	// Inner, encrypted layer
+	Create2Ntor        bool     // Whether the ntor handshake is supported
+	IntroAuthTypes     []string // Required introduction authentication types
+	SingleOnionService bool     // Whether the service is non-anonymous
+	IntroPoints        []*HSIntroPoint
+}
+
+// DecodeHSDescriptor decrypts and verifies the descriptor of the onion service
+// at address (without the .onion suffix) as fetched from an HSDir, decoding all
+// of its layers. Descriptors restricted to authorized clients need the private
+// client authorization key of one of them, clientKey is nil otherwise.
+func DecodeHSDescriptor(address string, encoded string, clientKey *[32]byte) (*HSDescriptor, error) {
+	if err := cryptoInit(); err != nil {
+		return nil, err
+	}
+	caddr, cenc := C.CString(address), C.CString(encoded)
+	defer C.free(unsafe.Pointer(caddr))
+	defer C.free(unsafe.Pointer(cenc))
+
+	var csk *C.uint8_t
+	if clientKey != nil {
+		sk := C.CBytes(clientKey[:])
+		defer C.free(sk)
+		defer C.memwipe(sk, 0, C.size_t(len(clientKey)))
+		csk = (*C.uint8_t)(sk)
+	}
+	var desc *C.hs_descriptor_t
+	switch C.libtor_hs_decode(caddr, cenc, csk, &desc) {
+	case 0:
+	case -1:
+		return nil, fmt.Errorf("invalid onion address %q", address)
+	case -2:
+		return nil, errors.New("malformed descriptor")
+	default:
+		return nil, errors.New("failed to decrypt descriptor")
+	}
+	defer C.hs_descriptor_free_(desc)
+
+	d := new(HSDescriptor)
+	d.readPlaintext(&desc.plaintext_data)
+
+	super := &desc.superencrypted_data
+	copyBytes(d.AuthEphemeralKey[:], unsafe.Pointer(&super.auth_ephemeral_pubkey.public_key[0]))
+	for i := 0; i < int(C.libtor_hs_list_len(super.clients)); i++ {
+		client := (*C.hs_desc_authorized_client_t)(C.libtor_hs_list_get(super.clients, C.int(i)))
+
+		var auth HSAuthClient
+		copyBytes(auth.ID[:], unsafe.Pointer(&client.client_id[0]))
+		copyBytes(auth.IV[:], unsafe.Pointer(&client.iv[0]))
+		copyBytes(auth.EncryptedCookie[:], unsafe.Pointer(&client.encrypted_cookie[0]))
+		d.AuthClients = append(d.AuthClients, auth)
+	}
+	enc := &desc.encrypted_data
+	d.Create2Ntor = C.libtor_hs_create2_ntor(desc) != 0
+	d.SingleOnionService = C.libtor_hs_single_onion(desc) != 0
+	for i := 0; i < int(C.libtor_hs_list_len(enc.intro_auth_types)); i++ {
+		d.IntroAuthTypes = append(d.IntroAuthTypes, C.GoString((*C.char)(C.libtor_hs_list_get(enc.intro_auth_types, C.int(i)))))
+	}
+	for i := 0; i < int(C.libtor_hs_list_len(enc.intro_points)); i++ {
+		ip := (*C.hs_desc_intro_point_t)(C.libtor_hs_list_get(enc.intro_points, C.int(i)))
+
+		intro, err := readIntroPoint(ip)
+		if err != nil {
+			return nil, err
+		}
+		d.IntroPoints = append(d.IntroPoints, intro)
+	}
+	return d, nil
+}
+
+// DecodeHSDescriptorPlaintext decodes the outer layer of a descriptor only,
+// which needs no keys, e.g. to inspect descriptors that fail to decrypt.
+func DecodeHSDescriptorPlaintext(encoded string) (*HSDescriptor, error) {
+	if err := cryptoInit(); err != nil {
+		return nil, err
+	}
+	cenc := C.CString(encoded)
+	defer C.free(unsafe.Pointer(cenc))
+
+	var plaintext C.hs_desc_plaintext_data_t
+	defer C.hs_desc_plaintext_data_free_contents(&plaintext)
+
+	if C.hs_desc_decode_plaintext(cenc, &plaintext) < 0 {
+		return nil, errors.New("malformed descriptor")
+	}
+	d := new(HSDescriptor)
+	d.readPlaintext(&plaintext)
+	return d, nil
+}
+
+// readPlaintext copies the fields of the outer layer of a descriptor.
+func (d *HSDescriptor) readPlaintext(plaintext *C.hs_desc_plaintext_data_t) {
+	d.Version = int(plaintext.version)
+	d.Lifetime = time.Duration(plaintext.lifetime_sec) * time.Second
+	d.RevisionCounter = uint64(plaintext.revision_counter)
+	copyBytes(d.SigningKey[:], unsafe.Pointer(&plaintext.signing_pubkey.pubkey[0]))
+	copyBytes(d.BlindedKey[:], unsafe.Pointer(&plaintext.blinded_pubkey.pubkey[0]))
+	if plaintext.signing_key_cert != nil {
+		d.SigningKeyExpiry = time.Unix(int64(plaintext.signing_key_cert.valid_until), 0)
+	}
+}
+
+// readIntroPoint copies the fields of an introduction point.
+func readIntroPoint(ip *C.hs_desc_intro_point_t) (*HSIntroPoint, error) {
+	intro := &HSIntroPoint{Legacy: ip.legacy.key != nil}
+
+	copyBytes(intro.OnionKey[:], unsafe.Pointer(&ip.onion_key.public_key[0]))
+	copyBytes(intro.EncKey[:], unsafe.Pointer(&ip.enc_key.public_key[0]))
+	if ip.auth_key_cert != nil {
+		copyBytes(intro.AuthKey[:], unsafe.Pointer(&ip.auth_key_cert.signed_key.pubkey[0]))
+		intro.AuthKeyExpiry = time.Unix(int64(ip.auth_key_cert.valid_until), 0)
+	}
+	for i := 0; i < int(C.libtor_hs_list_len(ip.link_specifiers)); i++ {
+		spec := (*C.hs_desc_link_specifier_t)(C.libtor_hs_list_get(ip.link_specifiers, C.int(i)))
+
+		var (
+			addr [C.TOR_ADDR_BUF_LEN]C.char
+			port C.uint16_t
+			id   [32]byte
+		)
+		n := C.libtor_hs_link_spec(spec, &addr[0], C.size_t(len(addr)), &port, (*C.uint8_t)(unsafe.Pointer(&id[0])))
+		if n < 0 {
+			return nil, fmt.Errorf("unknown link specifier type %d", int(spec._type))
+		}
+		link := HSLinkSpecifier{Type: int(spec._type)}
+		switch link.Type {
+		case LinkSpecIPv4, LinkSpecIPv6:
+			link.Addr, link.Port = net.ParseIP(C.GoString(&addr[0])), int(port)
+		default:
+			link.ID = append([]byte(nil), id[:n]...)
+		}
+		intro.LinkSpecifiers = append(intro.LinkSpecifiers, link)
+	}
+	return intro, nil
+}
+
+// EncodeHSDescriptor signs and encrypts a descriptor of the onion service of an
+// identity keypair for a time period of a given length (see HSTimePeriod), as
+// Tor would publish it. The keys of the outer layer are derived anew, the ones
+// of the introduction points certified by a fresh signing key. Without
+// authorized clients, fake ones are listed; a zero ephemeral key is replaced by
+// a random one. Encoding descriptors for real client authorization is not
+// supported. It does not need a running Tor instance.
+func EncodeHSDescriptor(sec [64]byte, pub [32]byte, timePeriod uint64, periodLength time.Duration, desc *HSDescriptor) (string, error) {
+	param, err := hsBlindParam(pub, timePeriod, periodLength)
+	if err != nil {
+		return "", err
+	}
+	if desc.Version != 0 && desc.Version != 3 {
+		return "", fmt.Errorf("unsupported descriptor version %d", desc.Version)
+	}
+	lifetime := desc.Lifetime
+	if lifetime == 0 {
+		lifetime = HSDescriptorLifetime
+	}
+	csec, cpub := C.CBytes(sec[:]), C.CBytes(pub[:])
+	defer C.free(csec)
+	defer C.free(cpub)
+	defer C.memwipe(csec, 0, C.size_t(len(sec)))
+
+	var ephemeral unsafe.Pointer
+	if desc.AuthEphemeralKey != [32]byte{} {
+		ephemeral = C.CBytes(desc.AuthEphemeralKey[:])
+		defer C.free(ephemeral)
+	}
+	single := 0
+	if desc.SingleOnionService {
+		single = 1
+	}
+	b := C.libtor_hs_builder_new((*C.uint8_t)(csec), (*C.uint8_t)(cpub), (*C.uint8_t)(unsafe.Pointer(&param[0])),
+		C.uint64_t(desc.RevisionCounter), C.uint32_t(lifetime/time.Second), C.int(single), (*C.uint8_t)(ephemeral))
+	if b == nil {
+		return "", errors.New("failed to create descriptor")
+	}
+	defer C.libtor_hs_builder_free(b)
+
+	for _, client := range desc.AuthClients {
+		id, iv, cookie := C.CBytes(client.ID[:]), C.CBytes(client.IV[:]), C.CBytes(client.EncryptedCookie[:])
+		C.libtor_hs_builder_add_client(b, (*C.uint8_t)(id), (*C.uint8_t)(iv), (*C.uint8_t)(cookie))
+		C.free(id)
+		C.free(iv)
+		C.free(cookie)
+	}
+	C.libtor_hs_builder_add_fake_clients(b)
+
+	for i, intro := range desc.IntroPoints {
+		if err := addIntroPoint(b, intro); err != nil {
+			return "", fmt.Errorf("introduction point %d: %v", i, err)
+		}
+	}
+	var out *C.char
+	if C.libtor_hs_builder_encode(b, &out) != 0 {
+		return "", errors.New("failed to encode descriptor")
+	}
+	defer C.tor_free_(unsafe.Pointer(out))
+
+	return C.GoString(out), nil
+}
+
+// addIntroPoint adds an introduction point to a descriptor being built.
+func addIntroPoint(b *C.libtor_hs_builder_t, intro *HSIntroPoint) error {
+	if intro.Legacy {
+		return errors.New("legacy introduction point")
+	}
+	keys := C.CBytes(append(append(intro.OnionKey[:], intro.AuthKey[:]...), intro.EncKey[:]...))
+	defer C.free(keys)
+
+	ip := C.libtor_hs_builder_add_intro(b, (*C.uint8_t)(keys),
+		(*C.uint8_t)(unsafe.Pointer(uintptr(keys)+32)), (*C.uint8_t)(unsafe.Pointer(uintptr(keys)+64)))
+	if ip == nil {
+		return errors.New("failed to certify keys")
+	}
+	for _, link := range intro.LinkSpecifiers {
+		var (
+			addr *C.char
+			id   unsafe.Pointer
+		)
+		switch link.Type {
+		case LinkSpecIPv4, LinkSpecIPv6:
+			addr = C.CString(link.Addr.String())
+			defer C.free(unsafe.Pointer(addr))
+		default:
+			if len(link.ID) > 0 {
+				id = C.CBytes(link.ID)
+				defer C.free(id)
+			}
+		}
+		if C.libtor_hs_intro_add_link(ip, C.uint8_t(link.Type), addr, C.uint16_t(link.Port),
+			(*C.uint8_t)(id), C.size_t(len(link.ID))) != 0 {
+			return fmt.Errorf("invalid link specifier %+v", link)
+		}
+	}
+	return nil
+}
+
+// copyBytes copies a fixed size C byte array into a Go slice of the same size.
+func copyBytes(dst []byte, src unsafe.Pointer) {
+	copy(dst, C.GoBytes(src, C.int(len(dst))))
+}
+
+// hsBlindParam computes the parameter blinding an identity key for a time
+// period of a given length.
+func hsBlindParam(pub [32]byte, timePeriod uint64, periodLength time.Duration) ([32]byte, error) {
+	var param [32]byte
+	if periodLength < time.Minute {
+		return param, fmt.Errorf("invalid time period length %v", periodLength)
+	}
+	if err := cryptoInit(); err != nil {
+		return param, err
+	}
+	C.libtor_hs_blind_param((*C.uint8_t)(unsafe.Pointer(&pub[0])), C.uint64_t(timePeriod),
+		C.uint64_t(periodLength/time.Minute), (*C.uint8_t)(unsafe.Pointer(&param[0])))
+	return param, nil
+}
+
+// HSTimePeriod returns the number of the onion service time period a moment
+// falls in, which the blinded keys of the services are derived from. Periods of
+// the given length start at offset past the Unix epoch modulo the length; on the
+// public network they are HSPeriodLength and HSRotationOffset.
+func HSTimePeriod(now time.Time, length, offset time.Duration) uint64 {
+	minutes := now.Unix()/60 - int64(offset/time.Minute)
+	return uint64(minutes / int64(length/time.Minute))
+}
@@ -0,0 +1,83 @@
+// +build cgo
+
+package libtor
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Tests that descriptors encoded without a running Tor decode back into the
+// same introduction points, and only for their own service.
+func TestHSDescriptorRoundTrip(t *testing.T) {
+	sec, pub, err := GenerateED25519()
+	if err != nil {
+		t.Fatalf("failed to generate identity key: %v", err)
+	}
+	intro := &HSIntroPoint{
+		LinkSpecifiers: []HSLinkSpecifier{
+			{Type: LinkSpecIPv4, Addr: net.IPv4(127, 0, 0, 1), Port: 9001},
+			{Type: LinkSpecLegacyID, ID: make([]byte, 20)},
+		},
+	}
+	for i := range intro.OnionKey {
+		intro.OnionKey[i], intro.AuthKey[i], intro.EncKey[i] = byte(i), byte(i+1), byte(i+2)
+	}
+	period := HSTimePeriod(time.Now(), HSPeriodLength, HSRotationOffset)
+
+	encoded, err := EncodeHSDescriptor(sec, pub, period, HSPeriodLength, &HSDescriptor{
+		RevisionCounter: 42,
+		IntroPoints:     []*HSIntroPoint{intro},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode descriptor: %v", err)
+	}
+	desc, err := DecodeHSDescriptor(HSAddress(pub), encoded, nil)
+	if err != nil {
+		t.Fatalf("failed to decode descriptor: %v", err)
+	}
+	if desc.Version != 3 || desc.RevisionCounter != 42 || desc.Lifetime != HSDescriptorLifetime {
+		t.Errorf("outer layer mismatch: version %d, revision %d, lifetime %v", desc.Version, desc.RevisionCounter, desc.Lifetime)
+	}
+	if len(desc.AuthClients) != 16 {
+		t.Errorf("fake client count mismatch: have %d, want 16", len(desc.AuthClients))
+	}
+	if len(desc.IntroPoints) != 1 {
+		t.Fatalf("introduction point count mismatch: have %d, want 1", len(desc.IntroPoints))
+	}
+	have := desc.IntroPoints[0]
+	if have.OnionKey != intro.OnionKey || have.AuthKey != intro.AuthKey || have.EncKey != intro.EncKey {
+		t.Errorf("introduction point keys mismatch")
+	}
+	if len(have.LinkSpecifiers) != 2 || !have.LinkSpecifiers[0].Addr.Equal(net.IPv4(127, 0, 0, 1)) || have.LinkSpecifiers[0].Port != 9001 {
+		t.Errorf("link specifiers mismatch: have %+v", have.LinkSpecifiers)
+	}
+	plain, err := DecodeHSDescriptorPlaintext(encoded)
+	if err != nil {
+		t.Fatalf("failed to decode outer layer: %v", err)
+	}
+	if plain.BlindedKey != desc.BlindedKey || len(plain.IntroPoints) != 0 {
+		t.Errorf("outer layer mismatch: have %+v", plain)
+	}
+	// Descriptors must not decode for other services
+	_, other, err := GenerateED25519()
+	if err != nil {
+		t.Fatalf("failed to generate identity key: %v", err)
+	}
+	if _, err := DecodeHSDescriptor(HSAddress(other), encoded, nil); err == nil {
+		t.Errorf("decoded descriptor of another service")
+	}
+}
+
+// Tests that time periods roll over at the rotation offset.
+func TestHSTimePeriod(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2016, 4, 13, hour, 0, 0, 0, time.UTC) }
+
+	if period := HSTimePeriod(at(11), HSPeriodLength, HSRotationOffset); period != 16903 {
+		t.Errorf("time period mismatch: have %d, want 16903", period)
+	}
+	if period := HSTimePeriod(at(12), HSPeriodLength, HSRotationOffset); period != 16904 {
+		t.Errorf("time period mismatch: have %d, want 16904", period)
+	}
+}
@@ -0,0 +1,161 @@
+package libtor
+
+/*
+#include <stdlib.h>
+#include <string.h>
+
+#include "core/or/or.h"
+#include "feature/hs/hs_common.h"
+#include "lib/crypt_ops/crypto_digest.h"
+#include "lib/crypt_ops/crypto_ed25519.h"
+
+// libtor_hs_disaster_srv computes the shared random value HSDirs fall back to
+// when the consensus has none, for a time period of a given length in minutes.
+static void libtor_hs_disaster_srv(uint64_t period_num, uint64_t period_length, uint8_t *srv_out) {
+	crypto_digest_t *digest = crypto_digest256_new(DIGEST_SHA3_256);
+	char period_stuff[sizeof(uint64_t) * 2];
+
+	crypto_digest_add_bytes(digest, HS_SRV_DISASTER_PREFIX, HS_SRV_DISASTER_PREFIX_LEN);
+	set_uint64(period_stuff, tor_htonll(period_length));
+	set_uint64(period_stuff + sizeof(uint64_t), tor_htonll(period_num));
+	crypto_digest_add_bytes(digest, period_stuff, sizeof(period_stuff));
+	crypto_digest_get_digest(digest, (char *)srv_out, DIGEST256_LEN);
+	crypto_digest_free(digest);
+}
+
+// libtor_hs_index hashes an identity into an index of the hash ring, like
+// hs_build_hsdir_index and hs_build_hs_index do, but with the period length (in
+// minutes) passed in: Tor's versions read it from the global options, which only
+// exist while Tor runs. HSDirs are placed at H("node-idx" | identity | SRV |
+// INT_8(period_num) | INT_8(period_length)), the replicas of a descriptor at
+// H("store-at-idx" | blinded key | INT_8(replica) | INT_8(period_length) |
+// INT_8(period_num)).
+static void libtor_hs_index(const char *prefix, const uint8_t *key, const uint8_t *srv, uint64_t replica,
+		uint64_t period_num, uint64_t period_length, uint8_t *index_out) {
+	crypto_digest_t *digest = crypto_digest256_new(DIGEST_SHA3_256);
+	char buf[sizeof(uint64_t)];
+
+	crypto_digest_add_bytes(digest, prefix, strlen(prefix));
+	crypto_digest_add_bytes(digest, (const char *)key, ED25519_PUBKEY_LEN);
+	if (srv) {
+		crypto_digest_add_bytes(digest, (const char *)srv, DIGEST256_LEN);
+		set_uint64(buf, tor_htonll(period_num));
+		crypto_digest_add_bytes(digest, buf, sizeof(buf));
+		set_uint64(buf, tor_htonll(period_length));
+		crypto_digest_add_bytes(digest, buf, sizeof(buf));
+	} else {
+		set_uint64(buf, tor_htonll(replica));
+		crypto_digest_add_bytes(digest, buf, sizeof(buf));
+		set_uint64(buf, tor_htonll(period_length));
+		crypto_digest_add_bytes(digest, buf, sizeof(buf));
+		set_uint64(buf, tor_htonll(period_num));
+		crypto_digest_add_bytes(digest, buf, sizeof(buf));
+	}
+	crypto_digest_get_digest(digest, (char *)index_out, DIGEST256_LEN);
+	crypto_digest_free(digest);
+}
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// HSPublicKey extracts the ed25519 identity key of a v3 onion service from its
+// address (without the .onion suffix), verifying the checksum and version.
+func HSPublicKey(address string) ([32]byte, error) {
+	var (
+		pub      [32]byte
+		cpub     C.ed25519_public_key_t
+		checksum [C.DIGEST256_LEN]C.uint8_t
+		version  C.uint8_t
+	)
+	if len(address) != C.HS_SERVICE_ADDR_LEN_BASE32 {
+		return pub, fmt.Errorf("invalid onion address %q", address)
+	}
+	caddr := C.CString(address)
+	defer C.free(unsafe.Pointer(caddr))
+
+	if C.hs_parse_address(caddr, &cpub, &checksum[0], &version) < 0 || C.hs_address_is_valid(caddr) == 0 {
+		return pub, fmt.Errorf("invalid onion address %q", address)
+	}
+	for i := range pub {
+		pub[i] = byte(cpub.pubkey[i])
+	}
+	return pub, nil
+}
+
+// HSBlindedKey derives the blinded key an onion service identity publishes its
+// descriptors under during a time period of a given length.
+func HSBlindedKey(pub [32]byte, timePeriod uint64, periodLength time.Duration) ([32]byte, error) {
+	var (
+		blinded [32]byte
+		cpub    C.ed25519_public_key_t
+		cout    C.ed25519_public_key_t
+	)
+	param, err := hsBlindParam(pub, timePeriod, periodLength)
+	if err != nil {
+		return blinded, err
+	}
+	for i, b := range pub {
+		cpub.pubkey[i] = C.uint8_t(b)
+	}
+	if C.ed25519_public_blind(&cout, &cpub, (*C.uint8_t)(unsafe.Pointer(&param[0]))) < 0 {
+		return blinded, errors.New("failed to blind key")
+	}
+	for i := range blinded {
+		blinded[i] = byte(cout.pubkey[i])
+	}
+	return blinded, nil
+}
+
+// HSDirIndex computes the position of an HSDir on the hash ring of a time
+// period of a given length from its ed25519 identity and the shared random
+// value of the period.
+func HSDirIndex(identity [32]byte, srv [32]byte, timePeriod uint64, periodLength time.Duration) ([32]byte, error) {
+	return hsIndex("node-idx", identity, &srv, 0, timePeriod, periodLength)
+}
+
+// HSIndex computes the position on the hash ring a replica (1-based) of the
+// descriptor of a blinded key is stored at during a time period of a given
+// length.
+func HSIndex(replica uint64, blinded [32]byte, timePeriod uint64, periodLength time.Duration) ([32]byte, error) {
+	return hsIndex("store-at-idx", blinded, nil, replica, timePeriod, periodLength)
+}
+
+// hsIndex computes an index of the hash ring, see libtor_hs_index.
+func hsIndex(prefix string, key [32]byte, srv *[32]byte, replica uint64, timePeriod uint64, periodLength time.Duration) ([32]byte, error) {
+	var index [32]byte
+	if periodLength < time.Minute {
+		return index, fmt.Errorf("invalid time period length %v", periodLength)
+	}
+	if err := cryptoInit(); err != nil {
+		return index, err
+	}
+	cprefix := C.CString(prefix)
+	defer C.free(unsafe.Pointer(cprefix))
+
+	var csrv *C.uint8_t
+	if srv != nil {
+		csrv = (*C.uint8_t)(unsafe.Pointer(&srv[0]))
+	}
+	C.libtor_hs_index(cprefix, (*C.uint8_t)(unsafe.Pointer(&key[0])), csrv, C.uint64_t(replica),
+		C.uint64_t(timePeriod), C.uint64_t(periodLength/time.Minute), (*C.uint8_t)(unsafe.Pointer(&index[0])))
+	return index, nil
+}
+
+// HSDisasterSRV computes the shared random value standing in for a missing one
+// of the consensus, for a time period of a given length.
+func HSDisasterSRV(timePeriod uint64, periodLength time.Duration) ([32]byte, error) {
+	var srv [32]byte
+	if periodLength < time.Minute {
+		return srv, fmt.Errorf("invalid time period length %v", periodLength)
+	}
+	if err := cryptoInit(); err != nil {
+		return srv, err
+	}
+	C.libtor_hs_disaster_srv(C.uint64_t(timePeriod), C.uint64_t(periodLength/time.Minute), (*C.uint8_t)(unsafe.Pointer(&srv[0])))
+	return srv, nil
+}
@@ -0,0 +1,94 @@
+// +build cgo
+
+package libtor
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that onion addresses decode back into their keys.
+func TestHSPublicKey(t *testing.T) {
+	_, pub, err := GenerateED25519()
+	if err != nil {
+		t.Fatalf("failed to generate identity key: %v", err)
+	}
+	have, err := HSPublicKey(HSAddress(pub))
+	if err != nil {
+		t.Fatalf("failed to parse address: %v", err)
+	}
+	if have != pub {
+		t.Errorf("public key mismatch: have %x, want %x", have, pub)
+	}
+	if _, err := HSPublicKey("invalid"); err == nil {
+		t.Errorf("parsed an invalid address")
+	}
+}
+
+// Tests that keys are blinded the way descriptors are signed, for any period
+// length, without a running Tor.
+func TestHSBlindedKey(t *testing.T) {
+	sec, pub, err := GenerateED25519()
+	if err != nil {
+		t.Fatalf("failed to generate identity key: %v", err)
+	}
+	for _, length := range []time.Duration{HSPeriodLength, 8 * time.Minute} {
+		period := HSTimePeriod(time.Now(), length, HSRotationOffset)
+
+		encoded, err := EncodeHSDescriptor(sec, pub, period, length, &HSDescriptor{})
+		if err != nil {
+			t.Fatalf("length %v: failed to encode descriptor: %v", length, err)
+		}
+		desc, err := DecodeHSDescriptorPlaintext(encoded)
+		if err != nil {
+			t.Fatalf("length %v: failed to decode descriptor: %v", length, err)
+		}
+		blinded, err := HSBlindedKey(pub, period, length)
+		if err != nil {
+			t.Fatalf("length %v: failed to blind key: %v", length, err)
+		}
+		if blinded != desc.BlindedKey {
+			t.Errorf("length %v: blinded key mismatch: have %x, want %x", length, blinded, desc.BlindedKey)
+		}
+	}
+	if _, err := HSBlindedKey(pub, 1, time.Second); err == nil {
+		t.Errorf("blinded key with an invalid period length")
+	}
+}
+
+// Tests that ring indices depend on all their inputs.
+func TestHSIndices(t *testing.T) {
+	var key, srv [32]byte
+	key[0], srv[0] = 1, 2
+
+	base, err := HSDirIndex(key, srv, 1, HSPeriodLength)
+	if err != nil {
+		t.Fatalf("failed to compute HSDir index: %v", err)
+	}
+	for i, index := range []func() ([32]byte, error){
+		func() ([32]byte, error) { return HSDirIndex(srv, srv, 1, HSPeriodLength) },
+		func() ([32]byte, error) { return HSDirIndex(key, key, 1, HSPeriodLength) },
+		func() ([32]byte, error) { return HSDirIndex(key, srv, 2, HSPeriodLength) },
+		func() ([32]byte, error) { return HSDirIndex(key, srv, 1, time.Hour) },
+		func() ([32]byte, error) { return HSIndex(1, key, 1, HSPeriodLength) },
+	} {
+		have, err := index()
+		if err != nil {
+			t.Fatalf("index %d: failed to compute: %v", i, err)
+		}
+		if have == base {
+			t.Errorf("index %d: collides with the base index", i)
+		}
+	}
+	first, err := HSIndex(1, key, 1, HSPeriodLength)
+	if err != nil {
+		t.Fatalf("failed to compute replica index: %v", err)
+	}
+	second, err := HSIndex(2, key, 1, HSPeriodLength)
+	if err != nil {
+		t.Fatalf("failed to compute replica index: %v", err)
+	}
+	if first == second {
+		t.Errorf("replicas share an index")
+	}
+}
@@ -0,0 +1,48 @@
+package libtor
+
+/*
+#include <stddef.h>
+
+size_t cell_queues_get_total_allocation(void);
+size_t half_streams_get_total_allocation(void);
+size_t buf_get_total_allocation(void);
+size_t tor_compress_get_total_allocation(void);
+size_t rend_cache_get_total_allocation(void);
+size_t geoip_client_cache_total_allocation(void);
+size_t dns_cache_total_allocation(void);
+*/
+import "C"
+
+// MemoryStats is a snapshot of the allocations Tor accounts for in its OOM
+// handler, which are the ones capped by MaxMemInQueues.
+type MemoryStats struct {
+	CellQueues  uint64 // Cells queued on circuits
+	HalfStreams uint64 // Half-closed streams awaiting their final cells
+	Buffers     uint64 // Connection input and output buffers
+	Compression uint64 // Compression and decompression state
+	HSCache     uint64 // Onion service descriptor caches (v2 and v3)
+	GeoIPCache  uint64 // Client GeoIP cache (relays and bridges only)
+	DNSCache    uint64 // Exit DNS cache (exit relays only)
+}
+
+// Total returns the sum of all the accounted allocations, the figure Tor weighs
+// against MaxMemInQueues.
+func (s *MemoryStats) Total() uint64 {
+	return s.CellQueues + s.HalfStreams + s.Buffers + s.Compression + s.HSCache + s.GeoIPCache + s.DNSCache
+}
+
+// ReadMemoryStats collects the allocation counters of the Tor instance running
+// in this process. The counters are maintained by Tor's main loop and read here
+// without synchronization, which is fine for word sized values, but means the
+// snapshot is not atomic as a whole.
+func ReadMemoryStats() *MemoryStats {
+	return &MemoryStats{
+		CellQueues:  uint64(C.cell_queues_get_total_allocation()),
+		HalfStreams: uint64(C.half_streams_get_total_allocation()),
+		Buffers:     uint64(C.buf_get_total_allocation()),
+		Compression: uint64(C.tor_compress_get_total_allocation()),
+		HSCache:     uint64(C.rend_cache_get_total_allocation()),
+		GeoIPCache:  uint64(C.geoip_client_cache_total_allocation()),
+		DNSCache:    uint64(C.dns_cache_total_allocation()),
+	}
+}
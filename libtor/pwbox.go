@@ -0,0 +1,67 @@
+package libtor
+
+/*
+#include <stdlib.h>
+#include <stdint.h>
+
+#include "lib/crypt_ops/crypto_pwbox.h"
+#include "lib/malloc/malloc.h"
+*/
+import "C"
+import (
+	"errors"
+	"unsafe"
+)
+
+// ErrBadPassphrase is returned by Unpwbox if the passphrase does not match the
+// one the data was sealed with.
+var ErrBadPassphrase = errors.New("bad passphrase")
+
+// Pwbox encrypts and authenticates data with a key derived from passphrase via
+// scrypt, using Tor's own pwbox format (the one of encrypted ed25519 keys).
+func Pwbox(data []byte, passphrase []byte) ([]byte, error) {
+	if err := cryptoInit(); err != nil {
+		return nil, err
+	}
+	var (
+		out    *C.uint8_t
+		outlen C.size_t
+	)
+	cdata, cpass := C.CBytes(data), C.CBytes(passphrase)
+	defer C.free(cdata)
+	defer C.free(cpass)
+
+	if C.crypto_pwbox(&out, &outlen, (*C.uint8_t)(cdata), C.size_t(len(data)),
+		(*C.char)(cpass), C.size_t(len(passphrase)), 0) != 0 {
+		return nil, errors.New("failed to seal pwbox")
+	}
+	defer C.tor_free_(unsafe.Pointer(out))
+
+	return C.GoBytes(unsafe.Pointer(out), C.int(outlen)), nil
+}
+
+// Unpwbox decrypts and verifies data sealed by Pwbox (or by Tor itself).
+func Unpwbox(box []byte, passphrase []byte) ([]byte, error) {
+	if err := cryptoInit(); err != nil {
+		return nil, err
+	}
+	var (
+		out    *C.uint8_t
+		outlen C.size_t
+	)
+	cbox, cpass := C.CBytes(box), C.CBytes(passphrase)
+	defer C.free(cbox)
+	defer C.free(cpass)
+
+	switch C.crypto_unpwbox(&out, &outlen, (*C.uint8_t)(cbox), C.size_t(len(box)),
+		(*C.char)(cpass), C.size_t(len(passphrase))) {
+	case C.UNPWBOX_OKAY:
+	case C.UNPWBOX_BAD_SECRET:
+		return nil, ErrBadPassphrase
+	default:
+		return nil, errors.New("corrupted pwbox")
+	}
+	defer C.tor_free_(unsafe.Pointer(out))
+
+	return C.GoBytes(unsafe.Pointer(out), C.int(outlen)), nil
+}
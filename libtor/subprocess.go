@@ -0,0 +1,228 @@
+package libtor
+
+// This file runs the embedded Tor in a child process re-executing the current
+// binary, isolating the Go program from any crash within Tor.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/cretz/bine/process"
+)
+
+// subprocessEnv is the environment variable turning a re-executed binary into a
+// Tor subprocess. Its value tells whether an owning controller socket has been
+// passed on after the bug report pipe.
+const subprocessEnv = "LIBTOR_SUBPROCESS"
+
+// Values of subprocessEnv, signalling whether a controller socket is inherited.
+const (
+	subprocessBare    = "bare"
+	subprocessControl = "control"
+)
+
+// File descriptors inherited by the subprocess after stdin, stdout and stderr.
+const (
+	subprocessBugsFd    = 3 // Pipe to stream the bugs hit by Tor to the parent
+	subprocessControlFd = 4 // Owning controller socket, if requested
+)
+
+// init hijacks the binary if it was started as a Tor subprocess, running the
+// embedded Tor with the command line arguments instead of the program's own
+// main function.
+func init() {
+	mode := os.Getenv(subprocessEnv)
+	if mode != subprocessBare && mode != subprocessControl {
+		return
+	}
+	if err := runSubprocess(mode == subprocessControl, os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Tor subprocess failed: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// runSubprocess is the entrypoint of a Tor subprocess, starting the in-process
+// Tor and relaying the inherited controller socket to its owning control one.
+func runSubprocess(control bool, args []string) error {
+	// Forward any bug hit by Tor to the parent, which reports it to its own
+	// handler. The write is synchronous, so it lands before a fatal abort.
+	bugs := json.NewEncoder(os.NewFile(subprocessBugsFd, "bugs"))
+	HandleBugs(func(bug *Bug) {
+		bugs.Encode(bug)
+	})
+	proc, err := Creator.New(context.Background(), args...)
+	if err != nil {
+		return err
+	}
+	if control {
+		parent, err := net.FileConn(os.NewFile(subprocessControlFd, "control"))
+		if err != nil {
+			return fmt.Errorf("unable to open inherited control socket: %v", err)
+		}
+		owner, err := proc.EmbeddedControlConn()
+		if err != nil {
+			return err
+		}
+		// Tor shuts down when its owning controller goes away, so closing the
+		// relayed connection when the parent hangs up (or dies) is enough to
+		// not leave orphans behind.
+		go func() {
+			io.Copy(owner, parent)
+			owner.Close()
+		}()
+		go func() {
+			io.Copy(parent, owner)
+			parent.Close()
+		}()
+	}
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	return proc.Wait()
+}
+
+// SubprocessCreator implements the bine.process.Creator, running the embedded
+// Tor in a child process built from the current binary instead of within the
+// calling one. It's a drop-in replacement for Creator, trading a bit of startup
+// time for surviving crashes and assertion failures inside Tor.
+var SubprocessCreator process.Creator = new(subprocessCreator)
+
+// subprocessCreator implements process.Creator, launching Tor subprocesses.
+type subprocessCreator struct{}
+
+// New implements process.Creator, creating a new Tor subprocess.
+func (subprocessCreator) New(ctx context.Context, args ...string) (process.Process, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate executable: %v", err)
+	}
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+
+	return &subprocessProcess{
+		ctx: ctx,
+		cmd: cmd,
+	}, nil
+}
+
+// subprocessProcess implements process.Process, driving a Tor subprocess.
+type subprocessProcess struct {
+	ctx     context.Context
+	cmd     *exec.Cmd
+	control *os.File // Child end of the owning controller socket, if requested
+
+	done chan struct{} // Closed when the subprocess terminates
+	err  error         // Exit status of the subprocess
+}
+
+// Start implements process.Process, launching the Tor subprocess.
+func (s *subprocessProcess) Start() error {
+	if s.done != nil {
+		return errors.New("already started")
+	}
+	bugs, bugsSink, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create bug report pipe: %v", err)
+	}
+	mode := subprocessBare
+	s.cmd.ExtraFiles = []*os.File{bugsSink}
+	if s.control != nil {
+		mode = subprocessControl
+		s.cmd.ExtraFiles = append(s.cmd.ExtraFiles, s.control)
+	}
+	s.cmd.Env = append(os.Environ(), subprocessEnv+"="+mode)
+
+	err = s.cmd.Start()
+
+	// The child holds its own copies by now, drop ours so the pipe and socket
+	// close with the subprocess
+	bugsSink.Close()
+	if s.control != nil {
+		s.control.Close()
+		s.control = nil
+	}
+	if err != nil {
+		bugs.Close()
+		return fmt.Errorf("failed to start tor subprocess: %v", err)
+	}
+	go relayBugs(bugs)
+
+	s.done = make(chan struct{})
+	go func() {
+		s.err = s.cmd.Wait()
+		close(s.done)
+	}()
+	return nil
+}
+
+// Wait implements process.Process, blocking until the subprocess terminates.
+func (s *subprocessProcess) Wait() error {
+	if s.done == nil {
+		return errors.New("not started")
+	}
+	select {
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+
+	case <-s.done:
+		if s.err != nil {
+			return fmt.Errorf("tor subprocess failed: %v", s.err)
+		}
+		return nil
+	}
+}
+
+// relayBugs reports the bugs streamed by a subprocess to the handler registered
+// in this process, until the subprocess terminates.
+func relayBugs(pipe *os.File) {
+	defer pipe.Close()
+
+	dec := json.NewDecoder(pipe)
+	for {
+		bug := new(Bug)
+		if err := dec.Decode(bug); err != nil {
+			return
+		}
+		reportBug(bug)
+	}
+}
+
+// EmbeddedControlConn implements process.Process, creating the socket pair the
+// subprocess will relay to the owning control connection of its Tor instance.
+// It must be called before Start.
+func (s *subprocessProcess) EmbeddedControlConn() (net.Conn, error) {
+	if s.done != nil {
+		return nil, errors.New("already started")
+	}
+	if s.control != nil {
+		return nil, errors.New("control connection already created")
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create control socket: %v", err)
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+
+	local := os.NewFile(uintptr(fds[0]), "control")
+	defer local.Close()
+
+	conn, err := net.FileConn(local)
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, fmt.Errorf("unable to create control socket: %v", err)
+	}
+	s.control = os.NewFile(uintptr(fds[1]), "control")
+	return conn, nil
+}
@@ -0,0 +1,219 @@
+// Package lifecycle puts an embedded Tor instance to sleep and wakes it up as
+// a mobile app moves between background and foreground, and recovers it from
+// device network changes.
+package lifecycle
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/internal/torversion"
+)
+
+// ErrStreamsOpen is returned when putting Tor to sleep while it's still serving
+// streams, unless forced.
+var ErrStreamsOpen = errors.New("streams still open")
+
+// ErrDormantUnsupported is returned when the running Tor has no dormant mode,
+// which was introduced in 0.4.0.
+var ErrDormantUnsupported = errors.New("dormant mode not supported")
+
+// Controller drives the network state of a Tor instance through its control
+// connection.
+type Controller struct {
+	conn *control.Conn
+
+	dormantOK *bool // Whether Tor supports dormant mode, nil until detected
+
+	asleep          bool // Whether Tor was put to sleep
+	sleptDormant    bool // Whether sleeping went dormant (or disabled the network)
+	networkDisabled bool // Whether the network was explicitly disabled
+	networkChanged  bool // Whether the network changed while asleep
+
+	lock sync.Mutex
+}
+
+// New creates a lifecycle controller for the Tor instance behind an
+// authenticated control connection.
+func New(conn *control.Conn) *Controller {
+	return &Controller{conn: conn}
+}
+
+// SetNetworkEnabled toggles DisableNetwork. Disabling the network closes every
+// connection and stops Tor from making new ones until enabled again.
+func (c *Controller) SetNetworkEnabled(enabled bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.setDisableNetwork(!enabled); err != nil {
+		return err
+	}
+	c.networkDisabled = !enabled
+	return nil
+}
+
+// SetDormant signals Tor to enter or leave dormant mode, in which it idles its
+// connections and stops building circuits, without tearing anything down.
+func (c *Controller) SetDormant(dormant bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.signalDormant(dormant)
+}
+
+// Sleep puts Tor to sleep, e.g. when the app is backgrounded. Dormant mode is
+// used where supported, otherwise the network is disabled. If Tor is still
+// serving streams, ErrStreamsOpen is returned unless the sleep is forced, in
+// which case the streams may stall or be closed.
+func (c *Controller) Sleep(force bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.asleep {
+		return nil
+	}
+	if !force {
+		open, err := c.openStreams()
+		if err != nil {
+			return err
+		}
+		if open > 0 {
+			return ErrStreamsOpen
+		}
+	}
+	switch err := c.signalDormant(true); err {
+	case nil:
+		c.sleptDormant = true
+
+	case ErrDormantUnsupported:
+		if err := c.setDisableNetwork(true); err != nil {
+			return err
+		}
+		c.sleptDormant = false
+
+	default:
+		return err
+	}
+	c.asleep = true
+	return nil
+}
+
+// Wake undoes Sleep, e.g. when the app is foregrounded. If the network changed
+// in the meantime, Tor is also reset onto the new one.
+func (c *Controller) Wake() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.asleep {
+		return nil
+	}
+	if c.sleptDormant {
+		if err := c.signalDormant(false); err != nil {
+			return err
+		}
+	} else if !c.networkDisabled {
+		if err := c.setDisableNetwork(false); err != nil {
+			return err
+		}
+		// Re-enabling the network builds everything anew already
+		c.networkChanged = false
+	}
+	c.asleep = false
+
+	if c.networkChanged {
+		c.networkChanged = false
+		return c.reset()
+	}
+	return nil
+}
+
+// NetworkChanged notifies Tor that the device switched networks (e.g. from
+// Wi-Fi to cellular), so its connections are probably dead. All connections
+// are dropped and new circuits are built for new streams. Streams still open
+// are torn down, as they can't survive the change anyway. While asleep, the
+// reset is deferred until woken up.
+func (c *Controller) NetworkChanged() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.asleep {
+		c.networkChanged = true
+		return nil
+	}
+	return c.reset()
+}
+
+// reset drops all the OR connections of Tor by cycling DisableNetwork, and asks
+// for fresh circuits. The lock must be held.
+func (c *Controller) reset() error {
+	if !c.networkDisabled {
+		if err := c.setDisableNetwork(true); err != nil {
+			return err
+		}
+		if err := c.setDisableNetwork(false); err != nil {
+			return err
+		}
+	}
+	return c.conn.Signal("NEWNYM")
+}
+
+// setDisableNetwork sets the DisableNetwork option of Tor.
+func (c *Controller) setDisableNetwork(disable bool) error {
+	value := "0"
+	if disable {
+		value = "1"
+	}
+	return c.conn.SetConf(control.KeyVals("DisableNetwork", value)...)
+}
+
+// signalDormant sends the DORMANT or ACTIVE signal if Tor supports them. The
+// lock must be held.
+func (c *Controller) signalDormant(dormant bool) error {
+	if c.dormantOK == nil {
+		ok, err := c.supportsDormant()
+		if err != nil {
+			return err
+		}
+		c.dormantOK = &ok
+	}
+	if !*c.dormantOK {
+		return ErrDormantUnsupported
+	}
+	if dormant {
+		return c.conn.Signal("DORMANT")
+	}
+	return c.conn.Signal("ACTIVE")
+}
+
+// supportsDormant checks whether the Tor version is at least 0.4.0.
+func (c *Controller) supportsDormant() (bool, error) {
+	version, err := torversion.Query(c.conn)
+	if err != nil {
+		return false, err
+	}
+	return torversion.AtLeast(version, 0, 4, 0), nil
+}
+
+// openStreams counts the streams Tor is currently serving.
+func (c *Controller) openStreams() (int, error) {
+	infos, err := c.conn.GetInfo("stream-status")
+	if err != nil {
+		return 0, err
+	}
+	var open int
+	for _, info := range infos {
+		for _, line := range strings.Split(info.Val, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			if fields[1] != "CLOSED" && fields[1] != "FAILED" {
+				open++
+			}
+		}
+	}
+	return open, nil
+}
@@ -0,0 +1,186 @@
+package lifecycle
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// newTestController starts a fake control port reporting the given Tor version,
+// accepting all option changes and signals.
+func newTestController(t *testing.T, version string) (*Controller, *controltest.Server, *control.Conn) {
+	server := controltest.NewServer()
+	server.SetInfo("version", version)
+	server.SetInfo("stream-status", "")
+	server.Handle("SETCONF", func(args string) ([]string, error) { return nil, nil })
+	server.Handle("SIGNAL", func(args string) ([]string, error) { return nil, nil })
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	return New(conn), server, conn
+}
+
+// changes returns the option changes and signals sent to the fake control port.
+func changes(server *controltest.Server) []string {
+	var cmds []string
+	for _, cmd := range server.History() {
+		if strings.HasPrefix(cmd, "SETCONF") || strings.HasPrefix(cmd, "SIGNAL") {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+// checkChanges verifies the option changes and signals sent so far.
+func checkChanges(t *testing.T, server *controltest.Server, want ...string) {
+	t.Helper()
+	if have := changes(server); strings.Join(have, "\n") != strings.Join(want, "\n") {
+		t.Errorf("command mismatch:\nhave:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// Tests that sleeping falls back to disabling the network on Tor versions
+// without dormant mode.
+func TestSleepDisableNetwork(t *testing.T) {
+	c, server, conn := newTestController(t, "0.3.5.14-dev (git-1693b6151e1369ce)")
+	defer conn.Close()
+
+	if err := c.SetDormant(true); err != ErrDormantUnsupported {
+		t.Fatalf("dormant error mismatch: have %v, want %v", err, ErrDormantUnsupported)
+	}
+	if err := c.Sleep(false); err != nil {
+		t.Fatalf("failed to sleep: %v", err)
+	}
+	if err := c.Sleep(false); err != nil {
+		t.Fatalf("failed to sleep again: %v", err)
+	}
+	if err := c.Wake(); err != nil {
+		t.Fatalf("failed to wake: %v", err)
+	}
+	checkChanges(t, server,
+		"SETCONF DisableNetwork=1",
+		"SETCONF DisableNetwork=0",
+	)
+}
+
+// Tests that sleeping uses dormant mode where supported.
+func TestSleepDormant(t *testing.T) {
+	c, server, conn := newTestController(t, "0.4.5.10")
+	defer conn.Close()
+
+	if err := c.Sleep(false); err != nil {
+		t.Fatalf("failed to sleep: %v", err)
+	}
+	if err := c.Wake(); err != nil {
+		t.Fatalf("failed to wake: %v", err)
+	}
+	if err := c.Wake(); err != nil {
+		t.Fatalf("failed to wake again: %v", err)
+	}
+	checkChanges(t, server,
+		"SIGNAL DORMANT",
+		"SIGNAL ACTIVE",
+	)
+}
+
+// Tests that Tor is not put to sleep while serving streams, unless forced.
+func TestSleepWithOpenStreams(t *testing.T) {
+	c, server, conn := newTestController(t, "0.4.5.10")
+	defer conn.Close()
+	server.SetInfo("stream-status", strings.Join([]string{
+		"1 SUCCEEDED 5 example.onion:80",
+		"2 CLOSED 5 example.onion:80",
+	}, "\n"))
+
+	if err := c.Sleep(false); err != ErrStreamsOpen {
+		t.Fatalf("sleep error mismatch: have %v, want %v", err, ErrStreamsOpen)
+	}
+	checkChanges(t, server)
+
+	// Once the streams are done, sleeping should succeed
+	server.SetInfo("stream-status", "2 CLOSED 5 example.onion:80")
+	if err := c.Sleep(false); err != nil {
+		t.Fatalf("failed to sleep: %v", err)
+	}
+	checkChanges(t, server, "SIGNAL DORMANT")
+
+	// Forcing should ignore any open streams
+	c, server, conn = newTestController(t, "0.4.5.10")
+	defer conn.Close()
+	server.SetInfo("stream-status", "1 SUCCEEDED 5 example.onion:80")
+	if err := c.Sleep(true); err != nil {
+		t.Fatalf("failed to force sleep: %v", err)
+	}
+	checkChanges(t, server, "SIGNAL DORMANT")
+}
+
+// Tests that network changes reset Tor's connections and circuits, even while
+// streams are open, and that they are deferred while asleep.
+func TestNetworkChanged(t *testing.T) {
+	c, server, conn := newTestController(t, "0.4.5.10")
+	defer conn.Close()
+	server.SetInfo("stream-status", "1 SUCCEEDED 5 example.onion:80")
+
+	if err := c.NetworkChanged(); err != nil {
+		t.Fatalf("failed to handle network change: %v", err)
+	}
+	checkChanges(t, server,
+		"SETCONF DisableNetwork=1",
+		"SETCONF DisableNetwork=0",
+		"SIGNAL NEWNYM",
+	)
+	// Changes during a dormant sleep should be applied on wake
+	if err := c.Sleep(true); err != nil {
+		t.Fatalf("failed to sleep: %v", err)
+	}
+	if err := c.NetworkChanged(); err != nil {
+		t.Fatalf("failed to handle network change: %v", err)
+	}
+	if err := c.Wake(); err != nil {
+		t.Fatalf("failed to wake: %v", err)
+	}
+	checkChanges(t, server,
+		"SETCONF DisableNetwork=1",
+		"SETCONF DisableNetwork=0",
+		"SIGNAL NEWNYM",
+		"SIGNAL DORMANT",
+		"SIGNAL ACTIVE",
+		"SETCONF DisableNetwork=1",
+		"SETCONF DisableNetwork=0",
+		"SIGNAL NEWNYM",
+	)
+}
+
+// Tests that network changes don't enable an explicitly disabled network, and
+// that waking from a network disabling sleep needs no further reset.
+func TestNetworkChangedDisabled(t *testing.T) {
+	c, server, conn := newTestController(t, "0.3.5.14-dev")
+	defer conn.Close()
+
+	if err := c.Sleep(false); err != nil {
+		t.Fatalf("failed to sleep: %v", err)
+	}
+	if err := c.NetworkChanged(); err != nil {
+		t.Fatalf("failed to handle network change: %v", err)
+	}
+	if err := c.Wake(); err != nil {
+		t.Fatalf("failed to wake: %v", err)
+	}
+	if err := c.SetNetworkEnabled(false); err != nil {
+		t.Fatalf("failed to disable network: %v", err)
+	}
+	if err := c.NetworkChanged(); err != nil {
+		t.Fatalf("failed to handle network change: %v", err)
+	}
+	checkChanges(t, server,
+		"SETCONF DisableNetwork=1",
+		"SETCONF DisableNetwork=0",
+		"SETCONF DisableNetwork=1",
+		"SIGNAL NEWNYM",
+	)
+}
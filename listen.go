@@ -0,0 +1,443 @@
+package libtor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/torutil/ed25519"
+
+	"berty.tech/go-libtor/health"
+)
+
+// ListenConf is the configuration for an onion service created via Listen.
+type ListenConf struct {
+	// Control is the authenticated controller connection of the Tor instance to
+	// host the onion service on (e.g. Tor.Control).
+	Control *control.Conn
+
+	// Key is the v3 onion service private key. If nil, it is loaded from the
+	// KeyStore, or a new one is generated.
+	Key *control.ED25519Key
+
+	// KeyStore, if set, persists the service key under KeyName. A missing key is
+	// generated and stored before the service is created, rotations replace it.
+	KeyStore KeyStore
+	KeyName  string
+
+	// RemotePorts are the virtual ports the onion service is reachable on. If
+	// empty, port 80 is used.
+	RemotePorts []int
+
+	// SocketDir is the directory to create the Unix socket Tor delivers streams
+	// to. If empty, a private temporary directory is used.
+	SocketDir string
+
+	// MaxStreams is the maximum number of streams permitted per rendezvous
+	// circuit, zero meaning unlimited.
+	MaxStreams int
+
+	// MaxStreamsCloseCircuit tears down the circuit if MaxStreams is exceeded
+	// instead of just rejecting the stream. Limits ADD_ONION can't set, like the
+	// number of introduction points, require an OnionServiceConf instead.
+	MaxStreamsCloseCircuit bool
+
+	// ClientAuths are the authorized clients, passed verbatim to ADD_ONION. Note,
+	// the embedded Tor (0.3.5) rejects client authorization for v3 services.
+	ClientAuths map[string]string
+
+	// Detach keeps the service alive after the controller connection closes. It
+	// can still be removed via Close.
+	Detach bool
+
+	// DiscardKey asks Tor not to return a newly generated private key.
+	DiscardKey bool
+
+	// NoWait returns as soon as the service is created, without waiting for its
+	// descriptor to be published. Waiting requires the network to be enabled.
+	NoWait bool
+
+	// OnRotate, if set, is called after Rotate moved the service to a new address.
+	OnRotate func(oldID, newID string)
+
+	// OnRetire, if set, is called after a previous address of a rotated service
+	// was taken down.
+	OnRetire func(id string)
+}
+
+// OnionListener is a net.Listener accepting inbound connections of a v3 onion
+// service hosted by the embedded Tor instance.
+type OnionListener struct {
+	Key         *control.ED25519Key // Private key of the service (nil if discarded)
+	ClientAuths map[string]string   // Client authorization settings of the service
+	RemotePorts []int               // Virtual ports the service is reachable on
+
+	conf     ListenConf // Configuration of the service, reused on rotation
+	conn     *control.Conn
+	listener net.Listener
+	sockPath string // Unix socket Tor delivers the streams to
+	sockDir  string // Temporary socket directory to remove on close
+
+	lock     sync.Mutex
+	id       string                 // Onion service ID, updated by Rotate
+	retiring map[string]*time.Timer // Rotated out services, pending removal
+	closed   bool                   // Whether Close was called, blocking rotations
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Listen creates an ephemeral v3 onion service via ADD_ONION and returns a
+// listener for its inbound connections. Streams are delivered over a Unix
+// socket, so no local TCP port is opened.
+func Listen(ctx context.Context, conf *ListenConf) (*OnionListener, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if conf == nil || conf.Control == nil {
+		return nil, errors.New("no controller connection")
+	}
+	l := &OnionListener{
+		RemotePorts: conf.RemotePorts,
+		conf:        *conf,
+		conn:        conf.Control,
+		retiring:    make(map[string]*time.Timer),
+	}
+	if len(l.RemotePorts) == 0 {
+		l.RemotePorts = []int{80}
+	}
+	// Load or create the persistent service key if a store is configured
+	key := conf.Key
+	if key == nil && conf.KeyStore != nil {
+		if conf.KeyName == "" {
+			return nil, errors.New("no key name for key store")
+		}
+		var err error
+		if key, err = conf.KeyStore.LoadKey(conf.KeyName); err == ErrKeyNotFound {
+			if key, err = generateKey(); err == nil {
+				err = conf.KeyStore.StoreKey(conf.KeyName, key)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load onion service key: %v", err)
+		}
+	}
+	// Create the Unix socket for Tor to connect to
+	dir := conf.SocketDir
+	if dir == "" {
+		tmp, err := ioutil.TempDir("", "libtor-onion")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create socket directory: %v", err)
+		}
+		dir, l.sockDir = tmp, tmp
+	}
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		l.cleanup()
+		return nil, fmt.Errorf("failed to generate socket name: %v", err)
+	}
+	l.sockPath = filepath.Join(dir, "onion-"+hex.EncodeToString(nonce[:])+".sock")
+
+	listener, err := net.Listen("unix", l.sockPath)
+	if err != nil {
+		l.cleanup()
+		return nil, fmt.Errorf("failed to create onion socket: %v", err)
+	}
+	l.listener = listener
+
+	// Create the onion service and wait for it to be published if requested
+	resp, err := l.addOnion(key)
+	if err != nil {
+		l.cleanup()
+		return nil, err
+	}
+	l.id, l.Key, l.ClientAuths = resp.ServiceID, key, resp.ClientAuths
+	if key, ok := resp.Key.(*control.ED25519Key); ok {
+		l.Key = key
+	}
+	if !conf.NoWait {
+		if err := l.waitPublished(ctx, l.id); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// generateKey creates a new random v3 onion service key.
+func generateKey() (*control.ED25519Key, error) {
+	pair, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	return &control.ED25519Key{KeyPair: pair}, nil
+}
+
+// addOnion issues the ADD_ONION request for a service delivering its streams to
+// the listener's socket. If key is nil, Tor generates a new one.
+func (l *OnionListener) addOnion(key *control.ED25519Key) (*control.AddOnionResponse, error) {
+	req := &control.AddOnionRequest{
+		Key:         control.GenKey(control.KeyAlgoED25519V3),
+		MaxStreams:  l.conf.MaxStreams,
+		ClientAuths: l.conf.ClientAuths,
+	}
+	if key != nil {
+		req.Key = key
+	}
+	if l.conf.Detach {
+		req.Flags = append(req.Flags, "Detach")
+	}
+	if l.conf.DiscardKey {
+		req.Flags = append(req.Flags, "DiscardPK")
+	}
+	if l.conf.MaxStreamsCloseCircuit {
+		req.Flags = append(req.Flags, "MaxStreamsCloseCircuit")
+	}
+	if len(l.conf.ClientAuths) > 0 {
+		req.Flags = append(req.Flags, "BasicAuth")
+	}
+	for _, port := range l.RemotePorts {
+		req.Ports = append(req.Ports, control.NewKeyVal(strconv.Itoa(port), "unix:"+l.sockPath))
+	}
+	resp, err := l.conn.AddOnion(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create onion service: %v", err)
+	}
+	return resp, nil
+}
+
+// waitPublished blocks until at least one HSDir accepted the descriptor of the
+// service, or all the upload attempts failed.
+func (l *OnionListener) waitPublished(ctx context.Context, id string) error {
+	var (
+		attempts int
+		failures []string
+	)
+	_, err := l.conn.EventWait(ctx, []control.EventCode{control.EventCodeHSDesc}, func(event control.Event) (bool, error) {
+		hs, ok := event.(*control.HSDescEvent)
+		if !ok || hs.Address != id {
+			return false, nil
+		}
+		switch hs.Action {
+		case "UPLOAD":
+			attempts++
+		case "UPLOADED":
+			return true, nil
+		case "FAILED":
+			failures = append(failures, fmt.Sprintf("%s: %s", hs.HSDir, hs.Reason))
+			if len(failures) == attempts {
+				return false, fmt.Errorf("failed to publish onion service: %v", failures)
+			}
+		}
+		return false, nil
+	})
+	return err
+}
+
+// Rotate moves the service to a freshly generated key and address, replacing
+// the stored key if a KeyStore is configured. The previous address keeps being
+// served alongside the new one for the overlap period, after which it is taken
+// down. Note, retiring addresses are not persisted: they vanish early if the
+// listener is closed before the overlap ends.
+func (l *OnionListener) Rotate(ctx context.Context, overlap time.Duration) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	key, err := generateKey()
+	if err != nil {
+		return err
+	}
+	resp, err := l.addOnion(key)
+	if err != nil {
+		return err
+	}
+	if !l.conf.NoWait {
+		if err := l.waitPublished(ctx, resp.ServiceID); err != nil {
+			l.conn.DelOnion(resp.ServiceID)
+			return err
+		}
+	}
+	// Swap the active service over and schedule the retirement of the old one,
+	// unless the listener was closed meanwhile and missed the new service
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		l.conn.DelOnion(resp.ServiceID)
+		return errors.New("listener closed")
+	}
+	if l.conf.KeyStore != nil {
+		if err := l.conf.KeyStore.StoreKey(l.conf.KeyName, key); err != nil {
+			l.lock.Unlock()
+			l.conn.DelOnion(resp.ServiceID)
+			return fmt.Errorf("failed to store onion service key: %v", err)
+		}
+	}
+	old := l.id
+	l.id, l.Key, l.ClientAuths = resp.ServiceID, key, resp.ClientAuths
+	l.retiring[old] = time.AfterFunc(overlap, func() { l.Retire(old) })
+	l.lock.Unlock()
+
+	if l.conf.OnRotate != nil {
+		l.conf.OnRotate(old, resp.ServiceID)
+	}
+	return nil
+}
+
+// Retire takes down a previous address of a rotated service immediately,
+// without waiting for its overlap period to end.
+func (l *OnionListener) Retire(id string) error {
+	l.lock.Lock()
+	timer, ok := l.retiring[id]
+	delete(l.retiring, id)
+	l.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no retiring onion service %s", id)
+	}
+	timer.Stop()
+	if err := l.conn.DelOnion(id); err != nil {
+		return fmt.Errorf("failed to remove onion service: %v", err)
+	}
+	if l.conf.OnRetire != nil {
+		l.conf.OnRetire(id)
+	}
+	return nil
+}
+
+// Recreate takes the service down and creates it again under the same address,
+// e.g. when it became unreachable. It requires the private key of the service.
+func (l *OnionListener) Recreate(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	l.lock.Lock()
+	id, key := l.id, l.Key
+	l.lock.Unlock()
+
+	if key == nil {
+		return errors.New("onion service key discarded")
+	}
+	// The service may be gone already, e.g. removed by another controller
+	if err := l.conn.DelOnion(id); err != nil && !strings.Contains(err.Error(), "Unknown Onion Service") {
+		return fmt.Errorf("failed to remove onion service: %v", err)
+	}
+	resp, err := l.addOnion(key)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	l.ClientAuths = resp.ClientAuths
+	l.lock.Unlock()
+
+	if !l.conf.NoWait {
+		return l.waitPublished(ctx, id)
+	}
+	return nil
+}
+
+// Monitor starts watching the health of the service, probing it over a
+// dedicated isolation identity and repairing it via Recreate. The service
+// related fields of the configuration are filled in, which may be nil for the
+// defaults.
+func (l *OnionListener) Monitor(conf *health.Config) (*health.Monitor, error) {
+	if conf == nil {
+		conf = new(health.Config)
+	}
+	prober, err := NewIdentity(l.conn)
+	if err != nil {
+		return nil, err
+	}
+	bound := *conf
+	bound.Control = l.conn
+	bound.ServiceID = l.ID
+	if bound.Port == 0 {
+		bound.Port = l.RemotePorts[0]
+	}
+	bound.Dial = prober.DialContext
+	bound.Recreate = l.Recreate
+
+	return health.NewMonitor(&bound)
+}
+
+// ID returns the onion service ID, without the .onion suffix. It changes when
+// the service is rotated.
+func (l *OnionListener) ID() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.id
+}
+
+// Accept implements net.Listener, waiting for the next inbound onion connection.
+func (l *OnionListener) Accept() (net.Conn, error) {
+	return l.listener.Accept()
+}
+
+// Addr implements net.Listener, returning the onion address of the service.
+func (l *OnionListener) Addr() net.Addr {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return &OnionAddr{ID: l.id, Port: l.RemotePorts[0]}
+}
+
+// Close implements net.Listener, removing the onion service via DEL_ONION and
+// tearing down the local Unix socket. Any retiring addresses are removed too.
+func (l *OnionListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.lock.Lock()
+		l.closed = true
+		ids := []string{l.id}
+		for id, timer := range l.retiring {
+			timer.Stop()
+			ids = append(ids, id)
+		}
+		l.retiring = make(map[string]*time.Timer)
+		l.lock.Unlock()
+
+		for _, id := range ids {
+			if err := l.conn.DelOnion(id); err != nil && l.closeErr == nil {
+				l.closeErr = fmt.Errorf("failed to remove onion service: %v", err)
+			}
+		}
+		l.cleanup()
+	})
+	return l.closeErr
+}
+
+// cleanup closes the local listener and removes any temporary socket directory.
+func (l *OnionListener) cleanup() {
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	if l.sockDir != "" {
+		os.RemoveAll(l.sockDir)
+	}
+}
+
+// OnionAddr is the net.Addr of an onion service.
+type OnionAddr struct {
+	ID   string // Onion service ID, without the .onion suffix
+	Port int    // Virtual port of the service
+}
+
+// Network implements net.Addr.
+func (a *OnionAddr) Network() string {
+	return "onion"
+}
+
+// String implements net.Addr, returning "<id>.onion:<port>".
+func (a *OnionAddr) String() string {
+	return fmt.Sprintf("%s.onion:%d", a.ID, a.Port)
+}
@@ -0,0 +1,195 @@
+package libtor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// Tests that rotations move the service to a new stored key, keep serving the
+// previous address for the overlap period and take it down once that ends or
+// on request.
+func TestRotate(t *testing.T) {
+	// Hand out sequential service IDs, recording the removed ones
+	var (
+		lock    sync.Mutex
+		created int
+		deleted []string
+	)
+	server := controltest.NewServer()
+	server.Handle("ADD_ONION", func(args string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		created++
+		return []string{fmt.Sprintf("ServiceID=service%d", created)}, nil
+	})
+	server.Handle("DEL_ONION", func(args string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		deleted = append(deleted, args)
+		return nil, nil
+	})
+	removed := func() string {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return strings.Join(deleted, " ")
+	}
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileKeyStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create key store: %v", err)
+	}
+	rotated := make(chan string, 1)
+	retired := make(chan string, 1)
+
+	listener, err := Listen(context.Background(), &ListenConf{
+		Control:   conn,
+		KeyStore:  store,
+		KeyName:   "service",
+		SocketDir: dir,
+		NoWait:    true,
+		OnRotate:  func(oldID, newID string) { rotated <- oldID + "->" + newID },
+		OnRetire:  func(id string) { retired <- id },
+	})
+	if err != nil {
+		t.Fatalf("failed to create onion service: %v", err)
+	}
+	defer listener.Close()
+
+	if listener.ID() != "service1" {
+		t.Fatalf("service ID mismatch: have %s, want %s", listener.ID(), "service1")
+	}
+	stored, err := store.LoadKey("service")
+	if err != nil || !bytes.Equal(stored.PrivateKey(), listener.Key.PrivateKey()) {
+		t.Fatalf("generated key not stored: %v", err)
+	}
+	// Rotate with a long overlap and retire the old address manually
+	if err := listener.Rotate(context.Background(), time.Hour); err != nil {
+		t.Fatalf("failed to rotate service: %v", err)
+	}
+	if have, want := <-rotated, "service1->service2"; have != want {
+		t.Errorf("rotation mismatch: have %s, want %s", have, want)
+	}
+	if listener.ID() != "service2" || listener.Addr().String() != "service2.onion:80" {
+		t.Errorf("rotated address mismatch: have %s", listener.Addr())
+	}
+	if bytes.Equal(stored.PrivateKey(), listener.Key.PrivateKey()) {
+		t.Errorf("key not rotated")
+	}
+	if rekeyed, err := store.LoadKey("service"); err != nil || !bytes.Equal(rekeyed.PrivateKey(), listener.Key.PrivateKey()) {
+		t.Errorf("rotated key not stored: %v", err)
+	}
+	if have := removed(); have != "" {
+		t.Errorf("services removed during overlap: %s", have)
+	}
+	if err := listener.Retire("service1"); err != nil {
+		t.Fatalf("failed to retire service: %v", err)
+	}
+	if have := <-retired; have != "service1" {
+		t.Errorf("retirement mismatch: have %s, want %s", have, "service1")
+	}
+	if err := listener.Retire("service1"); err == nil {
+		t.Errorf("retired service retired again")
+	}
+	if err := listener.Retire("service2"); err == nil {
+		t.Errorf("active service retired")
+	}
+	// Rotate with a short overlap and wait for the old address to expire
+	if err := listener.Rotate(context.Background(), 10*time.Millisecond); err != nil {
+		t.Fatalf("failed to rotate service: %v", err)
+	}
+	<-rotated
+
+	select {
+	case id := <-retired:
+		if id != "service2" {
+			t.Errorf("expiry mismatch: have %s, want %s", id, "service2")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("overlap did not expire")
+	}
+	// Closing must remove the active service and any pending retirement
+	if err := listener.Rotate(context.Background(), time.Hour); err != nil {
+		t.Fatalf("failed to rotate service: %v", err)
+	}
+	<-rotated
+
+	if err := listener.Close(); err != nil {
+		t.Fatalf("failed to close listener: %v", err)
+	}
+	if have, want := removed(), "service1 service2 service4 service3"; have != want {
+		t.Errorf("removed services mismatch: have %s, want %s", have, want)
+	}
+}
+
+// Tests that rotating a closed listener takes the new service down again instead
+// of leaving it orphaned.
+func TestRotateClosed(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		created int
+		deleted []string
+	)
+	server := controltest.NewServer()
+	server.Handle("ADD_ONION", func(args string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		created++
+		return []string{fmt.Sprintf("ServiceID=service%d", created)}, nil
+	})
+	server.Handle("DEL_ONION", func(args string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		deleted = append(deleted, args)
+		return nil, nil
+	})
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	listener, err := Listen(context.Background(), &ListenConf{Control: conn, NoWait: true})
+	if err != nil {
+		t.Fatalf("failed to create onion service: %v", err)
+	}
+	if err := listener.Close(); err != nil {
+		t.Fatalf("failed to close listener: %v", err)
+	}
+	if err := listener.Rotate(context.Background(), time.Hour); err == nil {
+		t.Fatalf("closed listener rotated")
+	}
+	if listener.ID() != "service1" {
+		t.Errorf("service ID mismatch: have %s, want %s", listener.ID(), "service1")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	if have, want := strings.Join(deleted, " "), "service1 service2"; have != want {
+		t.Errorf("removed services mismatch: have %s, want %s", have, want)
+	}
+}
@@ -0,0 +1,14 @@
+package libtor
+
+import "berty.tech/go-libtor/libtor"
+
+// MemoryStats is a snapshot of the allocations Tor weighs against its
+// MaxMemInQueues limit: cell queues, buffers and caches.
+type MemoryStats = libtor.MemoryStats
+
+// ReadMemoryStats collects the allocation counters of the Tor instance running
+// in this process. Instances started with SubprocessCreator are not accounted,
+// their limits can still be managed via the memory package.
+func ReadMemoryStats() *MemoryStats {
+	return libtor.ReadMemoryStats()
+}
@@ -0,0 +1,165 @@
+// Package memory enforces a memory budget on an embedded Tor instance, scaling
+// its queue limit (and thus the thresholds of its OOM handler) down as the host
+// signals memory pressure.
+package memory
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cretz/bine/control"
+)
+
+// MinLimit is the smallest MaxMemInQueues Tor accepts, any lower value being
+// raised to it.
+const MinLimit = 256 << 20
+
+// Pressure is the level of memory pressure reported by the host, e.g. mapped
+// from Android's onTrimMemory levels or iOS memory warnings.
+type Pressure int
+
+// Memory pressure levels, each one halving the budget of the previous.
+const (
+	PressureNone     Pressure = iota // Normal operation, the full budget is usable
+	PressureModerate                 // Host is low on memory, use half the budget
+	PressureCritical                 // Host is about to kill processes, use a quarter
+)
+
+// String implements fmt.Stringer.
+func (p Pressure) String() string {
+	switch p {
+	case PressureNone:
+		return "none"
+	case PressureModerate:
+		return "moderate"
+	case PressureCritical:
+		return "critical"
+	default:
+		return fmt.Sprintf("Pressure(%d)", int(p))
+	}
+}
+
+// Limits are the memory thresholds enforced by Tor's OOM handler.
+type Limits struct {
+	MaxMemInQueues uint64 // Allocations above this trigger the OOM handler
+	LowThreshold   uint64 // Allocations above this count as memory pressure
+}
+
+// ReadLimits queries the thresholds the OOM handler of Tor currently enforces.
+// The low threshold is derived the same way Tor does, at 3/4 of the limit.
+func ReadLimits(conn *control.Conn) (*Limits, error) {
+	infos, err := conn.GetInfo("limits/max-mem-in-queues")
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("missing limits/max-mem-in-queues")
+	}
+	limit, err := strconv.ParseUint(strings.TrimSpace(infos[0].Val), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid limits/max-mem-in-queues: %v", err)
+	}
+	return &Limits{MaxMemInQueues: limit, LowThreshold: limit / 4 * 3}, nil
+}
+
+// Budget is a memory allowance for the queues, buffers and caches of a Tor
+// instance, translated into its MaxMemInQueues option.
+type Budget struct {
+	conn  *control.Conn
+	limit uint64 // Allowance without any memory pressure, zero for Tor's default
+
+	pressure Pressure
+	lock     sync.Mutex
+}
+
+// NewBudget creates a memory budget for the Tor instance behind an authenticated
+// control connection. A zero limit keeps Tor's own default, derived from the
+// total system memory, which is still scaled down under pressure. The budget
+// has no effect until it's applied.
+func NewBudget(conn *control.Conn, limit uint64) *Budget {
+	return &Budget{
+		conn:  conn,
+		limit: limit,
+	}
+}
+
+// Apply configures Tor with the budget at the current pressure level.
+func (b *Budget) Apply() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.apply(b.pressure)
+}
+
+// SetLimit changes the allowance without memory pressure and reapplies the
+// budget.
+func (b *Budget) SetLimit(limit uint64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.limit = limit
+	return b.apply(b.pressure)
+}
+
+// SetPressure reacts to a memory pressure signal of the host, shrinking or
+// restoring Tor's queue limit. Lowering the limit below the current usage makes
+// Tor's OOM handler free circuits and caches as soon as the next cell is queued.
+// On critical pressure, the DNS cache is dropped right away too.
+func (b *Budget) SetPressure(level Pressure) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := b.apply(level); err != nil {
+		return err
+	}
+	if level >= PressureCritical && b.pressure < PressureCritical {
+		if err := b.conn.Signal("CLEARDNSCACHE"); err != nil {
+			return err
+		}
+	}
+	b.pressure = level
+	return nil
+}
+
+// Pressure returns the memory pressure level the budget is applied at.
+func (b *Budget) Pressure() Pressure {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.pressure
+}
+
+// apply sets MaxMemInQueues for the given pressure level. The lock must be held.
+func (b *Budget) apply(level Pressure) error {
+	if b.limit == 0 && level == PressureNone {
+		return b.conn.SetConf(control.KeyVals("MaxMemInQueues", "0")...)
+	}
+	limit := b.limit
+	if limit == 0 {
+		// Tor picks its default limit whenever the option is reset, so query
+		// it after doing so to derive the scaled down value from.
+		if err := b.conn.SetConf(control.KeyVals("MaxMemInQueues", "0")...); err != nil {
+			return err
+		}
+		limits, err := ReadLimits(b.conn)
+		if err != nil {
+			return err
+		}
+		limit = limits.MaxMemInQueues
+	}
+	return b.conn.SetConf(control.KeyVals("MaxMemInQueues", strconv.FormatUint(Scale(limit, level), 10)+" bytes")...)
+}
+
+// Scale returns the queue limit to enforce for an allowance at a given memory
+// pressure level, never going below MinLimit.
+func Scale(limit uint64, level Pressure) uint64 {
+	if level > PressureNone {
+		limit >>= uint(level)
+	}
+	if limit < MinLimit {
+		limit = MinLimit
+	}
+	return limit
+}
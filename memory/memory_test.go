@@ -0,0 +1,97 @@
+package memory
+
+import (
+	"strings"
+	"testing"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// Tests that budgets are scaled by memory pressure, bounded by Tor's minimum.
+func TestScale(t *testing.T) {
+	tests := []struct {
+		limit uint64
+		level Pressure
+		want  uint64
+	}{
+		{2 << 30, PressureNone, 2 << 30},
+		{2 << 30, PressureModerate, 1 << 30},
+		{2 << 30, PressureCritical, 512 << 20},
+		{512 << 20, PressureCritical, MinLimit},
+		{64 << 20, PressureNone, MinLimit},
+	}
+	for i, tt := range tests {
+		if have := Scale(tt.limit, tt.level); have != tt.want {
+			t.Errorf("test %d: limit mismatch: have %d, want %d", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that memory pressure signals are translated into Tor options and that
+// the DNS cache is only cleared when entering critical pressure.
+func TestBudgetPressure(t *testing.T) {
+	server := controltest.NewServer()
+	server.Handle("SETCONF", func(args string) ([]string, error) { return nil, nil })
+	server.Handle("SIGNAL", func(args string) ([]string, error) { return nil, nil })
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	budget := NewBudget(conn, 1<<30)
+	if err := budget.Apply(); err != nil {
+		t.Fatalf("failed to apply budget: %v", err)
+	}
+	for _, level := range []Pressure{PressureModerate, PressureCritical, PressureCritical, PressureNone} {
+		if err := budget.SetPressure(level); err != nil {
+			t.Fatalf("failed to set %v pressure: %v", level, err)
+		}
+	}
+	var have []string
+	for _, cmd := range server.History() {
+		if strings.HasPrefix(cmd, "SETCONF") || strings.HasPrefix(cmd, "SIGNAL") {
+			have = append(have, cmd)
+		}
+	}
+	want := []string{
+		`SETCONF MaxMemInQueues="1073741824 bytes"`,
+		`SETCONF MaxMemInQueues="536870912 bytes"`,
+		`SETCONF MaxMemInQueues="268435456 bytes"`,
+		`SIGNAL CLEARDNSCACHE`,
+		`SETCONF MaxMemInQueues="268435456 bytes"`,
+		`SETCONF MaxMemInQueues="1073741824 bytes"`,
+	}
+	if strings.Join(have, "\n") != strings.Join(want, "\n") {
+		t.Errorf("command mismatch:\nhave:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// Tests that Tor's default limit is queried and scaled when no budget is set.
+func TestBudgetDefault(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("limits/max-mem-in-queues", "2147483648")
+	server.Handle("SETCONF", func(args string) ([]string, error) { return nil, nil })
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	limits, err := ReadLimits(conn)
+	if err != nil {
+		t.Fatalf("failed to read limits: %v", err)
+	}
+	if limits.MaxMemInQueues != 2<<30 || limits.LowThreshold != 3<<29 {
+		t.Errorf("limits mismatch: have %+v", limits)
+	}
+	if err := NewBudget(conn, 0).SetPressure(PressureModerate); err != nil {
+		t.Fatalf("failed to set pressure: %v", err)
+	}
+	history := server.History()
+	if last := history[len(history)-1]; last != `SETCONF MaxMemInQueues="1073741824 bytes"` {
+		t.Errorf("last command mismatch: have %q", last)
+	}
+}
@@ -0,0 +1,204 @@
+// Package metrics exports the state of an embedded Tor instance in the
+// OpenMetrics text format, ready to be scraped by Prometheus.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/bine/control"
+)
+
+// ContentType is the media type of the exposition format served by Collector.
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// infoKeys are the GETINFO entries polled on every collection.
+var infoKeys = []string{
+	"traffic/read",
+	"traffic/written",
+	"status/bootstrap-phase",
+	"dormant",
+	"circuit-status",
+	"entry-guards",
+	"orconn-status",
+}
+
+// Known states for the labelled families, always exported (even when zero) so
+// series don't appear and vanish between scrapes.
+var (
+	circuitStates = []string{"LAUNCHED", "BUILT", "GUARD_WAIT", "EXTENDED", "FAILED", "CLOSED"}
+	guardStatuses = []string{"up", "down", "never-connected", "unusable", "unlisted"}
+	orconnStates  = []string{"NEW", "LAUNCHED", "CONNECTED", "FAILED", "CLOSED"}
+)
+
+// Stats is a single snapshot of the embedded Tor's runtime state.
+type Stats struct {
+	BytesRead         uint64 // Total bytes read since Tor started
+	BytesWritten      uint64 // Total bytes written since Tor started
+	BootstrapProgress int    // Bootstrap progress in percent
+	Dormant           bool   // Whether Tor is in dormant mode
+
+	Circuits    map[string]int // Number of circuits by state
+	EntryGuards map[string]int // Number of entry guards by status
+	ORConns     map[string]int // Number of OR connections by state
+}
+
+// Collector polls the control connection of an embedded Tor instance and
+// exposes the results as an http.Handler.
+type Collector struct {
+	conn *control.Conn
+}
+
+// NewCollector creates a metrics collector around an authenticated Tor control
+// connection.
+func NewCollector(conn *control.Conn) *Collector {
+	return &Collector{conn: conn}
+}
+
+// Collect polls Tor once and returns the assembled statistics.
+func (c *Collector) Collect() (*Stats, error) {
+	infos, err := c.conn.GetInfo(infoKeys...)
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{
+		Circuits:    make(map[string]int),
+		EntryGuards: make(map[string]int),
+		ORConns:     make(map[string]int),
+	}
+	for _, info := range infos {
+		switch info.Key {
+		case "traffic/read":
+			if stats.BytesRead, err = strconv.ParseUint(strings.TrimSpace(info.Val), 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid traffic/read: %v", err)
+			}
+		case "traffic/written":
+			if stats.BytesWritten, err = strconv.ParseUint(strings.TrimSpace(info.Val), 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid traffic/written: %v", err)
+			}
+		case "status/bootstrap-phase":
+			for _, field := range strings.Fields(info.Val) {
+				if strings.HasPrefix(field, "PROGRESS=") {
+					if stats.BootstrapProgress, err = strconv.Atoi(strings.TrimPrefix(field, "PROGRESS=")); err != nil {
+						return nil, fmt.Errorf("invalid bootstrap progress: %v", err)
+					}
+				}
+			}
+		case "dormant":
+			stats.Dormant = strings.TrimSpace(info.Val) == "1"
+
+		case "circuit-status":
+			// Lines are "CircuitID SP CircStatus [SP Path] ..."
+			countField(stats.Circuits, info.Val, 1)
+		case "entry-guards":
+			// Lines are "$Fingerprint~Nickname SP Status [SP ISOTime]"
+			countField(stats.EntryGuards, info.Val, 1)
+		case "orconn-status":
+			// Lines are "$Fingerprint~Nickname SP ORStatus"
+			countField(stats.ORConns, info.Val, 1)
+		}
+	}
+	return stats, nil
+}
+
+// countField tallies the index-th space separated field of each line of a
+// multi-line GETINFO value.
+func countField(counts map[string]int, value string, index int) {
+	for _, line := range strings.Split(value, "\n") {
+		if fields := strings.Fields(line); len(fields) > index {
+			counts[fields[index]]++
+		}
+	}
+}
+
+// ServeHTTP implements http.Handler, polling Tor and serving the results in the
+// OpenMetrics text format. A failed poll is reported via the tor_up metric.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stats, err := c.Collect()
+
+	w.Header().Set("Content-Type", ContentType)
+	buf := bufio.NewWriter(w)
+	writeStats(buf, stats, err)
+	buf.Flush()
+}
+
+// writeStats encodes a statistics snapshot into the OpenMetrics text format.
+func writeStats(w io.Writer, stats *Stats, err error) {
+	writeFamily(w, "tor_up", "gauge", "Whether the last poll of the Tor controller succeeded.")
+	if err != nil {
+		fmt.Fprintln(w, "tor_up 0")
+		fmt.Fprintln(w, "# EOF")
+		return
+	}
+	fmt.Fprintln(w, "tor_up 1")
+
+	writeFamily(w, "tor_traffic_read_bytes", "counter", "Total number of bytes read by Tor.")
+	fmt.Fprintf(w, "tor_traffic_read_bytes_total %d\n", stats.BytesRead)
+	writeFamily(w, "tor_traffic_written_bytes", "counter", "Total number of bytes written by Tor.")
+	fmt.Fprintf(w, "tor_traffic_written_bytes_total %d\n", stats.BytesWritten)
+
+	writeFamily(w, "tor_bootstrap_progress", "gauge", "Bootstrap progress of Tor in percent.")
+	fmt.Fprintf(w, "tor_bootstrap_progress %d\n", stats.BootstrapProgress)
+
+	writeFamily(w, "tor_dormant", "gauge", "Whether Tor is in dormant mode.")
+	if stats.Dormant {
+		fmt.Fprintln(w, "tor_dormant 1")
+	} else {
+		fmt.Fprintln(w, "tor_dormant 0")
+	}
+	writeFamily(w, "tor_circuits", "gauge", "Number of circuits by state.")
+	writeLabelled(w, "tor_circuits", "state", stats.Circuits, circuitStates)
+
+	writeFamily(w, "tor_entry_guards", "gauge", "Number of entry guards by status.")
+	writeLabelled(w, "tor_entry_guards", "status", stats.EntryGuards, guardStatuses)
+
+	writeFamily(w, "tor_or_connections", "gauge", "Number of OR connections by state.")
+	writeLabelled(w, "tor_or_connections", "state", stats.ORConns, orconnStates)
+
+	fmt.Fprintln(w, "# EOF")
+}
+
+// writeFamily emits the metadata lines of a metric family.
+func writeFamily(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+}
+
+// writeLabelled emits one sample per label value, including all the known
+// values even if zero.
+func writeLabelled(w io.Writer, name, label string, counts map[string]int, known []string) {
+	values := append([]string(nil), known...)
+	for value := range counts {
+		if !contains(known, value) {
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(value), counts[value])
+	}
+}
+
+// contains reports whether a string is present in a slice.
+func contains(list []string, item string) bool {
+	for _, entry := range list {
+		if entry == item {
+			return true
+		}
+	}
+	return false
+}
+
+// labelEscaper escapes label values as mandated by the OpenMetrics format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the exposition format.
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
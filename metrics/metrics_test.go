@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// Tests that a scrape polls the control port and renders every metric family.
+func TestScrape(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("traffic/read", "1234")
+	server.SetInfo("traffic/written", "5678")
+	server.SetInfo("status/bootstrap-phase", `NOTICE BOOTSTRAP PROGRESS=85 TAG=ap_conn_done SUMMARY="Connected to a relay to build circuits"`)
+	server.SetInfo("dormant", "0")
+	server.SetInfo("circuit-status", strings.Join([]string{
+		"1 BUILT $A~a,$B~b,$C~c BUILD_FLAGS=NEED_CAPACITY PURPOSE=GENERAL",
+		"2 BUILT $A~a,$D~d,$E~e PURPOSE=GENERAL",
+		"3 EXTENDED $A~a PURPOSE=GENERAL",
+	}, "\n"))
+	server.SetInfo("entry-guards", strings.Join([]string{
+		"$AAAA~guard1 up",
+		"$BBBB~guard2 never-connected",
+	}, "\n"))
+	server.SetInfo("orconn-status", "$AAAA~guard1 CONNECTED")
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	rec := httptest.NewRecorder()
+	NewCollector(conn).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("content type mismatch: have %q, want %q", ct, ContentType)
+	}
+	body, _ := ioutil.ReadAll(rec.Body)
+	for _, want := range []string{
+		"tor_up 1\n",
+		"# TYPE tor_traffic_read_bytes counter\n",
+		"tor_traffic_read_bytes_total 1234\n",
+		"tor_traffic_written_bytes_total 5678\n",
+		"tor_bootstrap_progress 85\n",
+		"tor_dormant 0\n",
+		`tor_circuits{state="BUILT"} 2` + "\n",
+		`tor_circuits{state="EXTENDED"} 1` + "\n",
+		`tor_circuits{state="FAILED"} 0` + "\n",
+		`tor_entry_guards{status="up"} 1` + "\n",
+		`tor_entry_guards{status="never-connected"} 1` + "\n",
+		`tor_or_connections{state="CONNECTED"} 1` + "\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing sample %q in scrape:\n%s", want, body)
+		}
+	}
+	if !strings.HasSuffix(string(body), "# EOF\n") {
+		t.Errorf("scrape not terminated by EOF marker:\n%s", body)
+	}
+}
+
+// Tests that a failing controller is reported via tor_up instead of an error.
+func TestScrapeFailure(t *testing.T) {
+	server := controltest.NewServer() // No info keys, every GETINFO fails
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	rec := httptest.NewRecorder()
+	NewCollector(conn).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := ioutil.ReadAll(rec.Body)
+	if !strings.Contains(string(body), "tor_up 0\n") {
+		t.Errorf("failed poll not reported:\n%s", body)
+	}
+}
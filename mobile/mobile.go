@@ -0,0 +1,317 @@
+// Package mobile is a gomobile compatible binding of the embedded Tor, meant to
+// be packaged for Android and iOS via:
+//
+//	gomobile bind berty.tech/go-libtor/mobile
+//
+// Only types gomobile can bind are exported: Tor is started and stopped through
+// a Config, while bootstrap progress and log messages are delivered to callback
+// interfaces implemented on the Java or Objective-C side.
+package mobile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor"
+	"berty.tech/go-libtor/lifecycle"
+)
+
+// BootstrapCallback receives the bootstrap progress of Tor.
+type BootstrapCallback interface {
+	// OnBootstrap is called with the progress in percent, the machine readable
+	// tag and the human readable summary of each bootstrap phase.
+	OnBootstrap(progress int, tag string, summary string)
+}
+
+// LogCallback receives the log messages of Tor.
+type LogCallback interface {
+	// OnLog is called with the severity ("DEBUG", "INFO", "NOTICE", "WARN" or
+	// "ERR") and the text of each message.
+	OnLog(severity string, message string)
+}
+
+// Config is the configuration used to start Tor.
+type Config struct {
+	// DataDir is the Tor data directory, which should be within the private
+	// storage of the app so state is kept across restarts.
+	DataDir string
+
+	// SocksPort is the SOCKS listener configuration, "auto" (the default) for
+	// a random local port, or "unix:/path" for a Unix socket.
+	SocksPort string
+
+	// Torrc are extra configuration lines, separated by newlines.
+	Torrc string
+
+	// DisableNetwork starts Tor without connecting to the network, until it's
+	// enabled via SetNetworkEnabled.
+	DisableNetwork bool
+
+	// LogSeverity is the minimum severity of the messages passed to the log
+	// callback ("debug", "info", "notice", "warn" or "err"), "notice" if empty.
+	LogSeverity string
+}
+
+// NewConfig creates a default configuration for a data directory.
+func NewConfig(dataDir string) *Config {
+	return &Config{
+		DataDir:   dataDir,
+		SocksPort: "auto",
+	}
+}
+
+// logSeverities are the log events in increasing severity.
+var logSeverities = []control.EventCode{
+	control.EventCodeLogDebug,
+	control.EventCodeLogInfo,
+	control.EventCodeLogNotice,
+	control.EventCodeLogWarn,
+	control.EventCodeLogErr,
+}
+
+// Tor is a running embedded Tor instance.
+type Tor struct {
+	tor  *libtor.Tor // Embedded instance, nil if only a controller is attached
+	conn *control.Conn
+	life *lifecycle.Controller
+
+	bootstrap BootstrapCallback
+	logs      LogCallback
+
+	progress  int           // Last reported bootstrap progress
+	ready     chan struct{} // Closed when bootstrapping completes
+	readyOnce sync.Once
+	lock      sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Start launches Tor with the given configuration. Any of the callbacks may be
+// nil. The call returns as soon as Tor runs, use WaitBootstrap to wait until
+// it's connected to the network.
+func Start(conf *Config, bootstrap BootstrapCallback, logs LogCallback) (*Tor, error) {
+	if conf == nil || conf.DataDir == "" {
+		return nil, errors.New("no data directory")
+	}
+	start := &libtor.StartConf{
+		DataDir:        conf.DataDir,
+		DisableNetwork: conf.DisableNetwork,
+	}
+	if conf.Torrc != "" {
+		start.TorrcFile = filepath.Join(conf.DataDir, "torrc")
+		if err := ioutil.WriteFile(start.TorrcFile, []byte(conf.Torrc+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write torrc: %v", err)
+		}
+	}
+	tor, err := libtor.Start(context.Background(), start)
+	if err != nil {
+		return nil, err
+	}
+	if conf.SocksPort != "" && conf.SocksPort != "auto" {
+		if err := tor.Control.SetConf(control.KeyVals("SocksPort", conf.SocksPort)...); err != nil {
+			tor.Close()
+			return nil, fmt.Errorf("failed to configure SOCKS port: %v", err)
+		}
+	}
+	t, err := attach(tor.Control, conf.LogSeverity, bootstrap, logs)
+	if err != nil {
+		tor.Close()
+		return nil, err
+	}
+	t.tor = tor
+	return t, nil
+}
+
+// attach wraps a Tor control connection, subscribing to the events needed by
+// the callbacks.
+func attach(conn *control.Conn, severity string, bootstrap BootstrapCallback, logs LogCallback) (*Tor, error) {
+	t := &Tor{
+		conn:      conn,
+		life:      lifecycle.New(conn),
+		bootstrap: bootstrap,
+		logs:      logs,
+		ready:     make(chan struct{}),
+	}
+	codes := []control.EventCode{control.EventCodeStatusClient}
+	if logs != nil {
+		if severity == "" {
+			severity = "notice"
+		}
+		min := -1
+		for i, code := range logSeverities {
+			if strings.EqualFold(string(code), severity) {
+				min = i
+			}
+		}
+		if min < 0 {
+			return nil, fmt.Errorf("unknown log severity %q", severity)
+		}
+		codes = append(codes, logSeverities[min:]...)
+	}
+	events := make(chan control.Event, 64)
+	if err := conn.AddEventListener(events, codes...); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to events: %v", err)
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	go conn.HandleEvents(t.ctx)
+	go t.dispatch(events)
+
+	// Report the phase reached before the subscription
+	infos, err := conn.GetInfo("status/bootstrap-phase")
+	if err != nil {
+		conn.RemoveEventListener(events, codes...)
+		t.cancel()
+		return nil, fmt.Errorf("failed to query bootstrap status: %v", err)
+	}
+	if len(infos) > 0 {
+		t.reportBootstrap(infos[0].Val)
+	}
+	return t, nil
+}
+
+// dispatch delivers the subscribed events to the callbacks until stopped.
+func (t *Tor) dispatch(events chan control.Event) {
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+
+		case event := <-events:
+			switch event := event.(type) {
+			case *control.StatusEvent:
+				if event.Action == "BOOTSTRAP" {
+					t.reportBootstrap(event.Raw)
+				}
+			case *control.LogEvent:
+				if t.logs != nil {
+					t.logs.OnLog(string(event.Severity), event.Raw)
+				}
+			}
+		}
+	}
+}
+
+// reportBootstrap parses a bootstrap status line ("NOTICE BOOTSTRAP PROGRESS=..
+// TAG=.. SUMMARY=..") and reports any progress to the callback.
+func (t *Tor) reportBootstrap(status string) {
+	var (
+		progress = -1
+		tag      string
+		summary  string
+	)
+	for _, field := range strings.Fields(status) {
+		switch {
+		case strings.HasPrefix(field, "PROGRESS="):
+			progress, _ = strconv.Atoi(strings.TrimPrefix(field, "PROGRESS="))
+		case strings.HasPrefix(field, "TAG="):
+			tag = strings.TrimPrefix(field, "TAG=")
+		}
+	}
+	// The summary is quoted and contains spaces, cut it out in whole
+	if idx := strings.Index(status, `SUMMARY="`); idx >= 0 {
+		summary = status[idx+len(`SUMMARY="`):]
+		if end := strings.IndexByte(summary, '"'); end >= 0 {
+			summary = summary[:end]
+		}
+	}
+	if progress < 0 {
+		return
+	}
+	t.lock.Lock()
+	if progress <= t.progress && progress < 100 {
+		t.lock.Unlock()
+		return
+	}
+	t.progress = progress
+	t.lock.Unlock()
+
+	if t.bootstrap != nil {
+		t.bootstrap.OnBootstrap(progress, tag, summary)
+	}
+	if progress == 100 {
+		t.readyOnce.Do(func() { close(t.ready) })
+	}
+}
+
+// Progress returns the last known bootstrap progress in percent.
+func (t *Tor) Progress() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.progress
+}
+
+// WaitBootstrap blocks until Tor is fully bootstrapped, or the timeout (in
+// milliseconds, zero meaning none) expires.
+func (t *Tor) WaitBootstrap(timeoutMillis int64) error {
+	var timeout <-chan time.Time
+	if timeoutMillis > 0 {
+		timer := time.NewTimer(time.Duration(timeoutMillis) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-t.ready:
+		return nil
+	case <-timeout:
+		return errors.New("bootstrap timed out")
+	case <-t.ctx.Done():
+		return errors.New("tor stopped")
+	}
+}
+
+// SocksAddress returns the address of the SOCKS listener of Tor, either as
+// "host:port" or "unix:/path".
+func (t *Tor) SocksAddress() (string, error) {
+	infos, err := t.conn.GetInfo("net/listeners/socks")
+	if err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		if fields := strings.Fields(info.Val); len(fields) > 0 {
+			return strings.Trim(fields[0], `"`), nil
+		}
+	}
+	return "", errors.New("no SOCKS listener")
+}
+
+// SetNetworkEnabled toggles whether Tor may use the network.
+func (t *Tor) SetNetworkEnabled(enabled bool) error {
+	return t.life.SetNetworkEnabled(enabled)
+}
+
+// Sleep puts Tor to sleep when the app is backgrounded. Unless forced, it fails
+// if Tor is still serving streams.
+func (t *Tor) Sleep(force bool) error {
+	return t.life.Sleep(force)
+}
+
+// Wake wakes Tor up when the app is foregrounded.
+func (t *Tor) Wake() error {
+	return t.life.Wake()
+}
+
+// NetworkChanged notifies Tor that the device switched networks, so it drops
+// its connections and builds fresh circuits.
+func (t *Tor) NetworkChanged() error {
+	return t.life.NetworkChanged()
+}
+
+// Stop shuts Tor down and waits for it to terminate.
+func (t *Tor) Stop() error {
+	t.cancel()
+	if t.tor != nil {
+		return t.tor.Close()
+	}
+	return t.conn.Close()
+}
@@ -0,0 +1,266 @@
+package mobile
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// bindableTypes are the builtin types gomobile can pass across the language
+// boundary.
+var bindableTypes = map[string]bool{
+	"bool": true, "string": true, "[]byte": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"float32": true, "float64": true,
+}
+
+// Tests that the exported API of the package only uses types gomobile can bind,
+// so that gomobile bind doesn't silently skip parts of it.
+func TestBindingSurface(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatalf("failed to parse package: %v", err)
+	}
+	pkg := pkgs["mobile"]
+
+	// Collect the exported structs and interfaces, which are bindable by reference
+	var (
+		structs    = make(map[string]*ast.StructType)
+		interfaces = make(map[string]*ast.InterfaceType)
+	)
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				spec := spec.(*ast.TypeSpec)
+				if !spec.Name.IsExported() {
+					continue
+				}
+				switch typ := spec.Type.(type) {
+				case *ast.StructType:
+					structs[spec.Name.Name] = typ
+				case *ast.InterfaceType:
+					interfaces[spec.Name.Name] = typ
+				default:
+					t.Errorf("type %s: unbindable kind %T", spec.Name.Name, typ)
+				}
+			}
+		}
+	}
+	bindable := func(expr ast.Expr) bool {
+		name := typeString(expr)
+		if bindableTypes[name] {
+			return true
+		}
+		if _, ok := interfaces[name]; ok {
+			return true
+		}
+		_, ok := structs[strings.TrimPrefix(name, "*")]
+		return ok && strings.HasPrefix(name, "*")
+	}
+	checkFunc := func(name string, fn *ast.FuncType) {
+		for _, param := range fn.Params.List {
+			if !bindable(param.Type) {
+				t.Errorf("%s: unbindable parameter type %s", name, typeString(param.Type))
+			}
+		}
+		if fn.Results == nil {
+			return
+		}
+		var results []ast.Expr
+		for _, res := range fn.Results.List {
+			for i := 0; i < len(res.Names) || i == 0; i++ {
+				results = append(results, res.Type)
+			}
+		}
+		if last := results[len(results)-1]; typeString(last) == "error" {
+			results = results[:len(results)-1]
+		}
+		if len(results) > 1 {
+			t.Errorf("%s: too many results", name)
+		}
+		for _, res := range results {
+			if !bindable(res) {
+				t.Errorf("%s: unbindable result type %s", name, typeString(res))
+			}
+		}
+	}
+	// Check every exported function, method, field and callback
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || !fn.Name.IsExported() {
+				continue
+			}
+			name := fn.Name.Name
+			if fn.Recv != nil {
+				recv := strings.TrimPrefix(typeString(fn.Recv.List[0].Type), "*")
+				if _, ok := structs[recv]; !ok {
+					continue
+				}
+				name = recv + "." + name
+			}
+			checkFunc(name, fn.Type)
+		}
+	}
+	for name, typ := range structs {
+		for _, field := range typ.Fields.List {
+			for _, ident := range field.Names {
+				if ident.IsExported() && !bindable(field.Type) {
+					t.Errorf("%s.%s: unbindable field type %s", name, ident.Name, typeString(field.Type))
+				}
+			}
+		}
+	}
+	for name, typ := range interfaces {
+		for _, method := range typ.Methods.List {
+			checkFunc(name+"."+method.Names[0].Name, method.Type.(*ast.FuncType))
+		}
+	}
+	for _, want := range []string{"Config", "Tor", "Onion"} {
+		if _, ok := structs[want]; !ok {
+			t.Errorf("missing exported type %s", want)
+		}
+	}
+}
+
+// typeString renders a type expression back into its source form.
+func typeString(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return expr.Name
+	case *ast.StarExpr:
+		return "*" + typeString(expr.X)
+	case *ast.ArrayType:
+		if expr.Len == nil {
+			return "[]" + typeString(expr.Elt)
+		}
+	case *ast.SelectorExpr:
+		return typeString(expr.X) + "." + expr.Sel.Name
+	}
+	return fmt.Sprintf("%T", expr)
+}
+
+// recorder implements the callbacks, collecting every invocation.
+type recorder struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (r *recorder) OnBootstrap(progress int, tag string, summary string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.calls = append(r.calls, fmt.Sprintf("bootstrap %d %s %s", progress, tag, summary))
+}
+
+func (r *recorder) OnLog(severity string, message string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.calls = append(r.calls, fmt.Sprintf("log %s %s", severity, message))
+}
+
+func (r *recorder) history() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]string(nil), r.calls...)
+}
+
+// Tests that bootstrap progress and log messages reach the callbacks.
+func TestCallbacks(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("status/bootstrap-phase", `NOTICE BOOTSTRAP PROGRESS=10 TAG=conn_done SUMMARY="Connected to a relay"`)
+	server.SetInfo("net/listeners/socks", `"127.0.0.1:9050"`)
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	rec := new(recorder)
+	tor, err := attach(conn, "warn", rec, rec)
+	if err != nil {
+		t.Fatalf("failed to attach to fake control port: %v", err)
+	}
+	defer tor.Stop()
+
+	if addr, err := tor.SocksAddress(); err != nil || addr != "127.0.0.1:9050" {
+		t.Errorf("SOCKS address mismatch: have %q, %v, want %q", addr, err, "127.0.0.1:9050")
+	}
+	server.Event("NOTICE Filtered out by severity")
+	server.Event("WARN Something went sideways")
+	server.Event(`STATUS_CLIENT NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"`)
+
+	if err := tor.WaitBootstrap(5000); err != nil {
+		t.Fatalf("failed to wait for bootstrap: %v", err)
+	}
+	if progress := tor.Progress(); progress != 100 {
+		t.Errorf("progress mismatch: have %d, want %d", progress, 100)
+	}
+	want := []string{
+		"bootstrap 10 conn_done Connected to a relay",
+		"log WARN Something went sideways",
+		"bootstrap 100 done Done",
+	}
+	if have := rec.history(); strings.Join(have, "\n") != strings.Join(want, "\n") {
+		t.Errorf("callback mismatch:\nhave:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// Tests that unknown log severities are rejected.
+func TestInvalidLogSeverity(t *testing.T) {
+	server := controltest.NewServer()
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := attach(conn, "loud", nil, new(recorder)); err == nil {
+		t.Fatalf("unknown severity accepted")
+	}
+	for _, cmd := range server.History() {
+		if strings.HasPrefix(cmd, "SETEVENTS") {
+			t.Errorf("events subscribed despite failure: %s", cmd)
+		}
+	}
+}
+
+// Tests that a failed attach drops its event subscription again.
+func TestAttachFailure(t *testing.T) {
+	server := controltest.NewServer()
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := attach(conn, "warn", nil, new(recorder)); err == nil {
+		t.Fatalf("missing bootstrap status accepted")
+	}
+	var setevents []string
+	for _, cmd := range server.History() {
+		if strings.HasPrefix(cmd, "SETEVENTS") {
+			setevents = append(setevents, strings.TrimSpace(cmd))
+		}
+	}
+	if len(setevents) != 2 || setevents[1] != "SETEVENTS" {
+		t.Errorf("subscription not dropped: %q", setevents)
+	}
+}
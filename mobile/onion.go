@@ -0,0 +1,91 @@
+package mobile
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+
+	"berty.tech/go-libtor"
+)
+
+// onionKeyName is the key store entry of persistent onion services.
+const onionKeyName = "onion"
+
+// Onion is an onion service forwarding its inbound streams to a local server
+// of the app.
+type Onion struct {
+	listener *libtor.OnionListener
+	target   string
+}
+
+// Listen publishes an onion service on remotePort, forwarding every inbound
+// stream to target, a "host:port" or "unix:/path" address the app is serving
+// on. If keyDir is set, the service key is persisted there so the address is
+// kept across restarts, otherwise a new address is generated. The call blocks
+// until the service descriptor is published.
+func (t *Tor) Listen(remotePort int, target string, keyDir string) (*Onion, error) {
+	conf := &libtor.ListenConf{
+		Control:     t.conn,
+		RemotePorts: []int{remotePort},
+	}
+	if keyDir != "" {
+		store, err := libtor.NewFileKeyStore(keyDir)
+		if err != nil {
+			return nil, err
+		}
+		conf.KeyStore, conf.KeyName = store, onionKeyName
+	}
+	listener, err := libtor.Listen(t.ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	o := &Onion{listener: listener, target: target}
+	go o.serve()
+	return o, nil
+}
+
+// ID returns the onion service ID, without the .onion suffix.
+func (o *Onion) ID() string {
+	return o.listener.ID()
+}
+
+// Address returns the full .onion address of the service.
+func (o *Onion) Address() string {
+	return o.listener.ID() + ".onion"
+}
+
+// Close takes the onion service down.
+func (o *Onion) Close() error {
+	return o.listener.Close()
+}
+
+// serve accepts inbound streams and forwards them until the service is closed.
+func (o *Onion) serve() {
+	for {
+		conn, err := o.listener.Accept()
+		if err != nil {
+			return
+		}
+		go o.forward(conn)
+	}
+}
+
+// forward pipes an inbound stream to the target server of the app.
+func (o *Onion) forward(conn net.Conn) {
+	defer conn.Close()
+
+	network, addr := "tcp", o.target
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	var dialer net.Dialer
+	target, err := dialer.DialContext(context.Background(), network, addr)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
@@ -0,0 +1,183 @@
+package onionbalance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cretz/bine/control"
+)
+
+// fetchDescriptors asks Tor to fetch the descriptors of several services from
+// their HSDirs at once, waiting for the HS_DESC_CONTENT events delivering them.
+// The descriptors and failures are returned in the order of ids. The requests
+// are sent one after another, as bine mixes up the replies of concurrent ones.
+func fetchDescriptors(ctx context.Context, conn *control.Conn, ids []string) ([]string, []error) {
+	descs, errs := make([]string, len(ids)), make([]error, len(ids))
+	fail := func(err error) ([]string, []error) {
+		for i := range errs {
+			if descs[i] == "" && errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return descs, errs
+	}
+	// Subscribe before asking, so no answer can slip through
+	events := make(chan control.Event, 10)
+	codes := []control.EventCode{control.EventCodeHSDesc, control.EventCodeHSDescContent}
+	if err := conn.AddEventListener(events, codes...); err != nil {
+		return fail(err)
+	}
+	defer unsubscribe(conn, events, codes...)
+
+	pending := make(map[string][]int)
+	for i, id := range ids {
+		if len(pending[id]) == 0 {
+			if err := conn.GetHiddenServiceDescriptorAsync(id, ""); err != nil {
+				errs[i] = fmt.Errorf("failed to fetch descriptor: %v", err)
+				continue
+			}
+		}
+		pending[id] = append(pending[id], i)
+	}
+	eventCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() { errc <- conn.HandleEvents(eventCtx) }()
+
+	for len(pending) > 0 {
+		select {
+		case <-eventCtx.Done():
+			return fail(fmt.Errorf("failed to fetch descriptor: %v", eventCtx.Err()))
+
+		case err := <-errc:
+			return fail(err)
+
+		case event := <-events:
+			var (
+				id   string
+				desc string
+				err  error
+			)
+			switch event := event.(type) {
+			case *control.HSDescEvent:
+				if event.Action != "FAILED" {
+					continue
+				}
+				id, err = event.Address, fmt.Errorf("failed to fetch descriptor from %s: %s", event.HSDir, event.Reason)
+			case *control.HSDescContentEvent:
+				// Failed fetches are also reported with an empty content
+				if strings.TrimSpace(event.Descriptor) == "" {
+					continue
+				}
+				id, desc = event.Address, event.Descriptor
+			}
+			for _, i := range pending[id] {
+				descs[i], errs[i] = desc, err
+			}
+			delete(pending, id)
+		}
+	}
+	return descs, errs
+}
+
+// postDescriptor asks Tor to upload a descriptor of a service to its responsible
+// HSDirs via HSPOST, waiting until one of them accepted it or all refused.
+func postDescriptor(ctx context.Context, conn *control.Conn, id string, desc string) error {
+	events := make(chan control.Event, 32)
+	if err := conn.AddEventListener(events, control.EventCodeHSDesc); err != nil {
+		return err
+	}
+	defer unsubscribe(conn, events, control.EventCodeHSDesc)
+
+	// bine's HSPOST leaves out the space before HSADDRESS, so send it directly
+	lines := strings.Split(strings.TrimRight(desc, "\n"), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") {
+			lines[i] = "." + line
+		}
+	}
+	if _, err := conn.SendRequest("+HSPOST HSADDRESS=%s\r\n%s\r\n.", id, strings.Join(lines, "\r\n")); err != nil {
+		return fmt.Errorf("failed to upload descriptor: %v", err)
+	}
+	eventCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() { errc <- conn.HandleEvents(eventCtx) }()
+
+	var (
+		attempts int
+		failures []string
+	)
+	for {
+		select {
+		case <-eventCtx.Done():
+			return fmt.Errorf("failed to upload descriptor: %v", eventCtx.Err())
+
+		case err := <-errc:
+			return err
+
+		case event := <-events:
+			hs, ok := event.(*control.HSDescEvent)
+			if !ok || hs.Address != id {
+				continue
+			}
+			switch hs.Action {
+			case "UPLOAD":
+				attempts++
+			case "UPLOADED":
+				return nil
+			case "FAILED":
+				failures = append(failures, fmt.Sprintf("%s: %s", hs.HSDir, hs.Reason))
+				if len(failures) == attempts {
+					return fmt.Errorf("failed to upload descriptor: %v", failures)
+				}
+			}
+		}
+	}
+}
+
+// unsubscribe removes an event listener, draining its channel until done since
+// bine blocks the whole connection while delivering to a full listener.
+func unsubscribe(conn *control.Conn, events chan control.Event, codes ...control.EventCode) {
+	removed := make(chan struct{})
+	go func() {
+		conn.RemoveEventListener(events, codes...)
+		close(removed)
+	}()
+	for {
+		select {
+		case <-events:
+		case <-removed:
+			return
+		}
+	}
+}
+
+// introPick references an introduction point of a backend.
+type introPick struct {
+	backend int // Index of the backend
+	index   int // Index of the introduction point within its descriptor
+}
+
+// pickIntroPoints selects up to max introduction points out of backends having
+// the given counts, taking one of each backend in turn so they get an even share
+// of the clients.
+func pickIntroPoints(counts []int, max int) []introPick {
+	var picks []introPick
+	for index := 0; len(picks) < max; index++ {
+		added := false
+		for backend, count := range counts {
+			if index < count && len(picks) < max {
+				picks = append(picks, introPick{backend: backend, index: index})
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	return picks
+}
@@ -0,0 +1,197 @@
+package onionbalance
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// backendID is the backend service used by the tests.
+const backendID = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"
+
+// descriptor is a stand-in for an encoded descriptor, with a line needing to be
+// dot-escaped on the control connection.
+const descriptor = "hs-descriptor 3\ndescriptor-lifetime 180\n.leading dot\nsignature abcd"
+
+// Tests that descriptors are fetched via HSFETCH, skipping the contents of other
+// services and empty contents of failed attempts.
+func TestFetchDescriptors(t *testing.T) {
+	server := controltest.NewServer()
+	server.Handle("HSFETCH", func(args string) ([]string, error) {
+		go func() {
+			server.Event("HS_DESC_CONTENT otherservice abcd $AAAA~hsdir\nhs-descriptor 3")
+			server.Event("HS_DESC_CONTENT " + backendID + " abcd $BBBB~hsdir\n")
+			server.Event("HS_DESC_CONTENT " + backendID + " abcd $CCCC~hsdir\n" + descriptor)
+		}()
+		return nil, nil
+	})
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	descs, errs := fetchDescriptors(ctx, conn, []string{backendID})
+	if errs[0] != nil {
+		t.Fatalf("failed to fetch descriptor: %v", errs[0])
+	}
+	if strings.TrimSpace(descs[0]) != descriptor {
+		t.Errorf("descriptor mismatch: have %q, want %q", descs[0], descriptor)
+	}
+	var fetches []string
+	for _, cmd := range server.History() {
+		if strings.HasPrefix(cmd, "HSFETCH") {
+			fetches = append(fetches, cmd)
+		}
+	}
+	if len(fetches) != 1 || fetches[0] != "HSFETCH "+backendID {
+		t.Errorf("fetch commands mismatch: have %q", fetches)
+	}
+	// Failures reported by the HSDirs must abort the fetch of their service
+	// only, and services never answered for must time out
+	const otherID = "otherservice"
+	server.Handle("HSFETCH", func(args string) ([]string, error) {
+		switch args {
+		case backendID:
+			go server.Event("HS_DESC FAILED " + backendID + " NO_AUTH $CCCC~hsdir abcd REASON=NOT_FOUND")
+		case otherID:
+			go server.Event("HS_DESC_CONTENT " + otherID + " abcd $AAAA~hsdir\n" + descriptor)
+		}
+		return nil, nil
+	})
+	descs, errs = fetchDescriptors(ctx, conn, []string{backendID, otherID})
+	if errs[0] == nil || !strings.Contains(errs[0].Error(), "NOT_FOUND") {
+		t.Errorf("fetch failure mismatch: have %v, want NOT_FOUND", errs[0])
+	}
+	if errs[1] != nil || strings.TrimSpace(descs[1]) != descriptor {
+		t.Errorf("concurrent fetch mismatch: have %q, %v", descs[1], errs[1])
+	}
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer timeoutCancel()
+
+	if _, errs = fetchDescriptors(timeoutCtx, conn, []string{"silentservice"}); errs[0] == nil {
+		t.Errorf("fetch of an unanswered service succeeded")
+	}
+}
+
+// Tests that unsubscribing a listener bine is blocked delivering to leaves the
+// connection usable, instead of wedging it.
+func TestUnsubscribeBlocked(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("version", "0.3.5.8")
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	events := make(chan control.Event, 1)
+	if err := conn.AddEventListener(events, control.EventCodeHSDesc); err != nil {
+		t.Fatalf("failed to subscribe to events: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go conn.HandleEvents(ctx)
+
+	// Fill the listener and leave bine blocked on the next event
+	go func() {
+		for i := 0; i < 3; i++ {
+			server.Event(fmt.Sprintf("HS_DESC RECEIVED service%d NO_AUTH $AAAA~hsdir abcd", i))
+		}
+	}()
+	for len(events) < cap(events) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		unsubscribe(conn, events, control.EventCodeHSDesc)
+		_, err := conn.GetInfo("version")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to query connection after unsubscribing: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("unsubscribing wedged the connection")
+	}
+}
+
+// Tests that descriptors are uploaded via HSPOST, waiting for an HSDir to accept
+// them or all to refuse.
+func TestPostDescriptor(t *testing.T) {
+	var (
+		server = controltest.NewServer()
+		posted = make(chan string, 1)
+		accept bool
+	)
+	server.Handle("HSPOST", func(args string) ([]string, error) {
+		posted <- args
+		server.Event("HS_DESC UPLOAD " + backendID + " UNKNOWN $AAAA~hsdir abcd")
+		server.Event("HS_DESC UPLOAD " + backendID + " UNKNOWN $BBBB~hsdir abcd")
+		go func() {
+			server.Event("HS_DESC FAILED " + backendID + " UNKNOWN $AAAA~hsdir REASON=UPLOAD_REJECTED")
+			if accept {
+				server.Event("HS_DESC UPLOADED " + backendID + " UNKNOWN $BBBB~hsdir")
+			} else {
+				server.Event("HS_DESC FAILED " + backendID + " UNKNOWN $BBBB~hsdir REASON=UPLOAD_REJECTED")
+			}
+		}()
+		return nil, nil
+	})
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	accept = true
+	if err := postDescriptor(ctx, conn, backendID, descriptor); err != nil {
+		t.Fatalf("failed to upload descriptor: %v", err)
+	}
+	if have, want := <-posted, "HSADDRESS="+backendID+"\n"+descriptor; have != want {
+		t.Errorf("upload mismatch: have %q, want %q", have, want)
+	}
+	accept = false
+	if err := postDescriptor(ctx, conn, backendID, descriptor); err == nil || !strings.Contains(err.Error(), "UPLOAD_REJECTED") {
+		t.Errorf("upload failure mismatch: have %v, want UPLOAD_REJECTED", err)
+	}
+	<-posted
+}
+
+// Tests that introduction points are shared out evenly among the backends.
+func TestPickIntroPoints(t *testing.T) {
+	tests := []struct {
+		counts []int
+		max    int
+		picks  []introPick
+	}{
+		{nil, 20, nil},
+		{[]int{0, 0}, 20, nil},
+		{[]int{2, 0, 1}, 20, []introPick{{0, 0}, {2, 0}, {0, 1}}},
+		{[]int{3, 3, 3}, 4, []introPick{{0, 0}, {1, 0}, {2, 0}, {0, 1}}},
+		{[]int{1, 3}, 3, []introPick{{0, 0}, {1, 0}, {1, 1}}},
+	}
+	for i, tt := range tests {
+		if picks := pickIntroPoints(tt.counts, tt.max); !reflect.DeepEqual(picks, tt.picks) {
+			t.Errorf("test %d: picks mismatch: have %v, want %v", i, picks, tt.picks)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Package onionbalance spreads the load of one v3 onion address across several
+// backend services, each possibly hosted by a different process or machine, the
+// way Onionbalance does.
+//
+// A frontend holds the identity key of the public address. It periodically
+// fetches the descriptors of the backends, merges their introduction points into
+// a descriptor of its own and uploads that via HSPOST. Clients of the frontend
+// address thus introduce themselves to the backends directly, which need to be
+// configured as instances of the frontend (libtor.OnionServiceConf with an
+// OnionbalanceMaster) to accept them.
+//
+// The package is experimental: fetching and uploading v3 descriptors over the
+// control port requires Tor 0.4.1 for the frontend and the backends require Tor
+// 0.4.3, so the embedded Tor (0.3.5) can't take part on either side. New fails
+// with ErrOnionbalanceUnsupported of the go-libtor package on older versions,
+// and the frontend is only exercised against a simulated control port until a
+// supported Tor is embedded. Its API may change once it can run end to end.
+package onionbalance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+
+	golibtor "berty.tech/go-libtor"
+	"berty.tech/go-libtor/internal/torversion"
+	"berty.tech/go-libtor/libtor"
+)
+
+// Defaults of the frontend configuration.
+const (
+	DefaultInterval       = 10 * time.Minute
+	DefaultFetchTimeout   = 2 * time.Minute
+	DefaultMaxIntroPoints = 20 // The most a descriptor may list
+)
+
+// Config is the configuration of a frontend.
+type Config struct {
+	// Control is the authenticated controller connection of the Tor instance
+	// fetching and uploading the descriptors.
+	Control *control.Conn
+
+	// Key is the identity key of the frontend address.
+	Key *control.ED25519Key
+
+	// Backends are the IDs of the backend services, without the .onion suffix.
+	Backends []string
+
+	Interval       time.Duration // Time between publications, DefaultInterval if zero
+	FetchTimeout   time.Duration // Time limit of the descriptor fetches, DefaultFetchTimeout if zero
+	MaxIntroPoints int           // Introduction points to publish, DefaultMaxIntroPoints if zero
+
+	// PeriodLength and RotationOffset describe the time periods of the network
+	// (see libtor.HSTimePeriod), those of the public network if zero.
+	PeriodLength   time.Duration
+	RotationOffset time.Duration
+
+	// OnPublish, if set, is called after every publication attempt.
+	OnPublish func(status *Status)
+}
+
+// Status is the outcome of a publication of the frontend descriptor.
+type Status struct {
+	TimePeriod  uint64    // Time period the descriptor was built for
+	Revision    uint64    // Revision counter of the descriptor
+	Published   time.Time // When an HSDir accepted the descriptor, zero on failure
+	IntroPoints int       // Introduction points listed in the descriptor
+	Err         error     // Failure of the publication, nil if it succeeded
+
+	Backends []*BackendStatus // Contribution of each backend
+}
+
+// BackendStatus is the contribution of a backend to a publication.
+type BackendStatus struct {
+	ID          string // Backend service ID, without the .onion suffix
+	IntroPoints int    // Introduction points taken from the backend
+	Err         error  // Failure fetching or decoding its descriptor
+}
+
+// Frontend publishes the descriptor of an address merging its backends.
+type Frontend struct {
+	ID string // Frontend service ID, without the .onion suffix
+
+	conf     Config
+	sec      [64]byte
+	pub      [32]byte
+	revision uint64 // Last published revision counter
+
+	status    *Status
+	lock      sync.Mutex
+	roundLock sync.Mutex // Serializes publications
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New starts a frontend, publishing its descriptor right away and then every
+// interval. Tor versions predating HSFETCH and HSPOST for v3 descriptors (0.4.1)
+// are refused with ErrOnionbalanceUnsupported.
+func New(conf *Config) (*Frontend, error) {
+	if conf == nil || conf.Control == nil {
+		return nil, errors.New("no controller connection configured")
+	}
+	if conf.Key == nil {
+		return nil, errors.New("no identity key configured")
+	}
+	if len(conf.Backends) == 0 {
+		return nil, errors.New("no backends configured")
+	}
+	f := &Frontend{conf: *conf}
+	if f.conf.Interval == 0 {
+		f.conf.Interval = DefaultInterval
+	}
+	if f.conf.FetchTimeout == 0 {
+		f.conf.FetchTimeout = DefaultFetchTimeout
+	}
+	if f.conf.MaxIntroPoints == 0 {
+		f.conf.MaxIntroPoints = DefaultMaxIntroPoints
+	}
+	if f.conf.PeriodLength == 0 {
+		f.conf.PeriodLength = libtor.HSPeriodLength
+	}
+	if f.conf.RotationOffset == 0 {
+		f.conf.RotationOffset = libtor.HSRotationOffset
+	}
+	if f.conf.MaxIntroPoints < 0 || f.conf.MaxIntroPoints > DefaultMaxIntroPoints {
+		return nil, fmt.Errorf("invalid introduction point count %d", f.conf.MaxIntroPoints)
+	}
+	version, err := torversion.Query(conf.Control)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Tor version: %v", err)
+	}
+	if !torversion.AtLeast(version, 0, 4, 1) {
+		return nil, golibtor.ErrOnionbalanceUnsupported
+	}
+	copy(f.sec[:], conf.Key.PrivateKey())
+	copy(f.pub[:], conf.Key.PublicKey())
+	f.ID = libtor.HSAddress(f.pub)
+
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f.wg.Add(1)
+	go f.loop()
+	return f, nil
+}
+
+// Status returns the outcome of the last publication, nil if none finished yet.
+func (f *Frontend) Status() *Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.status
+}
+
+// Close stops publishing the descriptor. The last one stays valid at the HSDirs
+// until it expires.
+func (f *Frontend) Close() error {
+	f.cancel()
+	f.wg.Wait()
+	return nil
+}
+
+// loop publishes the descriptor every interval until stopped.
+func (f *Frontend) loop() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(f.conf.Interval)
+	defer ticker.Stop()
+
+	for {
+		f.Publish(f.ctx)
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Publish fetches the descriptors of the backends and uploads the merged one of
+// the frontend right away, e.g. after a backend changed its introduction points.
+// It returns once an HSDir accepted the descriptor, or all of them refused it.
+func (f *Frontend) Publish(ctx context.Context) (*Status, error) {
+	f.roundLock.Lock()
+	defer f.roundLock.Unlock()
+
+	status := f.publish(ctx)
+
+	f.lock.Lock()
+	f.status = status
+	f.lock.Unlock()
+
+	if f.conf.OnPublish != nil {
+		f.conf.OnPublish(status)
+	}
+	return status, status.Err
+}
+
+// publish runs a single publication round.
+func (f *Frontend) publish(ctx context.Context) *Status {
+	status := &Status{Backends: make([]*BackendStatus, len(f.conf.Backends))}
+
+	// Fetch the descriptors of all the backends at once, then decrypt them
+	fetchCtx, cancel := context.WithTimeout(ctx, f.conf.FetchTimeout)
+	fetched, errs := fetchDescriptors(fetchCtx, f.conf.Control, f.conf.Backends)
+	cancel()
+
+	descs := make([]*libtor.HSDescriptor, len(f.conf.Backends))
+	for i, id := range f.conf.Backends {
+		status.Backends[i] = &BackendStatus{ID: id, Err: errs[i]}
+		if errs[i] == nil {
+			descs[i], status.Backends[i].Err = libtor.DecodeHSDescriptor(id, fetched[i], nil)
+		}
+	}
+
+	// Pick the introduction points evenly among the backends and publish them
+	counts := make([]int, len(descs))
+	for i, desc := range descs {
+		if desc != nil {
+			counts[i] = len(desc.IntroPoints)
+		}
+	}
+	picks := pickIntroPoints(counts, f.conf.MaxIntroPoints)
+	if len(picks) == 0 {
+		status.Err = errors.New("no backend introduction points")
+		return status
+	}
+	intros := make([]*libtor.HSIntroPoint, len(picks))
+	for i, pick := range picks {
+		intros[i] = descs[pick.backend].IntroPoints[pick.index]
+		status.Backends[pick.backend].IntroPoints++
+	}
+	now := time.Now()
+	status.TimePeriod = libtor.HSTimePeriod(now, f.conf.PeriodLength, f.conf.RotationOffset)
+
+	// HSDirs refuse revisions not above the one they have
+	status.Revision = uint64(now.Unix())
+	if status.Revision <= f.revision {
+		status.Revision = f.revision + 1
+	}
+	desc := &libtor.HSDescriptor{RevisionCounter: status.Revision, IntroPoints: intros}
+	encoded, err := libtor.EncodeHSDescriptor(f.sec, f.pub, status.TimePeriod, f.conf.PeriodLength, desc)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	f.revision = status.Revision
+	status.IntroPoints = len(intros)
+
+	if err := postDescriptor(ctx, f.conf.Control, f.ID, encoded); err != nil {
+		status.Err = err
+		return status
+	}
+	status.Published = time.Now()
+	return status
+}
@@ -0,0 +1,154 @@
+package onionbalance
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	golibtor "berty.tech/go-libtor"
+	"berty.tech/go-libtor/internal/controltest"
+	"berty.tech/go-libtor/libtor"
+)
+
+// Tests that frontends are refused on Tor versions lacking HSFETCH and HSPOST
+// for v3 descriptors.
+func TestNewUnsupported(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("version", "0.3.5.8 (git-5030edfb534245ed)")
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	key, err := golibtor.GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("failed to generate frontend key: %v", err)
+	}
+	_, err = New(&Config{Control: conn, Key: key, Backends: []string{backendID}})
+	if err != golibtor.ErrOnionbalanceUnsupported {
+		t.Errorf("version error mismatch: have %v, want %v", err, golibtor.ErrOnionbalanceUnsupported)
+	}
+}
+
+// Tests that a publication fetches and decodes the descriptors of the backends,
+// merges their introduction points into a descriptor of the frontend and uploads
+// that via HSPOST, reporting backends that could not be fetched.
+func TestPublish(t *testing.T) {
+	sec, pub, err := libtor.GenerateED25519()
+	if err != nil {
+		t.Fatalf("failed to generate backend key: %v", err)
+	}
+	backend := libtor.HSAddress(pub)
+	missing := backendID
+
+	var intros []*libtor.HSIntroPoint
+	for i := 0; i < 2; i++ {
+		intro := &libtor.HSIntroPoint{
+			LinkSpecifiers: []libtor.HSLinkSpecifier{
+				{Type: libtor.LinkSpecIPv4, Addr: net.IPv4(127, 0, 0, byte(i+1)), Port: 9001},
+				{Type: libtor.LinkSpecLegacyID, ID: make([]byte, 20)},
+			},
+		}
+		for j := range intro.OnionKey {
+			intro.OnionKey[j], intro.AuthKey[j], intro.EncKey[j] = byte(i), byte(j), byte(i+j)
+		}
+		intros = append(intros, intro)
+	}
+	period := libtor.HSTimePeriod(time.Now(), libtor.HSPeriodLength, libtor.HSRotationOffset)
+	encoded, err := libtor.EncodeHSDescriptor(sec, pub, period, libtor.HSPeriodLength, &libtor.HSDescriptor{
+		RevisionCounter: 1,
+		IntroPoints:     intros,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode backend descriptor: %v", err)
+	}
+	// Serve the descriptor of one backend, report the other one as missing
+	server := controltest.NewServer()
+	server.SetInfo("version", "0.4.1.5 (git-9ed4c5b66b3c8d2e)")
+	server.Handle("HSFETCH", func(args string) ([]string, error) {
+		go func() {
+			switch args {
+			case backend:
+				server.Event("HS_DESC_CONTENT " + backend + " abcd $AAAA~hsdir\n" + encoded)
+			default:
+				server.Event("HS_DESC FAILED " + args + " NO_AUTH $BBBB~hsdir abcd REASON=NOT_FOUND")
+			}
+		}()
+		return nil, nil
+	})
+	posted := make(chan string, 1)
+	server.Handle("HSPOST", func(args string) ([]string, error) {
+		lines := strings.SplitN(args, "\n", 2)
+		id := strings.TrimPrefix(lines[0], "HSADDRESS=")
+		posted <- lines[1]
+
+		server.Event("HS_DESC UPLOAD " + id + " UNKNOWN $CCCC~hsdir abcd")
+		go server.Event("HS_DESC UPLOADED " + id + " UNKNOWN $CCCC~hsdir")
+		return nil, nil
+	})
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	key, err := golibtor.GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("failed to generate frontend key: %v", err)
+	}
+	published := make(chan *Status, 1)
+	frontend, err := New(&Config{
+		Control:      conn,
+		Key:          key,
+		Backends:     []string{backend, missing},
+		Interval:     time.Hour,
+		FetchTimeout: time.Second,
+		OnPublish:    func(status *Status) { published <- status },
+	})
+	if err != nil {
+		t.Fatalf("failed to start frontend: %v", err)
+	}
+	defer frontend.Close()
+
+	var status *Status
+	select {
+	case status = <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("frontend not published")
+	}
+	if status.Err != nil {
+		t.Fatalf("failed to publish frontend: %v", status.Err)
+	}
+	if status.TimePeriod != period || status.IntroPoints != len(intros) {
+		t.Errorf("status mismatch: time period %d, introduction points %d", status.TimePeriod, status.IntroPoints)
+	}
+	if have := status.Backends[0]; have.ID != backend || have.IntroPoints != len(intros) || have.Err != nil {
+		t.Errorf("backend status mismatch: have %+v", have)
+	}
+	if have := status.Backends[1]; have.ID != missing || have.IntroPoints != 0 || have.Err == nil || !strings.Contains(have.Err.Error(), "NOT_FOUND") {
+		t.Errorf("missing backend status mismatch: have %+v", have)
+	}
+	// The uploaded descriptor must be the frontend's, listing the backend's
+	// introduction points
+	desc, err := libtor.DecodeHSDescriptor(frontend.ID, <-posted, nil)
+	if err != nil {
+		t.Fatalf("failed to decode frontend descriptor: %v", err)
+	}
+	if desc.RevisionCounter != status.Revision {
+		t.Errorf("revision mismatch: have %d, want %d", desc.RevisionCounter, status.Revision)
+	}
+	if len(desc.IntroPoints) != len(intros) {
+		t.Fatalf("introduction point count mismatch: have %d, want %d", len(desc.IntroPoints), len(intros))
+	}
+	for i, intro := range desc.IntroPoints {
+		if intro.AuthKey != intros[i].AuthKey || intro.EncKey != intros[i].EncKey {
+			t.Errorf("introduction point %d mismatch", i)
+		}
+	}
+	if frontend.Status() != status {
+		t.Errorf("last status mismatch")
+	}
+}
@@ -0,0 +1,55 @@
+package libtor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/torutil/ed25519"
+
+	"berty.tech/go-libtor/libtor"
+)
+
+// GenerateOnionKey creates a new v3 onion service key via the ed25519
+// implementation of the embedded Tor. It does not need a running instance.
+func GenerateOnionKey() (*control.ED25519Key, error) {
+	sec, _, err := libtor.GenerateED25519()
+	if err != nil {
+		return nil, err
+	}
+	return &control.ED25519Key{KeyPair: ed25519.PrivateKey(sec[:]).KeyPair()}, nil
+}
+
+// OnionID returns the v3 onion service ID (the address without the .onion
+// suffix) of a key, as computed by the embedded Tor.
+func OnionID(key *control.ED25519Key) string {
+	var pub [32]byte
+	copy(pub[:], key.PublicKey())
+	return libtor.HSAddress(pub)
+}
+
+// WriteHiddenServiceDir stores a key in dir using the exact layout Tor loads
+// from a HiddenServiceDir: hs_ed25519_secret_key, hs_ed25519_public_key and
+// hostname. The directory is created with private permissions if needed.
+func WriteHiddenServiceDir(dir string, key *control.ED25519Key) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create service directory: %v", err)
+	}
+	var (
+		sec [64]byte
+		pub [32]byte
+	)
+	copy(sec[:], key.PrivateKey())
+	copy(pub[:], key.PublicKey())
+
+	if err := libtor.WriteHSKeys(dir, sec, pub); err != nil {
+		return err
+	}
+	hostname := libtor.HSAddress(pub) + ".onion\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "hostname"), []byte(hostname), 0600); err != nil {
+		return fmt.Errorf("failed to write hostname: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package libtor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"berty.tech/go-libtor/libtor"
+)
+
+// Tests that generated keys map to onion addresses decoding back into their
+// public keys.
+func TestOnionKey(t *testing.T) {
+	key, err := GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	id := OnionID(key)
+	if len(id) != 56 {
+		t.Fatalf("onion ID length mismatch: have %d, want %d", len(id), 56)
+	}
+	pub, err := libtor.HSPublicKey(id)
+	if err != nil {
+		t.Fatalf("failed to decode onion ID: %v", err)
+	}
+	if !bytes.Equal(pub[:], key.PublicKey()) {
+		t.Errorf("public key mismatch: have %x, want %x", pub, key.PublicKey())
+	}
+	other, err := GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if OnionID(other) == id {
+		t.Errorf("distinct keys share onion ID %s", id)
+	}
+}
+
+// Tests that keys are written in the layout Tor loads from a HiddenServiceDir.
+func TestWriteHiddenServiceDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onionkey")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	service := filepath.Join(dir, "service")
+	if err := WriteHiddenServiceDir(service, key); err != nil {
+		t.Fatalf("failed to write service directory: %v", err)
+	}
+	tests := []struct {
+		file   string
+		header string
+		data   []byte
+	}{
+		{"hs_ed25519_secret_key", "== ed25519v1-secret: type0 ==", key.PrivateKey()},
+		{"hs_ed25519_public_key", "== ed25519v1-public: type0 ==", key.PublicKey()},
+	}
+	for i, tt := range tests {
+		blob, err := ioutil.ReadFile(filepath.Join(service, tt.file))
+		if err != nil {
+			t.Errorf("test %d: failed to read %s: %v", i, tt.file, err)
+			continue
+		}
+		if len(blob) != 32+len(tt.data) {
+			t.Errorf("test %d: %s length mismatch: have %d, want %d", i, tt.file, len(blob), 32+len(tt.data))
+			continue
+		}
+		if header := string(bytes.TrimRight(blob[:32], "\x00")); header != tt.header {
+			t.Errorf("test %d: %s header mismatch: have %q, want %q", i, tt.file, header, tt.header)
+		}
+		if !bytes.Equal(blob[32:], tt.data) {
+			t.Errorf("test %d: %s key mismatch", i, tt.file)
+		}
+	}
+	hostname, err := ioutil.ReadFile(filepath.Join(service, "hostname"))
+	if err != nil {
+		t.Fatalf("failed to read hostname: %v", err)
+	}
+	if have, want := string(hostname), OnionID(key)+".onion\n"; have != want {
+		t.Errorf("hostname mismatch: have %q, want %q", have, want)
+	}
+	if info, err := os.Stat(service); err != nil {
+		t.Errorf("failed to stat service directory: %v", err)
+	} else if info.Mode().Perm() != 0700 {
+		t.Errorf("service directory mode mismatch: have %v, want %v", info.Mode().Perm(), os.FileMode(0700))
+	}
+}
@@ -0,0 +1,225 @@
+package libtor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/internal/torversion"
+)
+
+// ErrOnionbalanceUnsupported is returned when a service is configured as the
+// backend of an Onionbalance frontend on a Tor version predating it (0.4.3), or
+// when a frontend (see the onionbalance package) runs on a Tor lacking the
+// descriptor control commands (0.4.1). The embedded Tor (0.3.5) supports neither.
+var ErrOnionbalanceUnsupported = errors.New("onionbalance requires Tor 0.4.1 for frontends and 0.4.3 for instances")
+
+// OnionServiceConf is a v3 onion service configured via HiddenServiceDir. Unlike
+// Listen, which uses ADD_ONION, it can set every per service limit of Tor. Its
+// key is kept in the directory.
+//
+// Note, the introduction DoS defense (HiddenServiceEnableIntroDoSDefense) came
+// with Tor 0.4.2 and the embedded Tor (0.3.5) neither has it nor reports the
+// introductions its introduction points rejected, so neither is offered.
+type OnionServiceConf struct {
+	// Dir is the directory holding the keys and hostname of the service.
+	Dir string
+
+	// Ports are the HiddenServicePort values of the service, each a virtual
+	// port optionally followed by the target, e.g. "80 unix:/path/to.sock".
+	Ports []string
+
+	// MaxStreams is the maximum number of streams permitted per rendezvous
+	// circuit, zero meaning unlimited.
+	MaxStreams int
+
+	// MaxStreamsCloseCircuit tears down the circuit if MaxStreams is exceeded
+	// instead of just rejecting the stream.
+	MaxStreamsCloseCircuit bool
+
+	// NumIntroPoints is the number of introduction points of the service, 1 to
+	// 20, or zero for the default of Tor (3).
+	NumIntroPoints int
+
+	// OnionbalanceMaster, if set, is the ID of the frontend address the service
+	// is a backend of (see the onionbalance package), making it accept the
+	// introductions of clients connecting to the frontend.
+	OnionbalanceMaster string
+}
+
+// Validate checks the configuration for settings Tor would refuse.
+func (c *OnionServiceConf) Validate() error {
+	if c.Dir == "" {
+		return errors.New("no onion service directory")
+	}
+	if strings.ContainsAny(c.Dir, "\r\n") {
+		return errors.New("onion service directory spans multiple lines")
+	}
+	if len(c.Ports) == 0 {
+		return errors.New("no onion service ports")
+	}
+	for _, port := range c.Ports {
+		if strings.ContainsAny(port, "\r\n") {
+			return fmt.Errorf("invalid onion service port %q", port)
+		}
+		virtual := strings.Fields(port)
+		if len(virtual) == 0 || len(virtual) > 2 {
+			return fmt.Errorf("invalid onion service port %q", port)
+		}
+		if n, err := strconv.Atoi(virtual[0]); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid virtual port in %q", port)
+		}
+	}
+	if c.MaxStreams < 0 || c.MaxStreams > 65535 {
+		return fmt.Errorf("invalid maximum stream count %d", c.MaxStreams)
+	}
+	if c.MaxStreamsCloseCircuit && c.MaxStreams == 0 {
+		return errors.New("circuit closing set without a maximum stream count")
+	}
+	if strings.ContainsAny(c.OnionbalanceMaster, " \t\r\n.") {
+		return fmt.Errorf("invalid onionbalance master %q", c.OnionbalanceMaster)
+	}
+	if c.NumIntroPoints < 0 || c.NumIntroPoints > 20 {
+		return fmt.Errorf("invalid introduction point count %d", c.NumIntroPoints)
+	}
+	return nil
+}
+
+// KeyVals returns the configuration options of the service, starting with its
+// HiddenServiceDir as Tor requires.
+func (c *OnionServiceConf) KeyVals() ([]*control.KeyVal, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	// Without an explicit version, Tor picks the one of the keys found in the
+	// directory, so a leftover v2 key would turn the service into a v2 one
+	kvs := []*control.KeyVal{
+		control.NewKeyVal("HiddenServiceDir", c.Dir),
+		control.NewKeyVal("HiddenServiceVersion", "3"),
+	}
+	for _, port := range c.Ports {
+		kvs = append(kvs, control.NewKeyVal("HiddenServicePort", port))
+	}
+	if c.MaxStreams != 0 {
+		kvs = append(kvs, control.NewKeyVal("HiddenServiceMaxStreams", strconv.Itoa(c.MaxStreams)))
+	}
+	if c.MaxStreamsCloseCircuit {
+		kvs = append(kvs, control.NewKeyVal("HiddenServiceMaxStreamsCloseCircuit", "1"))
+	}
+	if c.NumIntroPoints != 0 {
+		kvs = append(kvs, control.NewKeyVal("HiddenServiceNumIntroductionPoints", strconv.Itoa(c.NumIntroPoints)))
+	}
+	if c.OnionbalanceMaster != "" {
+		kvs = append(kvs, control.NewKeyVal("HiddenServiceOnionbalanceInstance", "1"))
+	}
+	return kvs, nil
+}
+
+// writeOnionbalanceConfig writes the ob_config file Tor reads the frontend
+// address of an Onionbalance backend from, if the service is one.
+func (c *OnionServiceConf) writeOnionbalanceConfig() error {
+	if c.OnionbalanceMaster == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return fmt.Errorf("failed to create service directory: %v", err)
+	}
+	config := "MasterOnionAddress " + c.OnionbalanceMaster + ".onion\n"
+	if err := ioutil.WriteFile(filepath.Join(c.Dir, "ob_config"), []byte(config), 0600); err != nil {
+		return fmt.Errorf("failed to write onionbalance config: %v", err)
+	}
+	return nil
+}
+
+// checkVersion fails on services needing options the Tor version predates, as
+// Tor rejects the whole set of services over an unknown option.
+func checkVersion(version [3]int, confs []*OnionServiceConf) error {
+	for _, conf := range confs {
+		if conf.OnionbalanceMaster != "" && !torversion.AtLeast(version, 0, 4, 3) {
+			return ErrOnionbalanceUnsupported
+		}
+	}
+	return nil
+}
+
+// OnionServiceArgs returns the command line arguments hosting the services, e.g.
+// to be used as the ExtraArgs of Start. They replace any service of the torrc.
+// Options the embedded Tor doesn't support are refused, as Tor wouldn't start.
+func OnionServiceArgs(confs ...*OnionServiceConf) ([]string, error) {
+	version, err := torversion.ParseProvider(ProviderVersion())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse embedded Tor version: %v", err)
+	}
+	return onionServiceArgs(version, confs)
+}
+
+// onionServiceArgs returns the command line arguments hosting the services on a
+// given Tor version.
+func onionServiceArgs(version [3]int, confs []*OnionServiceConf) ([]string, error) {
+	var args []string
+	for _, conf := range confs {
+		kvs, err := conf.KeyVals()
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			args = append(args, "--"+kv.Key, kv.Val)
+		}
+	}
+	if err := checkVersion(version, confs); err != nil {
+		return nil, err
+	}
+	for _, conf := range confs {
+		if err := conf.writeOnionbalanceConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// ConfigureOnionServices sets the services hosted from a HiddenServiceDir by a
+// running Tor instance. Tor only accepts them as a whole, so all of them must be
+// passed every time: services left out are taken down, passing none takes all
+// of them down. Services created with Listen are unaffected.
+func ConfigureOnionServices(conn *control.Conn, confs ...*OnionServiceConf) error {
+	var (
+		kvs []*control.KeyVal
+		obi bool
+	)
+	for _, conf := range confs {
+		confKVs, err := conf.KeyVals()
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, confKVs...)
+		obi = obi || conf.OnionbalanceMaster != ""
+	}
+	// Only query the version if an option depends on it
+	if obi {
+		version, err := torversion.Query(conn)
+		if err != nil {
+			return fmt.Errorf("failed to query Tor version: %v", err)
+		}
+		if err := checkVersion(version, confs); err != nil {
+			return err
+		}
+	}
+	for _, conf := range confs {
+		if err := conf.writeOnionbalanceConfig(); err != nil {
+			return err
+		}
+	}
+	if len(kvs) == 0 {
+		kvs = append(kvs, control.NewKeyVal("HiddenServiceDir", ""))
+	}
+	if err := conn.SetConf(kvs...); err != nil {
+		return fmt.Errorf("failed to configure onion services: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package libtor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// Tests that onion service configurations Tor would refuse are rejected upfront.
+func TestOnionServiceValidate(t *testing.T) {
+	valid := func() *OnionServiceConf {
+		return &OnionServiceConf{Dir: "/var/lib/onion", Ports: []string{"80 127.0.0.1:8080"}}
+	}
+	tests := []func(c *OnionServiceConf){
+		func(c *OnionServiceConf) { c.Dir = "" },
+		func(c *OnionServiceConf) { c.Dir = "/var/lib/onion\nHiddenServiceDir /tmp" },
+		func(c *OnionServiceConf) { c.Ports = nil },
+		func(c *OnionServiceConf) { c.Ports = []string{"http"} },
+		func(c *OnionServiceConf) { c.Ports = []string{"0"} },
+		func(c *OnionServiceConf) { c.Ports = []string{"80 127.0.0.1:8080 extra"} },
+		func(c *OnionServiceConf) { c.Ports = []string{"80\n443"} },
+		func(c *OnionServiceConf) { c.MaxStreams = -1 },
+		func(c *OnionServiceConf) { c.MaxStreams = 65536 },
+		func(c *OnionServiceConf) { c.MaxStreamsCloseCircuit = true },
+		func(c *OnionServiceConf) { c.NumIntroPoints = 21 },
+		func(c *OnionServiceConf) { c.OnionbalanceMaster = "frontend.onion" },
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("valid configuration rejected: %v", err)
+	}
+	for i, tt := range tests {
+		conf := valid()
+		tt(conf)
+		if err := conf.Validate(); err == nil {
+			t.Errorf("test %d: invalid configuration accepted: %+v", i, conf)
+		}
+	}
+}
+
+// Tests that onion service configurations are translated into Tor options.
+func TestOnionServiceKeyVals(t *testing.T) {
+	tests := []struct {
+		conf *OnionServiceConf
+		kvs  string
+	}{
+		// Defaults only pin the version
+		{
+			&OnionServiceConf{Dir: "/onion", Ports: []string{"80"}},
+			"HiddenServiceDir=/onion HiddenServiceVersion=3 HiddenServicePort=80",
+		},
+		// Every limit
+		{
+			&OnionServiceConf{
+				Dir:                    "/onion",
+				Ports:                  []string{"80 unix:/app.sock", "443 127.0.0.1:8443"},
+				MaxStreams:             16,
+				MaxStreamsCloseCircuit: true,
+				NumIntroPoints:         5,
+			},
+			"HiddenServiceDir=/onion HiddenServiceVersion=3 HiddenServicePort=80 unix:/app.sock " +
+				"HiddenServicePort=443 127.0.0.1:8443 HiddenServiceMaxStreams=16 HiddenServiceMaxStreamsCloseCircuit=1 " +
+				"HiddenServiceNumIntroductionPoints=5",
+		},
+		// Onionbalance backend
+		{
+			&OnionServiceConf{
+				Dir:                "/onion",
+				Ports:              []string{"80"},
+				OnionbalanceMaster: "frontend",
+			},
+			"HiddenServiceDir=/onion HiddenServiceVersion=3 HiddenServicePort=80 HiddenServiceOnionbalanceInstance=1",
+		},
+	}
+	for i, tt := range tests {
+		kvs, err := tt.conf.KeyVals()
+		if err != nil {
+			t.Errorf("test %d: failed to assemble options: %v", i, err)
+			continue
+		}
+		pairs := make([]string, len(kvs))
+		for j, kv := range kvs {
+			pairs[j] = kv.Key + "=" + kv.Val
+		}
+		if have := strings.Join(pairs, " "); have != tt.kvs {
+			t.Errorf("test %d: options mismatch:\nhave: %s\nwant: %s", i, have, tt.kvs)
+		}
+	}
+}
+
+// Tests that services are turned into command line arguments, with the frontend
+// address of Onionbalance backends written into their directory, and that
+// options the Tor version doesn't support are refused before writing anything.
+func TestOnionServiceArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onionservice")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := &OnionServiceConf{Dir: filepath.Join(dir, "plain"), Ports: []string{"80"}}
+	backend := &OnionServiceConf{Dir: filepath.Join(dir, "backend"), Ports: []string{"80"}, OnionbalanceMaster: "frontend"}
+
+	if _, err := onionServiceArgs([3]int{0, 4, 2}, []*OnionServiceConf{plain, backend}); err != ErrOnionbalanceUnsupported {
+		t.Errorf("onionbalance error mismatch: have %v, want %v", err, ErrOnionbalanceUnsupported)
+	}
+	if _, err := os.Stat(filepath.Join(backend.Dir, "ob_config")); !os.IsNotExist(err) {
+		t.Errorf("onionbalance config written for an unsupported backend: %v", err)
+	}
+	args, err := onionServiceArgs([3]int{0, 4, 3}, []*OnionServiceConf{plain, backend})
+	if err != nil {
+		t.Fatalf("failed to assemble arguments: %v", err)
+	}
+	want := "--HiddenServiceDir " + plain.Dir + " --HiddenServiceVersion 3 --HiddenServicePort 80 " +
+		"--HiddenServiceDir " + backend.Dir + " --HiddenServiceVersion 3 --HiddenServicePort 80 --HiddenServiceOnionbalanceInstance 1"
+	if have := strings.Join(args, " "); have != want {
+		t.Errorf("arguments mismatch:\nhave: %s\nwant: %s", have, want)
+	}
+	config, err := ioutil.ReadFile(filepath.Join(backend.Dir, "ob_config"))
+	if err != nil {
+		t.Fatalf("failed to read onionbalance config: %v", err)
+	}
+	if have, want := string(config), "MasterOnionAddress frontend.onion\n"; have != want {
+		t.Errorf("onionbalance config mismatch: have %q, want %q", have, want)
+	}
+	if _, err := os.Stat(filepath.Join(plain.Dir, "ob_config")); !os.IsNotExist(err) {
+		t.Errorf("onionbalance config written for a plain service: %v", err)
+	}
+	if _, err := OnionServiceArgs(plain, &OnionServiceConf{}); err == nil {
+		t.Errorf("invalid service accepted")
+	}
+	// The embedded Tor is checked when assembling the arguments for it
+	if args, err := OnionServiceArgs(plain); err != nil || len(args) != 6 {
+		t.Errorf("embedded arguments mismatch: have %q, %v", args, err)
+	}
+}
+
+// Tests that services are configured as a whole, and that options the Tor
+// version doesn't support are refused before touching the configuration.
+func TestConfigureOnionServices(t *testing.T) {
+	server := controltest.NewServer()
+	server.Handle("SETCONF", func(args string) ([]string, error) { return nil, nil })
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	backend := &OnionServiceConf{Dir: "/onion", Ports: []string{"80"}, OnionbalanceMaster: "frontend"}
+	tests := []struct {
+		version string
+		err     error
+	}{
+		{"0.3.5.8", ErrOnionbalanceUnsupported},
+		{"0.4.2.7", ErrOnionbalanceUnsupported},
+	}
+	for i, tt := range tests {
+		server.SetInfo("version", tt.version)
+		if err := ConfigureOnionServices(conn, backend); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+	plain := &OnionServiceConf{Dir: "/onion", Ports: []string{"80"}, MaxStreams: 16}
+	if err := ConfigureOnionServices(conn, plain); err != nil {
+		t.Fatalf("failed to configure onion service: %v", err)
+	}
+	if err := ConfigureOnionServices(conn); err != nil {
+		t.Fatalf("failed to remove onion services: %v", err)
+	}
+	var setconfs []string
+	for _, cmd := range server.History() {
+		if strings.HasPrefix(cmd, "SETCONF") {
+			setconfs = append(setconfs, cmd)
+		}
+	}
+	want := []string{
+		"SETCONF HiddenServiceDir=/onion HiddenServiceVersion=3 HiddenServicePort=80 HiddenServiceMaxStreams=16",
+		"SETCONF HiddenServiceDir",
+	}
+	if len(setconfs) != len(want) {
+		t.Fatalf("SETCONF count mismatch: have %q, want %q", setconfs, want)
+	}
+	for i := range want {
+		if setconfs[i] != want[i] {
+			t.Errorf("SETCONF %d mismatch:\nhave: %s\nwant: %s", i, setconfs[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Args are the key=value arguments of a bridge line (e.g. the cert and
+// iat-mode of an obfs4 bridge), passed to the transport on every connection.
+// The type mirrors goptlib's Args, so one can be converted into the other.
+type Args map[string][]string
+
+// Get returns the first value of a key, and whether it's set at all.
+func (a Args) Get(key string) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	values := a[key]
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// Add appends a value to a key.
+func (a Args) Add(key, value string) {
+	a[key] = append(a[key], value)
+}
+
+// Encode formats the arguments the way Tor passes them to a transport, as
+// "key=value" pairs separated by semicolons, escaping semicolons, equal signs
+// in keys and backslashes. Keys are sorted to keep the output stable.
+func (a Args) Encode() string {
+	keys := make([]string, 0, len(a))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range a[key] {
+			pairs = append(pairs, escapeArg(key, ";=\\")+"="+escapeArg(value, ";\\"))
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+// ParseArgs parses arguments in the format produced by Encode.
+func ParseArgs(s string) (Args, error) {
+	args := make(Args)
+	if s == "" {
+		return args, nil
+	}
+	var (
+		key, value strings.Builder
+		inValue    bool
+		escaped    bool
+	)
+	flush := func() error {
+		if !inValue {
+			return fmt.Errorf("argument %q has no value", key.String())
+		}
+		if key.Len() == 0 {
+			return errors.New("argument with empty key")
+		}
+		args.Add(key.String(), value.String())
+		key.Reset()
+		value.Reset()
+		inValue = false
+		return nil
+	}
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+			continue
+		case r == ';':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		case r == '=' && !inValue:
+			inValue = true
+			continue
+		}
+		if inValue {
+			value.WriteRune(r)
+		} else {
+			key.WriteRune(r)
+		}
+	}
+	if escaped {
+		return nil, errors.New("arguments end in an escape")
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// escapeArg backslash escapes the given special characters in s.
+func escapeArg(s string, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
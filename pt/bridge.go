@@ -0,0 +1,177 @@
+package pt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor/extorport"
+)
+
+// Bridge is the server side of pluggable transports implemented in Go, feeding
+// the connections they accept into the Extended ORPort of an embedded Tor bridge
+// (see relay.ModeBridge). Unlike managed transports, no helper executable nor
+// port dedicated to a transport is needed: connections accepted anywhere in the
+// process, e.g. WebSocket upgrades of an HTTPS frontend, can be handed over.
+type Bridge struct {
+	addr   string // ExtORPort address, "host:port" or "unix:/path"
+	cookie []byte // ExtORPort authentication cookie
+
+	listeners map[net.Listener]struct{} // Listeners being served, closed on close
+	conns     map[net.Conn]struct{}     // Open connections, torn down on close
+	lock      sync.Mutex
+	wg        sync.WaitGroup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewBridge attaches to the ExtORPort of the Tor instance behind an authenticated
+// control connection, opening one on a loopback port if none is configured.
+func NewBridge(conn *control.Conn) (*Bridge, error) {
+	addr, err := extorport.Addr(conn)
+	if err != nil {
+		return nil, err
+	}
+	if addr == "" {
+		if err := conn.SetConf(control.NewKeyVal("ExtORPort", "auto")); err != nil {
+			return nil, fmt.Errorf("failed to open ExtORPort: %v", err)
+		}
+		if addr, err = extorport.Addr(conn); err != nil {
+			return nil, err
+		}
+		if addr == "" {
+			return nil, errors.New("no ExtORPort listener")
+		}
+	}
+	path, err := extorport.CookiePath(conn)
+	if err != nil {
+		return nil, err
+	}
+	cookie, err := extorport.ReadCookie(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ExtORPort cookie: %v", err)
+	}
+	b := &Bridge{
+		addr:      addr,
+		cookie:    cookie,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	return b, nil
+}
+
+// Serve accepts connections of the named transport on a listener, handing each
+// one over to Tor, until the listener or the bridge is closed. The listener is
+// closed when the bridge is.
+func (b *Bridge) Serve(listener net.Listener, transport string) error {
+	b.lock.Lock()
+	if b.ctx.Err() != nil {
+		b.lock.Unlock()
+		listener.Close()
+		return nil
+	}
+	b.listeners[listener] = struct{}{}
+	b.lock.Unlock()
+
+	defer func() {
+		b.lock.Lock()
+		delete(b.listeners, listener)
+		b.lock.Unlock()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if b.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.Handle(conn, transport)
+		}()
+	}
+}
+
+// Handle hands a connection of the named transport over to Tor, relaying the
+// traffic between the two until either side closes. The remote address of the
+// connection is reported to Tor as the address of the user, for its statistics.
+// The connection is closed once done.
+func (b *Bridge) Handle(conn net.Conn, transport string) error {
+	if !b.track(conn) {
+		conn.Close()
+		return errors.New("bridge closed")
+	}
+	defer b.untrack(conn)
+
+	info := &extorport.Info{Transport: transport}
+	if remote := conn.RemoteAddr(); remote != nil {
+		info.UserAddr = remote.String()
+	}
+	tor, err := extorport.Dial(b.ctx, b.addr, b.cookie, info)
+	if err != nil {
+		return fmt.Errorf("failed to hand over connection: %v", err)
+	}
+	if !b.track(tor) {
+		tor.Close()
+		return errors.New("bridge closed")
+	}
+	defer b.untrack(tor)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(tor, conn)
+		tor.Close()
+		close(done)
+	}()
+	io.Copy(conn, tor)
+	conn.Close()
+	<-done
+	return nil
+}
+
+// Close stops serving all listeners, tearing down all the connections going
+// through the bridge.
+func (b *Bridge) Close() error {
+	b.lock.Lock()
+	b.cancel()
+	for listener := range b.listeners {
+		listener.Close()
+	}
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.lock.Unlock()
+
+	b.wg.Wait()
+	return nil
+}
+
+// track registers an open connection, returning false if the bridge is closed.
+func (b *Bridge) track(conn net.Conn) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.ctx.Err() != nil {
+		return false
+	}
+	b.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack closes and forgets a connection.
+func (b *Bridge) untrack(conn net.Conn) {
+	b.lock.Lock()
+	delete(b.conns, conn)
+	b.lock.Unlock()
+
+	conn.Close()
+}
@@ -0,0 +1,215 @@
+// Package pt serves pluggable transports implemented in Go (e.g. obfs4 or
+// snowflake clients) to an embedded Tor instance.
+//
+// Tor normally runs pluggable transports as managed subprocesses, which isn't
+// possible on iOS and needs shipping helper executables everywhere else. Here,
+// each transport is instead served on a local SOCKS5 endpoint within the same
+// process, configured as an external ClientTransportPlugin of Tor. Connections
+// to bridges using the transport are then handed to its Go implementation,
+// along with the arguments of the bridge line.
+//
+// On the server side, a Bridge hands connections accepted in Go over to the
+// Extended ORPort of an embedded Tor bridge, again without any helper process.
+package pt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/cretz/bine/control"
+)
+
+// Transport is the client side of a pluggable transport.
+type Transport interface {
+	// Name returns the name of the transport, as used in bridge lines.
+	Name() string
+
+	// Dial connects to a bridge at addr ("host:port"), with the arguments of
+	// its bridge line, returning a connection Tor's traffic is written into.
+	Dial(ctx context.Context, addr string, args Args) (net.Conn, error)
+}
+
+// Server serves a set of transports to Tor on local SOCKS5 endpoints.
+type Server struct {
+	transports []Transport
+	listeners  []net.Listener
+
+	conns map[net.Conn]struct{} // Open connections, torn down on close
+	lock  sync.Mutex
+	wg    sync.WaitGroup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewServer starts serving the given transports, each on its own loopback
+// port. Tor only uses them once configured via Configure or the torrc lines
+// returned by Plugins.
+func NewServer(transports ...Transport) (*Server, error) {
+	s := &Server{
+		conns: make(map[net.Conn]struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	names := make(map[string]bool)
+	for _, transport := range transports {
+		name := transport.Name()
+		if name == "" {
+			s.Close()
+			return nil, errors.New("transport without name")
+		}
+		if names[name] {
+			s.Close()
+			return nil, fmt.Errorf("duplicate transport %q", name)
+		}
+		names[name] = true
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to listen for %s: %v", name, err)
+		}
+		s.transports = append(s.transports, transport)
+		s.listeners = append(s.listeners, listener)
+
+		s.wg.Add(1)
+		go s.serve(transport, listener)
+	}
+	return s, nil
+}
+
+// Addr returns the SOCKS5 address a transport is served on, or an empty string
+// if the transport is unknown.
+func (s *Server) Addr(name string) string {
+	for i, transport := range s.transports {
+		if transport.Name() == name {
+			return s.listeners[i].Addr().String()
+		}
+	}
+	return ""
+}
+
+// Plugins returns the values of the ClientTransportPlugin options directing Tor
+// to the served transports, e.g. "obfs4 socks5 127.0.0.1:41517". These may be
+// passed on the command line when starting Tor with bridges already in its
+// torrc, as Tor rejects bridges with unknown transports.
+func (s *Server) Plugins() []string {
+	plugins := make([]string, len(s.transports))
+	for i, transport := range s.transports {
+		plugins[i] = transport.Name() + " socks5 " + s.listeners[i].Addr().String()
+	}
+	return plugins
+}
+
+// Configure sets the ClientTransportPlugin options of a running Tor instance to
+// the served transports, replacing any previously configured ones. It must be
+// called before configuring bridges that use them.
+func (s *Server) Configure(conn *control.Conn) error {
+	var kvs []*control.KeyVal
+	for _, plugin := range s.Plugins() {
+		kvs = append(kvs, control.NewKeyVal("ClientTransportPlugin", plugin))
+	}
+	if len(kvs) == 0 {
+		return conn.ResetConf(control.NewKeyVal("ClientTransportPlugin", ""))
+	}
+	return conn.SetConf(kvs...)
+}
+
+// Close stops serving the transports, tearing down all the connections going
+// through them.
+func (s *Server) Close() error {
+	s.cancel()
+
+	var err error
+	for _, listener := range s.listeners {
+		if cerr := listener.Close(); err == nil {
+			err = cerr
+		}
+	}
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// serve accepts the connections of Tor to a transport until closed.
+func (s *Server) serve(transport Transport, listener net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		s.wg.Add(1)
+		go s.handle(transport, conn)
+	}
+}
+
+// handle runs the SOCKS5 handshake of a connection, dials the bridge through
+// the transport and relays the traffic between the two.
+func (s *Server) handle(transport Transport, conn net.Conn) {
+	defer s.wg.Done()
+	defer s.untrack(conn)
+
+	req, err := readSocksRequest(conn)
+	if err != nil {
+		return
+	}
+	remote, err := transport.Dial(s.ctx, req.addr, req.args)
+	if err != nil {
+		writeSocksReply(conn, socksGeneralFailure)
+		return
+	}
+	if !s.track(remote) {
+		remote.Close()
+		return
+	}
+	defer s.untrack(remote)
+
+	if err := writeSocksReply(conn, socksSucceeded); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(remote, conn)
+		remote.Close()
+		close(done)
+	}()
+	io.Copy(conn, remote)
+	conn.Close()
+	<-done
+}
+
+// track registers an open connection, returning false if the server is closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack closes and forgets a connection.
+func (s *Server) untrack(conn net.Conn) {
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.lock.Unlock()
+
+	conn.Close()
+}
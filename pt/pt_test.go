@@ -0,0 +1,285 @@
+package pt
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"berty.tech/go-libtor/extorport"
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// Tests that bridge line arguments survive an encoding round trip, including
+// the characters Tor escapes.
+func TestArgsRoundTrip(t *testing.T) {
+	tests := []Args{
+		{},
+		{"cert": {"ssH+9rP8dG2NLDN2XuFw63hIO/9MNNinLmxQDpVa+7kTOa9/m+tGWT1SmSYpQ9uTBGa6Hw"}, "iat-mode": {"0"}},
+		{"semi;colon": {"a;b"}, "back\\slash": {"c\\d"}, "equal=sign": {"e=f"}},
+		{"multi": {"1", "2"}, "empty": {""}},
+	}
+	for i, args := range tests {
+		parsed, err := ParseArgs(args.Encode())
+		if err != nil {
+			t.Errorf("test %d: failed to parse %q: %v", i, args.Encode(), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, args) {
+			t.Errorf("test %d: args mismatch: have %v, want %v", i, parsed, args)
+		}
+	}
+	for _, invalid := range []string{"novalue", "=empty", "a=b;", "a=b\\"} {
+		if _, err := ParseArgs(invalid); err == nil {
+			t.Errorf("invalid args %q accepted", invalid)
+		}
+	}
+}
+
+// echoTransport is a transport echoing everything back, recording the bridges
+// it was asked to dial.
+type echoTransport struct {
+	dials chan *socksRequest
+}
+
+func (e *echoTransport) Name() string { return "echo" }
+
+func (e *echoTransport) Dial(ctx context.Context, addr string, args Args) (net.Conn, error) {
+	e.dials <- &socksRequest{addr: addr, args: args}
+	if addr == "192.0.2.1:1" {
+		return nil, errors.New("unreachable")
+	}
+	local, remote := net.Pipe()
+	go func() {
+		io.Copy(remote, remote)
+		remote.Close()
+	}()
+	return local, nil
+}
+
+// dialSocks connects to a transport the way Tor does, passing the arguments as
+// username and password.
+func dialSocks(t *testing.T, addr string, args string, ip net.IP, port int) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to transport: %v", err)
+	}
+	conn.Write([]byte{5, 1, 2})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 2 {
+		t.Fatalf("authentication method mismatch: have %v, %v", reply, err)
+	}
+	user, pass := args, "\x00"
+	if len(user) > 255 {
+		user, pass = args[:255], args[255:]
+	}
+	auth := append([]byte{1, byte(len(user))}, user...)
+	auth = append(append(auth, byte(len(pass))), pass...)
+	conn.Write(auth)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("authentication failed: have %v, %v", reply, err)
+	}
+	req := append([]byte{5, 1, 0, 1}, ip.To4()...)
+	conn.Write(append(req, byte(port>>8), byte(port)))
+
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("failed to read connect reply: %v", err)
+	}
+	return conn, reply[1]
+}
+
+// Tests that connections of Tor are handed to the transport with the bridge
+// arguments, and that the traffic is relayed.
+func TestServer(t *testing.T) {
+	transport := &echoTransport{dials: make(chan *socksRequest, 2)}
+	server, err := NewServer(transport)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	// Arguments above 255 bytes are split between username and password
+	args := Args{"cert": {strings.Repeat("x", 300)}, "iat-mode": {"0"}}
+	conn, code := dialSocks(t, server.Addr("echo"), args.Encode(), net.IPv4(192, 0, 2, 7), 443)
+	defer conn.Close()
+	if code != socksSucceeded {
+		t.Fatalf("connect reply mismatch: have %d, want %d", code, socksSucceeded)
+	}
+	dial := <-transport.dials
+	if dial.addr != "192.0.2.7:443" {
+		t.Errorf("bridge address mismatch: have %s, want %s", dial.addr, "192.0.2.7:443")
+	}
+	if !reflect.DeepEqual(dial.args, args) {
+		t.Errorf("bridge args mismatch: have %v, want %v", dial.args, args)
+	}
+	msg := []byte("hello bridge")
+	conn.Write(msg)
+	echo := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != string(msg) {
+		t.Errorf("echo mismatch: have %q, %v, want %q", echo, err, msg)
+	}
+	// Failing dials should be reported to Tor
+	failed, code := dialSocks(t, server.Addr("echo"), "", net.IPv4(192, 0, 2, 1), 1)
+	defer failed.Close()
+	<-transport.dials
+	if code != socksGeneralFailure {
+		t.Errorf("failed connect reply mismatch: have %d, want %d", code, socksGeneralFailure)
+	}
+}
+
+// Tests that the served transports are configured as Tor plugins.
+func TestConfigure(t *testing.T) {
+	server, err := NewServer(&echoTransport{})
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	if _, err := NewServer(&echoTransport{}, &echoTransport{}); err == nil {
+		t.Errorf("duplicate transports accepted")
+	}
+	tor := controltest.NewServer()
+	tor.Handle("SETCONF", func(args string) ([]string, error) { return nil, nil })
+
+	conn, err := tor.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	if err := server.Configure(conn); err != nil {
+		t.Fatalf("failed to configure plugins: %v", err)
+	}
+	want := `SETCONF ClientTransportPlugin="echo socks5 ` + server.Addr("echo") + `"`
+	if history := tor.History(); history[len(history)-1] != want {
+		t.Errorf("command mismatch: have %s, want %s", history[len(history)-1], want)
+	}
+}
+
+// extORSession is what a fake ExtORPort learned about a handed over connection.
+type extORSession struct {
+	transport string
+	userAddr  string
+	err       error
+}
+
+// serveExtOR runs the Tor side of the ExtORPort protocol on every accepted
+// connection, echoing back the traffic once authenticated.
+func serveExtOR(listener net.Listener, cookie []byte, sessions chan *extORSession) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+
+			info, err := extorport.Accept(conn, cookie)
+			if err != nil {
+				sessions <- &extORSession{err: err}
+				return
+			}
+			sessions <- &extORSession{transport: info.Transport, userAddr: info.UserAddr}
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// Tests that connections accepted in Go are handed over to the ExtORPort with
+// their transport and user address.
+func TestBridge(t *testing.T) {
+	// Start a fake ExtORPort with a cookie file in a fake data directory
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create data directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cookie := make([]byte, extorport.CookieSize)
+	rand.Read(cookie)
+	if err := extorport.WriteCookie(filepath.Join(dir, extorport.CookieFile), cookie); err != nil {
+		t.Fatalf("failed to write cookie: %v", err)
+	}
+	extor, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for ExtORPort: %v", err)
+	}
+	defer extor.Close()
+
+	sessions := make(chan *extORSession, 1)
+	go serveExtOR(extor, cookie, sessions)
+
+	// Attach a bridge, which opens the ExtORPort as none is configured
+	tor := controltest.NewServer()
+	tor.SetInfo("net/listeners/extor", "")
+	tor.Handle("SETCONF", func(args string) ([]string, error) {
+		tor.SetInfo("net/listeners/extor", `"`+extor.Addr().String()+`"`)
+		return nil, nil
+	})
+	tor.Handle("GETCONF", func(args string) ([]string, error) {
+		return []string{"ExtORPortCookieAuthFile", "DataDirectory=" + dir}, nil
+	})
+	conn, err := tor.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	bridge, err := NewBridge(conn)
+	if err != nil {
+		t.Fatalf("failed to attach bridge: %v", err)
+	}
+	defer bridge.Close()
+
+	if history := tor.History(); !strings.Contains(strings.Join(history, "\n"), "SETCONF ExtORPort=auto") {
+		t.Errorf("ExtORPort not opened: %v", history)
+	}
+	// Serve a transport and ensure its connections reach Tor
+	frontend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for transport: %v", err)
+	}
+	go bridge.Serve(frontend, "webtunnel")
+
+	user, err := net.Dial("tcp", frontend.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to transport: %v", err)
+	}
+	defer user.Close()
+
+	session := <-sessions
+	if session.err != nil {
+		t.Fatalf("ExtORPort handshake failed: %v", session.err)
+	}
+	if session.transport != "webtunnel" {
+		t.Errorf("transport mismatch: have %q, want %q", session.transport, "webtunnel")
+	}
+	if session.userAddr != user.LocalAddr().String() {
+		t.Errorf("user address mismatch: have %q, want %q", session.userAddr, user.LocalAddr().String())
+	}
+	msg := []byte("hello relay")
+	user.Write(msg)
+	echo := make([]byte, len(msg))
+	if _, err := io.ReadFull(user, echo); err != nil || string(echo) != string(msg) {
+		t.Errorf("echo mismatch: have %q, %v, want %q", echo, err, msg)
+	}
+	// A bridge with the wrong cookie must not get through
+	bridge.cookie = make([]byte, extorport.CookieSize)
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	if err := bridge.Handle(remote, "webtunnel"); err == nil {
+		t.Errorf("handshake with wrong cookie succeeded")
+	}
+	if session := <-sessions; session.err == nil {
+		t.Errorf("wrong cookie accepted")
+	}
+}
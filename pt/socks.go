@@ -0,0 +1,164 @@
+package pt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 authentication methods, commands, address types and reply codes used
+// between Tor and a transport.
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthRejected = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded        = 0x00
+	socksGeneralFailure   = 0x01
+	socksCmdNotSupported  = 0x07
+	socksAddrNotSupported = 0x08
+	socksPasswordVersion  = 0x01 // Version of the username/password subnegotiation
+)
+
+// socksRequest is a CONNECT request of Tor to reach a bridge.
+type socksRequest struct {
+	addr string // Address of the bridge, as "host:port"
+	args Args   // Bridge line arguments, passed as credentials
+}
+
+// readSocksRequest runs the server side of a SOCKS5 handshake up to the point
+// of the CONNECT request. Bridge line arguments are taken from the username and
+// password, which Tor uses to smuggle them to the transport.
+func readSocksRequest(conn net.Conn) (*socksRequest, error) {
+	// Negotiate the authentication method, preferring credentials
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksAuthRejected)
+	for _, m := range methods {
+		if m == socksAuthPassword || (m == socksAuthNone && method == socksAuthRejected) {
+			method = m
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	req := new(socksRequest)
+	switch method {
+	case socksAuthRejected:
+		return nil, errors.New("no acceptable SOCKS authentication method")
+
+	case socksAuthPassword:
+		args, err := readSocksCredentials(conn)
+		if err != nil {
+			conn.Write([]byte{socksPasswordVersion, socksGeneralFailure})
+			return nil, err
+		}
+		if _, err := conn.Write([]byte{socksPasswordVersion, socksSucceeded}); err != nil {
+			return nil, err
+		}
+		req.args = args
+
+	default:
+		req.args = make(Args)
+	}
+	// Read the actual connection request
+	header = make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != socksCmdConnect {
+		writeSocksReply(conn, socksCmdNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", header[1])
+	}
+	var host string
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+
+	default:
+		writeSocksReply(conn, socksAddrNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS address type %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	req.addr = net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	return req, nil
+}
+
+// readSocksCredentials reads a username/password subnegotiation and decodes the
+// bridge line arguments from it. Tor splits arguments longer than 255 bytes
+// across the two fields, otherwise the password is a single NUL byte.
+func readSocksCredentials(conn net.Conn) (Args, error) {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return nil, err
+	}
+	if version[0] != socksPasswordVersion {
+		return nil, fmt.Errorf("unsupported SOCKS authentication version %d", version[0])
+	}
+	var fields [2][]byte
+	for i := range fields {
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return nil, err
+		}
+		fields[i] = make([]byte, size[0])
+		if _, err := io.ReadFull(conn, fields[i]); err != nil {
+			return nil, err
+		}
+	}
+	encoded := string(fields[0])
+	if string(fields[1]) != "\x00" {
+		encoded += string(fields[1])
+	}
+	return ParseArgs(encoded)
+}
+
+// writeSocksReply sends the reply to a CONNECT request. The bound address is
+// meaningless for a transport, so it's always zero.
+func writeSocksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,244 @@
+// Package relay runs the embedded Tor as a relay or bridge, contributing to the
+// network instead of only using it. The configuration never turns Tor into an
+// exit relay and keeps the directory port closed, so operating it exposes the
+// host as little as relaying permits.
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/bine/control"
+)
+
+// MinBandwidthRate is the smallest BandwidthRate Tor accepts for relays, in
+// bytes per second.
+const MinBandwidthRate = 75 << 10
+
+// Mode is the way the embedded Tor contributes to the network.
+type Mode int
+
+// Relay modes, both of them non-exit.
+const (
+	ModeMiddle Mode = iota // Public relay, listed in the consensus
+	ModeBridge             // Unlisted bridge, only handed out to censored users
+)
+
+// String implements fmt.Stringer.
+func (m Mode) String() string {
+	switch m {
+	case ModeMiddle:
+		return "middle"
+	case ModeBridge:
+		return "bridge"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+// Config is the relay configuration of a Tor instance. Zero fields keep the
+// defaults of Tor.
+type Config struct {
+	Mode        Mode   // Whether to run as a public relay or a bridge
+	Nickname    string // Name of the relay, 1 to 19 alphanumeric characters
+	ContactInfo string // How to reach the operator, published in the descriptor
+
+	// ORPort is the onion router port to listen on, picked by Tor if zero. It
+	// must be reachable from the Internet for the relay to be used.
+	ORPort int
+
+	// Address is the public IP address or hostname of the relay, guessed by Tor
+	// if empty.
+	Address string
+
+	BandwidthRate  uint64 // Average bandwidth in bytes per second
+	BandwidthBurst uint64 // Maximum bandwidth in bytes per second
+
+	// AccountingMax is the number of bytes the relay may transfer in each
+	// accounting period, zero disabling accounting. Tor hibernates once it's
+	// used up, until the next period starts.
+	AccountingMax uint64
+
+	// AccountingStart is when accounting periods start, e.g. "day 00:00" or
+	// "month 1 00:00" (Tor's default).
+	AccountingStart string
+
+	// AccountingRule is what counts against AccountingMax: "sum" (default),
+	// "max", "in" or "out".
+	AccountingRule string
+
+	// BridgeDistribution is how a bridge is handed out by BridgeDB, e.g. "any",
+	// "https", "email" or "none" for private bridges.
+	BridgeDistribution string
+}
+
+// options are all the configuration options set by a relay configuration, so
+// applying one replaces anything a previous one set.
+var options = []string{
+	"ORPort",
+	"Address",
+	"Nickname",
+	"ContactInfo",
+	"BridgeRelay",
+	"BridgeDistribution",
+	"BandwidthRate",
+	"BandwidthBurst",
+	"AccountingMax",
+	"AccountingStart",
+	"AccountingRule",
+	"ExitRelay",
+	"ExitPolicy",
+	"DirPort",
+}
+
+// Validate checks the configuration for settings Tor would refuse.
+func (c *Config) Validate() error {
+	if c.Mode != ModeMiddle && c.Mode != ModeBridge {
+		return fmt.Errorf("unknown relay mode %d", int(c.Mode))
+	}
+	if c.Nickname != "" && !isNickname(c.Nickname) {
+		return fmt.Errorf("invalid nickname %q", c.Nickname)
+	}
+	if strings.ContainsAny(c.ContactInfo, "\r\n") {
+		return errors.New("contact info spans multiple lines")
+	}
+	if c.ORPort < 0 || c.ORPort > 65535 {
+		return fmt.Errorf("invalid ORPort %d", c.ORPort)
+	}
+	if strings.ContainsAny(c.Address, " \t\r\n") {
+		return fmt.Errorf("invalid address %q", c.Address)
+	}
+	if c.BandwidthRate != 0 && c.BandwidthRate < MinBandwidthRate {
+		return fmt.Errorf("bandwidth rate %d below the minimum of %d", c.BandwidthRate, MinBandwidthRate)
+	}
+	if c.BandwidthBurst != 0 && c.BandwidthBurst < c.BandwidthRate {
+		return fmt.Errorf("bandwidth burst %d below the rate of %d", c.BandwidthBurst, c.BandwidthRate)
+	}
+	if c.AccountingMax == 0 && (c.AccountingStart != "" || c.AccountingRule != "") {
+		return errors.New("accounting period or rule set without a maximum")
+	}
+	switch c.AccountingRule {
+	case "", "sum", "max", "in", "out":
+	default:
+		return fmt.Errorf("unknown accounting rule %q", c.AccountingRule)
+	}
+	if strings.ContainsAny(c.AccountingStart, "\r\n") {
+		return errors.New("accounting start spans multiple lines")
+	}
+	if c.BridgeDistribution != "" {
+		if c.Mode != ModeBridge {
+			return errors.New("bridge distribution set for a public relay")
+		}
+		for _, r := range c.BridgeDistribution {
+			if !isAlnum(r) && r != '-' && r != '_' {
+				return fmt.Errorf("invalid bridge distribution %q", c.BridgeDistribution)
+			}
+		}
+	}
+	return nil
+}
+
+// KeyVals returns the configuration options implementing the relay mode, with
+// every option managed here present so that applying them replaces an earlier
+// configuration. Options without a value reset to the default of Tor.
+func (c *Config) KeyVals() ([]*control.KeyVal, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	values := map[string]string{
+		"ORPort":      "auto",
+		"Address":     c.Address,
+		"Nickname":    c.Nickname,
+		"ContactInfo": c.ContactInfo,
+		"BridgeRelay": "0",
+		"ExitRelay":   "0",
+		"ExitPolicy":  "reject *:*",
+		"DirPort":     "0",
+	}
+	if c.ORPort != 0 {
+		values["ORPort"] = strconv.Itoa(c.ORPort)
+	}
+	if c.Mode == ModeBridge {
+		values["BridgeRelay"] = "1"
+		values["BridgeDistribution"] = c.BridgeDistribution
+	}
+	if c.BandwidthRate != 0 {
+		values["BandwidthRate"] = strconv.FormatUint(c.BandwidthRate, 10) + " bytes"
+	}
+	if c.BandwidthBurst != 0 {
+		values["BandwidthBurst"] = strconv.FormatUint(c.BandwidthBurst, 10) + " bytes"
+	}
+	if c.AccountingMax != 0 {
+		values["AccountingMax"] = strconv.FormatUint(c.AccountingMax, 10) + " bytes"
+		values["AccountingStart"] = c.AccountingStart
+		values["AccountingRule"] = c.AccountingRule
+	}
+	kvs := make([]*control.KeyVal, 0, len(options))
+	for _, option := range options {
+		kvs = append(kvs, control.NewKeyVal(option, values[option]))
+	}
+	return kvs, nil
+}
+
+// Args returns the command line arguments starting Tor in the relay mode, e.g.
+// to be used as the ExtraArgs of libtor.Start. Options at their default are
+// left out.
+func (c *Config) Args() ([]string, error) {
+	kvs, err := c.KeyVals()
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for _, kv := range kvs {
+		if kv.Val != "" {
+			args = append(args, "--"+kv.Key, kv.Val)
+		}
+	}
+	return args, nil
+}
+
+// Configure switches a running Tor instance into the relay mode, or updates the
+// settings of a running relay.
+func Configure(conn *control.Conn, conf *Config) error {
+	kvs, err := conf.KeyVals()
+	if err != nil {
+		return err
+	}
+	if err := conn.SetConf(kvs...); err != nil {
+		return fmt.Errorf("failed to configure relay: %v", err)
+	}
+	return nil
+}
+
+// Disable turns a relay back into a plain client, resetting all the options the
+// relay mode set.
+func Disable(conn *control.Conn) error {
+	kvs := make([]*control.KeyVal, 0, len(options))
+	for _, option := range options {
+		kvs = append(kvs, control.NewKeyVal(option, ""))
+	}
+	if err := conn.ResetConf(kvs...); err != nil {
+		return fmt.Errorf("failed to disable relay: %v", err)
+	}
+	return nil
+}
+
+// isNickname reports whether a string is a valid relay nickname.
+func isNickname(s string) bool {
+	if len(s) == 0 || len(s) > 19 {
+		return false
+	}
+	for _, r := range s {
+		if !isAlnum(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAlnum reports whether r is an ASCII letter or digit.
+func isAlnum(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
@@ -0,0 +1,152 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// Tests that relay configurations are translated into safe Tor options.
+func TestArgs(t *testing.T) {
+	tests := []struct {
+		conf *Config
+		args string
+	}{
+		// Defaults only open an ORPort, never an exit or a directory port
+		{
+			&Config{},
+			"--ORPort auto --BridgeRelay 0 --ExitRelay 0 --ExitPolicy reject *:* --DirPort 0",
+		},
+		// Public relay with bandwidth limits and accounting
+		{
+			&Config{
+				Nickname:        "libtor",
+				ContactInfo:     "ops@example.com",
+				ORPort:          9001,
+				Address:         "192.0.2.1",
+				BandwidthRate:   1 << 20,
+				BandwidthBurst:  2 << 20,
+				AccountingMax:   10 << 30,
+				AccountingStart: "day 00:00",
+				AccountingRule:  "max",
+			},
+			"--ORPort 9001 --Address 192.0.2.1 --Nickname libtor --ContactInfo ops@example.com --BridgeRelay 0 " +
+				"--BandwidthRate 1048576 bytes --BandwidthBurst 2097152 bytes --AccountingMax 10737418240 bytes " +
+				"--AccountingStart day 00:00 --AccountingRule max --ExitRelay 0 --ExitPolicy reject *:* --DirPort 0",
+		},
+		// Private bridge
+		{
+			&Config{Mode: ModeBridge, BridgeDistribution: "none"},
+			"--ORPort auto --BridgeRelay 1 --BridgeDistribution none --ExitRelay 0 --ExitPolicy reject *:* --DirPort 0",
+		},
+	}
+	for i, tt := range tests {
+		args, err := tt.conf.Args()
+		if err != nil {
+			t.Errorf("test %d: failed to assemble arguments: %v", i, err)
+			continue
+		}
+		if have := strings.Join(args, " "); have != tt.args {
+			t.Errorf("test %d: arguments mismatch:\nhave: %s\nwant: %s", i, have, tt.args)
+		}
+	}
+}
+
+// Tests that configurations Tor would refuse are rejected upfront.
+func TestValidate(t *testing.T) {
+	tests := []*Config{
+		{Mode: Mode(2)},
+		{Nickname: "a-dash"},
+		{Nickname: "waytoolongtobeanickname"},
+		{ContactInfo: "line\nbreak"},
+		{ORPort: 70000},
+		{Address: "192.0.2.1 192.0.2.2"},
+		{BandwidthRate: 1024},
+		{BandwidthRate: 1 << 20, BandwidthBurst: 1 << 19},
+		{AccountingRule: "sum"},
+		{AccountingMax: 1 << 30, AccountingRule: "both"},
+		{BridgeDistribution: "any"},
+		{Mode: ModeBridge, BridgeDistribution: "no way"},
+	}
+	for i, conf := range tests {
+		if err := conf.Validate(); err == nil {
+			t.Errorf("test %d: invalid configuration accepted: %+v", i, conf)
+		}
+	}
+}
+
+// Tests that relay mode is switched on and off at runtime.
+func TestConfigure(t *testing.T) {
+	server := controltest.NewServer()
+	server.Handle("SETCONF", func(args string) ([]string, error) { return nil, nil })
+	server.Handle("RESETCONF", func(args string) ([]string, error) { return nil, nil })
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	if err := Configure(conn, &Config{Mode: ModeBridge, ORPort: 443}); err != nil {
+		t.Fatalf("failed to configure relay: %v", err)
+	}
+	if err := Disable(conn); err != nil {
+		t.Fatalf("failed to disable relay: %v", err)
+	}
+	history := server.History()
+	want := []string{
+		`SETCONF ORPort=443 Address Nickname ContactInfo BridgeRelay=1 BridgeDistribution BandwidthRate BandwidthBurst AccountingMax AccountingStart AccountingRule ExitRelay=0 ExitPolicy="reject *:*" DirPort=0`,
+		`RESETCONF ORPort Address Nickname ContactInfo BridgeRelay BridgeDistribution BandwidthRate BandwidthBurst AccountingMax AccountingStart AccountingRule ExitRelay ExitPolicy DirPort`,
+	}
+	if have := strings.Join(history[len(history)-2:], "\n"); have != strings.Join(want, "\n") {
+		t.Errorf("command mismatch:\nhave:\n%s\nwant:\n%s", have, strings.Join(want, "\n"))
+	}
+}
+
+// Tests that the relay status is assembled from Tor's self-test, descriptor and
+// accounting reports.
+func TestReadStatus(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("fingerprint", "4352E58420E68F5E40BF7C74FADDCCD9D1349413")
+	server.SetInfo("status/reachability-succeeded/or", "1")
+	server.SetInfo("status/accepted-server-descriptor", "0")
+	server.SetInfo("accounting/enabled", "1")
+	server.SetInfo("accounting/hibernating", "soft")
+	server.SetInfo("accounting/bytes", "1000 2000")
+	server.SetInfo("accounting/bytes-left", "500 300")
+	server.SetInfo("accounting/interval-end", "2020-08-01 00:00:00")
+
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	status, err := ReadStatus(conn)
+	if err != nil {
+		t.Fatalf("failed to read status: %v", err)
+	}
+	want := &Status{
+		Fingerprint:  "4352E58420E68F5E40BF7C74FADDCCD9D1349413",
+		ORReachable:  true,
+		Accounting:   true,
+		Hibernation:  HibernationSoft,
+		BytesRead:    1000,
+		BytesWritten: 2000,
+		BytesLeft:    300,
+		PeriodEnd:    time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if *status != *want {
+		t.Errorf("status mismatch:\nhave: %+v\nwant: %+v", status, want)
+	}
+	// Without accounting, its details aren't queried at all
+	server.SetInfo("accounting/enabled", "0")
+	if status, err = ReadStatus(conn); err != nil {
+		t.Fatalf("failed to read status without accounting: %v", err)
+	}
+	if status.Accounting || status.Hibernation != HibernationAwake || status.BytesRead != 0 {
+		t.Errorf("accounting reported while disabled: %+v", status)
+	}
+}
@@ -0,0 +1,147 @@
+package relay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/control"
+)
+
+// Hibernation is the accounting state of a relay.
+type Hibernation int
+
+// Hibernation states, as reported by Tor's accounting subsystem.
+const (
+	HibernationAwake Hibernation = iota // Relaying normally
+	HibernationSoft                     // Running low, no new circuits accepted
+	HibernationHard                     // Budget used up, not relaying at all
+)
+
+// String implements fmt.Stringer.
+func (h Hibernation) String() string {
+	switch h {
+	case HibernationAwake:
+		return "awake"
+	case HibernationSoft:
+		return "soft"
+	case HibernationHard:
+		return "hard"
+	default:
+		return fmt.Sprintf("Hibernation(%d)", int(h))
+	}
+}
+
+// Status is the operational state of a relay.
+type Status struct {
+	Fingerprint string // Relay identity fingerprint
+
+	// ORReachable reports whether the self-test managed to reach the ORPort
+	// from the outside, through a circuit back to the relay. Until it does,
+	// Tor doesn't publish a descriptor.
+	ORReachable bool
+
+	// DescriptorAccepted reports whether a directory authority (or the bridge
+	// authority) accepted the most recently uploaded descriptor.
+	DescriptorAccepted bool
+
+	Accounting   bool        // Whether bandwidth accounting is enabled
+	Hibernation  Hibernation // Accounting state (always awake without accounting)
+	BytesRead    uint64      // Bytes read in the current accounting period
+	BytesWritten uint64      // Bytes written in the current accounting period
+	BytesLeft    uint64      // Bytes left before hibernating in the period
+	PeriodEnd    time.Time   // End of the current accounting period
+}
+
+// ReadStatus queries the state of the relay run by the Tor instance behind an
+// authenticated control connection.
+func ReadStatus(conn *control.Conn) (*Status, error) {
+	infos, err := conn.GetInfo(
+		"fingerprint",
+		"status/reachability-succeeded/or",
+		"status/accepted-server-descriptor",
+		"accounting/enabled",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query relay status: %v", err)
+	}
+	status := new(Status)
+	for _, info := range infos {
+		val := strings.TrimSpace(info.Val)
+		switch info.Key {
+		case "fingerprint":
+			status.Fingerprint = val
+		case "status/reachability-succeeded/or":
+			status.ORReachable = val == "1"
+		case "status/accepted-server-descriptor":
+			status.DescriptorAccepted = val == "1"
+		case "accounting/enabled":
+			status.Accounting = val == "1"
+		}
+	}
+	if !status.Accounting {
+		return status, nil
+	}
+	if infos, err = conn.GetInfo(
+		"accounting/hibernating",
+		"accounting/bytes",
+		"accounting/bytes-left",
+		"accounting/interval-end",
+	); err != nil {
+		return nil, fmt.Errorf("failed to query accounting status: %v", err)
+	}
+	for _, info := range infos {
+		val := strings.TrimSpace(info.Val)
+		switch info.Key {
+		case "accounting/hibernating":
+			switch val {
+			case "awake":
+				status.Hibernation = HibernationAwake
+			case "soft":
+				status.Hibernation = HibernationSoft
+			case "hard":
+				status.Hibernation = HibernationHard
+			default:
+				return nil, fmt.Errorf("unknown hibernation state %q", val)
+			}
+		case "accounting/bytes":
+			// Reported as "read SP written"
+			if status.BytesRead, status.BytesWritten, err = parseBytePair(val); err != nil {
+				return nil, fmt.Errorf("invalid accounting/bytes: %v", err)
+			}
+		case "accounting/bytes-left":
+			// Reported as "read SP written", identical unless the rule is in or out
+			read, written, err := parseBytePair(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid accounting/bytes-left: %v", err)
+			}
+			status.BytesLeft = read
+			if written < read {
+				status.BytesLeft = written
+			}
+		case "accounting/interval-end":
+			if status.PeriodEnd, err = time.Parse("2006-01-02 15:04:05", val); err != nil {
+				return nil, fmt.Errorf("invalid accounting/interval-end: %v", err)
+			}
+		}
+	}
+	return status, nil
+}
+
+// parseBytePair parses two space separated byte counts.
+func parseBytePair(s string) (uint64, uint64, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("expected two counts, have %q", s)
+	}
+	first, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	second, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, second, nil
+}
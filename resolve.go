@@ -0,0 +1,28 @@
+package libtor
+
+import (
+	"context"
+	"net"
+
+	"berty.tech/go-libtor/resolver"
+)
+
+// Resolve looks up the IP addresses of a hostname through the Tor network,
+// without requiring a DNSPort to be opened.
+func (t *Tor) Resolve(ctx context.Context, host string) ([]resolver.Addr, error) {
+	return t.Resolver().Resolve(ctx, host)
+}
+
+// ResolvePTR looks up the hostname of an IP address through the Tor network.
+func (t *Tor) ResolvePTR(ctx context.Context, ip net.IP) ([]resolver.Name, error) {
+	return t.Resolver().ResolvePTR(ctx, ip)
+}
+
+// Resolver returns the resolver doing lookups through the Tor instance, with the
+// same Lookup methods as net.Resolver. All the lookups of an instance share it.
+func (t *Tor) Resolver() *resolver.Resolver {
+	t.resolverOnce.Do(func() {
+		t.resolver = resolver.New(t.Control)
+	})
+	return t.resolver
+}
@@ -0,0 +1,346 @@
+// Package resolver resolves hostnames and addresses through Tor over its control
+// connection, without opening a DNSPort. Lookups are issued with the RESOLVE
+// command and answered by ADDRMAP events, which also carry the expiry of the
+// answers.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+)
+
+// Addr is an IP address a hostname resolved to.
+type Addr struct {
+	IP  net.IP
+	TTL time.Duration // Time until the answer expires, zero if unknown
+}
+
+// Name is a hostname an IP address resolved to.
+type Name struct {
+	Name string
+	TTL  time.Duration // Time until the answer expires, zero if unknown
+}
+
+// Resolver looks up names through a Tor instance. Its Lookup methods mirror the
+// ones of net.Resolver, so the two are interchangeable behind an interface.
+//
+// Concurrent lookups share a single ADDRMAP subscription, held while any lookup
+// is pending, and their requests are serialized, as bine can't pipeline them.
+type Resolver struct {
+	conn *control.Conn
+
+	reqLock sync.Mutex // Serializes the control requests of the lookups
+
+	subLock sync.Mutex    // Guards the subscription, held while (un)subscribing
+	users   int           // Number of lookups using the subscription
+	sub     *subscription // Active ADDRMAP subscription, nil if idle
+
+	// waiters are the pending lookups by lower case query. Their lock is never
+	// held during control requests, so the dispatch can't stall a reply.
+	waiters  map[string][]chan *addrMap
+	waitLock sync.Mutex
+}
+
+// subscription is a single ADDRMAP event subscription of a resolver.
+type subscription struct {
+	events  chan control.Event
+	stop    context.CancelFunc // Stops the event loop reading the connection
+	removed chan struct{}      // Closed once unsubscribed, ending the dispatch
+	failed  chan struct{}      // Closed if the event loop failed
+	err     error              // Failure of the event loop
+}
+
+// New creates a resolver for the Tor instance behind an authenticated control
+// connection.
+func New(conn *control.Conn) *Resolver {
+	return &Resolver{
+		conn:    conn,
+		waiters: make(map[string][]chan *addrMap),
+	}
+}
+
+// Resolve looks up the IP addresses of a hostname through the Tor network.
+func (r *Resolver) Resolve(ctx context.Context, host string) ([]Addr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []Addr{{IP: ip}}, nil
+	}
+	answer, ttl, err := r.resolve(ctx, host, false)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(answer)
+	if ip == nil {
+		return nil, &net.DNSError{Err: "invalid answer " + answer, Name: host}
+	}
+	return []Addr{{IP: ip, TTL: ttl}}, nil
+}
+
+// ResolvePTR looks up the hostname of an IP address through the Tor network.
+func (r *Resolver) ResolvePTR(ctx context.Context, ip net.IP) ([]Name, error) {
+	if ip == nil {
+		return nil, errors.New("no IP address")
+	}
+	answer, ttl, err := r.resolve(ctx, ip.String(), true)
+	if err != nil {
+		return nil, err
+	}
+	return []Name{{Name: answer, TTL: ttl}}, nil
+}
+
+// LookupHost looks up a hostname, returning its addresses in textual form.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, err := r.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		hosts[i] = addr.IP.String()
+	}
+	return hosts, nil
+}
+
+// LookupIPAddr looks up a hostname, returning its IP addresses.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := r.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IPAddr, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = net.IPAddr{IP: addr.IP}
+	}
+	return ips, nil
+}
+
+// LookupAddr performs a reverse lookup of an address, returning the names it
+// maps to.
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	names, err := r.ResolvePTR(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, len(names))
+	for i, name := range names {
+		hosts[i] = name.Name
+	}
+	return hosts, nil
+}
+
+// resolve issues a RESOLVE command and waits for the ADDRMAP event answering it.
+func (r *Resolver) resolve(ctx context.Context, query string, reverse bool) (string, time.Duration, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// Wait for answers before asking, so they can't slip through
+	answers := make(chan *addrMap, 1)
+	sub, err := r.acquire(query, answers)
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.release(query, answers)
+
+	r.reqLock.Lock()
+	err = r.conn.ResolveAsync(query, reverse)
+	r.reqLock.Unlock()
+	if err != nil {
+		return "", 0, err
+	}
+	select {
+	case <-ctx.Done():
+		return "", 0, &net.DNSError{Err: ctx.Err().Error(), Name: query, IsTimeout: true}
+
+	case <-sub.failed:
+		return "", 0, sub.err
+
+	case mapping := <-answers:
+		if mapping.err != "" || mapping.answer == "<error>" {
+			return "", 0, &net.DNSError{Err: "resolution failed: " + mapping.err, Name: query, IsNotFound: true}
+		}
+		var ttl time.Duration
+		if !mapping.expires.IsZero() {
+			if ttl = time.Until(mapping.expires).Round(time.Second); ttl < 0 {
+				ttl = 0
+			}
+		}
+		return mapping.answer, ttl, nil
+	}
+}
+
+// acquire registers a pending lookup, subscribing to ADDRMAP events if no other
+// lookup did already.
+func (r *Resolver) acquire(query string, answers chan *addrMap) (*subscription, error) {
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+
+	if r.sub == nil {
+		sub := &subscription{
+			events:  make(chan control.Event, 16),
+			removed: make(chan struct{}),
+			failed:  make(chan struct{}),
+		}
+		r.reqLock.Lock()
+		err := r.conn.AddEventListener(sub.events, control.EventCodeAddrMap)
+		r.reqLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		ctx, stop := context.WithCancel(context.Background())
+		sub.stop = stop
+
+		go func() {
+			if err := r.conn.HandleEvents(ctx); ctx.Err() == nil {
+				sub.err = err
+				close(sub.failed)
+			}
+		}()
+		go r.dispatch(sub)
+
+		r.sub = sub
+	}
+	r.users++
+
+	key := strings.ToLower(query)
+	r.waitLock.Lock()
+	r.waiters[key] = append(r.waiters[key], answers)
+	r.waitLock.Unlock()
+
+	return r.sub, nil
+}
+
+// release drops a finished lookup, unsubscribing from ADDRMAP events if it was
+// the last one.
+func (r *Resolver) release(query string, answers chan *addrMap) {
+	key := strings.ToLower(query)
+	r.waitLock.Lock()
+	for i, waiter := range r.waiters[key] {
+		if waiter == answers {
+			r.waiters[key] = append(r.waiters[key][:i], r.waiters[key][i+1:]...)
+			break
+		}
+	}
+	if len(r.waiters[key]) == 0 {
+		delete(r.waiters, key)
+	}
+	r.waitLock.Unlock()
+
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+
+	if r.users--; r.users > 0 {
+		return
+	}
+	sub := r.sub
+	r.sub = nil
+
+	// The dispatcher keeps draining the events until unsubscribed, as bine blocks
+	// the whole connection on a full listener
+	r.reqLock.Lock()
+	r.conn.RemoveEventListener(sub.events, control.EventCodeAddrMap)
+	r.reqLock.Unlock()
+
+	sub.stop()
+	close(sub.removed)
+}
+
+// dispatch routes the ADDRMAP events of a subscription to the lookups waiting
+// for them, until unsubscribed.
+func (r *Resolver) dispatch(sub *subscription) {
+	for {
+		select {
+		case <-sub.removed:
+			return
+
+		case event := <-sub.events:
+			addrmap, ok := event.(*control.AddrMapEvent)
+			if !ok {
+				continue
+			}
+			mapping := parseAddrMap(addrmap.Raw)
+			if mapping == nil {
+				continue
+			}
+			key := strings.ToLower(mapping.address)
+
+			r.waitLock.Lock()
+			for _, waiter := range r.waiters[key] {
+				select {
+				case waiter <- mapping:
+				default:
+				}
+			}
+			r.waitLock.Unlock()
+		}
+	}
+}
+
+// addrMap is a parsed ADDRMAP event.
+type addrMap struct {
+	address string    // Name or address that was resolved
+	answer  string    // Resolved address or name, "<error>" on failure
+	err     string    // Error code of a failed resolution
+	expires time.Time // UTC expiry of the answer, zero if it never expires
+}
+
+// parseAddrMap parses an ADDRMAP event of the form:
+//
+//	ADDRMAP Address NewAddress ("YYYY-MM-DD HH:MM:SS"|NEVER) [error=Code]
+//	  [EXPIRES="YYYY-MM-DD HH:MM:SS"] [CACHED="YES"|"NO"] [STREAMID=ID]
+//
+// The timestamps contain spaces within their quotes, which is why bine's own
+// parser can't be relied on.
+func parseAddrMap(raw string) *addrMap {
+	fields := splitQuoted(strings.TrimPrefix(raw, "ADDRMAP "))
+	if len(fields) < 2 {
+		return nil
+	}
+	m := &addrMap{address: fields[0], answer: fields[1]}
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "error="):
+			m.err = strings.TrimPrefix(field, "error=")
+		case strings.HasPrefix(field, "EXPIRES="):
+			value := strings.Trim(strings.TrimPrefix(field, "EXPIRES="), `"`)
+			if expires, err := time.Parse("2006-01-02 15:04:05", value); err == nil {
+				m.expires = expires
+			}
+		}
+	}
+	return m
+}
+
+// splitQuoted splits a line on spaces, keeping the spaces within double quotes.
+func splitQuoted(line string) []string {
+	var (
+		fields []string
+		field  strings.Builder
+		quoted bool
+	)
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		}
+		field.WriteRune(r)
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
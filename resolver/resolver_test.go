@@ -0,0 +1,176 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"berty.tech/go-libtor/internal/controltest"
+)
+
+// newTestResolver starts a fake control port answering RESOLVE commands from a
+// static table, the way Tor does via ADDRMAP events.
+func newTestResolver(t *testing.T, answers map[string]string) (*Resolver, func()) {
+	server := controltest.NewServer()
+	expires := time.Now().UTC().Add(time.Hour).Format("2006-01-02 15:04:05")
+
+	server.Handle("RESOLVE", func(args string) ([]string, error) {
+		query := args[strings.LastIndexByte(args, ' ')+1:]
+		answer, ok := answers[query]
+		if !ok {
+			go server.Event(`ADDRMAP ` + query + ` <error> "` + expires + `" error=yes EXPIRES="` + expires + `" CACHED="NO"`)
+			return nil, nil
+		}
+		// Answer some unrelated query first, which should be skipped
+		go func() {
+			server.Event(`ADDRMAP unrelated.example 192.0.2.99 NEVER CACHED="NO"`)
+			server.Event(`ADDRMAP ` + query + ` ` + answer + ` "` + expires + `" EXPIRES="` + expires + `" CACHED="NO"`)
+		}()
+		return nil, nil
+	})
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	return New(conn), func() { conn.Close() }
+}
+
+// Tests that forward and reverse lookups are answered from ADDRMAP events, along
+// with the expiry of the answers.
+func TestResolve(t *testing.T) {
+	r, done := newTestResolver(t, map[string]string{
+		"example.com": "192.0.2.1",
+		"192.0.2.1":   "example.com",
+	})
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs, err := r.Resolve(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if len(addrs) != 1 || !addrs[0].IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("addresses mismatch: have %v, want 192.0.2.1", addrs)
+	}
+	if addrs[0].TTL < 59*time.Minute || addrs[0].TTL > time.Hour {
+		t.Errorf("TTL mismatch: have %v, want about %v", addrs[0].TTL, time.Hour)
+	}
+	names, err := r.LookupAddr(ctx, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("failed to reverse resolve: %v", err)
+	}
+	if len(names) != 1 || names[0] != "example.com" {
+		t.Errorf("names mismatch: have %v, want [example.com]", names)
+	}
+	// IP addresses need no lookup at all
+	if hosts, err := r.LookupHost(ctx, "192.0.2.7"); err != nil || len(hosts) != 1 || hosts[0] != "192.0.2.7" {
+		t.Errorf("literal lookup mismatch: have %v, %v", hosts, err)
+	}
+}
+
+// Tests that failed lookups are reported as DNS errors.
+func TestResolveFailure(t *testing.T) {
+	r, done := newTestResolver(t, nil)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.LookupIPAddr(ctx, "missing.example")
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok || !dnsErr.IsNotFound || dnsErr.Name != "missing.example" {
+		t.Errorf("error mismatch: have %#v", err)
+	}
+}
+
+// Tests that ADDRMAP events are parsed despite the spaces in their timestamps.
+func TestParseAddrMap(t *testing.T) {
+	m := parseAddrMap(`example.com 192.0.2.1 "2020-07-19 20:46:00" EXPIRES="2020-07-19 18:46:00" CACHED="YES" STREAMID=12`)
+	if m == nil || m.address != "example.com" || m.answer != "192.0.2.1" || m.err != "" {
+		t.Fatalf("mapping mismatch: have %+v", m)
+	}
+	if want := time.Date(2020, 7, 19, 18, 46, 0, 0, time.UTC); !m.expires.Equal(want) {
+		t.Errorf("expiry mismatch: have %v, want %v", m.expires, want)
+	}
+}
+
+// Tests that many concurrent lookups, flooded with answers to each other's and
+// unrelated queries, all complete without wedging the control connection.
+func TestResolveConcurrent(t *testing.T) {
+	server := controltest.NewServer()
+	server.SetInfo("version", "0.3.5.8")
+	server.Handle("RESOLVE", func(args string) ([]string, error) {
+		query := args[strings.LastIndexByte(args, ' ')+1:]
+		go func() {
+			for i := 0; i < 20; i++ {
+				server.Event(fmt.Sprintf(`ADDRMAP unrelated%d.example 192.0.2.99 NEVER CACHED="NO"`, i))
+			}
+			server.Event(`ADDRMAP ` + query + ` 192.0.2.` + strings.TrimSuffix(strings.TrimPrefix(query, "host"), ".example") + ` NEVER CACHED="NO"`)
+		}()
+		return nil, nil
+	})
+	conn, err := server.Dial()
+	if err != nil {
+		t.Fatalf("failed to connect to fake control port: %v", err)
+	}
+	defer conn.Close()
+
+	r := New(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		pending sync.WaitGroup
+		errs    = make(chan error, 50)
+	)
+	for i := 0; i < 50; i++ {
+		pending.Add(1)
+		go func(i int) {
+			defer pending.Done()
+
+			host := fmt.Sprintf("host%d.example", i)
+			addrs, err := r.Resolve(ctx, host)
+			if err != nil {
+				errs <- fmt.Errorf("%s: %v", host, err)
+				return
+			}
+			if want := net.IPv4(192, 0, 2, byte(i)); len(addrs) != 1 || !addrs[0].IP.Equal(want) {
+				errs <- fmt.Errorf("%s: addresses mismatch: have %v, want %v", host, addrs, want)
+			}
+		}(i)
+	}
+	pending.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	// The connection must stay usable, with the subscription dropped
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.GetInfo("version")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to query connection: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("control connection wedged")
+	}
+	history := server.History()
+	for i := len(history) - 1; i >= 0; i-- {
+		if strings.HasPrefix(history[i], "SETEVENTS") {
+			if strings.Contains(history[i], "ADDRMAP") {
+				t.Errorf("subscription not dropped: %s", history[i])
+			}
+			break
+		}
+	}
+}
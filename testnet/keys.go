@@ -0,0 +1,128 @@
+package testnet
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Key sizes of the generated keys. Relay identities must be 1024 bits, the
+// authority keys are kept smaller than tor-gencert's to speed up the startup.
+const (
+	relayIdentityBits     = 1024
+	authorityIdentityBits = 2048
+	authoritySigningBits  = 2048
+)
+
+// writeRelayIdentity generates the RSA identity key of a relay into keyDir,
+// returning its fingerprint.
+func writeRelayIdentity(keyDir string) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, relayIdentityBits)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate relay identity: %v", err)
+	}
+	if err := writePrivateKey(filepath.Join(keyDir, "secret_id_key"), key); err != nil {
+		return "", err
+	}
+	return fingerprint(&key.PublicKey), nil
+}
+
+// writeAuthorityKeys generates the v3 directory authority identity and signing
+// keys into keyDir, along with the certificate binding them, just as the
+// tor-gencert tool would. The v3 identity fingerprint is returned.
+func writeAuthorityKeys(keyDir string) (string, error) {
+	identity, err := rsa.GenerateKey(rand.Reader, authorityIdentityBits)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate authority identity: %v", err)
+	}
+	signing, err := rsa.GenerateKey(rand.Reader, authoritySigningBits)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate authority signing key: %v", err)
+	}
+	cert, err := authorityCertificate(identity, signing, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if err := writePrivateKey(filepath.Join(keyDir, "authority_identity_key"), identity); err != nil {
+		return "", err
+	}
+	if err := writePrivateKey(filepath.Join(keyDir, "authority_signing_key"), signing); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(keyDir, "authority_certificate"), cert, 0600); err != nil {
+		return "", fmt.Errorf("failed to write authority certificate: %v", err)
+	}
+	return fingerprint(&identity.PublicKey), nil
+}
+
+// authorityCertificate assembles and signs a v3 authority key certificate, as
+// specified in section 3.1 of dir-spec.txt.
+func authorityCertificate(identity, signing *rsa.PrivateKey, now time.Time) ([]byte, error) {
+	const timeFormat = "2006-01-02 15:04:05"
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "dir-key-certificate-version 3\n")
+	fmt.Fprintf(buf, "fingerprint %s\n", fingerprint(&identity.PublicKey))
+	fmt.Fprintf(buf, "dir-key-published %s\n", now.UTC().Add(-time.Hour).Format(timeFormat))
+	fmt.Fprintf(buf, "dir-key-expires %s\n", now.UTC().AddDate(1, 0, 0).Format(timeFormat))
+	fmt.Fprintf(buf, "dir-identity-key\n")
+	writePublicKey(buf, &identity.PublicKey)
+	fmt.Fprintf(buf, "dir-signing-key\n")
+	writePublicKey(buf, &signing.PublicKey)
+
+	// The signing key cross-certifies the identity key digest
+	digest := sha1.Sum(x509.MarshalPKCS1PublicKey(&identity.PublicKey))
+	crosscert, err := rsa.SignPKCS1v15(rand.Reader, signing, crypto.Hash(0), digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to cross-certify authority identity: %v", err)
+	}
+	fmt.Fprintf(buf, "dir-key-crosscert\n")
+	pem.Encode(buf, &pem.Block{Type: "ID SIGNATURE", Bytes: crosscert})
+
+	// The identity key signs everything up to and including the certification
+	// keyword line
+	fmt.Fprintf(buf, "dir-key-certification\n")
+	digest = sha1.Sum(buf.Bytes())
+	certification, err := rsa.SignPKCS1v15(rand.Reader, identity, crypto.Hash(0), digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign authority certificate: %v", err)
+	}
+	pem.Encode(buf, &pem.Block{Type: "SIGNATURE", Bytes: certification})
+
+	return buf.Bytes(), nil
+}
+
+// fingerprint returns the hex encoded SHA1 digest of an RSA public key, the way
+// Tor identifies relays and authorities.
+func fingerprint(key *rsa.PublicKey) string {
+	digest := sha1.Sum(x509.MarshalPKCS1PublicKey(key))
+	return strings.ToUpper(hex.EncodeToString(digest[:]))
+}
+
+// writePublicKey appends a PEM encoded RSA public key to a document.
+func writePublicKey(buf *bytes.Buffer, key *rsa.PublicKey) {
+	pem.Encode(buf, &pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(key)})
+}
+
+// writePrivateKey saves a PEM encoded RSA private key into a private file.
+func writePrivateKey(path string, key *rsa.PrivateKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %v", err)
+	}
+	blob := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(path, blob, 0600); err != nil {
+		return fmt.Errorf("failed to write key: %v", err)
+	}
+	return nil
+}
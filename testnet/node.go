@@ -0,0 +1,153 @@
+package testnet
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor"
+)
+
+// Role is the function of a node within the test network.
+type Role string
+
+// Node roles supported by the test network.
+const (
+	Authority Role = "authority" // Directory authority (also a relay)
+	Relay     Role = "relay"     // Middle relay, also a guard and HSDir
+	Exit      Role = "exit"      // Relay permitting exits to the loopback interface
+	Client    Role = "client"    // Client only node with a SOCKS port
+)
+
+// Node is a single Tor instance of the test network, running in a separate
+// child process.
+type Node struct {
+	Name        string // Nickname of the node
+	Role        Role   // Function of the node within the network
+	DataDir     string // Data directory of the node, containing its notice.log
+	Fingerprint string // Relay identity fingerprint (empty for clients)
+	ORPort      int    // Onion router port (zero for clients)
+	DirPort     int    // Directory port (zero for clients)
+	SocksAddr   string // Address of the SOCKS listener (empty for relays)
+
+	// Control is the authenticated controller connection of the node.
+	Control *control.Conn
+
+	kill    context.CancelFunc // Kills the node process
+	exited  chan struct{}      // Closed when the node process terminates
+	exitErr error              // Exit status of the node process
+}
+
+// start launches the node process with the given configuration and connects
+// to its control port.
+func (n *Node) start(ctx context.Context, torrc []string) error {
+	path := filepath.Join(n.DataDir, "torrc")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(torrc, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write torrc: %v", err)
+	}
+	// Nodes are Tor subprocesses, logging to their data directory only once
+	// the configuration is loaded
+	procCtx, kill := context.WithCancel(context.Background())
+	proc, err := libtor.SubprocessCreator.New(procCtx, "-f", path, "--hush")
+	if err == nil {
+		err = proc.Start()
+	}
+	if err != nil {
+		kill()
+		return fmt.Errorf("failed to start node %s: %v", n.Name, err)
+	}
+	n.kill, n.exited = kill, make(chan struct{})
+	go func() {
+		n.exitErr = proc.Wait()
+		close(n.exited)
+	}()
+	// Wait for Tor to report its control port and connect to it
+	portFile := filepath.Join(n.DataDir, "control_port")
+	for {
+		blob, err := ioutil.ReadFile(portFile)
+		if err == nil && strings.HasSuffix(string(blob), "\n") {
+			addr := strings.TrimPrefix(strings.TrimSpace(string(blob)), "PORT=")
+			if err := n.connect(addr); err != nil {
+				return err
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("node %s did not open its control port: %v", n.Name, ctx.Err())
+		case <-n.exited:
+			return fmt.Errorf("node %s terminated: %v", n.Name, n.exitErr)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if n.Role != Client {
+		return nil
+	}
+	infos, err := n.Control.GetInfo("net/listeners/socks")
+	if err != nil {
+		return fmt.Errorf("failed to query SOCKS port of %s: %v", n.Name, err)
+	}
+	for _, info := range infos {
+		if fields := strings.Fields(info.Val); len(fields) > 0 {
+			n.SocksAddr = strings.Trim(fields[0], `"`)
+		}
+	}
+	return nil
+}
+
+// connect dials and authenticates with the control port of the node.
+func (n *Node) connect(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to node %s: %v", n.Name, err)
+	}
+	n.Control = control.NewConn(textproto.NewConn(conn))
+	if err := n.Control.Authenticate(""); err != nil {
+		n.Control.Close()
+		return fmt.Errorf("failed to authenticate with node %s: %v", n.Name, err)
+	}
+	return nil
+}
+
+// waitBootstrap blocks until the node reports a complete bootstrap.
+func (n *Node) waitBootstrap(ctx context.Context) error {
+	for {
+		infos, err := n.Control.GetInfo("status/bootstrap-phase")
+		if err != nil {
+			return fmt.Errorf("failed to query bootstrap status of %s: %v", n.Name, err)
+		}
+		if len(infos) > 0 && strings.Contains(infos[0].Val, "PROGRESS=100") {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("node %s failed to bootstrap: %v", n.Name, ctx.Err())
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// stop halts the node and waits for its process to exit, killing it if needed.
+func (n *Node) stop() {
+	if n.exited == nil {
+		return
+	}
+	if n.Control != nil {
+		n.Control.Signal("HALT")
+		n.Control.Close()
+	}
+	select {
+	case <-n.exited:
+	case <-time.After(5 * time.Second):
+		n.kill()
+		<-n.exited
+	}
+	n.kill()
+}
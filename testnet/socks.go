@@ -0,0 +1,18 @@
+package testnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"berty.tech/go-libtor/internal/socks"
+)
+
+// Dial connects to addr (which may be an onion address) through the SOCKS port
+// of a client node, resolving hostnames within the test network.
+func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if n.SocksAddr == "" {
+		return nil, fmt.Errorf("node %s has no SOCKS port", n.Name)
+	}
+	return socks.Dial(ctx, n.SocksAddr, network, addr, nil)
+}
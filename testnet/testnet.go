@@ -0,0 +1,287 @@
+// Package testnet runs a private Tor network on the loopback interface, in the
+// spirit of chutney, permitting onion service and client code to be exercised
+// end-to-end without any Internet access.
+//
+// Every node runs in a child process re-executing the current binary, started
+// through libtor.SubprocessCreator. Since Tor only permits a single running
+// instance per process, this is what lets a whole network be built from the one
+// static library linked into a test binary.
+package testnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Config is the layout of a test network to start.
+type Config struct {
+	Authorities int // Number of directory authorities (default 3)
+	Relays      int // Number of middle relays (default 2)
+	Exits       int // Number of exit relays (default 1)
+	Clients     int // Number of client nodes (default 1)
+
+	// Dir is the working directory of the network. If empty, a temporary one is
+	// created and removed when the network is closed.
+	Dir string
+
+	// ExtraTorrc are additional configuration lines for every node.
+	ExtraTorrc []string
+}
+
+// Network is a running private Tor network.
+type Network struct {
+	Dir   string  // Working directory holding the data directories of all nodes
+	Nodes []*Node // All the nodes of the network, authorities first
+
+	dirAuthorities []string // DirAuthority lines of the network
+	deleteDir      bool     // Whether the working directory is temporary
+}
+
+// Timing options making the authorities vote every few seconds, so the network
+// produces its first consensus quickly.
+var fastVoting = []string{
+	"TestingV3AuthInitialVotingInterval 5",
+	"TestingV3AuthInitialVoteDelay 2",
+	"TestingV3AuthInitialDistDelay 2",
+	"V3AuthVotingInterval 10",
+	"V3AuthVoteDelay 2",
+	"V3AuthDistDelay 2",
+	"V3AuthNIntervalsValid 2",
+}
+
+// Start launches a new test network and waits until all its clients are
+// bootstrapped, which takes a few tens of seconds.
+func Start(ctx context.Context, conf *Config) (*Network, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if conf == nil {
+		conf = new(Config)
+	}
+	layout := []struct {
+		role  Role
+		count int
+		def   int
+	}{
+		{Authority, conf.Authorities, 3},
+		{Relay, conf.Relays, 2},
+		{Exit, conf.Exits, 1},
+		{Client, conf.Clients, 1},
+	}
+	nw := &Network{Dir: conf.Dir}
+	if nw.Dir == "" {
+		dir, err := ioutil.TempDir("", "libtor-testnet")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create network directory: %v", err)
+		}
+		nw.Dir, nw.deleteDir = dir, true
+	}
+	// Create the data directories and keys of all the nodes
+	for _, group := range layout {
+		count := group.count
+		if count == 0 {
+			count = group.def
+		}
+		for i := 0; i < count; i++ {
+			node, err := nw.createNode(group.role, i)
+			if err != nil {
+				nw.Close()
+				return nil, err
+			}
+			nw.Nodes = append(nw.Nodes, node)
+		}
+	}
+	// Launch every node, then wait for the clients to bootstrap
+	for _, node := range nw.Nodes {
+		if err := node.start(ctx, nw.torrc(node, conf.ExtraTorrc)); err != nil {
+			nw.Close()
+			return nil, err
+		}
+	}
+	for _, node := range nw.Clients() {
+		if err := node.waitBootstrap(ctx); err != nil {
+			nw.Close()
+			return nil, err
+		}
+	}
+	return nw, nil
+}
+
+// createNode sets up the data directory, ports and keys of a new node.
+func (nw *Network) createNode(role Role, index int) (*Node, error) {
+	node := &Node{
+		Name: fmt.Sprintf("test%s%03d", role, index),
+		Role: role,
+	}
+	node.DataDir = filepath.Join(nw.Dir, node.Name)
+	if err := os.MkdirAll(node.DataDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+	if role == Client {
+		return node, nil
+	}
+	var err error
+	if node.ORPort, err = freePort(); err != nil {
+		return nil, err
+	}
+	if node.DirPort, err = freePort(); err != nil {
+		return nil, err
+	}
+	keyDir := filepath.Join(node.DataDir, "keys")
+	if node.Fingerprint, err = writeRelayIdentity(keyDir); err != nil {
+		return nil, err
+	}
+	if role == Authority {
+		v3ident, err := writeAuthorityKeys(keyDir)
+		if err != nil {
+			return nil, err
+		}
+		nw.dirAuthorities = append(nw.dirAuthorities, fmt.Sprintf("%s orport=%d no-v2 v3ident=%s 127.0.0.1:%d %s",
+			node.Name, node.ORPort, v3ident, node.DirPort, node.Fingerprint))
+	}
+	return node, nil
+}
+
+// torrc assembles the configuration of a node.
+func (nw *Network) torrc(node *Node, extra []string) []string {
+	torrc := []string{
+		"TestingTorNetwork 1",
+		"DataDirectory " + node.DataDir,
+		"Nickname " + node.Name,
+		"Log notice file " + filepath.Join(node.DataDir, "notice.log"),
+		"SafeLogging 0",
+		"ShutdownWaitLength 0",
+		"ControlPort auto",
+		"ControlPortWriteToFile " + filepath.Join(node.DataDir, "control_port"),
+		"__OwningControllerProcess " + strconv.Itoa(os.Getpid()),
+		"AssumeReachable 1",
+		"PathsNeededToBuildCircuits 0.25",
+	}
+	for _, line := range nw.dirAuthorities {
+		torrc = append(torrc, "DirAuthority "+line)
+	}
+	torrc = append(torrc, fastVoting...)
+
+	switch node.Role {
+	case Client:
+		torrc = append(torrc, "SocksPort auto")
+	default:
+		torrc = append(torrc,
+			"SocksPort 0",
+			"Address 127.0.0.1",
+			"ORPort "+strconv.Itoa(node.ORPort),
+			"DirPort "+strconv.Itoa(node.DirPort),
+			"ContactInfo "+node.Name+"@testnet",
+		)
+	}
+	switch node.Role {
+	case Authority:
+		torrc = append(torrc,
+			"AuthoritativeDirectory 1",
+			"V3AuthoritativeDirectory 1",
+			"TestingDirAuthVoteExit *",
+			"TestingDirAuthVoteGuard *",
+			"TestingDirAuthVoteHSDir *",
+			"TestingMinExitFlagThreshold 0",
+			"ExitPolicy reject *:*",
+		)
+	case Relay:
+		torrc = append(torrc, "ExitRelay 0", "ExitPolicy reject *:*")
+	case Exit:
+		torrc = append(torrc,
+			"ExitRelay 1",
+			"ExitPolicyRejectPrivate 0",
+			"ExitPolicy accept 127.0.0.0/8:*",
+			"ExitPolicy reject *:*",
+		)
+	}
+	return append(torrc, extra...)
+}
+
+// Authorities returns the directory authority nodes of the network.
+func (nw *Network) Authorities() []*Node {
+	return nw.nodes(Authority)
+}
+
+// Relays returns the middle relay nodes of the network.
+func (nw *Network) Relays() []*Node {
+	return nw.nodes(Relay)
+}
+
+// Exits returns the exit relay nodes of the network.
+func (nw *Network) Exits() []*Node {
+	return nw.nodes(Exit)
+}
+
+// Clients returns the client nodes of the network.
+func (nw *Network) Clients() []*Node {
+	return nw.nodes(Client)
+}
+
+// nodes returns the nodes of a given role.
+func (nw *Network) nodes(role Role) []*Node {
+	var nodes []*Node
+	for _, node := range nw.Nodes {
+		if node.Role == role {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// ClientArgs returns the command line arguments joining a Tor client to the
+// network, e.g. to be used as the ExtraArgs of an in-process libtor.Start.
+func (nw *Network) ClientArgs() []string {
+	args := []string{"--TestingTorNetwork", "1"}
+	for _, line := range nw.dirAuthorities {
+		args = append(args, "--DirAuthority", line)
+	}
+	return args
+}
+
+// Close stops all the nodes of the network and removes any temporary working
+// directory.
+func (nw *Network) Close() error {
+	for i := len(nw.Nodes) - 1; i >= 0; i-- {
+		nw.Nodes[i].stop()
+	}
+	if nw.deleteDir {
+		return os.RemoveAll(nw.Dir)
+	}
+	return nil
+}
+
+// Range of the statically allocated ports, kept below the ephemeral range of
+// common kernels so nodes' outbound connections and auto ports cannot steal
+// them before they are bound.
+const (
+	minPort = 10000
+	maxPort = 30000
+)
+
+// portRand picks the port candidates, seeded so concurrent test binaries don't
+// all probe the same sequence.
+var portRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// freePort picks a random currently unused loopback TCP port.
+func freePort() (int, error) {
+	for i := 0; i < 100; i++ {
+		port := minPort + portRand.Intn(maxPort-minPort)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			continue
+		}
+		listener.Close()
+		return port, nil
+	}
+	return 0, errors.New("failed to allocate port")
+}
@@ -0,0 +1,739 @@
+package testnet_test
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control"
+
+	"berty.tech/go-libtor"
+	"berty.tech/go-libtor/health"
+	"berty.tech/go-libtor/hsdir"
+	"berty.tech/go-libtor/internal/torversion"
+	"berty.tech/go-libtor/onionbalance"
+	"berty.tech/go-libtor/relay"
+	"berty.tech/go-libtor/testnet"
+)
+
+// Tests that an onion service published on one client of a private network can
+// be reached from another one.
+func TestOnionService(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test network in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	network, err := testnet.Start(ctx, &testnet.Config{Clients: 2})
+	if err != nil {
+		t.Fatalf("failed to start test network: %v", err)
+	}
+	defer network.Close()
+
+	host, guest := network.Clients()[0], network.Clients()[1]
+
+	// Publish a web server as an onion service on the first client
+	onion, err := libtor.Listen(ctx, &libtor.ListenConf{Control: host.Control})
+	if err != nil {
+		t.Fatalf("failed to publish onion service: %v", err)
+	}
+	defer onion.Close()
+
+	go http.Serve(onion, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, Tor!"))
+	}))
+	// Fetch the page through the second client. Listen returns as soon as one
+	// HSDir accepted the descriptor, so the first lookup might still miss it.
+	client := &http.Client{Transport: &http.Transport{DialContext: guest.Dial}}
+
+	var res *http.Response
+	for {
+		if res, err = client.Get("http://" + onion.ID() + ".onion/"); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("failed to fetch onion page: %v", err)
+		case <-time.After(time.Second):
+		}
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "Hello, Tor!" {
+		t.Errorf("page mismatch: have %q, want %q", body, "Hello, Tor!")
+	}
+}
+
+// Tests that the Tor HTTP client reaches onion services, enforces its policies
+// and keeps the connections of different identities apart.
+func TestHTTPClient(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test network in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	network, err := testnet.Start(ctx, &testnet.Config{Clients: 2})
+	if err != nil {
+		t.Fatalf("failed to start test network: %v", err)
+	}
+	defer network.Close()
+
+	host, guest := network.Clients()[0], network.Clients()[1]
+
+	onion, err := libtor.Listen(ctx, &libtor.ListenConf{Control: host.Control})
+	if err != nil {
+		t.Fatalf("failed to publish onion service: %v", err)
+	}
+	defer onion.Close()
+
+	// Count the connections accepted by the web server to track pool reuse
+	var (
+		conns int
+		lock  sync.Mutex
+	)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello, Tor!"))
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				lock.Lock()
+				conns++
+				lock.Unlock()
+			}
+		},
+	}
+	go server.Serve(onion)
+
+	client, err := libtor.NewHTTPClient(&libtor.HTTPClientConf{Control: guest.Control})
+	if err != nil {
+		t.Fatalf("failed to create HTTP client: %v", err)
+	}
+	url := "http://" + onion.ID() + ".onion/"
+
+	fetch := func(ctx context.Context) error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		body, _ := ioutil.ReadAll(res.Body)
+		if string(body) != "Hello, Tor!" {
+			t.Errorf("page mismatch: have %q, want %q", body, "Hello, Tor!")
+		}
+		return nil
+	}
+	accepted := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return conns
+	}
+	// Plain HTTP is permitted to the onion service, retry until published
+	for {
+		if err = fetch(ctx); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("failed to fetch onion page: %v", err)
+		case <-time.After(time.Second):
+		}
+	}
+	if have := accepted(); have != 1 {
+		t.Fatalf("accepted connections mismatch: have %d, want %d", have, 1)
+	}
+	// The same identity reuses its connection, other identities don't
+	if err := fetch(ctx); err != nil {
+		t.Fatalf("failed to refetch onion page: %v", err)
+	}
+	if have := accepted(); have != 1 {
+		t.Errorf("connection not reused: have %d connections, want %d", have, 1)
+	}
+	if err := fetch(libtor.WithIdentity(ctx, "alice")); err != nil {
+		t.Fatalf("failed to fetch onion page as alice: %v", err)
+	}
+	if have := accepted(); have != 2 {
+		t.Errorf("connection shared across identities: have %d connections, want %d", have, 2)
+	}
+	// A new identity drops all pooled connections
+	if err := client.NewIdentity(); err != nil {
+		t.Fatalf("failed to switch identity: %v", err)
+	}
+	if err := fetch(ctx); err != nil {
+		t.Fatalf("failed to fetch onion page after new identity: %v", err)
+	}
+	if have := accepted(); have != 3 {
+		t.Errorf("connection reused after new identity: have %d connections, want %d", have, 3)
+	}
+	// Policies are enforced before anything is dialed
+	strict, err := libtor.NewHTTPClient(&libtor.HTTPClientConf{
+		Control:     guest.Control,
+		OnionPolicy: libtor.OnionTLSRequired,
+	})
+	if err != nil {
+		t.Fatalf("failed to create strict HTTP client: %v", err)
+	}
+	for _, target := range []string{url, "http://example.com/"} {
+		if _, err := strict.Get(target); err == nil {
+			t.Errorf("plain HTTP to %s permitted", target)
+		}
+	}
+	if have := accepted(); have != 3 {
+		t.Errorf("refused request reached the server: have %d connections, want %d", have, 3)
+	}
+}
+
+// Tests that the streams of different isolation identities never share a
+// circuit, and that retiring an identity tears its circuits down.
+func TestIdentities(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test network in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	network, err := testnet.Start(ctx, &testnet.Config{Clients: 2})
+	if err != nil {
+		t.Fatalf("failed to start test network: %v", err)
+	}
+	defer network.Close()
+
+	host, guest := network.Clients()[0], network.Clients()[1]
+
+	onion, err := libtor.Listen(ctx, &libtor.ListenConf{Control: host.Control})
+	if err != nil {
+		t.Fatalf("failed to publish onion service: %v", err)
+	}
+	defer onion.Close()
+
+	go http.Serve(onion, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, Tor!"))
+	}))
+	url := "http://" + onion.ID() + ".onion/"
+
+	// Fetch the page through two distinct identities
+	var (
+		identities = make([]*libtor.Identity, 2)
+		clients    = make([]*libtor.HTTPClient, 2)
+	)
+	for i := range identities {
+		if identities[i], err = libtor.NewIdentity(guest.Control); err != nil {
+			t.Fatalf("identity %d: failed to create: %v", i, err)
+		}
+		if clients[i], err = identities[i].HTTPClient(nil); err != nil {
+			t.Fatalf("identity %d: failed to create HTTP client: %v", i, err)
+		}
+		for {
+			res, err := clients[i].Get(url)
+			if err == nil {
+				res.Body.Close()
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("identity %d: failed to fetch onion page: %v", i, err)
+			case <-time.After(time.Second):
+			}
+		}
+	}
+	if identities[0].Token == identities[1].Token {
+		t.Fatalf("isolation token shared: %s", identities[0].Token)
+	}
+	// Open a few more streams per identity, following their circuits. Only the
+	// SOCKS connection of a stream identifies it, by its source address.
+	events := make(chan control.Event, 64)
+	if err := guest.Control.AddEventListener(events, control.EventCodeStream); err != nil {
+		t.Fatalf("failed to subscribe to stream events: %v", err)
+	}
+	eventCtx, eventCancel := context.WithCancel(ctx)
+	go guest.Control.HandleEvents(eventCtx)
+
+	var (
+		lock        sync.Mutex
+		sources     = make(map[string]string) // Stream IDs by source address
+		streamCircs = make(map[string]string) // Circuit IDs by stream ID
+		stop        = make(chan struct{})
+		stopped     = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			case event := <-events:
+				stream := event.(*control.StreamEvent)
+
+				lock.Lock()
+				switch stream.Status {
+				case "NEW":
+					sources[net.JoinHostPort(stream.SourceAddress, strconv.Itoa(stream.SourcePort))] = stream.StreamID
+				case "SUCCEEDED":
+					streamCircs[stream.StreamID] = stream.CircuitID
+				}
+				lock.Unlock()
+			}
+		}
+	}()
+	owners := make(map[string]int) // Identity indices by stream source address
+	for i, identity := range identities {
+		for j := 0; j < 3; j++ {
+			conn, err := identity.DialContext(ctx, "tcp", onion.ID()+".onion:80")
+			if err != nil {
+				t.Fatalf("identity %d: failed to open stream %d: %v", i, j, err)
+			}
+			owners[conn.LocalAddr().String()] = i
+
+			if _, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+				t.Fatalf("identity %d: failed to send request %d: %v", i, j, err)
+			}
+			if _, err := ioutil.ReadAll(conn); err != nil {
+				t.Fatalf("identity %d: failed to read response %d: %v", i, j, err)
+			}
+			conn.Close()
+		}
+	}
+	// Map the streams onto their circuits, once Tor reported them all
+	circuits := make(map[string]string) // Circuit IDs by stream source address
+	for len(circuits) < len(owners) {
+		lock.Lock()
+		for source := range owners {
+			if circuit, ok := streamCircs[sources[source]]; ok {
+				circuits[source] = circuit
+			}
+		}
+		lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("streams not reported: have %d, want %d", len(circuits), len(owners))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	eventCancel()
+	guest.Control.RemoveEventListener(events, control.EventCodeStream)
+	close(stop)
+	<-stopped
+
+	// Ensure no circuit carries the streams of both identities, and that each
+	// identity lists the circuits of its streams
+	circOwners := make(map[string]int)
+	for source, circuit := range circuits {
+		owner := owners[source]
+		if other, ok := circOwners[circuit]; ok && other != owner {
+			t.Errorf("circuit %s carries streams of identities %d and %d", circuit, other, owner)
+		}
+		circOwners[circuit] = owner
+	}
+	for i, identity := range identities {
+		listed, err := identity.Circuits()
+		if err != nil {
+			t.Fatalf("identity %d: failed to list circuits: %v", i, err)
+		}
+		for circuit, owner := range circOwners {
+			if owner != i {
+				continue
+			}
+			found := false
+			for _, id := range listed {
+				found = found || id == circuit
+			}
+			if !found {
+				t.Errorf("identity %d: stream circuit %s not listed in %v", i, circuit, listed)
+			}
+		}
+	}
+	// Retire the first identity and ensure only its circuits are gone
+	if err := identities[0].Retire(); err != nil {
+		t.Fatalf("failed to retire identity: %v", err)
+	}
+	if circuits, err := identities[0].Circuits(); err != nil {
+		t.Fatalf("failed to list circuits of retired identity: %v", err)
+	} else if len(circuits) != 0 {
+		t.Errorf("circuits of retired identity still open: %v", circuits)
+	}
+	if _, err := clients[0].Get(url); err == nil {
+		t.Errorf("retired identity fetched onion page")
+	}
+	if _, err := identities[0].Dial("tcp", onion.ID()+".onion:80"); err != libtor.ErrIdentityRetired {
+		t.Errorf("retired identity dial error mismatch: have %v, want %v", err, libtor.ErrIdentityRetired)
+	}
+	res, err := clients[1].Get(url)
+	if err != nil {
+		t.Fatalf("failed to fetch onion page through remaining identity: %v", err)
+	}
+	res.Body.Close()
+}
+
+// Tests that the embedded Tor run in relay mode passes its reachability self
+// test and gets its descriptor accepted by the directory authorities.
+func TestRelay(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test network in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	network, err := testnet.Start(ctx, &testnet.Config{Clients: 1})
+	if err != nil {
+		t.Fatalf("failed to start test network: %v", err)
+	}
+	defer network.Close()
+
+	tor, err := libtor.Start(ctx, &libtor.StartConf{
+		Relay: &relay.Config{
+			Nickname:      "embedded",
+			ContactInfo:   "embedded@testnet",
+			Address:       "127.0.0.1",
+			BandwidthRate: 1 << 20,
+		},
+		ExtraArgs: network.ClientArgs(),
+	})
+	if err != nil {
+		t.Fatalf("failed to start embedded relay: %v", err)
+	}
+	defer tor.Close()
+
+	var status *relay.Status
+	for {
+		if status, err = relay.ReadStatus(tor.Control); err != nil {
+			t.Fatalf("failed to read relay status: %v", err)
+		}
+		if status.ORReachable && status.DescriptorAccepted {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("relay not published: %+v", status)
+		case <-time.After(time.Second):
+		}
+	}
+	if len(status.Fingerprint) != 40 {
+		t.Errorf("invalid relay fingerprint %q", status.Fingerprint)
+	}
+	if status.Accounting {
+		t.Errorf("accounting enabled without a maximum")
+	}
+}
+
+// Tests that the health monitor finds a published onion service reachable
+// through a self-connection, and brings it back after it was taken down.
+func TestOnionHealth(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test network in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	network, err := testnet.Start(ctx, &testnet.Config{Clients: 1})
+	if err != nil {
+		t.Fatalf("failed to start test network: %v", err)
+	}
+	defer network.Close()
+
+	host := network.Clients()[0]
+
+	onion, err := libtor.Listen(ctx, &libtor.ListenConf{Control: host.Control})
+	if err != nil {
+		t.Fatalf("failed to publish onion service: %v", err)
+	}
+	defer onion.Close()
+
+	go http.Serve(onion, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	monitor, err := onion.Monitor(&health.Config{Interval: time.Hour, MaxFailures: 1})
+	if err != nil {
+		t.Fatalf("failed to start health monitor: %v", err)
+	}
+	defer monitor.Close()
+
+	check := func() *health.Status {
+		for {
+			status, err := monitor.Check(ctx)
+			if err != nil {
+				t.Fatalf("failed to check onion service: %v", err)
+			}
+			if status.Health == health.HealthHealthy {
+				return status
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("onion service not healthy: %+v", status)
+			case <-time.After(time.Second):
+			}
+		}
+	}
+	check()
+
+	// Take the service down behind the monitor's back, it must recover it
+	if err := host.Control.DelOnion(onion.ID()); err != nil {
+		t.Fatalf("failed to remove onion service: %v", err)
+	}
+	status := check()
+	if status.Republishes+status.Recreations == 0 {
+		t.Errorf("onion service recovered without repairs: %+v", status)
+	}
+}
+
+// Tests that the HSDirs computed from the consensus of a client are exactly the
+// ones its onion service uploads descriptors to, in the same order. The network
+// has more HSDirs than a descriptor is stored on, so the ring walk matters.
+func TestHSDirRing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test network in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	network, err := testnet.Start(ctx, &testnet.Config{Relays: 6, Clients: 1})
+	if err != nil {
+		t.Fatalf("failed to start test network: %v", err)
+	}
+	defer network.Close()
+
+	host := network.Clients()[0]
+
+	// Subscribe before publishing, so no upload slips through
+	events := make(chan control.Event, 64)
+	if err := host.Control.AddEventListener(events, control.EventCodeHSDesc); err != nil {
+		t.Fatalf("failed to subscribe to descriptor events: %v", err)
+	}
+	defer host.Control.RemoveEventListener(events, control.EventCodeHSDesc)
+
+	onion, err := libtor.Listen(ctx, &libtor.ListenConf{Control: host.Control, NoWait: true})
+	if err != nil {
+		t.Fatalf("failed to publish onion service: %v", err)
+	}
+	defer onion.Close()
+
+	go host.Control.HandleEvents(ctx)
+
+	// Descriptors are uploaded to all their HSDirs at once, so the uploads of
+	// each blinded key are complete once the first one succeeded
+	uploads := make(map[string][]string)
+	for published := false; !published; {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("onion service not published, uploads: %v", uploads)
+		case event := <-events:
+			hs, ok := event.(*control.HSDescEvent)
+			if !ok || hs.Address != onion.ID() {
+				continue
+			}
+			switch hs.Action {
+			case "UPLOAD":
+				fingerprint := strings.TrimPrefix(hs.HSDir, "$")
+				if i := strings.IndexAny(fingerprint, "~="); i >= 0 {
+					fingerprint = fingerprint[:i]
+				}
+				descID := strings.TrimRight(hs.DescID, "=")
+				uploads[descID] = append(uploads[descID], fingerprint)
+			case "UPLOADED":
+				published = true
+			}
+		}
+	}
+	consensus, err := hsdir.Load(host.DataDir)
+	if err != nil {
+		t.Fatalf("failed to load consensus: %v", err)
+	}
+	consensus.TestingTorNetwork = true
+
+	hsdirs := 0
+	for _, relay := range consensus.Relays {
+		if relay.HSDir() {
+			hsdirs++
+		}
+	}
+	if spread := hsdir.DefaultReplicas * hsdir.DefaultSpreadStore; hsdirs <= spread {
+		t.Fatalf("HSDir count too low: have %d, want more than %d", hsdirs, spread)
+	}
+	// The service uploads the descriptors of the current and next time period
+	results := make(map[string]*hsdir.Result)
+
+	period := consensus.TimePeriod(time.Now())
+	for _, p := range []uint64{period - 1, period, period + 1} {
+		res, err := consensus.Lookup(onion.ID(), consensus.TimePeriodStart(p))
+		if err != nil {
+			continue
+		}
+		results[base64.RawStdEncoding.EncodeToString(res.BlindedKey[:])] = res
+	}
+	if len(uploads) == 0 {
+		t.Fatalf("no descriptor uploads seen")
+	}
+	for descID, fingerprints := range uploads {
+		res, ok := results[descID]
+		if !ok {
+			t.Errorf("descriptor %s: blinded key of no computed time period", descID)
+			continue
+		}
+		if have, want := fingerprints, res.Fingerprints(); !reflect.DeepEqual(have, want) {
+			t.Errorf("time period %d: HSDirs mismatch: have %v, want %v", res.TimePeriod, have, want)
+		}
+	}
+}
+
+// Tests that onion services with limits are hosted from a HiddenServiceDir.
+func TestOnionServiceConf(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping embedded Tor in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tor, err := libtor.Start(ctx, &libtor.StartConf{DisableNetwork: true})
+	if err != nil {
+		t.Fatalf("failed to start embedded Tor: %v", err)
+	}
+	defer tor.Close()
+
+	conf := &libtor.OnionServiceConf{
+		Dir:                    filepath.Join(tor.DataDir, "onion"),
+		Ports:                  []string{"80 127.0.0.1:8080"},
+		MaxStreams:             16,
+		MaxStreamsCloseCircuit: true,
+		NumIntroPoints:         5,
+	}
+	if err := libtor.ConfigureOnionServices(tor.Control, conf); err != nil {
+		t.Fatalf("failed to configure onion service: %v", err)
+	}
+	hostname, err := ioutil.ReadFile(filepath.Join(conf.Dir, "hostname"))
+	if err != nil {
+		t.Fatalf("failed to read onion service hostname: %v", err)
+	}
+	if len(strings.TrimSpace(string(hostname))) != 62 {
+		t.Errorf("invalid v3 onion hostname %q", hostname)
+	}
+}
+
+// Tests that an onion address published by an Onionbalance frontend spreads its
+// clients over the backends. Backends need Tor 0.4.3, so the test is skipped as
+// long as the embedded Tor is older.
+func TestOnionBalance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test network in short mode")
+	}
+	// Check the version up front instead of after starting the network
+	version, err := torversion.ParseProvider(libtor.ProviderVersion())
+	if err != nil {
+		t.Fatalf("failed to parse embedded Tor version: %v", err)
+	}
+	if !torversion.AtLeast(version, 0, 4, 3) {
+		t.Skipf("onionbalance unsupported by embedded %s", libtor.ProviderVersion())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	network, err := testnet.Start(ctx, &testnet.Config{Clients: 3})
+	if err != nil {
+		t.Fatalf("failed to start test network: %v", err)
+	}
+	defer network.Close()
+
+	key, err := libtor.GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("failed to generate frontend key: %v", err)
+	}
+	master := libtor.OnionID(key)
+
+	// Run a web server behind each backend, answering with its name
+	var backends []string
+	for i, host := range network.Clients()[:2] {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen for backend %d: %v", i, err)
+		}
+		defer listener.Close()
+
+		name := host.Name
+		go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		conf := &libtor.OnionServiceConf{
+			Dir:                filepath.Join(host.DataDir, "onion"),
+			Ports:              []string{"80 " + listener.Addr().String()},
+			OnionbalanceMaster: master,
+		}
+		if err := libtor.ConfigureOnionServices(host.Control, conf); err != nil {
+			t.Fatalf("failed to configure backend %d: %v", i, err)
+		}
+		hostname, err := ioutil.ReadFile(filepath.Join(conf.Dir, "hostname"))
+		if err != nil {
+			t.Fatalf("failed to read backend %d hostname: %v", i, err)
+		}
+		backends = append(backends, strings.TrimSuffix(strings.TrimSpace(string(hostname)), ".onion"))
+	}
+	// Publish the merged descriptor from an embedded frontend, until the
+	// backends published theirs
+	tor, err := libtor.Start(ctx, &libtor.StartConf{ExtraArgs: network.ClientArgs()})
+	if err != nil {
+		t.Fatalf("failed to start frontend: %v", err)
+	}
+	defer tor.Close()
+
+	// Time periods of test networks last a shared random protocol run, 24
+	// votes of 10 seconds, starting 12 votes into a run
+	frontend, err := onionbalance.New(&onionbalance.Config{
+		Control:        tor.Control,
+		Key:            key,
+		Backends:       backends,
+		Interval:       time.Hour,
+		FetchTimeout:   30 * time.Second,
+		PeriodLength:   4 * time.Minute,
+		RotationOffset: 2 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("failed to start frontend: %v", err)
+	}
+	defer frontend.Close()
+
+	for {
+		status, err := frontend.Publish(ctx)
+		if err == nil && status.Backends[0].IntroPoints > 0 && status.Backends[1].IntroPoints > 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("frontend not published: %v", err)
+		case <-time.After(time.Second):
+		}
+	}
+	// Fetch the page of the frontend address through the remaining client
+	client := &http.Client{Transport: &http.Transport{DialContext: network.Clients()[2].Dial}}
+
+	var res *http.Response
+	for {
+		if res, err = client.Get("http://" + master + ".onion/"); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("failed to fetch frontend page: %v", err)
+		case <-time.After(time.Second):
+		}
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if name := string(body); name != network.Clients()[0].Name && name != network.Clients()[1].Name {
+		t.Errorf("page not served by a backend: %q", name)
+	}
+}
@@ -0,0 +1,164 @@
+package libtor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/process"
+
+	"berty.tech/go-libtor/relay"
+	"berty.tech/go-libtor/resolver"
+)
+
+// StartConf is the configuration used to start an embedded Tor instance.
+type StartConf struct {
+	// Creator is the process creator to launch Tor with. If nil, the in-process
+	// embedded Creator is used.
+	Creator process.Creator
+
+	// DataDir is the Tor data directory. If empty, a temporary directory is
+	// created and removed when the instance is closed.
+	DataDir string
+
+	// TorrcFile is the configuration file to load. If empty, an empty torrc is
+	// created in the data directory so no system wide configuration is picked up.
+	TorrcFile string
+
+	// DisableNetwork starts Tor with DisableNetwork set, deferring any network
+	// activity until the caller explicitly enables it.
+	DisableNetwork bool
+
+	// Relay, if set, runs Tor as a non-exit relay or bridge in addition to being
+	// a client.
+	Relay *relay.Config
+
+	// ExtraArgs are appended as-is to the Tor command line.
+	ExtraArgs []string
+
+	// DebugWriter, if set, receives the raw controller protocol exchange.
+	DebugWriter io.Writer
+}
+
+// Tor is an embedded Tor instance, driven through its owning controller
+// connection. Tor shuts down when the connection is closed.
+type Tor struct {
+	// Process is the running Tor process.
+	Process process.Process
+
+	// Control is the authenticated owning controller connection.
+	Control *control.Conn
+
+	// DataDir is the data directory Tor was started with.
+	DataDir string
+
+	deleteDataDir bool // Whether the data directory is temporary
+
+	resolver     *resolver.Resolver // Lookups sharing the controller, created on demand
+	resolverOnce sync.Once
+}
+
+// Start launches a new Tor instance and connects to it over the owning control
+// socket, without requiring any control port to be opened.
+func Start(ctx context.Context, conf *StartConf) (*Tor, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if conf == nil {
+		conf = new(StartConf)
+	}
+	creator := conf.Creator
+	if creator == nil {
+		creator = Creator
+	}
+	t := &Tor{DataDir: conf.DataDir}
+
+	// Create the data directory and the configuration file if needed
+	if t.DataDir == "" {
+		dir, err := ioutil.TempDir("", "libtor")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %v", err)
+		}
+		t.DataDir, t.deleteDataDir = dir, true
+	} else if err := os.MkdirAll(t.DataDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+	torrc := conf.TorrcFile
+	if torrc == "" {
+		torrc = filepath.Join(t.DataDir, "torrc")
+		if _, err := os.Stat(torrc); os.IsNotExist(err) {
+			if err := ioutil.WriteFile(torrc, nil, 0600); err != nil {
+				t.cleanup()
+				return nil, fmt.Errorf("failed to create torrc: %v", err)
+			}
+		}
+	}
+	args := []string{"-f", torrc, "--DataDirectory", t.DataDir, "--SocksPort", "auto"}
+	if conf.DisableNetwork {
+		args = append(args, "--DisableNetwork", "1")
+	}
+	if conf.Relay != nil {
+		relayArgs, err := conf.Relay.Args()
+		if err != nil {
+			t.cleanup()
+			return nil, fmt.Errorf("invalid relay configuration: %v", err)
+		}
+		args = append(args, relayArgs...)
+	}
+	args = append(args, conf.ExtraArgs...)
+
+	// Start the process and attach to its owning controller socket
+	proc, err := creator.New(ctx, args...)
+	if err != nil {
+		t.cleanup()
+		return nil, fmt.Errorf("failed to create tor process: %v", err)
+	}
+	sock, err := proc.EmbeddedControlConn()
+	if err != nil {
+		t.cleanup()
+		return nil, err
+	}
+	if err := proc.Start(); err != nil {
+		sock.Close()
+		t.cleanup()
+		return nil, fmt.Errorf("failed to start tor: %v", err)
+	}
+	t.Process = proc
+	t.Control = control.NewConn(textproto.NewConn(sock))
+	t.Control.DebugWriter = conf.DebugWriter
+
+	if err := t.Control.Authenticate(""); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("failed to authenticate controller: %v", err)
+	}
+	return t, nil
+}
+
+// EnableNetwork clears DisableNetwork, permitting Tor to bootstrap.
+func (t *Tor) EnableNetwork() error {
+	return t.Control.SetConf(control.KeyVals("DisableNetwork", "0")...)
+}
+
+// Close shuts Tor down by dropping the owning controller connection, waits for
+// the process to terminate and removes any temporary data directory.
+func (t *Tor) Close() error {
+	err := t.Control.Close()
+	if werr := t.Process.Wait(); err == nil {
+		err = werr
+	}
+	t.cleanup()
+	return err
+}
+
+// cleanup removes the data directory if it was created by Start.
+func (t *Tor) cleanup() {
+	if t.deleteDataDir {
+		os.RemoveAll(t.DataDir)
+	}
+}
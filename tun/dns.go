@@ -0,0 +1,213 @@
+package tun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS record types and response codes answered by the stack.
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeOK       = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImpl  = 4
+)
+
+// dnsTimeout bounds how long a single query may take to resolve through Tor.
+const dnsTimeout = 30 * time.Second
+
+// dnsTTL is the TTL of answers, as the resolver interface carries none.
+const dnsTTL = 60
+
+// dnsQuestion is the single question of a DNS query.
+type dnsQuestion struct {
+	id     uint16
+	rd     bool   // Whether recursion was desired, echoed back
+	name   string // Queried name, without the trailing dot
+	qtype  uint16
+	qclass uint16
+	raw    []byte // Wire format of the question section, echoed back
+}
+
+// parseDNSQuery parses a DNS query carrying exactly one question.
+func parseDNSQuery(b []byte) (*dnsQuestion, error) {
+	if len(b) < 12 {
+		return nil, errors.New("short DNS header")
+	}
+	if b[2]&0x80 != 0 {
+		return nil, errors.New("not a DNS query")
+	}
+	q := &dnsQuestion{id: binary.BigEndian.Uint16(b[0:2]), rd: b[2]&0x01 != 0}
+	if binary.BigEndian.Uint16(b[4:6]) != 1 {
+		return q, errors.New("expected a single DNS question")
+	}
+	var (
+		labels []string
+		off    = 12
+	)
+	for {
+		if off >= len(b) {
+			return q, errors.New("truncated DNS name")
+		}
+		size := int(b[off])
+		off++
+		if size == 0 {
+			break
+		}
+		if size > 63 || off+size > len(b) {
+			return q, errors.New("invalid DNS label")
+		}
+		labels = append(labels, string(b[off:off+size]))
+		off += size
+	}
+	if off+4 > len(b) {
+		return q, errors.New("truncated DNS question")
+	}
+	q.name = strings.Join(labels, ".")
+	q.qtype = binary.BigEndian.Uint16(b[off : off+2])
+	q.qclass = binary.BigEndian.Uint16(b[off+2 : off+4])
+	q.raw = append([]byte(nil), b[12:off+4]...)
+	return q, nil
+}
+
+// buildDNSResponse assembles the response to a query, with the given resource
+// data for each answer record (of the queried type).
+func buildDNSResponse(q *dnsQuestion, rcode byte, answers [][]byte) []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:2], q.id)
+	b[2] = 0x80 // Response
+	if q.rd {
+		b[2] |= 0x01
+	}
+	b[3] = 0x80 | rcode // Recursion available
+	if q.raw != nil {
+		binary.BigEndian.PutUint16(b[4:6], 1)
+		b = append(b, q.raw...)
+	}
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(answers)))
+	for _, data := range answers {
+		var rr [12]byte
+		binary.BigEndian.PutUint16(rr[0:2], 0xc00c) // Pointer to the question name
+		binary.BigEndian.PutUint16(rr[2:4], q.qtype)
+		binary.BigEndian.PutUint16(rr[4:6], dnsClassIN)
+		binary.BigEndian.PutUint32(rr[6:10], dnsTTL)
+		binary.BigEndian.PutUint16(rr[10:12], uint16(len(data)))
+		b = append(append(b, rr[:]...), data...)
+	}
+	return b
+}
+
+// answerDNS resolves a DNS query through the resolver, returning the response.
+func answerDNS(ctx context.Context, resolver Resolver, query []byte) []byte {
+	q, err := parseDNSQuery(query)
+	if err != nil {
+		if q == nil {
+			return nil
+		}
+		return buildDNSResponse(q, dnsRcodeFormErr, nil)
+	}
+	if q.qclass != dnsClassIN {
+		return buildDNSResponse(q, dnsRcodeNotImpl, nil)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	var answers [][]byte
+	switch q.qtype {
+	case dnsTypeA, dnsTypeAAAA:
+		addrs, err := resolver.LookupIPAddr(ctx, q.name)
+		if err != nil {
+			return buildDNSResponse(q, dnsErrorCode(err), nil)
+		}
+		for _, addr := range addrs {
+			if ip4 := addr.IP.To4(); ip4 != nil && q.qtype == dnsTypeA {
+				answers = append(answers, []byte(ip4))
+			} else if ip4 == nil && q.qtype == dnsTypeAAAA {
+				answers = append(answers, []byte(addr.IP.To16()))
+			}
+		}
+
+	case dnsTypePTR:
+		ip := parseReverseName(q.name)
+		if ip == nil {
+			return buildDNSResponse(q, dnsRcodeNXDomain, nil)
+		}
+		names, err := resolver.LookupAddr(ctx, ip.String())
+		if err != nil {
+			return buildDNSResponse(q, dnsErrorCode(err), nil)
+		}
+		for _, name := range names {
+			answers = append(answers, encodeDNSName(name))
+		}
+
+	default:
+		return buildDNSResponse(q, dnsRcodeNotImpl, nil)
+	}
+	return buildDNSResponse(q, dnsRcodeOK, answers)
+}
+
+// dnsErrorCode maps a lookup error to a DNS response code.
+func dnsErrorCode(err error) byte {
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return dnsRcodeNXDomain
+	}
+	return dnsRcodeServFail
+}
+
+// parseReverseName extracts the IP address from an in-addr.arpa or ip6.arpa
+// name, returning nil for anything else.
+func parseReverseName(name string) net.IP {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		parts := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(parts) != 4 {
+			return nil
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			v, err := strconv.ParseUint(nibble, 16, 8)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+			// Nibbles are listed least significant first
+			pos := 31 - i
+			ip[pos/2] |= byte(v) << (4 * uint(1-pos%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// encodeDNSName encodes a name into the uncompressed DNS wire format.
+func encodeDNSName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			continue
+		}
+		b = append(append(b, byte(len(label))), label...)
+	}
+	return append(b, 0)
+}
@@ -0,0 +1,252 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// IP protocol numbers handled by the stack.
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// TCP header flags.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// Header sizes without options.
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	tcpHeaderLen  = 20
+	udpHeaderLen  = 8
+)
+
+// ipPacket is a parsed IPv4 or IPv6 packet.
+type ipPacket struct {
+	src, dst net.IP
+	proto    byte
+	payload  []byte
+}
+
+// parseIP parses an IP packet as read from the TUN device. Fragments and IPv6
+// extension headers are not supported, such packets are rejected.
+func parseIP(b []byte) (*ipPacket, error) {
+	if len(b) < 1 {
+		return nil, errors.New("empty packet")
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < ipv4HeaderLen {
+			return nil, errors.New("short IPv4 header")
+		}
+		hlen := int(b[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(b[2:4]))
+		if hlen < ipv4HeaderLen || total < hlen || total > len(b) {
+			return nil, errors.New("invalid IPv4 length")
+		}
+		if frag := binary.BigEndian.Uint16(b[6:8]); frag&0x3fff != 0 {
+			return nil, errors.New("IPv4 fragment")
+		}
+		return &ipPacket{
+			src:     net.IP(b[12:16]),
+			dst:     net.IP(b[16:20]),
+			proto:   b[9],
+			payload: b[hlen:total],
+		}, nil
+
+	case 6:
+		if len(b) < ipv6HeaderLen {
+			return nil, errors.New("short IPv6 header")
+		}
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(b[4:6]))
+		if total > len(b) {
+			return nil, errors.New("invalid IPv6 length")
+		}
+		return &ipPacket{
+			src:     net.IP(b[8:24]),
+			dst:     net.IP(b[24:40]),
+			proto:   b[6],
+			payload: b[ipv6HeaderLen:total],
+		}, nil
+
+	default:
+		return nil, errors.New("unknown IP version")
+	}
+}
+
+// buildIP assembles an IP packet around a transport payload, whose checksum must
+// already be filled in. The IP version follows the addresses.
+func buildIP(src, dst net.IP, proto byte, payload []byte) []byte {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		b := make([]byte, ipv4HeaderLen+len(payload))
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+		b[6] = 0x40 // Don't fragment
+		b[8] = 64
+		b[9] = proto
+		copy(b[12:16], src4)
+		copy(b[16:20], dst4)
+		binary.BigEndian.PutUint16(b[10:12], ^checksum(0, b[:ipv4HeaderLen]))
+		copy(b[ipv4HeaderLen:], payload)
+		return b
+	}
+	b := make([]byte, ipv6HeaderLen+len(payload))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	b[6] = proto
+	b[7] = 64
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+	copy(b[ipv6HeaderLen:], payload)
+	return b
+}
+
+// tcpSegment is a parsed TCP segment.
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            byte
+	window           uint16
+	mss              uint16 // Maximum segment size option, zero if absent
+	payload          []byte
+}
+
+// parseTCP parses a TCP segment. The checksum is not verified, as packets from a
+// TUN device come from the local kernel.
+func parseTCP(b []byte) (*tcpSegment, error) {
+	if len(b) < tcpHeaderLen {
+		return nil, errors.New("short TCP header")
+	}
+	hlen := int(b[12]>>4) * 4
+	if hlen < tcpHeaderLen || hlen > len(b) {
+		return nil, errors.New("invalid TCP header length")
+	}
+	seg := &tcpSegment{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		seq:     binary.BigEndian.Uint32(b[4:8]),
+		ack:     binary.BigEndian.Uint32(b[8:12]),
+		flags:   b[13],
+		window:  binary.BigEndian.Uint16(b[14:16]),
+		payload: b[hlen:],
+	}
+	// Pick the MSS out of the options, skipping everything else
+	for opts := b[tcpHeaderLen:hlen]; len(opts) > 0; {
+		switch opts[0] {
+		case 0: // End of options
+			opts = nil
+			continue
+		case 1: // No-op
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if opts[0] == 2 && opts[1] == 4 {
+			seg.mss = binary.BigEndian.Uint16(opts[2:4])
+		}
+		opts = opts[opts[1]:]
+	}
+	return seg, nil
+}
+
+// buildTCP assembles a TCP segment with its checksum, adding an MSS option to
+// SYN segments.
+func buildTCP(src, dst net.IP, seg *tcpSegment) []byte {
+	hlen := tcpHeaderLen
+	if seg.flags&tcpSYN != 0 && seg.mss != 0 {
+		hlen += 4
+	}
+	b := make([]byte, hlen+len(seg.payload))
+	binary.BigEndian.PutUint16(b[0:2], seg.srcPort)
+	binary.BigEndian.PutUint16(b[2:4], seg.dstPort)
+	binary.BigEndian.PutUint32(b[4:8], seg.seq)
+	binary.BigEndian.PutUint32(b[8:12], seg.ack)
+	b[12] = byte(hlen/4) << 4
+	b[13] = seg.flags
+	binary.BigEndian.PutUint16(b[14:16], seg.window)
+	if hlen > tcpHeaderLen {
+		b[20], b[21] = 2, 4
+		binary.BigEndian.PutUint16(b[22:24], seg.mss)
+	}
+	copy(b[hlen:], seg.payload)
+	binary.BigEndian.PutUint16(b[16:18], ^checksum(pseudoHeaderSum(src, dst, protoTCP, len(b)), b))
+	return buildIP(src, dst, protoTCP, b)
+}
+
+// udpDatagram is a parsed UDP datagram.
+type udpDatagram struct {
+	srcPort, dstPort uint16
+	payload          []byte
+}
+
+// parseUDP parses a UDP datagram.
+func parseUDP(b []byte) (*udpDatagram, error) {
+	if len(b) < udpHeaderLen {
+		return nil, errors.New("short UDP header")
+	}
+	length := int(binary.BigEndian.Uint16(b[4:6]))
+	if length < udpHeaderLen || length > len(b) {
+		return nil, errors.New("invalid UDP length")
+	}
+	return &udpDatagram{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		payload: b[udpHeaderLen:length],
+	}, nil
+}
+
+// buildUDP assembles a UDP datagram with its checksum.
+func buildUDP(src, dst net.IP, dgram *udpDatagram) []byte {
+	b := make([]byte, udpHeaderLen+len(dgram.payload))
+	binary.BigEndian.PutUint16(b[0:2], dgram.srcPort)
+	binary.BigEndian.PutUint16(b[2:4], dgram.dstPort)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	copy(b[udpHeaderLen:], dgram.payload)
+
+	sum := ^checksum(pseudoHeaderSum(src, dst, protoUDP, len(b)), b)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[6:8], sum)
+	return buildIP(src, dst, protoUDP, b)
+}
+
+// pseudoHeaderSum sums the IPv4 or IPv6 pseudo header covered by transport
+// checksums.
+func pseudoHeaderSum(src, dst net.IP, proto byte, length int) uint32 {
+	var sum uint32
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		sum = uint32(checksum(sum, src4))
+		sum = uint32(checksum(sum, dst4))
+	} else {
+		sum = uint32(checksum(sum, src.To16()))
+		sum = uint32(checksum(sum, dst.To16()))
+	}
+	return sum + uint32(proto) + uint32(length)
+}
+
+// checksum adds data to a running ones' complement sum, returning it folded to
+// 16 bits (and thus usable as the initial sum of another round).
+func checksum(sum uint32, b []byte) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) > 0 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,520 @@
+package tun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxInbound is the amount of data buffered from the device before Tor
+	// takes it, advertised as the receive window. Window scaling is not used.
+	maxInbound = 65535
+
+	// defaultMSS is the segment size assumed if the device sends none.
+	defaultMSS = 536
+
+	// dialTimeout bounds how long opening a Tor stream for a flow may take.
+	dialTimeout = 2 * time.Minute
+
+	// retransmitTick is how often unacknowledged segments are checked.
+	retransmitTick = 250 * time.Millisecond
+
+	// minRTO and maxRTO bound the retransmission timeout, doubled on each
+	// retry and reset on progress.
+	minRTO = time.Second
+	maxRTO = 30 * time.Second
+
+	// maxRetries is how many retransmissions without progress are tolerated
+	// before a flow is reset.
+	maxRetries = 8
+)
+
+// Flow states.
+const (
+	stateDialing     = iota // Waiting for the Tor stream, SYN not answered yet
+	stateSynReceived        // SYN-ACK sent, waiting for its acknowledgement
+	stateEstablished        // Handshake done, data flowing
+	stateClosed             // Flow torn down
+)
+
+// flowKey identifies a TCP flow by its addresses and ports.
+type flowKey struct {
+	src, dst         [16]byte
+	srcPort, dstPort uint16
+}
+
+// newFlowKey creates the key of a flow as seen from the device.
+func newFlowKey(src net.IP, srcPort uint16, dst net.IP, dstPort uint16) flowKey {
+	key := flowKey{srcPort: srcPort, dstPort: dstPort}
+	copy(key.src[:], src.To16())
+	copy(key.dst[:], dst.To16())
+	return key
+}
+
+// flow is a TCP connection of the device terminated by the stack and relayed
+// over a Tor stream.
+type flow struct {
+	stack *Stack
+	key   flowKey
+
+	local      net.IP // Address of the app within the device
+	localPort  uint16
+	remote     net.IP // Destination the app connects to
+	remotePort uint16
+
+	conn  net.Conn // Tor stream, set once dialed
+	state int
+
+	iss     uint32 // Initial send sequence number
+	sndUna  uint32 // Oldest unacknowledged sequence number
+	sndNxt  uint32 // Next sequence number to send
+	rcvNxt  uint32 // Next sequence number expected from the device
+	peerWnd uint32 // Receive window advertised by the device
+	mss     int    // Largest segment the device accepts
+
+	unacked  []byte // Data between sndUna and sndNxt (sans FIN)
+	finSent  bool   // Whether the Tor stream ended and a FIN was sent
+	finAcked bool   // Whether the device acknowledged the FIN
+	finRecv  bool   // Whether the device sent its FIN
+	drained  bool   // Whether all data of the device was passed to Tor
+
+	inbound     [][]byte // Data from the device not yet written to Tor
+	inboundSize int
+
+	rto      time.Duration // Current retransmission timeout
+	deadline time.Time     // When to retransmit if no progress is made
+	retries  int           // Retransmissions since the last progress
+	dupAcks  int           // Duplicate acknowledgements of sndUna in a row
+
+	lock sync.Mutex
+	cond *sync.Cond // Signalled on every state, window or buffer change
+}
+
+// newFlow creates a flow from the SYN opening it.
+func newFlow(s *Stack, key flowKey, local net.IP, localPort uint16, remote net.IP, remotePort uint16, syn *tcpSegment) *flow {
+	var isn [4]byte
+	rand.Read(isn[:])
+
+	f := &flow{
+		stack:      s,
+		key:        key,
+		local:      local,
+		localPort:  localPort,
+		remote:     remote,
+		remotePort: remotePort,
+		iss:        binary.BigEndian.Uint32(isn[:]),
+		rcvNxt:     syn.seq + 1,
+		peerWnd:    uint32(syn.window),
+		mss:        defaultMSS,
+		rto:        minRTO,
+	}
+	if syn.mss != 0 {
+		f.mss = int(syn.mss)
+	}
+	if limit := f.maxSegment(); f.mss > limit {
+		f.mss = limit
+	}
+	f.sndUna, f.sndNxt = f.iss, f.iss
+	f.cond = sync.NewCond(&f.lock)
+	return f
+}
+
+// dial opens the Tor stream of the flow, answering the SYN once connected, or
+// resetting the flow if the destination is unreachable.
+func (f *flow) dial() {
+	defer f.stack.wg.Done()
+
+	ctx, cancel := context.WithTimeout(f.stack.ctx, dialTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(f.remote.String(), strconv.Itoa(int(f.remotePort)))
+	conn, err := f.stack.conf.Dial(ctx, "tcp", addr)
+
+	f.lock.Lock()
+	if err != nil || f.state == stateClosed {
+		if conn != nil {
+			conn.Close()
+		}
+		f.sendLocked(&tcpSegment{ack: f.rcvNxt, flags: tcpRST | tcpACK})
+		f.closeLocked()
+		f.lock.Unlock()
+		return
+	}
+	f.conn = conn
+	f.state = stateSynReceived
+	f.sndNxt = f.iss + 1
+	f.sendSynAck()
+	f.lock.Unlock()
+
+	f.stack.wg.Add(2)
+	go f.readLoop()
+	go f.writeLoop()
+}
+
+// handle processes a segment sent by the device.
+func (f *flow) handle(seg *tcpSegment) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.state == stateClosed {
+		return
+	}
+	if seg.flags&tcpRST != 0 {
+		f.closeLocked()
+		return
+	}
+	if seg.flags&tcpSYN != 0 {
+		// Retransmitted SYN, answer again if our SYN-ACK got lost
+		if f.state == stateSynReceived && seg.seq+1 == f.rcvNxt {
+			f.sendSynAck()
+		}
+		return
+	}
+	if f.state == stateDialing || seg.flags&tcpACK == 0 {
+		return
+	}
+	// Process the acknowledgement and window update
+	if seqLE(seg.ack, f.sndNxt) && seqGT(seg.ack, f.sndUna) {
+		acked := int(seg.ack - f.sndUna)
+		if f.state == stateSynReceived {
+			f.state = stateEstablished
+			acked--
+		}
+		if acked > len(f.unacked) {
+			f.finAcked = f.finSent
+			acked = len(f.unacked)
+		}
+		f.unacked = f.unacked[acked:]
+		f.sndUna = seg.ack
+		f.dupAcks = 0
+		f.progress()
+	} else if seg.ack == f.sndUna && len(seg.payload) == 0 && seg.flags&tcpFIN == 0 && len(f.unacked) > 0 {
+		// Fast retransmit on the third duplicate acknowledgement
+		if f.dupAcks++; f.dupAcks == 3 {
+			f.resendUnacked(f.mss)
+		}
+	}
+	if f.state == stateSynReceived {
+		return
+	}
+	if seqGE(seg.ack, f.sndUna) {
+		f.peerWnd = uint32(seg.window)
+		f.cond.Broadcast()
+
+		// Nothing in flight, the device is alive even if its window is closed
+		if len(f.unacked) == 0 && (!f.finSent || f.finAcked) {
+			f.retries = 0
+		}
+	}
+	// Accept in order data, trimming anything already received
+	payload, fin := seg.payload, seg.flags&tcpFIN != 0
+	if len(payload) > 0 || fin {
+		if seqLT(seg.seq, f.rcvNxt) {
+			skip := int(f.rcvNxt - seg.seq)
+			if skip > len(payload) {
+				// Pure retransmission (or of a FIN already seen)
+				f.sendAck()
+				return
+			}
+			payload = payload[skip:]
+		} else if seg.seq != f.rcvNxt {
+			// Out of order, ask for the missing data again
+			f.sendAck()
+			return
+		}
+		if f.finRecv {
+			payload, fin = nil, false
+		}
+		if window := f.window(); len(payload) > window {
+			payload, fin = payload[:window], false
+		}
+		if len(payload) > 0 {
+			f.inbound = append(f.inbound, append([]byte(nil), payload...))
+			f.inboundSize += len(payload)
+			f.rcvNxt += uint32(len(payload))
+		}
+		if fin {
+			f.finRecv = true
+			f.rcvNxt++
+		}
+		f.cond.Broadcast()
+		f.sendAck()
+	}
+	f.finishLocked()
+}
+
+// readLoop relays the data of the Tor stream into the device.
+func (f *flow) readLoop() {
+	defer f.stack.wg.Done()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.conn.Read(buf)
+		if n > 0 && !f.send(buf[:n]) {
+			return
+		}
+		if err != nil {
+			f.lock.Lock()
+			if err == io.EOF {
+				f.sendFin()
+			} else if f.state != stateClosed {
+				f.sendLocked(&tcpSegment{seq: f.sndNxt, ack: f.rcvNxt, flags: tcpRST | tcpACK})
+				f.closeLocked()
+			}
+			f.lock.Unlock()
+			return
+		}
+	}
+}
+
+// send segments data into the device within its receive window, blocking while
+// the window is full. It returns false if the flow was closed meanwhile.
+func (f *flow) send(data []byte) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for len(data) > 0 {
+		for f.state != stateClosed && (f.state != stateEstablished || uint32(len(f.unacked)) >= f.peerWnd) {
+			f.cond.Wait()
+		}
+		if f.state == stateClosed {
+			return false
+		}
+		n := len(data)
+		if n > f.mss {
+			n = f.mss
+		}
+		if room := int(f.peerWnd) - len(f.unacked); n > room {
+			n = room
+		}
+		if len(f.unacked) == 0 {
+			f.progress()
+		}
+		f.sendLocked(&tcpSegment{seq: f.sndNxt, ack: f.rcvNxt, flags: tcpACK | tcpPSH, payload: data[:n]})
+		f.unacked = append(f.unacked, data[:n]...)
+		f.sndNxt += uint32(n)
+		data = data[n:]
+	}
+	return true
+}
+
+// sendFin closes the sending half of the flow once the Tor stream ended. The
+// lock must be held.
+func (f *flow) sendFin() {
+	for f.state == stateSynReceived {
+		f.cond.Wait()
+	}
+	if f.state == stateClosed || f.finSent {
+		return
+	}
+	if len(f.unacked) == 0 {
+		f.progress()
+	}
+	f.sendLocked(&tcpSegment{seq: f.sndNxt, ack: f.rcvNxt, flags: tcpFIN | tcpACK})
+	f.finSent = true
+	f.sndNxt++
+}
+
+// writeLoop relays the data received from the device into the Tor stream,
+// reopening the receive window as data is taken.
+func (f *flow) writeLoop() {
+	defer f.stack.wg.Done()
+
+	for {
+		f.lock.Lock()
+		for len(f.inbound) == 0 && !f.finRecv && f.state != stateClosed {
+			f.cond.Wait()
+		}
+		if f.state == stateClosed {
+			f.lock.Unlock()
+			return
+		}
+		if len(f.inbound) == 0 {
+			// Device finished sending, pass the half close on if possible
+			f.lock.Unlock()
+			if closer, ok := f.conn.(interface{ CloseWrite() error }); ok {
+				closer.CloseWrite()
+			}
+			f.lock.Lock()
+			f.drained = true
+			f.finishLocked()
+			f.lock.Unlock()
+			return
+		}
+		chunk := f.inbound[0]
+		f.inbound = f.inbound[1:]
+		f.lock.Unlock()
+
+		_, err := f.conn.Write(chunk)
+
+		f.lock.Lock()
+		before := f.window()
+		f.inboundSize -= len(chunk)
+		if err != nil {
+			if f.state != stateClosed {
+				f.sendLocked(&tcpSegment{seq: f.sndNxt, ack: f.rcvNxt, flags: tcpRST | tcpACK})
+				f.closeLocked()
+			}
+			f.lock.Unlock()
+			return
+		}
+		// Announce the reopened window if the device may be waiting on it
+		if before < f.mss && f.window() >= f.mss {
+			f.sendAck()
+		}
+		f.lock.Unlock()
+	}
+}
+
+// retransmit resends all unacknowledged data (or the SYN-ACK or FIN) if the
+// device didn't acknowledge it in time, resetting the flow if it keeps failing.
+func (f *flow) retransmit(now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	zeroWindow := f.state == stateEstablished && f.peerWnd == 0
+	outstanding := f.state == stateSynReceived || len(f.unacked) > 0 || (f.finSent && !f.finAcked) || zeroWindow
+	if f.state == stateClosed || !outstanding || now.Before(f.deadline) {
+		return
+	}
+	if f.retries++; f.retries > maxRetries {
+		f.sendLocked(&tcpSegment{seq: f.sndNxt, ack: f.rcvNxt, flags: tcpRST | tcpACK})
+		f.closeLocked()
+		return
+	}
+	if f.rto *= 2; f.rto > maxRTO {
+		f.rto = maxRTO
+	}
+	f.deadline = now.Add(f.rto)
+
+	switch {
+	case f.state == stateSynReceived:
+		f.sendSynAck()
+
+	case len(f.unacked) > 0:
+		f.resendUnacked(len(f.unacked))
+
+	case f.finSent && !f.finAcked:
+		f.sendLocked(&tcpSegment{seq: f.sndNxt - 1, ack: f.rcvNxt, flags: tcpFIN | tcpACK})
+
+	default:
+		// Probe the closed window with an old sequence number, which the device
+		// answers with its current window
+		f.sendLocked(&tcpSegment{seq: f.sndNxt - 1, ack: f.rcvNxt, flags: tcpACK})
+	}
+}
+
+// resendUnacked resends up to limit bytes of unacknowledged data, starting at
+// the oldest. The lock must be held.
+func (f *flow) resendUnacked(limit int) {
+	if limit > len(f.unacked) {
+		limit = len(f.unacked)
+	}
+	for off := 0; off < limit; off += f.mss {
+		end := off + f.mss
+		if end > limit {
+			end = limit
+		}
+		f.sendLocked(&tcpSegment{seq: f.sndUna + uint32(off), ack: f.rcvNxt, flags: tcpACK | tcpPSH, payload: f.unacked[off:end]})
+	}
+}
+
+// progress resets the retransmission timer after the device acknowledged
+// something (or when starting to wait for an acknowledgement). The lock must be
+// held.
+func (f *flow) progress() {
+	f.rto, f.retries = minRTO, 0
+	f.deadline = time.Now().Add(f.rto)
+}
+
+// abort tears the flow down, resetting the device side if requested.
+func (f *flow) abort(reset bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.state == stateClosed {
+		return
+	}
+	if reset && f.state != stateDialing {
+		f.sendLocked(&tcpSegment{seq: f.sndNxt, ack: f.rcvNxt, flags: tcpRST | tcpACK})
+	}
+	f.closeLocked()
+}
+
+// finishLocked closes the flow once both sides finished sending and everything
+// was delivered. The lock must be held.
+func (f *flow) finishLocked() {
+	if f.finRecv && f.drained && f.finSent && f.finAcked {
+		f.closeLocked()
+	}
+}
+
+// closeLocked marks the flow closed, closes its Tor stream and removes it from
+// the stack. The lock must be held.
+func (f *flow) closeLocked() {
+	if f.state == stateClosed {
+		return
+	}
+	f.state = stateClosed
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.cond.Broadcast()
+	f.stack.remove(f)
+}
+
+// sendSynAck answers the SYN of the device. The lock must be held.
+func (f *flow) sendSynAck() {
+	f.sendLocked(&tcpSegment{seq: f.iss, ack: f.rcvNxt, flags: tcpSYN | tcpACK, mss: uint16(f.maxSegment())})
+	f.progress()
+}
+
+// sendAck acknowledges everything received so far. The lock must be held.
+func (f *flow) sendAck() {
+	f.sendLocked(&tcpSegment{seq: f.sndNxt, ack: f.rcvNxt, flags: tcpACK})
+}
+
+// sendLocked fills in the ports and window of a segment and writes it into the
+// device. The lock must be held.
+func (f *flow) sendLocked(seg *tcpSegment) {
+	seg.srcPort, seg.dstPort = f.remotePort, f.localPort
+	seg.window = uint16(f.window())
+	f.stack.write(buildTCP(f.remote, f.local, seg))
+}
+
+// window returns the free space of the inbound buffer. The lock must be held.
+func (f *flow) window() int {
+	return maxInbound - f.inboundSize
+}
+
+// maxSegment returns the largest segment fitting into the MTU of the device.
+func (f *flow) maxSegment() int {
+	if f.remote.To4() != nil {
+		return f.stack.conf.MTU - ipv4HeaderLen - tcpHeaderLen
+	}
+	return f.stack.conf.MTU - ipv6HeaderLen - tcpHeaderLen
+}
+
+// seqLen returns the sequence space a segment occupies.
+func seqLen(seg *tcpSegment) uint32 {
+	n := uint32(len(seg.payload))
+	if seg.flags&tcpSYN != 0 {
+		n++
+	}
+	if seg.flags&tcpFIN != 0 {
+		n++
+	}
+	return n
+}
+
+// Sequence number comparisons, modulo 2^32.
+func seqLT(a, b uint32) bool { return int32(a-b) < 0 }
+func seqLE(a, b uint32) bool { return int32(a-b) <= 0 }
+func seqGT(a, b uint32) bool { return int32(a-b) > 0 }
+func seqGE(a, b uint32) bool { return int32(a-b) >= 0 }
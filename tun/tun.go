@@ -0,0 +1,236 @@
+// Package tun routes the traffic of a TUN device through Tor, the way VPN style
+// apps need to. IP packets are read from the device and TCP is terminated in
+// userspace, each flow being mapped onto its own Tor stream. DNS queries sent
+// over UDP to port 53 are answered through Tor too, while any other UDP and
+// ICMP traffic is dropped, as Tor can't carry it.
+package tun
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultMTU is the MTU assumed for the TUN device if none is configured.
+const defaultMTU = 1500
+
+// Resolver answers DNS lookups, e.g. through Tor. Both *net.Resolver and the
+// resolver of the embedded Tor implement it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Config is the configuration of a TUN stack.
+type Config struct {
+	// Dial opens a stream to the destination of a TCP flow, e.g. the dialer of
+	// the embedded Tor.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Resolver answers the DNS queries sent through the device. If nil, DNS
+	// queries are dropped.
+	Resolver Resolver
+
+	// MTU is the MTU of the TUN device, 1500 if zero.
+	MTU int
+}
+
+// Stack terminates the TCP flows of a TUN device, forwarding them through Tor.
+type Stack struct {
+	dev  io.ReadWriteCloser
+	conf Config
+
+	flows map[flowKey]*flow
+	lock  sync.Mutex
+
+	writeLock sync.Mutex // Serializes the packets written to the device
+	wg        sync.WaitGroup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New creates a stack on top of a TUN device, any reader and writer exchanging
+// one IP packet per call. The stack takes ownership of the device.
+func New(dev io.ReadWriteCloser, conf *Config) (*Stack, error) {
+	if conf == nil || conf.Dial == nil {
+		return nil, errors.New("no dialer configured")
+	}
+	s := &Stack{
+		dev:   dev,
+		conf:  *conf,
+		flows: make(map[flowKey]*flow),
+	}
+	if s.conf.MTU == 0 {
+		s.conf.MTU = defaultMTU
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// NewFromFD creates a stack on top of the file descriptor of a TUN device, e.g.
+// the one returned by Android's VpnService.Builder.establish.
+func NewFromFD(fd int, conf *Config) (*Stack, error) {
+	return New(os.NewFile(uintptr(fd), "tun"), conf)
+}
+
+// Run processes the packets of the device until it's closed or fails. It should
+// be called once.
+func (s *Stack) Run() error {
+	s.wg.Add(1)
+	go s.retransmitLoop()
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := s.dev.Read(buf)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		s.handlePacket(buf[:n])
+	}
+}
+
+// Close stops the stack, tearing down all its flows and closing the device.
+func (s *Stack) Close() error {
+	s.cancel()
+	err := s.dev.Close()
+
+	s.lock.Lock()
+	flows := make([]*flow, 0, len(s.flows))
+	for _, f := range s.flows {
+		flows = append(flows, f)
+	}
+	s.lock.Unlock()
+
+	for _, f := range flows {
+		f.abort(true)
+	}
+	s.wg.Wait()
+	return err
+}
+
+// handlePacket dispatches a single packet read from the device.
+func (s *Stack) handlePacket(b []byte) {
+	pkt, err := parseIP(b)
+	if err != nil {
+		return
+	}
+	switch pkt.proto {
+	case protoTCP:
+		seg, err := parseTCP(pkt.payload)
+		if err != nil {
+			return
+		}
+		s.handleTCP(pkt, seg)
+
+	case protoUDP:
+		dgram, err := parseUDP(pkt.payload)
+		if err != nil || dgram.dstPort != 53 || s.conf.Resolver == nil {
+			return
+		}
+		var (
+			src   = copyIP(pkt.src)
+			dst   = copyIP(pkt.dst)
+			query = append([]byte(nil), dgram.payload...)
+		)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if resp := answerDNS(s.ctx, s.conf.Resolver, query); resp != nil && s.ctx.Err() == nil {
+				s.write(buildUDP(dst, src, &udpDatagram{srcPort: dgram.dstPort, dstPort: dgram.srcPort, payload: resp}))
+			}
+		}()
+	}
+}
+
+// handleTCP dispatches a TCP segment to its flow, starting a new one for SYNs
+// and resetting segments of unknown flows.
+func (s *Stack) handleTCP(pkt *ipPacket, seg *tcpSegment) {
+	key := newFlowKey(pkt.src, seg.srcPort, pkt.dst, seg.dstPort)
+
+	s.lock.Lock()
+	f, ok := s.flows[key]
+	if !ok && seg.flags&(tcpSYN|tcpACK|tcpRST) == tcpSYN && s.ctx.Err() == nil {
+		f = newFlow(s, key, copyIP(pkt.src), seg.srcPort, copyIP(pkt.dst), seg.dstPort, seg)
+		s.flows[key] = f
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go f.dial()
+		return
+	}
+	s.lock.Unlock()
+
+	if ok {
+		f.handle(seg)
+		return
+	}
+	if seg.flags&tcpRST != 0 {
+		return
+	}
+	// Nobody's listening, reset the sender
+	reply := &tcpSegment{srcPort: seg.dstPort, dstPort: seg.srcPort}
+	if seg.flags&tcpACK != 0 {
+		reply.seq, reply.flags = seg.ack, tcpRST
+	} else {
+		reply.ack, reply.flags = seg.seq+seqLen(seg), tcpRST|tcpACK
+	}
+	s.write(buildTCP(pkt.dst, pkt.src, reply))
+}
+
+// remove forgets a finished flow.
+func (s *Stack) remove(f *flow) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.flows[f.key] == f {
+		delete(s.flows, f.key)
+	}
+}
+
+// write sends a packet into the device.
+func (s *Stack) write(pkt []byte) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.dev.Write(pkt)
+}
+
+// retransmitLoop periodically resends the segments the device didn't
+// acknowledge in time.
+func (s *Stack) retransmitLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(retransmitTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.lock.Lock()
+			flows := make([]*flow, 0, len(s.flows))
+			for _, f := range s.flows {
+				flows = append(flows, f)
+			}
+			s.lock.Unlock()
+
+			for _, f := range flows {
+				f.retransmit(now)
+			}
+		}
+	}
+}
+
+// copyIP copies an address out of a packet buffer.
+func copyIP(ip net.IP) net.IP {
+	return append(net.IP(nil), ip...)
+}
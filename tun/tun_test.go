@@ -0,0 +1,366 @@
+package tun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// device is an in-memory TUN device, exchanging packets with the test.
+type device struct {
+	in     chan []byte // Packets read by the stack
+	out    chan []byte // Packets written by the stack
+	closed chan struct{}
+}
+
+func newDevice() *device {
+	return &device{
+		in:     make(chan []byte, 64),
+		out:    make(chan []byte, 1024),
+		closed: make(chan struct{}),
+	}
+}
+
+func (d *device) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-d.in:
+		return copy(b, pkt), nil
+	case <-d.closed:
+		return 0, io.EOF
+	}
+}
+
+func (d *device) Write(b []byte) (int, error) {
+	select {
+	case d.out <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-d.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (d *device) Close() error {
+	close(d.closed)
+	return nil
+}
+
+// client plays the kernel side of a single TCP flow through the device.
+type client struct {
+	t   *testing.T
+	dev *device
+
+	local, remote         net.IP
+	localPort, remotePort uint16
+
+	seq, ack uint32
+}
+
+// sendSegment writes a segment of the flow into the device.
+func (c *client) sendSegment(flags byte, window uint16, payload []byte) {
+	c.dev.in <- buildTCP(c.local, c.remote, &tcpSegment{
+		srcPort: c.localPort,
+		dstPort: c.remotePort,
+		seq:     c.seq,
+		ack:     c.ack,
+		flags:   flags,
+		window:  window,
+		mss:     1400,
+		payload: payload,
+	})
+	c.seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		c.seq++
+	}
+}
+
+// recvSegment reads the next segment of the flow from the device, verifying
+// its addressing and checksum.
+func (c *client) recvSegment() *tcpSegment {
+	c.t.Helper()
+	select {
+	case b := <-c.dev.out:
+		pkt, err := parseIP(b)
+		if err != nil || pkt.proto != protoTCP {
+			c.t.Fatalf("invalid packet from stack: %v", err)
+		}
+		if !pkt.src.Equal(c.remote) || !pkt.dst.Equal(c.local) {
+			c.t.Fatalf("address mismatch: have %v -> %v, want %v -> %v", pkt.src, pkt.dst, c.remote, c.local)
+		}
+		if sum := checksum(pseudoHeaderSum(pkt.src, pkt.dst, protoTCP, len(pkt.payload)), pkt.payload); sum != 0xffff {
+			c.t.Fatalf("invalid TCP checksum")
+		}
+		seg, err := parseTCP(pkt.payload)
+		if err != nil {
+			c.t.Fatalf("invalid segment from stack: %v", err)
+		}
+		return seg
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("timed out waiting for segment")
+	}
+	return nil
+}
+
+// newTestStack starts a stack on an in-memory device with the given dialer.
+func newTestStack(t *testing.T, dial func(ctx context.Context, network, addr string) (net.Conn, error), resolver Resolver) (*Stack, *device) {
+	dev := newDevice()
+	stack, err := New(dev, &Config{Dial: dial, Resolver: resolver})
+	if err != nil {
+		t.Fatalf("failed to create stack: %v", err)
+	}
+	go stack.Run()
+	return stack, dev
+}
+
+// Tests a full TCP flow: handshake, data in both directions, and teardown once
+// the Tor stream ends.
+func TestFlow(t *testing.T) {
+	dials := make(chan string, 1)
+	stack, dev := newTestStack(t, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials <- addr
+		local, remote := net.Pipe()
+		go func() {
+			// Echo a single message back, then hang up
+			buf := make([]byte, 64)
+			n, _ := remote.Read(buf)
+			remote.Write(bytes.ToUpper(buf[:n]))
+			remote.Close()
+		}()
+		return local, nil
+	}, nil)
+	defer stack.Close()
+
+	c := &client{
+		t: t, dev: dev,
+		local: net.IPv4(10, 0, 0, 2), localPort: 40000,
+		remote: net.IPv4(192, 0, 2, 1), remotePort: 80,
+		seq: 1000,
+	}
+	c.sendSegment(tcpSYN, 65535, nil)
+	synack := c.recvSegment()
+	if synack.flags != tcpSYN|tcpACK || synack.ack != 1001 || synack.mss == 0 {
+		t.Fatalf("SYN-ACK mismatch: flags %#x, ack %d, mss %d", synack.flags, synack.ack, synack.mss)
+	}
+	if addr := <-dials; addr != "192.0.2.1:80" {
+		t.Errorf("dialed address mismatch: have %s, want %s", addr, "192.0.2.1:80")
+	}
+	c.ack = synack.seq + 1
+	c.sendSegment(tcpACK|tcpPSH, 65535, []byte("hello tor"))
+
+	// Expect the acknowledgement, the echo and the FIN in whatever segmentation
+	var (
+		echo []byte
+		fin  bool
+	)
+	for !fin {
+		seg := c.recvSegment()
+		if len(seg.payload) > 0 {
+			if seg.seq != c.ack {
+				t.Fatalf("sequence mismatch: have %d, want %d", seg.seq, c.ack)
+			}
+			echo = append(echo, seg.payload...)
+			c.ack += uint32(len(seg.payload))
+		}
+		if seg.flags&tcpFIN != 0 {
+			fin = true
+			c.ack++
+		}
+	}
+	if string(echo) != "HELLO TOR" {
+		t.Errorf("echo mismatch: have %q, want %q", echo, "HELLO TOR")
+	}
+	c.sendSegment(tcpACK|tcpFIN, 65535, nil)
+	if seg := c.recvSegment(); seg.flags&tcpACK == 0 || seg.ack != c.seq {
+		t.Errorf("FIN acknowledgement mismatch: flags %#x, ack %d, want %d", seg.flags, seg.ack, c.seq)
+	}
+	// The flow should be gone once both sides are done
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stack.lock.Lock()
+		flows := len(stack.flows)
+		stack.lock.Unlock()
+		if flows == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("flow not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that data is sent within the window advertised by the device, and that
+// lost segments are retransmitted.
+func TestFlowControl(t *testing.T) {
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	stack, dev := newTestStack(t, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		local, remote := net.Pipe()
+		go func() {
+			remote.Write(data)
+			remote.Close()
+		}()
+		return local, nil
+	}, nil)
+	defer stack.Close()
+
+	c := &client{
+		t: t, dev: dev,
+		local: net.ParseIP("fd00::2"), localPort: 40001,
+		remote: net.ParseIP("2001:db8::1"), remotePort: 443,
+		seq: 5000,
+	}
+	const window = 4096
+
+	c.sendSegment(tcpSYN, window, nil)
+	synack := c.recvSegment()
+	c.ack = synack.seq + 1
+	c.sendSegment(tcpACK, window, nil)
+
+	var (
+		received []byte
+		dropped  bool
+	)
+	for len(received) < len(data) {
+		seg := c.recvSegment()
+		if seqGT(seg.seq+uint32(len(seg.payload)), c.ack+window) {
+			t.Fatalf("segment beyond window: seq %d, len %d, window end %d", seg.seq, len(seg.payload), c.ack+window)
+		}
+		if len(seg.payload) == 0 {
+			continue
+		}
+		// Drop the first data segment once to force a retransmission, and
+		// acknowledge out of order segments as duplicates, just as the kernel
+		if !dropped {
+			dropped = true
+			continue
+		}
+		if seg.seq != c.ack {
+			c.sendSegment(tcpACK, window, nil)
+			continue
+		}
+		received = append(received, seg.payload...)
+		c.ack += uint32(len(seg.payload))
+		c.sendSegment(tcpACK, window, nil)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("data mismatch")
+	}
+}
+
+// Tests that flows to unreachable destinations and segments of unknown flows
+// are reset.
+func TestReset(t *testing.T) {
+	stack, dev := newTestStack(t, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}, nil)
+	defer stack.Close()
+
+	c := &client{
+		t: t, dev: dev,
+		local: net.IPv4(10, 0, 0, 2), localPort: 40002,
+		remote: net.IPv4(192, 0, 2, 1), remotePort: 25,
+		seq: 7000,
+	}
+	c.sendSegment(tcpSYN, 65535, nil)
+	if seg := c.recvSegment(); seg.flags != tcpRST|tcpACK || seg.ack != 7001 {
+		t.Errorf("refused reply mismatch: flags %#x, ack %d", seg.flags, seg.ack)
+	}
+	c.ack = 12345
+	c.sendSegment(tcpACK, 65535, []byte("stray"))
+	if seg := c.recvSegment(); seg.flags != tcpRST || seg.seq != 12345 {
+		t.Errorf("stray reply mismatch: flags %#x, seq %d", seg.flags, seg.seq)
+	}
+}
+
+// fakeResolver answers lookups from static tables.
+type fakeResolver struct {
+	hosts map[string][]net.IPAddr
+	addrs map[string][]string
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "not found", Name: host, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.addrs[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "not found", Name: addr, IsNotFound: true}
+}
+
+// Tests that DNS queries through the device are answered by the resolver.
+func TestDNS(t *testing.T) {
+	stack, dev := newTestStack(t, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("unexpected dial")
+	}, &fakeResolver{
+		hosts: map[string][]net.IPAddr{"example.com": {{IP: net.IPv4(192, 0, 2, 1)}}},
+		addrs: map[string][]string{"192.0.2.1": {"example.com"}},
+	})
+	defer stack.Close()
+
+	var (
+		local  = net.IPv4(10, 0, 0, 2)
+		server = net.IPv4(10, 0, 0, 1)
+	)
+	query := func(id uint16, name string, qtype uint16) (rcode byte, answers []byte) {
+		msg := []byte{byte(id >> 8), byte(id), 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+		msg = append(msg, encodeDNSName(name)...)
+		msg = append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+		dev.in <- buildUDP(local, server, &udpDatagram{srcPort: 5353, dstPort: 53, payload: msg})
+
+		select {
+		case b := <-dev.out:
+			pkt, err := parseIP(b)
+			if err != nil || pkt.proto != protoUDP || !pkt.src.Equal(server) {
+				t.Fatalf("invalid DNS response packet: %v", err)
+			}
+			dgram, err := parseUDP(pkt.payload)
+			if err != nil || dgram.dstPort != 5353 {
+				t.Fatalf("invalid DNS response datagram: %v", err)
+			}
+			resp := dgram.payload
+			if resp[0] != byte(id>>8) || resp[1] != byte(id) || resp[2]&0x80 == 0 {
+				t.Fatalf("DNS response header mismatch: %x", resp[:4])
+			}
+			return resp[3] & 0x0f, resp[len(msg):]
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for DNS response")
+		}
+		return 0, nil
+	}
+	rcode, answers := query(1, "example.com", dnsTypeA)
+	if rcode != dnsRcodeOK || len(answers) != 16 || !net.IP(answers[12:16]).Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("A answer mismatch: rcode %d, answers %x", rcode, answers)
+	}
+	if rcode, answers = query(2, "example.com", dnsTypeAAAA); rcode != dnsRcodeOK || len(answers) != 0 {
+		t.Errorf("AAAA answer mismatch: rcode %d, answers %x", rcode, answers)
+	}
+	if rcode, _ = query(3, "missing.example", dnsTypeA); rcode != dnsRcodeNXDomain {
+		t.Errorf("missing answer mismatch: rcode %d", rcode)
+	}
+	rcode, answers = query(4, "1.2.0.192.in-addr.arpa", dnsTypePTR)
+	if want := encodeDNSName("example.com"); rcode != dnsRcodeOK || !bytes.HasSuffix(answers, want) {
+		t.Errorf("PTR answer mismatch: rcode %d, answers %x", rcode, answers)
+	}
+}
+
+// Tests that reverse names of both address families are understood.
+func TestParseReverseName(t *testing.T) {
+	if ip := parseReverseName("4.3.2.1.in-addr.arpa"); !ip.Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("IPv4 mismatch: have %v", ip)
+	}
+	name := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"
+	if ip := parseReverseName(name); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("IPv6 mismatch: have %v", ip)
+	}
+}